@@ -10,9 +10,13 @@ import (
 	"github.com/jellybean4/goleveldb/util"
 )
 
+// Compact describes the inputs of one compaction, Files[i] holds the
+// input files at level Level + i.  All inputs are merged into new
+// files at OutputLevel, or simply dropped if OutputLevel is -1.
 type Compact struct {
   Files  [][]*table.FileMetaData
   Level  int
+  OutputLevel int
   Smallest *util.InternalKey
   Largest *util.InternalKey
 }
@@ -23,16 +27,32 @@ func (c *Compact) init() {
 
 func (c *Compact) Dump() string {
   var buffer bytes.Buffer
-  for i := 0; i < 2; i++ {
+  for i := 0; i < len(c.Files); i++ {
+    if len(c.Files[i]) == 0 {
+      continue
+    }
     buffer.WriteString(fmt.Sprintf("Compacting Files Level : %d : [", c.Level + i))
     for _, meta := range c.Files[i] {
       buffer.WriteString(fmt.Sprintf("%d, ", meta.Number))
     }
     buffer.WriteString("]    ")
   }
+  buffer.WriteString(fmt.Sprintf("Output Level : %d", c.OutputLevel))
   return buffer.String()
 }
 
+// Returns true iff the file numbered num is an input of this compaction
+func (c *Compact) Contains(num int) bool {
+  for _, files := range c.Files {
+    for _, meta := range files {
+      if meta.Number == num {
+        return true
+      }
+    }
+  }
+  return false
+}
+
 func NewCompact() *Compact {
   comp := new(Compact)
   comp.init()
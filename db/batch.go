@@ -1,6 +1,7 @@
 package db
 
 import (
+  "time"
   "bytes"
   "errors"
 	"encoding/binary"
@@ -34,10 +35,42 @@ type WriteBatch interface {
   
   // Store the mapping "key->value" in the database.
   Put(key []byte, value  []byte)
+  
+  // Store the mapping "key->value" in the database for ttl seconds,
+  // after which the key reads as if it was deleted.
+  PutWithTTL(key []byte, value []byte, ttl int)
+  
+  // Merge "operand" into the value of "key" through the merge operator
+  // of the database.
+  Merge(key []byte, operand []byte)
+  
   // If the database contains a mapping for "key", erase it.  Else do nothing.
   Delete(key []byte)
+  
+  // Erase the mapping for "key", which must have been Put exactly once
+  // since it was last deleted.  Unlike Delete, the tombstone and the
+  // put vanish together as soon as compaction meets them, but the
+  // result is undefined if "key" was Put more than once or merged.
+  SingleDelete(key []byte)
+  
+  // Erase the mappings for all the keys within ["start", "end").
+  DeleteRange(start, end []byte)
+  
   // Clear all updates buffered in this batch.
   Clear()
+  
+  // Record the state of the batch for RollbackToSavePoint.  Save points
+  // nest, each call pushes a new one.
+  SetSavePoint()
+  
+  // Remove all the updates added since the most recent save point and
+  // pop the save point.  Returns an error if there is no save point.
+  RollbackToSavePoint() error
+  
+  // Pop the most recent save point without removing any update.
+  // Returns an error if there is no save point.
+  PopSavePoint() error
+  
   // Iterate all the key/val pairs in the bach to the given handle in args
   Iterate(handler BatchHandler) error
   
@@ -69,42 +102,162 @@ type BatchHandler interface {
   // Process the given key/val pair
   Put(key, value []byte)
   
+  // Process the given key/val pair which expires at unix time expiry
+  PutWithExpiry(key, value []byte, expiry int64)
+  
+  // Process the given merge operand for key
+  Merge(key, operand []byte)
+  
   // Delete data with the given key
   Delete(key []byte)
+  
+  // Delete the single put of key
+  SingleDelete(key []byte)
+  
+  // Delete data with keys within [start, end)
+  DeleteRange(start, end []byte)
+  
+  // The updates up to the next MarkEndPrepare belong to a prepared
+  // transaction
+  MarkBeginPrepare()
+  
+  // End the updates of the prepared transaction named name
+  MarkEndPrepare(name []byte)
+  
+  // Apply the updates of the prepared transaction named name
+  MarkCommit(name []byte)
+  
+  // Drop the updates of the prepared transaction named name
+  MarkRollback(name []byte)
 }
 
+// Types of the two-phase commit markers.  They are kept in batches and
+// in the log, but never reach a memtable.
+const (
+  beginPrepareMarker = mem.SeekType + 1 + iota
+  endPrepareMarker
+  commitMarker
+  rollbackMarker
+)
+
 const (
   BatchHeader = 12
 )
 
+// handlerImpl inserts the updates of batches into a memtable, the
+// updates of a prepared transaction are held back until its commit
 type handlerImpl struct {
   mem mem.Memtable
   seq uint64
+  prepared  map[string]*batchImpl   // prepared transactions not decided yet
+  preparing *batchImpl   // updates between the markers of a prepare
 }
 
 func NewBatchHandler(mem mem.Memtable, seq uint64) BatchHandler {
+  return newPreparedHandler(mem, seq, make(map[string]*batchImpl))
+}
+
+// Return a handler which keeps the prepared transactions in prepared
+func newPreparedHandler(mem mem.Memtable, seq uint64, prepared map[string]*batchImpl) *handlerImpl {
   handler := new(handlerImpl)
-  handler.init(mem, seq)
+  handler.init(mem, seq, prepared)
   return handler
 }
 
-func (h *handlerImpl) init(mem mem.Memtable, seq uint64) {
+func (h *handlerImpl) init(mem mem.Memtable, seq uint64, prepared map[string]*batchImpl) {
   h.mem = mem
   h.seq = seq
+  h.prepared = prepared
+  h.preparing = nil
 }
 
 func (h *handlerImpl) Put(key, value []byte) {
+  if h.preparing != nil {
+    h.preparing.Put(key, value)
+    return
+  }
   h.mem.Add(h.seq, mem.ValueType, key, value)
   h.seq++
 }
 
+func (h *handlerImpl) PutWithExpiry(key, value []byte, expiry int64) {
+  if h.preparing != nil {
+    h.preparing.putWithExpiry(key, value, expiry)
+    return
+  }
+  h.mem.Add(h.seq, mem.TTLValueType, key, mem.EncodeTTLValue(value, expiry))
+  h.seq++
+}
+
+func (h *handlerImpl) Merge(key, operand []byte) {
+  if h.preparing != nil {
+    h.preparing.Merge(key, operand)
+    return
+  }
+  h.mem.Add(h.seq, mem.MergeType, key, operand)
+  h.seq++
+}
+
 func (h *handlerImpl) Delete(key []byte) {
+  if h.preparing != nil {
+    h.preparing.Delete(key)
+    return
+  }
   h.mem.Add(h.seq, mem.DeleteType, key, []byte{})
   h.seq++
 }
 
+func (h *handlerImpl) SingleDelete(key []byte) {
+  if h.preparing != nil {
+    h.preparing.SingleDelete(key)
+    return
+  }
+  h.mem.Add(h.seq, mem.SingleDeleteType, key, []byte{})
+  h.seq++
+}
+
+func (h *handlerImpl) DeleteRange(start, end []byte) {
+  if h.preparing != nil {
+    h.preparing.DeleteRange(start, end)
+    return
+  }
+  h.mem.Add(h.seq, mem.RangeDeleteType, start, end)
+  h.seq++
+}
+
+func (h *handlerImpl) MarkBeginPrepare() {
+  h.preparing = new(batchImpl)
+  h.preparing.init()
+}
+
+func (h *handlerImpl) MarkEndPrepare(name []byte) {
+  if h.preparing != nil {
+    h.prepared[string(name)] = h.preparing
+    h.preparing = nil
+  }
+}
+
+func (h *handlerImpl) MarkCommit(name []byte) {
+  if batch, ok := h.prepared[string(name)]; ok {
+    delete(h.prepared, string(name))
+    batch.Iterate(h)
+  }
+}
+
+func (h *handlerImpl) MarkRollback(name []byte) {
+  delete(h.prepared, string(name))
+}
+
+// savePoint is the size and the count of a batch when SetSavePoint was
+// called
+type savePoint struct {
+  size  int
+  count int
+}
+
 type batchImpl struct {
-  buffer bytes.Buffer
+  buffer     bytes.Buffer
+  savePoints []savePoint
 }
 
 func NewWriteBatch() WriteBatch {
@@ -131,6 +284,35 @@ func (b *batchImpl) Put(key, value []byte) {
   b.SetCount(b.Count() + 1)
 }
 
+func (b *batchImpl) PutWithTTL(key, value []byte, ttl int) {
+  b.putWithExpiry(key, value, time.Now().Unix() + int64(ttl))
+}
+
+func (b *batchImpl) putWithExpiry(key, value []byte, expiry int64) {
+  value = mem.EncodeTTLValue(value, expiry)
+  b.buffer.WriteByte(mem.TTLValueType)
+  
+  b.buffer.Write(util.GetBytesLen(key))
+  b.buffer.Write(key)
+  
+  b.buffer.Write(util.GetBytesLen(value))
+  b.buffer.Write(value)
+  
+  b.SetCount(b.Count() + 1)
+}
+
+func (b *batchImpl) Merge(key, operand []byte) {
+  b.buffer.WriteByte(mem.MergeType)
+  
+  b.buffer.Write(util.GetBytesLen(key))
+  b.buffer.Write(key)
+  
+  b.buffer.Write(util.GetBytesLen(operand))
+  b.buffer.Write(operand)
+  
+  b.SetCount(b.Count() + 1)
+}
+
 func (b *batchImpl) Delete(key []byte) {
   b.buffer.WriteByte(mem.DeleteType)
   
@@ -140,11 +322,83 @@ func (b *batchImpl) Delete(key []byte) {
   b.SetCount(b.Count() + 1)
 }
 
+func (b *batchImpl) SingleDelete(key []byte) {
+  b.buffer.WriteByte(mem.SingleDeleteType)
+  
+  b.buffer.Write(util.GetBytesLen(key))
+  b.buffer.Write(key)
+  
+  b.SetCount(b.Count() + 1)
+}
+
+func (b *batchImpl) DeleteRange(start, end []byte) {
+  b.buffer.WriteByte(mem.RangeDeleteType)
+  
+  b.buffer.Write(util.GetBytesLen(start))
+  b.buffer.Write(start)
+  
+  b.buffer.Write(util.GetBytesLen(end))
+  b.buffer.Write(end)
+  
+  b.SetCount(b.Count() + 1)
+}
+
+func (b *batchImpl) markBeginPrepare() {
+  b.buffer.WriteByte(beginPrepareMarker)
+  b.SetCount(b.Count() + 1)
+}
+
+func (b *batchImpl) markEndPrepare(name []byte) {
+  b.writeMarker(endPrepareMarker, name)
+}
+
+func (b *batchImpl) markCommit(name []byte) {
+  b.writeMarker(commitMarker, name)
+}
+
+func (b *batchImpl) markRollback(name []byte) {
+  b.writeMarker(rollbackMarker, name)
+}
+
+func (b *batchImpl) writeMarker(marker byte, name []byte) {
+  b.buffer.WriteByte(marker)
+  
+  b.buffer.Write(util.GetBytesLen(name))
+  b.buffer.Write(name)
+  
+  b.SetCount(b.Count() + 1)
+}
+
 func (b *batchImpl) Clear() {
   b.buffer.Reset()
   for i := 0; i < BatchHeader; i++ {
     b.buffer.WriteByte(0)
   }
+  b.savePoints = nil
+}
+
+func (b *batchImpl) SetSavePoint() {
+  b.savePoints = append(b.savePoints, savePoint{b.buffer.Len(), b.Count()})
+}
+
+func (b *batchImpl) RollbackToSavePoint() error {
+  if len(b.savePoints) == 0 {
+    return errors.New("no save point")
+  }
+  
+  point := b.savePoints[len(b.savePoints) - 1]
+  b.savePoints = b.savePoints[:len(b.savePoints) - 1]
+  b.buffer.Truncate(point.size)
+  b.SetCount(point.count)
+  return nil
+}
+
+func (b *batchImpl) PopSavePoint() error {
+  if len(b.savePoints) == 0 {
+    return errors.New("no save point")
+  }
+  b.savePoints = b.savePoints[:len(b.savePoints) - 1]
+  return nil
 }
 
 func (b *batchImpl) Iterate(handler BatchHandler) error {
@@ -164,6 +418,25 @@ func (b *batchImpl) Iterate(handler BatchHandler) error {
         return errors.New("bad patch put")
       }
       handler.Put(key, val)
+    } else if content[0] == mem.TTLValueType {
+      key, content = util.GetLenPrefixBytes(content[1:])
+      val, content = util.GetLenPrefixBytes(content)
+      if key == nil || val == nil {
+        return errors.New("bad batch ttl put")
+      }
+      
+      data, expiry, err := mem.DecodeTTLValue(val)
+      if err != nil {
+        return err
+      }
+      handler.PutWithExpiry(key, data, expiry)
+    } else if content[0] == mem.MergeType {
+      key, content = util.GetLenPrefixBytes(content[1:])
+      val, content = util.GetLenPrefixBytes(content)
+      if key == nil || val == nil {
+        return errors.New("bad batch merge")
+      }
+      handler.Merge(key, val)
     } else if content[0] == mem.DeleteType {
       key, content = util.GetLenPrefixBytes(content[1:])
       
@@ -171,6 +444,38 @@ func (b *batchImpl) Iterate(handler BatchHandler) error {
         return errors.New("bad batch del")
       }
       handler.Delete(key)
+    } else if content[0] == mem.SingleDeleteType {
+      key, content = util.GetLenPrefixBytes(content[1:])
+      
+      if key == nil {
+        return errors.New("bad batch single del")
+      }
+      handler.SingleDelete(key)
+    } else if content[0] == mem.RangeDeleteType {
+      key, content = util.GetLenPrefixBytes(content[1:])
+      val, content = util.GetLenPrefixBytes(content)
+      if key == nil || val == nil {
+        return errors.New("bad batch range del")
+      }
+      handler.DeleteRange(key, val)
+    } else if content[0] == beginPrepareMarker {
+      content = content[1:]
+      handler.MarkBeginPrepare()
+    } else if content[0] >= endPrepareMarker && content[0] <= rollbackMarker {
+      marker := content[0]
+      key, content = util.GetLenPrefixBytes(content[1:])
+      if key == nil {
+        return errors.New("bad batch marker")
+      }
+      
+      switch marker {
+      case endPrepareMarker:
+        handler.MarkEndPrepare(key)
+      case commitMarker:
+        handler.MarkCommit(key)
+      case rollbackMarker:
+        handler.MarkRollback(key)
+      }
     } else {
       return errors.New("bad content format")
     }
@@ -220,6 +525,7 @@ func (b *batchImpl) SetContents(contents []byte) {
   } 
   b.buffer.Reset()
   b.buffer.Write(contents)
+  b.savePoints = nil
 }
 
 func (b *batchImpl) InsertInto(memtable mem.Memtable) error {
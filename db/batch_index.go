@@ -0,0 +1,548 @@
+package db
+
+import (
+  "time"
+)
+
+import (
+  "code.google.com/p/log4go"
+)
+
+import (
+  "github.com/jellybean4/goleveldb/mem"
+  "github.com/jellybean4/goleveldb/util"
+)
+
+// WriteBatchWithIndex is a WriteBatch which also indexes its updates,
+// so they can be read before the batch is written to the db.
+type WriteBatchWithIndex interface {
+  WriteBatch
+
+  // Return the value of key as if the batch was written to db.  Keys
+  // the batch can't decide alone are read from db with option.
+  GetFromBatchAndDB(db DB, option *util.ReadOption, key []byte) (error, []byte)
+
+  // Return an iterator over base, an iterator returned by
+  // DB.NewIterator, with the updates of the batch applied on top of
+  // it.  The batch must not be changed while the iterator is in use.
+  NewIteratorWithBase(base mem.Iterator) mem.Iterator
+}
+
+// States of a user key within an indexed batch
+const (
+  batchMissing = iota   // the batch holds no entry for the key
+  batchFound            // the batch decides the value of the key
+  batchDeleted          // the batch deletes the key
+  batchMerge            // the batch merges operands into the value in the db
+)
+
+type indexedBatchImpl struct {
+  batchImpl
+  ucmp   util.Comparator
+  merger util.MergeOperator
+  index  *batchIndex
+}
+
+// Create an indexed batch for a db opened with option, whose
+// comparator and merge operator are used to read the batch
+func NewWriteBatchWithIndex(option *util.Option) WriteBatchWithIndex {
+  batch := new(indexedBatchImpl)
+  batch.init(option)
+  return batch
+}
+
+func (b *indexedBatchImpl) init(option *util.Option) {
+  b.batchImpl.init()
+  b.ucmp = option.Comparator
+  b.merger = option.MergeOperator
+  b.index = newBatchIndex(b.ucmp)
+}
+
+func (b *indexedBatchImpl) Put(key, value []byte) {
+  b.batchImpl.Put(key, value)
+  b.index.Put(key, value)
+}
+
+func (b *indexedBatchImpl) PutWithTTL(key, value []byte, ttl int) {
+  expiry := time.Now().Unix() + int64(ttl)
+  b.batchImpl.putWithExpiry(key, value, expiry)
+  b.index.PutWithExpiry(key, value, expiry)
+}
+
+func (b *indexedBatchImpl) Merge(key, operand []byte) {
+  b.batchImpl.Merge(key, operand)
+  b.index.Merge(key, operand)
+}
+
+func (b *indexedBatchImpl) Delete(key []byte) {
+  b.batchImpl.Delete(key)
+  b.index.Delete(key)
+}
+
+func (b *indexedBatchImpl) SingleDelete(key []byte) {
+  b.batchImpl.SingleDelete(key)
+  b.index.SingleDelete(key)
+}
+
+func (b *indexedBatchImpl) DeleteRange(start, end []byte) {
+  b.batchImpl.DeleteRange(start, end)
+  b.index.DeleteRange(start, end)
+}
+
+func (b *indexedBatchImpl) Clear() {
+  b.batchImpl.Clear()
+  b.index = newBatchIndex(b.ucmp)
+}
+
+func (b *indexedBatchImpl) RollbackToSavePoint() error {
+  if err := b.batchImpl.RollbackToSavePoint(); err != nil {
+    return err
+  }
+  b.reindex()
+  return nil
+}
+
+func (b *indexedBatchImpl) SetContents(contents []byte) {
+  b.batchImpl.SetContents(contents)
+  b.reindex()
+}
+
+func (b *indexedBatchImpl) Append(src WriteBatch) {
+  b.batchImpl.Append(src)
+  b.reindex()
+}
+
+// Rebuild the index from the content of the batch
+func (b *indexedBatchImpl) reindex() {
+  b.index = newBatchIndex(b.ucmp)
+  if err := b.batchImpl.Iterate(b.index); err != nil {
+    log4go.Error("index batch content failed %v", err)
+  }
+}
+
+func (b *indexedBatchImpl) GetFromBatchAndDB(db DB, option *util.ReadOption, key []byte) (error, []byte) {
+  iter := b.index.list.NewIterator()
+  iter.Seek(encodeIndexEntry(util.NewInternalKey(key, util.Global.MaxSeq, mem.SeekType).Encode(), nil))
+  state, value, operands, err := b.resolve(iter, key, time.Now().Unix())
+  switch state {
+  case batchFound:
+    return err, value
+  case batchDeleted:
+    return util.ErrNotFound, nil
+  }
+
+  err, value = db.Get(option, key)
+  if state == batchMissing || (err != nil && err != util.ErrNotFound) {
+    return err, value
+  }
+  value, err = fullMerge(b.merger, key, value, operands)
+  return err, value
+}
+
+func (b *indexedBatchImpl) NewIteratorWithBase(base mem.Iterator) mem.Iterator {
+  iter := new(batchBaseIter)
+  iter.init(b, base)
+  return iter
+}
+
+// Resolve the entries of the user key key from the one iter is at,
+// iter is left after them.  Returns the state of key within the batch,
+// the value of key if it is batchFound, and the operands from the
+// oldest to the newest if it is batchMerge.
+func (b *indexedBatchImpl) resolve(iter mem.Iterator, key []byte, now int64) (int, []byte, [][]byte, error) {
+  // a range tombstone of the batch deletes the key in the db
+  delSeq := b.deleted(key)
+  state := batchMerge
+  if delSeq != 0 {
+    state = batchDeleted
+  }
+
+  var base []byte
+  var operands [][]byte
+  ikey := new(util.ParsedInternalKey)
+  for ; iter.Valid(); iter.Next() {
+    entry, value := decodeIndexEntry(iter.Key().([]byte))
+    if err := ikey.Decode(entry); err != nil || b.ucmp.Compare(ikey.Key, key) != 0 {
+      break
+    }
+
+    if ikey.Seq < delSeq {
+      state = batchDeleted
+      break
+    } else if ikey.Rtype == mem.MergeType {
+      // entries of a key are met from the newest to the oldest
+      operands = append([][]byte{value}, operands...)
+      continue
+    }
+
+    var err error
+    if base, err = resolveEntry(ikey.Rtype, value, now); err == nil {
+      state = batchFound
+    } else {
+      state = batchDeleted
+    }
+    break
+  }
+
+  for ; iter.Valid(); iter.Next() {
+    entry, _ := decodeIndexEntry(iter.Key().([]byte))
+    if b.ucmp.Compare(util.ExtractUserKey(entry), key) != 0 {
+      break
+    }
+  }
+
+  if len(operands) == 0 {
+    if state == batchMerge {
+      // the batch holds no entry for key
+      return batchMissing, nil, nil, nil
+    }
+    return state, base, nil, nil
+  } else if state == batchMerge {
+    return batchMerge, nil, operands, nil
+  }
+
+  value, err := fullMerge(b.merger, key, base, operands)
+  return batchFound, value, nil, err
+}
+
+// Return the sequence of the newest range tombstone of the batch
+// covering key, 0 if there is none
+func (b *indexedBatchImpl) deleted(key []byte) uint64 {
+  if len(b.index.dels) == 0 {
+    return 0
+  }
+  return b.index.dels.MaxCoveringSeq(b.ucmp, key, util.Global.MaxSeq)
+}
+
+// batchIndex keeps the updates of a batch in a skiplist ordered like
+// the entries of a memtable, the n-th update of the batch gets the
+// sequence n.  Range tombstones are kept apart.
+type batchIndex struct {
+  list mem.Skiplist
+  dels mem.RangeTombstones
+  seq  uint64
+}
+
+func newBatchIndex(ucmp util.Comparator) *batchIndex {
+  index := new(batchIndex)
+  index.init(ucmp)
+  return index
+}
+
+func (x *batchIndex) init(ucmp util.Comparator) {
+  x.list = mem.NewSkiplist(mem.NewMemtableKeyComparator(mem.NewInternalKeyComparator(ucmp)))
+  x.dels = mem.RangeTombstones{}
+  x.seq = 0
+}
+
+func (x *batchIndex) add(rtype byte, key, value []byte) {
+  x.seq++
+  x.list.Insert(encodeIndexEntry(util.NewInternalKey(key, x.seq, rtype).Encode(), value))
+}
+
+func (x *batchIndex) Put(key, value []byte) {
+  x.add(mem.ValueType, key, value)
+}
+
+func (x *batchIndex) PutWithExpiry(key, value []byte, expiry int64) {
+  x.add(mem.TTLValueType, key, mem.EncodeTTLValue(value, expiry))
+}
+
+func (x *batchIndex) Merge(key, operand []byte) {
+  x.add(mem.MergeType, key, operand)
+}
+
+func (x *batchIndex) Delete(key []byte) {
+  x.add(mem.DeleteType, key, []byte{})
+}
+
+func (x *batchIndex) SingleDelete(key []byte) {
+  x.add(mem.SingleDeleteType, key, []byte{})
+}
+
+func (x *batchIndex) DeleteRange(start, end []byte) {
+  x.seq++
+  x.dels = append(x.dels, &mem.RangeTombstone{Start : copyBytes(start), End : copyBytes(end), Seq : x.seq})
+}
+
+// The markers of two-phase commit change nothing the batch reads see
+func (x *batchIndex) MarkBeginPrepare() {
+}
+
+func (x *batchIndex) MarkEndPrepare(name []byte) {
+}
+
+func (x *batchIndex) MarkCommit(name []byte) {
+}
+
+func (x *batchIndex) MarkRollback(name []byte) {
+}
+
+// Format of an index entry is concatenation of:
+// key_size   : uint32 of internal_key.size()
+// key bytes  : [internal_key.size()]byte
+// value_size : len(value)
+// value bytes: [value_size]byte
+func encodeIndexEntry(ikey, value []byte) []byte {
+  entry := make([]byte, 0, 8 + len(ikey) + len(value))
+  entry = append(entry, util.GetBytesLen(ikey)...)
+  entry = append(entry, ikey...)
+  entry = append(entry, util.GetBytesLen(value)...)
+  return append(entry, value...)
+}
+
+func decodeIndexEntry(entry []byte) ([]byte, []byte) {
+  ikey, rest := util.GetLenPrefixBytes(entry)
+  value, _ := util.GetLenPrefixBytes(rest)
+  return ikey, value
+}
+
+// batchDeltaIter walks the user keys of an indexed batch, each of them
+// resolved to its state within the batch
+type batchDeltaIter struct {
+  batch    *indexedBatchImpl
+  iter     mem.Iterator   // at the newest entry of key
+  now      int64
+  key      []byte
+  state    int
+  value    []byte
+  operands [][]byte
+  err      error
+}
+
+func newBatchDeltaIter(batch *indexedBatchImpl) *batchDeltaIter {
+  iter := new(batchDeltaIter)
+  iter.init(batch)
+  return iter
+}
+
+func (i *batchDeltaIter) init(batch *indexedBatchImpl) {
+  i.batch = batch
+  i.iter = batch.index.list.NewIterator()
+  i.now = time.Now().Unix()
+}
+
+func (i *batchDeltaIter) Valid() bool {
+  return i.iter.Valid()
+}
+
+func (i *batchDeltaIter) Next() {
+  for i.iter.Valid() && i.batch.ucmp.Compare(i.userKey(), i.key) == 0 {
+    i.iter.Next()
+  }
+  i.load()
+}
+
+func (i *batchDeltaIter) Prev() {
+  i.iter.Prev()
+  if i.iter.Valid() {
+    // from the oldest entry of the previous key to its newest one
+    i.seekNewest(i.userKey())
+  }
+  i.load()
+}
+
+func (i *batchDeltaIter) Seek(key []byte) {
+  i.seekNewest(key)
+  i.load()
+}
+
+func (i *batchDeltaIter) SeekToFirst() {
+  i.iter.SeekToFirst()
+  i.load()
+}
+
+func (i *batchDeltaIter) SeekToLast() {
+  i.iter.SeekToLast()
+  if i.iter.Valid() {
+    i.seekNewest(i.userKey())
+  }
+  i.load()
+}
+
+func (i *batchDeltaIter) seekNewest(key []byte) {
+  i.iter.Seek(encodeIndexEntry(util.NewInternalKey(key, util.Global.MaxSeq, mem.SeekType).Encode(), nil))
+}
+
+func (i *batchDeltaIter) userKey() []byte {
+  ikey, _ := decodeIndexEntry(i.iter.Key().([]byte))
+  return util.ExtractUserKey(ikey)
+}
+
+// Resolve the entries of the key iter is at
+func (i *batchDeltaIter) load() {
+  if !i.iter.Valid() {
+    i.key, i.value, i.operands, i.err = nil, nil, nil, nil
+    return
+  }
+
+  i.key = i.userKey()
+  probe := i.batch.index.list.NewIterator()
+  probe.Seek(i.iter.Key())
+  i.state, i.value, i.operands, i.err = i.batch.resolve(probe, i.key, i.now)
+}
+
+// batchBaseIter overlays the updates of an indexed batch onto base, an
+// iterator over the user view of a db.  Moving forward, both base and
+// delta are at the first key not less than the current one; moving
+// backward, at the last key not larger than it.
+type batchBaseIter struct {
+  batch   *indexedBatchImpl
+  base    mem.Iterator
+  delta   *batchDeltaIter
+  forward bool
+  valid   bool
+  key     []byte
+  value   []byte
+}
+
+func (i *batchBaseIter) init(batch *indexedBatchImpl, base mem.Iterator) {
+  i.batch = batch
+  i.base = base
+  i.delta = newBatchDeltaIter(batch)
+  i.forward = true
+  i.valid = false
+}
+
+func (i *batchBaseIter) Valid() bool {
+  return i.valid
+}
+
+func (i *batchBaseIter) Key() interface{} {
+  return i.key
+}
+
+func (i *batchBaseIter) Value() interface{} {
+  return i.value
+}
+
+func (i *batchBaseIter) Next() {
+  if !i.forward {
+    i.forward = true
+    i.base.Seek(i.key)
+    i.delta.Seek(i.key)
+  }
+  i.advance(i.key)
+  i.findEntry()
+}
+
+func (i *batchBaseIter) Prev() {
+  if i.forward {
+    // step both iterators before the current key
+    i.forward = false
+    if i.base.Seek(i.key); i.base.Valid() {
+      i.base.Prev()
+    } else {
+      i.base.SeekToLast()
+    }
+
+    if i.delta.Seek(i.key); i.delta.Valid() {
+      i.delta.Prev()
+    } else {
+      i.delta.SeekToLast()
+    }
+  } else {
+    i.advance(i.key)
+  }
+  i.findEntry()
+}
+
+func (i *batchBaseIter) Seek(key interface{}) {
+  i.forward = true
+  i.base.Seek(key)
+  i.delta.Seek(key.([]byte))
+  i.findEntry()
+}
+
+func (i *batchBaseIter) SeekToFirst() {
+  i.forward = true
+  i.base.SeekToFirst()
+  i.delta.SeekToFirst()
+  i.findEntry()
+}
+
+func (i *batchBaseIter) SeekToLast() {
+  i.forward = false
+  i.base.SeekToLast()
+  i.delta.SeekToLast()
+  i.findEntry()
+}
+
+// Move the iterators at key one step in the current direction
+func (i *batchBaseIter) advance(key []byte) {
+  if i.base.Valid() && i.batch.ucmp.Compare(i.base.Key(), key) == 0 {
+    if i.forward {
+      i.base.Next()
+    } else {
+      i.base.Prev()
+    }
+  }
+
+  if i.delta.Valid() && i.batch.ucmp.Compare(i.delta.key, key) == 0 {
+    if i.forward {
+      i.delta.Next()
+    } else {
+      i.delta.Prev()
+    }
+  }
+}
+
+// Settle at the nearest key in the current direction which is not
+// deleted by the batch
+func (i *batchBaseIter) findEntry() {
+  for i.base.Valid() || i.delta.Valid() {
+    useBase, useDelta := i.base.Valid(), i.delta.Valid()
+    if useBase && useDelta {
+      cmp := i.batch.ucmp.Compare(i.base.Key(), i.delta.key)
+      if !i.forward {
+        cmp = -cmp
+      }
+      useBase, useDelta = cmp <= 0, cmp >= 0
+    }
+
+    var key, value []byte
+    live := true
+    if !useDelta {
+      key, value = i.base.Key().([]byte), i.base.Value().([]byte)
+      live = i.batch.deleted(key) == 0
+    } else {
+      key = i.delta.key
+      switch i.delta.state {
+      case batchFound:
+        if i.delta.err != nil {
+          log4go.Error("merge operands of key %s failed %v", key, i.delta.err)
+        }
+        value, live = i.delta.value, i.delta.err == nil
+      case batchMerge:
+        var existing []byte
+        if useBase {
+          existing = i.base.Value().([]byte)
+        }
+        value, live = i.merge(key, existing, i.delta.operands)
+      default:
+        live = false
+      }
+    }
+
+    key = copyBytes(key)
+    if live {
+      i.valid = true
+      i.key, i.value = key, value
+      return
+    }
+    i.advance(key)
+  }
+  i.valid = false
+  i.key, i.value = nil, nil
+}
+
+// Apply operands to the value existing for key, keys which fail to
+// merge are left out of the iteration
+func (i *batchBaseIter) merge(key, existing []byte, operands [][]byte) ([]byte, bool) {
+  value, err := fullMerge(i.batch.merger, key, existing, operands)
+  if err != nil {
+    log4go.Error("merge operands of key %s failed %v", key, err)
+    return nil, false
+  }
+  return value, true
+}
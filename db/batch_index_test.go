@@ -0,0 +1,93 @@
+package db
+
+import (
+  "os"
+  "testing"
+)
+
+import (
+  "github.com/jellybean4/goleveldb/util"
+)
+
+func TestWriteBatchWithIndex(t *testing.T) {
+  os.RemoveAll("/tmp/test_batch_index")
+  option := util.DefaultOption
+  option.MergeOperator = new(appendOperator)
+  db := openDB(t, &option, "/tmp/test_batch_index")
+  for _, key := range []string{"a", "b", "c", "d", "e", "f"} {
+    db.Put(&util.DefaultWriteOption, []byte(key), []byte("db" + key))
+  }
+
+  batch := NewWriteBatchWithIndex(&option)
+  batch.Put([]byte("a"), []byte("x"))
+  batch.Put([]byte("a"), []byte("y"))
+  batch.Delete([]byte("b"))
+  batch.Merge([]byte("c"), []byte("m"))
+  batch.DeleteRange([]byte("d"), []byte("f"))
+  batch.Put([]byte("e"), []byte("z"))
+  batch.Merge([]byte("g"), []byte("n"))
+  batch.Put([]byte("h"), []byte("w"))
+  batch.Delete([]byte("h"))
+
+  expects := map[string]string{"a" : "y", "b" : "", "c" : "dbc,m", "d" : "",
+      "e" : "z", "f" : "dbf", "g" : "n", "h" : ""}
+  for key, expect := range expects {
+    err, val := batch.GetFromBatchAndDB(db, &util.DefaultReadOption, []byte(key))
+    if expect == "" {
+      if err != util.ErrNotFound {
+        t.Errorf("get deleted key %s returns %s %v", key, val, err)
+      }
+    } else if err != nil || string(val) != expect {
+      t.Errorf("get key %s returns %s %v", key, val, err)
+    }
+  }
+
+  keys := ""
+  base := db.NewIterator(&util.DefaultReadOption)
+  defer base.Release()
+  iter := batch.NewIteratorWithBase(base)
+  for iter.SeekToFirst(); iter.Valid(); iter.Next() {
+    keys += string(iter.Key().([]byte)) + "=" + string(iter.Value().([]byte)) + ";"
+  }
+  if keys != "a=y;c=dbc,m;e=z;f=dbf;g=n;" {
+    t.Errorf("iterate keys not match %s", keys)
+  }
+
+  keys = ""
+  for iter.SeekToLast(); iter.Valid(); iter.Prev() {
+    keys += string(iter.Key().([]byte)) + ";"
+  }
+  if keys != "g;f;e;c;a;" {
+    t.Errorf("reverse iterate keys not match %s", keys)
+  }
+
+  // change direction in the middle
+  keys = ""
+  iter.Seek([]byte("d"))
+  for _, forward := range []bool{true, false, false, true, true} {
+    keys += string(iter.Key().([]byte)) + ";"
+    if forward {
+      iter.Next()
+    } else {
+      iter.Prev()
+    }
+  }
+  if keys != "e;f;e;c;e;" {
+    t.Errorf("iterate keys back and forth not match %s", keys)
+  }
+
+  if err, _ := db.Get(&util.DefaultReadOption, []byte("g")); err != util.ErrNotFound {
+    t.Errorf("get key of unwritten batch returns %v", err)
+  }
+  db.Write(&util.DefaultWriteOption, batch)
+  if err, val := db.Get(&util.DefaultReadOption, []byte("c")); err != nil || string(val) != "dbc,m" {
+    t.Errorf("get key of written batch returns %s %v", val, err)
+  }
+
+  batch.SetSavePoint()
+  batch.Put([]byte("c"), []byte("x"))
+  batch.RollbackToSavePoint()
+  if err, val := batch.GetFromBatchAndDB(db, &util.DefaultReadOption, []byte("c")); err != nil || string(val) != "dbc,m,m" {
+    t.Errorf("get key after rollback returns %s %v", val, err)
+  }
+}
@@ -33,6 +33,23 @@ func PrintBatch(t *testing.T, batch WriteBatch) []byte {
       msg := fmt.Sprintf("Put(%s, %s)", ikey.Key, iter.Value().([]byte))
       buffer.WriteString(msg)
       cnt++
+    } else if ikey.Rtype == mem.TTLValueType {
+      value, _, err := mem.DecodeTTLValue(iter.Value().([]byte))
+      if err != nil {
+        t.Errorf("decode ttl value error %v", err)
+        return nil
+      }
+      msg := fmt.Sprintf("PutWithTTL(%s, %s)", ikey.Key, value)
+      buffer.WriteString(msg)
+      cnt++
+    } else if ikey.Rtype == mem.SingleDeleteType {
+      msg := fmt.Sprintf("SingleDelete(%s)", ikey.Key)
+      buffer.WriteString(msg)
+      cnt++
+    } else if ikey.Rtype == mem.MergeType {
+      msg := fmt.Sprintf("Merge(%s, %s)", ikey.Key, iter.Value().([]byte))
+      buffer.WriteString(msg)
+      cnt++
     } else {
       t.Errorf("deocde unknown %d", ikey.Rtype)
       return nil
@@ -41,6 +58,12 @@ func PrintBatch(t *testing.T, batch WriteBatch) []byte {
     buffer.WriteString(fmt.Sprintf("%d", ikey.Seq))
   }
   
+  for _, tombstone := range table.RangeTombstones() {
+    msg := fmt.Sprintf("DeleteRange(%s, %s)@%d", tombstone.Start, tombstone.End, tombstone.Seq)
+    buffer.WriteString(msg)
+    cnt++
+  }
+  
   if cnt != batch.Count() {
     t.Errorf("count mismatch %d / %d %s", cnt, batch.Count(), buffer.Bytes())
   }
@@ -70,7 +93,7 @@ func TestMulti(t *testing.T) {
   }
   
   if batch.Count() != 3 {
-    t.Errorf("batch count not match %d", batch.Count)
+    t.Errorf("batch count not match %d", batch.Count())
   }
  
   content := PrintBatch(t, batch)
@@ -109,4 +132,114 @@ func TestBatch(t *testing.T) {
   if msg := string(PrintBatch(t, b1)); msg != "Put(a, va)@200Put(b, vb)@202Put(b, vb)@201Delete(foo)@203" {
     t.Errorf("final concat error %s", msg)
   }
-}
\ No newline at end of file
+}
+
+func TestTTLBatch(t *testing.T) {
+  batch := NewWriteBatch()
+  batch.Put([]byte("foo"), []byte("bar"))
+  batch.PutWithTTL([]byte("baz"), []byte("boo"), 60)
+  batch.SetSequence(100)
+
+  if batch.Count() != 2 {
+    t.Errorf("batch count not match %d", batch.Count())
+  }
+
+  content := PrintBatch(t, batch)
+  if string(content) != "PutWithTTL(baz, boo)@101Put(foo, bar)@100" {
+    t.Errorf("batch content not match %s", content)
+  }
+}
+
+func TestMergeBatch(t *testing.T) {
+  batch := NewWriteBatch()
+  batch.Put([]byte("foo"), []byte("bar"))
+  batch.Merge([]byte("foo"), []byte("baz"))
+  batch.Merge([]byte("cnt"), []byte("1"))
+  batch.SetSequence(100)
+
+  if batch.Count() != 3 {
+    t.Errorf("batch count not match %d", batch.Count())
+  }
+
+  content := PrintBatch(t, batch)
+  if string(content) != "Merge(cnt, 1)@102Merge(foo, baz)@101Put(foo, bar)@100" {
+    t.Errorf("batch content not match %s", content)
+  }
+}
+
+func TestDeleteRangeBatch(t *testing.T) {
+  batch := NewWriteBatch()
+  batch.Put([]byte("foo"), []byte("bar"))
+  batch.DeleteRange([]byte("a"), []byte("f"))
+  batch.Delete([]byte("baz"))
+  batch.SetSequence(100)
+
+  if batch.Count() != 3 {
+    t.Errorf("batch count not match %d", batch.Count())
+  }
+
+  content := PrintBatch(t, batch)
+  if string(content) != "Delete(baz)@102Put(foo, bar)@100DeleteRange(a, f)@101" {
+    t.Errorf("batch content not match %s", content)
+  }
+}
+
+func TestSingleDeleteBatch(t *testing.T) {
+  batch := NewWriteBatch()
+  batch.Put([]byte("foo"), []byte("bar"))
+  batch.SingleDelete([]byte("foo"))
+  batch.SingleDelete([]byte("baz"))
+  batch.SetSequence(100)
+
+  if batch.Count() != 3 {
+    t.Errorf("batch count not match %d", batch.Count())
+  }
+
+  content := PrintBatch(t, batch)
+  if string(content) != "SingleDelete(baz)@102SingleDelete(foo)@101Put(foo, bar)@100" {
+    t.Errorf("batch content not match %s", content)
+  }
+}
+
+func TestSavePoint(t *testing.T) {
+  batch := NewWriteBatch()
+  if err := batch.RollbackToSavePoint(); err == nil {
+    t.Errorf("rollback without save point succeeded")
+  }
+
+  batch.Put([]byte("foo"), []byte("bar"))
+  batch.SetSavePoint()
+  batch.Delete([]byte("baz"))
+  batch.SetSavePoint()
+  batch.Put([]byte("qux"), []byte("v1"))
+  batch.SetSavePoint()
+  batch.Merge([]byte("qux"), []byte("v2"))
+  batch.SetSequence(100)
+
+  if err := batch.PopSavePoint(); err != nil {
+    t.Errorf("pop save point error %v", err)
+  }
+  if err := batch.RollbackToSavePoint(); err != nil {
+    t.Errorf("rollback to save point error %v", err)
+  }
+  if batch.Count() != 2 {
+    t.Errorf("batch count not match %d", batch.Count())
+  }
+  content := PrintBatch(t, batch)
+  if string(content) != "Delete(baz)@101Put(foo, bar)@100" {
+    t.Errorf("batch content not match %s", content)
+  }
+
+  batch.Put([]byte("quux"), []byte("v3"))
+  if err := batch.RollbackToSavePoint(); err != nil {
+    t.Errorf("rollback to save point error %v", err)
+  }
+  content = PrintBatch(t, batch)
+  if string(content) != "Put(foo, bar)@100" {
+    t.Errorf("batch content not match %s", content)
+  }
+
+  if err := batch.PopSavePoint(); err == nil {
+    t.Errorf("pop without save point succeeded")
+  }
+}
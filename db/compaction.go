@@ -0,0 +1,364 @@
+package db
+
+import (
+  "sort"
+  "time"
+)
+
+import (
+  "code.google.com/p/log4go"
+)
+
+import (
+  "github.com/jellybean4/goleveldb/util"
+  "github.com/jellybean4/goleveldb/mem"
+  "github.com/jellybean4/goleveldb/version"
+  "github.com/jellybean4/goleveldb/compact"
+)
+
+// compactionState decides which entries read from the inputs of a
+// compaction are written to its outputs.  Entries must be fed in
+// internal key order, so every subcompaction needs its own copy.
+type compactionState struct {
+  comp    *compact.Compact
+  current *version.Version
+  ucmp    util.Comparator
+  filter  util.CompactionFilter
+  merger  util.MergeOperator
+  dels    mem.RangeTombstones   // range tombstones of the inputs
+
+  // entries at or below smallestSnapshot are visible to every snapshot,
+  // entries above newestSnapshot are visible to none of them
+  smallestSnapshot uint64
+  newestSnapshot   uint64
+  snapshots        []uint64   // from the oldest to the newest
+  hasSnapshot      bool
+  bottommost       bool
+  now              int64   // unix time ttl values are checked against
+
+  currentKey []byte
+  lastSeq    uint64
+  misuses    []int   // SingleDelete misuses met, by type
+}
+
+// Capture the snapshots and version comp runs against, the version is
+// referenced until the merge is done.
+// REQUIRES: db.mutex is held
+func (db *dbImpl) newCompactionState(comp *compact.Compact) *compactionState {
+  state := new(compactionState)
+  state.comp = comp
+  state.current = db.vset.Current()
+  state.current.Ref()
+  state.ucmp = db.option.Comparator.(*mem.InternalKeyComparator).UserComparator()
+  state.filter = db.option.CompactionFilter
+  state.merger = db.option.MergeOperator
+  state.dels = mem.RangeTombstones{}
+  for _, files := range comp.Files {
+    for _, meta := range files {
+      if !meta.HasRangeDels {
+        continue
+      }
+      
+      if tbl := db.cache.FindTable(meta.Number, meta.FileSize); tbl != nil {
+        state.dels = append(state.dels, tbl.RangeTombstones()...)
+      }
+    }
+  }
+  state.now = time.Now().Unix()
+  state.hasSnapshot = !db.snapshots.Empty()
+  state.snapshots = db.snapshots.Sequences()
+  if state.hasSnapshot {
+    state.smallestSnapshot = db.snapshots.Oldest().Sequence()
+    state.newestSnapshot = db.snapshots.Newest().Sequence()
+  } else {
+    state.smallestSnapshot = db.vset.LastSequence()
+  }
+
+  // older level0 runs of universal compactions are not below the output
+  state.bottommost = comp.OutputLevel > 0
+  smallest, largest := comp.Smallest.UserKey(), comp.Largest.UserKey()
+  for level := comp.OutputLevel + 1; level < util.Global.MaxLevel; level++ {
+    if state.current.OverlapInLevel(level, smallest, largest) {
+      state.bottommost = false
+      break
+    }
+  }
+  return state
+}
+
+// Return a fresh copy of s for one subcompaction
+func (s *compactionState) fork() *compactionState {
+  state := *s
+  state.currentKey = nil
+  state.misuses = make([]int, misuseTypes)
+  return &state
+}
+
+// Consume the next entries of iter, returns the entries to write in
+// their place
+func (s *compactionState) next(iter mem.Iterator) ([][]byte, [][]byte) {
+  key, value, keep := s.process(iter.Key().([]byte), iter.Value().([]byte))
+  if !keep {
+    iter.Next()
+    return nil, nil
+  }
+  
+  ikey := new(util.ParsedInternalKey)
+  if ikey.Decode(key); ikey.Rtype == mem.MergeType && s.merger != nil {
+    return s.mergeOperands(ikey, value, iter)
+  } else if ikey.Rtype == mem.SingleDeleteType {
+    return s.singleDelete(ikey, key, value, iter)
+  }
+  iter.Next()
+  return [][]byte{key}, [][]byte{value}
+}
+
+// Returns the entry to write in place of key -> value, keep is false
+// if the entry should be dropped.
+func (s *compactionState) process(key, value []byte) (outKey, outValue []byte, keep bool) {
+  ikey := new(util.ParsedInternalKey)
+  if err := ikey.Decode(key); err != nil {
+    // do not hide corrupted keys
+    s.currentKey = nil
+    return key, value, true
+  }
+
+  if s.currentKey == nil || s.ucmp.Compare(ikey.Key, s.currentKey) != 0 {
+    s.currentKey = ikey.Key
+    s.lastSeq = util.Global.MaxSeq
+  }
+  lastSeq := s.lastSeq
+  s.lastSeq = ikey.Seq
+
+  if ikey.Rtype == mem.TTLValueType && s.expired(value) {
+    // invisible to every reader, it only hides the older values now
+    ikey.Rtype = mem.DeleteType
+    key = util.NewInternalKey(ikey.Key, ikey.Seq, mem.DeleteType).Encode()
+    value = []byte{}
+  }
+
+  if lastSeq <= s.smallestSnapshot {
+    // hidden by a newer entry for the same user key
+    return nil, nil, false
+  }
+  
+  if s.covered(ikey) {
+    return nil, nil, false
+  }
+
+  if ikey.Rtype == mem.DeleteType && ikey.Seq <= s.smallestSnapshot && s.isBaseLevelForKey(ikey.Key) {
+    // nothing older is left to delete and no snapshot needs the marker
+    return nil, nil, false
+  }
+
+  if (ikey.Rtype != mem.ValueType && ikey.Rtype != mem.TTLValueType) || s.filter == nil {
+    return key, value, true
+  }
+
+  if s.hasSnapshot && ikey.Seq <= s.newestSnapshot {
+    // a live snapshot may still read this value
+    return key, value, true
+  }
+  return s.applyFilter(ikey, key, value)
+}
+
+// Pass the value key -> value to the compaction filter, the filter sees
+// the user value of a ttl value, whose expiry is kept if it is changed
+func (s *compactionState) applyFilter(ikey *util.ParsedInternalKey, key, value []byte) ([]byte, []byte, bool) {
+  data, expiry := value, int64(0)
+  if ikey.Rtype == mem.TTLValueType {
+    var err error
+    if data, expiry, err = mem.DecodeTTLValue(value); err != nil {
+      // do not hide corrupted values
+      return key, value, true
+    }
+  }
+  
+  decision, changed := s.filter.Filter(s.comp.OutputLevel, ikey.Key, data, s.bottommost)
+  if decision == util.FilterChange && ikey.Rtype == mem.TTLValueType {
+    changed = mem.EncodeTTLValue(changed, expiry)
+  }
+  switch decision {
+  case util.FilterRemove:
+    // without snapshots the older values of the key within the inputs
+    // are dropped as hidden, so only values below need the deletion
+    if !s.hasSnapshot && s.isBaseLevelForKey(ikey.Key) {
+      return nil, nil, false
+    }
+    // shadow the older values of the key with a deletion
+    return util.NewInternalKey(ikey.Key, ikey.Seq, mem.DeleteType).Encode(), []byte{}, true
+  case util.FilterChange:
+    return key, changed, true
+  }
+  return key, value, true
+}
+
+// Returns true iff no older data for userKey may exist outside the inputs
+func (s *compactionState) isBaseLevelForKey(userKey []byte) bool {
+  if s.comp.OutputLevel == 0 {
+    return false
+  }
+  return s.current.IsBaseLevelForKey(s.comp.OutputLevel, userKey)
+}
+
+// Returns true iff ikey is deleted by a range tombstone for every reader
+func (s *compactionState) covered(ikey *util.ParsedInternalKey) bool {
+  return len(s.dels) != 0 && s.dels.MaxCoveringSeq(s.ucmp, ikey.Key, s.smallestSnapshot) > ikey.Seq
+}
+
+// Return the range tombstones within [start, end) to write to the
+// outputs.  A tombstone seen by every reader is dropped once no data
+// below the outputs is left for it to delete.
+func (s *compactionState) outputTombstones(start, end []byte) mem.RangeTombstones {
+  rslt := mem.RangeTombstones{}
+  for _, t := range s.dels.Clip(s.ucmp, start, end) {
+    if t.Seq <= s.smallestSnapshot && s.isBaseLevelForRange(t.Start, t.End) {
+      continue
+    }
+    rslt = append(rslt, t)
+  }
+  return rslt
+}
+
+// Returns true iff no older data within [start, end] may exist outside
+// the inputs
+func (s *compactionState) isBaseLevelForRange(start, end []byte) bool {
+  if s.comp.OutputLevel == 0 {
+    return false
+  }
+  
+  for level := s.comp.OutputLevel + 1; level < util.Global.MaxLevel; level++ {
+    if s.current.OverlapInLevel(level, start, end) {
+      return false
+    }
+  }
+  return true
+}
+
+// Returns true iff the TTLValueType value has expired
+func (s *compactionState) expired(value []byte) bool {
+  _, expiry, err := mem.DecodeTTLValue(value)
+  return err == nil && mem.TTLExpired(expiry, s.now)
+}
+
+// Combine the merge operand ikey -> operand iter is at with the older
+// entries of its key which no snapshot can tell apart from it.  If a
+// value or a deletion is met, or if there is no data for the key
+// below, the operands are merged into a value at the sequence of the
+// newest operand.  Otherwise they are partially merged into a single
+// operand, or kept as they are if the merge operator can't do that.
+// iter is left after the entries consumed.
+func (s *compactionState) mergeOperands(ikey *util.ParsedInternalKey, operand []byte, iter mem.Iterator) ([][]byte, [][]byte) {
+  ukey, seq := copyBytes(ikey.Key), ikey.Seq
+  keys, operands := [][]byte{iter.Key().([]byte)}, [][]byte{operand}
+  iter.Next()
+
+  // the entry the operands apply to, if met
+  var baseKey, baseValue []byte
+  deleted := false
+  entry := new(util.ParsedInternalKey)
+  for iter.Valid() {
+    key, value := iter.Key().([]byte), iter.Value().([]byte)
+    if err := entry.Decode(key); err != nil {
+      break
+    }
+    
+    if s.ucmp.Compare(entry.Key, ukey) != 0 || s.stripe(entry.Seq) != s.stripe(seq) {
+      break
+    }
+    
+    if s.dels.MaxCoveringSeq(s.ucmp, ukey, seq) > entry.Seq {
+      // deleted for every reader of the operands, which are merged
+      // into nothing.  The entry itself is left to process.
+      deleted = true
+      break
+    }
+    
+    s.lastSeq = entry.Seq
+    iter.Next()
+    if entry.Rtype != mem.MergeType {
+      baseKey, baseValue = key, value
+      break
+    }
+    keys = append(keys, key)
+    operands = append(operands, value)
+  }
+  
+  // the operands were gathered from the newest one
+  reverseEntries(keys, operands)
+  reachedEnd := !iter.Valid() || s.ucmp.Compare(util.ExtractUserKey(iter.Key().([]byte)), ukey) != 0
+  if baseKey != nil || deleted || (reachedEnd && s.isBaseLevelForKey(ukey)) {
+    var existing []byte
+    if baseKey != nil {
+      // deleted or expired values leave nothing to merge into
+      existing, _ = resolveEntry(entry.Rtype, baseValue, s.now)
+    }
+    
+    value, err := s.merger.FullMerge(ukey, existing, operands)
+    if err == nil {
+      return [][]byte{util.NewInternalKey(ukey, seq, mem.ValueType).Encode()}, [][]byte{value}
+    }
+    // keep the entries as they are, reads will report the error
+    log4go.Error("merge operands of key %s failed %v", ukey, err)
+  } else if len(operands) > 1 {
+    if merged, ok := s.merger.PartialMerge(ukey, operands); ok {
+      return [][]byte{util.NewInternalKey(ukey, seq, mem.MergeType).Encode()}, [][]byte{merged}
+    }
+  }
+  
+  reverseEntries(keys, operands)
+  if baseKey != nil {
+    keys, operands = append(keys, baseKey), append(operands, baseValue)
+  }
+  return keys, operands
+}
+
+// Drop the SingleDelete ikey iter is at together with the Put right
+// below it if no snapshot can tell them apart.  Otherwise it is kept as
+// key -> value, unless nothing is left for it to delete like a Delete
+// at the base level.  Anything but a Put right below the SingleDelete,
+// or a value left below the pair, is counted as a misuse.
+// iter is left after the entries consumed.
+func (s *compactionState) singleDelete(ikey *util.ParsedInternalKey, key, value []byte, iter mem.Iterator) ([][]byte, [][]byte) {
+  ukey, seq := copyBytes(ikey.Key), ikey.Seq
+  iter.Next()
+  
+  entry := new(util.ParsedInternalKey)
+  if iter.Valid() && entry.Decode(iter.Key().([]byte)) == nil && s.ucmp.Compare(entry.Key, ukey) == 0 {
+    if entry.Rtype != mem.ValueType && entry.Rtype != mem.TTLValueType {
+      s.misuses[misuseMismatch]++
+    } else if s.stripe(entry.Seq) == s.stripe(seq) {
+      s.lastSeq = entry.Seq
+      iter.Next()
+      if iter.Valid() && entry.Decode(iter.Key().([]byte)) == nil && s.ucmp.Compare(entry.Key, ukey) == 0 {
+        if entry.Rtype != mem.DeleteType && entry.Rtype != mem.SingleDeleteType {
+          // the older entry comes back to the readers
+          s.misuses[misuseMultiplePuts]++
+        }
+      }
+      return nil, nil
+    }
+    // otherwise a snapshot reads the put, which is left to process
+  }
+  
+  if seq <= s.smallestSnapshot && s.isBaseLevelForKey(ukey) {
+    // the older entries, if any, are dropped as hidden
+    return nil, nil
+  }
+  return [][]byte{key}, [][]byte{value}
+}
+
+func reverseEntries(keys, values [][]byte) {
+  for i, j := 0, len(keys) - 1; i < j; i, j = i + 1, j - 1 {
+    keys[i], keys[j] = keys[j], keys[i]
+    values[i], values[j] = values[j], values[i]
+  }
+}
+
+// Return the index of the oldest snapshot which sees the entries at
+// seq, entries with the same index are seen by the same snapshots
+func (s *compactionState) stripe(seq uint64) int {
+  return sort.Search(len(s.snapshots), func(i int) bool {
+    return s.snapshots[i] >= seq
+  })
+}
@@ -1,10 +1,14 @@
 package db
 
 import (
+  "io"
   "os"
+  "sort"
+  "runtime"
   "sync"
   "sync/atomic"
   "errors"
+  "time"
 )
 
 import (
@@ -17,6 +21,7 @@ import (
   "github.com/jellybean4/goleveldb/table"
   "github.com/jellybean4/goleveldb/log"
   "github.com/jellybean4/goleveldb/version"
+  "github.com/jellybean4/goleveldb/compact"
 )
 
 type DB interface {
@@ -25,17 +30,53 @@ type DB interface {
   // Note: consider setting options.sync = true.
   Put(option *util.WriteOption, key, value []byte) error
   
+  // Set the database entry for "key" to "value" for ttl seconds.  Once
+  // the ttl has passed the key reads as missing, and its entry is
+  // dropped by later compactions.
+  PutWithTTL(option *util.WriteOption, key, value []byte, ttl int) error
+  
+  // Merge "operand" into the database entry for "key".  The operands of
+  // a key are combined with its value by the MergeOperator of the
+  // option the database was opened with when the key is read.
+  Merge(option *util.WriteOption, key, operand []byte) error
+  
   // Remove the database entry (if any) for "key".  Returns OK on
   // success, and a non-OK status on error.  It is not an error if "key"
   // did not exist in the database.
   // Note: consider setting options.sync = true. 
   Delete(option *util.WriteOption, key []byte) error
   
+  // Remove the database entry for "key", which must have been Put
+  // exactly once since it was last deleted.  The entry and its
+  // tombstone are dropped together by the first compaction that meets
+  // both of them.  Misuse is counted in the "leveldb.stats" property.
+  SingleDelete(option *util.WriteOption, key []byte) error
+  
+  // Remove the database entries (if any) for all the keys within
+  // ["start", "end").  Returns OK on success, and a non-OK status on
+  // error.
+  DeleteRange(option *util.WriteOption, start, end []byte) error
+  
   // Apply the specified updates to the database.
   // Returns OK on success, non-OK on failure.
   // Note: consider setting options.sync = true. 
   Write(option *util.WriteOption, batch WriteBatch) error
   
+  // Start an optimistic transaction, which takes no lock and fails to
+  // commit if a key it read was written by someone else meanwhile.
+  BeginOptimisticTransaction() Transaction
+  
+  // Start a pessimistic transaction, which locks the keys it reads or
+  // writes until it commits or rolls back.  Others wait for the locks
+  // as long as option allows.
+  BeginTransaction(option *util.TransactionOption) Transaction
+  
+  // Return the transactions which were prepared but neither committed
+  // nor rolled back when the db was opened.  They hold the locks of
+  // their keys until the application commits or rolls them back.  Only
+  // the first call returns them.
+  GetPreparedTransactions() []Transaction
+  
   // If the database contains an entry for "key" store the
   // corresponding value in *value and return OK.
   //
@@ -49,9 +90,9 @@ type DB interface {
   // The result of NewIterator() is initially invalid (caller must
   // call one of the Seek methods on the iterator before using it).
   //
-  // Caller should delete the iterator when it is no longer needed.
-  // The returned iterator should be deleted before this db is deleted.
-  NewIterator(option *util.ReadOption) mem.Iterator
+  // Caller should release the iterator when it is no longer needed.
+  // The returned iterator should be released before this db is closed.
+  NewIterator(option *util.ReadOption) Iterator
   
   // Return a handle to the current DB state.  Iterators created with
   // this handle will all observe a stable snapshot of the current DB
@@ -59,6 +100,10 @@ type DB interface {
   // snapshot is no longer needed.  
   GetSnapshot() Snapshot
   
+  // Release a previously acquired snapshot.  The caller must not
+  // use "snapshot" after this call.
+  ReleaseSnapshot(snapshot Snapshot)
+  
   // DB implementations can export properties about their state
   // via this method.  If "property" is a valid property understood by this
   // DB implementation, fills "*value" with its current value and returns
@@ -85,6 +130,10 @@ type DB interface {
   // The results may not include the sizes of recently written data. 
   GetApproximateSizes(trange []Range) []uint64
   
+  // Return the properties of every table of the current version keyed
+  // by the name of its file.
+  GetPropertiesOfAllTables() (map[string]*table.TableProperties, error)
+  
   // Compact the underlying storage for the key range [*begin,*end].
   // In particular, deleted and overwritten versions are discarded,
   // and the data is rearranged to reduce the cost of operations
@@ -96,17 +145,23 @@ type DB interface {
   // Therefore the following call will compact the entire database:
   //    db->CompactRange(NULL, NULL);
   CompactRange(begin, end []byte) error  
+  
+  // Close the db once its background work is done.  The iterators of
+  // the db should be released before, and the db must not be used
+  // after this call.
+  Close() error
 }
 
 // Open the database with the specified "name".
-// Stores a pointer to a heap-allocated database in *dbptr and returns
-// OK on success.
-// Stores NULL in *dbptr and returns a non-OK status on error.
-// Caller should delete *dbptr when it is no longer needed.
-func Open(option *util.Option, name string) *dbImpl {
+// Returns the database on success, and nil with a non-nil error if it
+// can not be recovered, e.g. it was written with another comparator or
+// merge operator.
+func Open(option *util.Option, name string) (*dbImpl, error) {
   db := new(dbImpl)
-  db.init(option, name)
-  return db
+  if err := db.init(option, name); err != nil {
+    return nil, err
+  }
+  return db, nil
 }
 
 func init() {
@@ -120,20 +175,29 @@ type dbImpl struct {
   batches []*writer
   mutex   *sync.Mutex
   bg_cv   *sync.Cond
-  is_cmp  bool
+  flushing    bool   // a memtable flush is running
+  compactions int    // number of table compactions running
   option  *util.Option
   name    string
   wlog    log.Writer
+  logNumber int   // number of wlog, the log of db.mem
   vset    *version.VersionSet
   status  int
   shut    *atomic.Value
   cache   table.TableCache
+  stats   *dbStats
+  snapshots *snapshotList
+  locks   *lockManager   // key locks of the pessimistic transactions
+  prepared  map[string]*batchImpl   // name -> updates of a prepared transaction
+  recovered []Transaction   // prepared transactions found by the recovery
+  obsolete  []int   // tables deleted from the db, removed from disk once no version lists them
 }
 
 type writer struct {
   batch  WriteBatch
   cv     *sync.Cond
   option *util.WriteOption
+  check  func() error
   state  int
   err    error
 }
@@ -143,39 +207,183 @@ const (
   writer_UNDONE
 )
 
-func (db *dbImpl) init(option *util.Option, name string) {
+func (db *dbImpl) init(option *util.Option, name string) error {
+  // the caller may open other dbs with the same option, leave it intact
+  copied := *option
+  option = &copied
   icmp := mem.NewInternalKeyComparator(option.Comparator)
   option.Comparator = icmp
+  if option.Policy != nil {
+    // tables hold internal keys, lookups match them by user key
+    option.Policy = mem.NewInternalFilterPolicy(option.Policy)
+  }
 
   db.batches = []*writer{}
   db.mutex  = new(sync.Mutex)
   db.bg_cv = sync.NewCond(db.mutex)
   db.status = 0
-  db.is_cmp = false
+  db.flushing = false
+  db.compactions = 0
   db.shut = new(atomic.Value)
   db.shut.Store(false)
   db.option = option
   db.name = name
   db.mem = mem.NewMemtable(icmp)
+  db.stats = newDBStats()
+  db.snapshots = newSnapshotList()
+  db.locks = newLockManager(util.Global.LockStripes)
+  db.prepared = make(map[string]*batchImpl)
+  db.obsolete = []int{}
   db.cache = table.NewTableCache(name, option, util.Global.TableCacheEntries)
   db.vset = version.NewVersionSet(name, option, db.cache)
+  if db.vset == nil {
+    return errors.New("recover version set failed")
+  }
   
   if _, err := os.Stat(db.name); err != nil && os.IsNotExist(err) {
     os.Mkdir(db.name, os.ModePerm)
     log4go.Info("Making directory %s for new db", db.name)
   } else if err != nil {
     log4go.Info("Stating db directory error %v", err)
-    panic(err.Error())
+    return err
   }
   
-  filenum := db.vset.NewFileNumber()
-  filename := util.LogFileName(name, filenum)
-  if wlog, err := log.NewWriter(filename); err != nil {
-    log4go.Error("init log writer failed %s", err.Error())
-    panic(err.Error())
+  db.mutex.Lock()
+  defer db.mutex.Unlock()
+  if err := db.recover(); err != nil {
+    log4go.Error("recover db from logs failed %s", err.Error())
+    return err
+  }
+  
+  for name, batch := range db.prepared {
+    db.recovered = append(db.recovered, newPreparedTxn(db, name, batch))
+  }
+  return nil
+}
+
+// Replay the logs whose updates are not in the tables yet, then switch
+// to a new log and flush the updates replayed.  The transactions left
+// prepared by the logs are kept in db.prepared and logged again.
+// REQUIRES: db.mutex is held
+func (db *dbImpl) recover() error {
+  dir, err := os.Open(db.name)
+  if err != nil {
+    return err
+  }
+  names, err := dir.Readdirnames(-1)
+  dir.Close()
+  if err != nil {
+    return err
+  }
+  
+  var lognums []int
+  for _, name := range names {
+    num, ftype := util.ParseFileName(name)
+    if ftype != util.LogFile {
+      continue
+    } else if num < db.vset.LogNumber() {
+      os.Remove(util.LogFileName(db.name, num))
+    } else {
+      lognums = append(lognums, num)
+      db.vset.MarkFileNumberUsed(num)
+    }
+  }
+  sort.Ints(lognums)
+  
+  // the tables flushed meanwhile still need all of the logs
+  db.logNumber = db.vset.LogNumber()
+  for _, num := range lognums {
+    if err := db.replayLog(num); err != nil {
+      return err
+    }
+  }
+  
+  lognum := db.vset.NewFileNumber()
+  if wlog, err := log.NewWriter(util.LogFileName(db.name, lognum), db.option.Format); err != nil {
+    return err
   } else {
     db.wlog = wlog
+    db.logNumber = lognum
+  }
+  
+  if err := db.logPrepared(); err != nil {
+    return err
   }
+  
+  if len(lognums) > 0 {
+    // the flush makes the replayed logs obsolete
+    db.imm = db.mem
+    db.mem = mem.NewMemtable(db.option.Comparator)
+    db.compactMemtable()
+    for _, num := range lognums {
+      os.Remove(util.LogFileName(db.name, num))
+    }
+    db.mayScheduleCompaction()
+  }
+  return nil
+}
+
+// Apply the records of log lognum to db.mem, flushing it whenever it
+// gets full.  A corrupted record ends the log.
+// REQUIRES: db.mutex is held
+func (db *dbImpl) replayLog(lognum int) error {
+  reader, err := log.NewReader(util.LogFileName(db.name, lognum), true, 0, db.option.Format)
+  if err != nil {
+    return err
+  }
+  defer reader.Close()
+  
+  var batch WriteBatch = NewWriteBatch()
+  for {
+    record, err := reader.Read()
+    if err == io.EOF {
+      return nil
+    } else if err != nil {
+      log4go.Warn("drop the rest of log %d: %v", lognum, err)
+      return nil
+    } else if len(record) < BatchHeader {
+      log4go.Warn("drop log %d record of %d bytes", lognum, len(record))
+      continue
+    }
+    
+    if db.option.Format != util.LevelDBFormat {
+      batch.SetContents(record)
+    } else if batch, err = decodeLevelDBBatch(record); err != nil {
+      log4go.Warn("drop the rest of log %d: %v", lognum, err)
+      return nil
+    }
+    handler := newPreparedHandler(db.mem, batch.Sequence(), db.prepared)
+    if err := batch.Iterate(handler); err != nil {
+      return err
+    }
+    
+    if handler.seq > db.vset.LastSequence() + 1 {
+      db.vset.SetLastSequence(handler.seq - 1)
+    }
+    
+    if db.mem.ApproximateMemoryUsage() >= db.option.BufferSize {
+      db.imm = db.mem
+      db.mem = mem.NewMemtable(db.option.Comparator)
+      db.compactMemtable()
+    }
+  }
+}
+
+// Write the prepared transactions to the current log, the logs they
+// were prepared in are obsolete once db.mem is flushed
+// REQUIRES: db.mutex is held, no write is in progress
+func (db *dbImpl) logPrepared() error {
+  for name, batch := range db.prepared {
+    record := NewWriteBatch().(*batchImpl)
+    record.SetSequence(db.vset.LastSequence() + 1)
+    record.markBeginPrepare()
+    record.Append(batch)
+    record.markEndPrepare([]byte(name))
+    if err := db.wlog.AddRecord(record.Contents()); err != nil {
+      return err
+    }
+  }
+  return nil
 }
 
 func (db *dbImpl) Put(option *util.WriteOption, key, value []byte) error {
@@ -184,14 +392,64 @@ func (db *dbImpl) Put(option *util.WriteOption, key, value []byte) error {
   return db.Write(option, batch)
 }
 
+func (db *dbImpl) PutWithTTL(option *util.WriteOption, key, value []byte, ttl int) error {
+  batch := NewWriteBatch()
+  batch.PutWithTTL(key, value, ttl)
+  return db.Write(option, batch)
+}
+
+func (db *dbImpl) Merge(option *util.WriteOption, key, operand []byte) error {
+  batch := NewWriteBatch()
+  batch.Merge(key, operand)
+  return db.Write(option, batch)
+}
+
 func (db *dbImpl) Delete(option *util.WriteOption, key []byte) error {
   batch := NewWriteBatch()
   batch.Delete(key)
   return db.Write(option, batch)
 }
 
+func (db *dbImpl) SingleDelete(option *util.WriteOption, key []byte) error {
+  batch := NewWriteBatch()
+  batch.SingleDelete(key)
+  return db.Write(option, batch)
+}
+
+func (db *dbImpl) DeleteRange(option *util.WriteOption, start, end []byte) error {
+  batch := NewWriteBatch()
+  batch.DeleteRange(start, end)
+  return db.Write(option, batch)
+}
+
+func (db *dbImpl) BeginOptimisticTransaction() Transaction {
+  return newOptimisticTxn(db)
+}
+
+func (db *dbImpl) BeginTransaction(option *util.TransactionOption) Transaction {
+  return newPessimisticTxn(db, option)
+}
+
+func (db *dbImpl) GetPreparedTransactions() []Transaction {
+  db.mutex.Lock()
+  defer db.mutex.Unlock()
+  
+  txns := db.recovered
+  db.recovered = nil
+  return txns
+}
+
 func (db *dbImpl) Write(option *util.WriteOption, batch WriteBatch) error {
-  w := &writer{batch, sync.NewCond(db.mutex), option, writer_UNDONE, nil}
+  return db.write(option, batch, nil)
+}
+
+// Apply batch to the db, a nil batch only makes room in the memtable.
+// Writers queue up and the one at the front writes the batches of the
+// others along with its own.  If check is not nil it is called once no
+// other write can take place before batch, and batch is dropped if it
+// returns an error.
+func (db *dbImpl) write(option *util.WriteOption, batch WriteBatch, check func() error) error {
+  w := &writer{batch, sync.NewCond(db.mutex), option, check, writer_UNDONE, nil}
   db.mutex.Lock()
   defer db.mutex.Unlock()
 
@@ -204,83 +462,367 @@ func (db *dbImpl) Write(option *util.WriteOption, batch WriteBatch) error {
     return w.err
   }
   
-  group := NewWriteBatch()
-  seq := db.vset.LastSequence()
-  handler := NewBatchHandler(db.mem, db.vset.LastSequence())
-
+  // may unlock the mutex while waiting, the later writers keep queued
   err := db.makeRoomForWrite(batch == nil)
-  var last *writer = w
+  last := w
   if err != nil {
     log4go.Error("make room for write failed %v", err)
-    goto finish
+  } else if check != nil {
+    err = check()
   }
   
-  for _, later := range db.batches {
+  if err == nil && batch != nil {
+    var group WriteBatch
+    group, last = db.buildBatchGroup()
+    group.SetSequence(db.vset.LastSequence() + 1)
+    // the markers of the group take no sequence, and the updates of a
+    // prepared transaction take theirs when it commits
+    handler := newPreparedHandler(db.mem, group.Sequence(), db.prepared)
+    
+    // the writers of the group wait for w, which is the only one
+    // touching the log, the memtable and db.prepared until it is done
+    db.mutex.Unlock()
+    record := group.Contents()
+    if db.option.Format == util.LevelDBFormat {
+      record, err = encodeLevelDBBatch(group)
+    }
+    
+    if err == nil {
+      err = db.wlog.AddRecord(record)
+    }
+    if err != nil {
+      log4go.Error("add log record failed %v", err)
+    } else if err = group.Iterate(handler); err != nil {
+      log4go.Error("add k/v pairs into mem failed %v", err)
+    }
+    db.mutex.Lock()
+    
+    if err == nil {
+      db.vset.SetLastSequence(handler.seq - 1)
+    }
+  }
+
+  for {
+    ready := db.batches[0]
+    db.batches = db.batches[1:]
+    if ready != w {
+      ready.state = writer_DONE
+      ready.err = err
+      ready.cv.Signal()
+    }
+    
+    if ready == last {
+      break
+    }
+  }
+  
+  if len(db.batches) != 0 {
+    // wake the writer at the front up to lead the next group
+    db.batches[0].cv.Signal()
+  }
+  return err
+}
+
+// Join the batches of the writers at the front of the queue into one
+// group, returns the group and the last writer in it.  Writers making
+// room or checking their batch are left for later groups.
+// REQUIRES: db.mutex is held, db.batches is not empty
+func (db *dbImpl) buildBatchGroup() (WriteBatch, *writer) {
+  first := db.batches[0]
+  group, last := first.batch, first
+  size := first.batch.ByteSize()
+  // limit the delay of a small write
+  maxSize := util.Global.MaxBatchGroupSize
+  if size <= maxSize / 8 {
+    maxSize = size + maxSize / 8
+  }
+  
+  for _, later := range db.batches[1:] {
+    if later.batch == nil || later.check != nil {
+      break
+    }
+    
+    if size += later.batch.ByteSize(); size > maxSize {
+      break
+    }
+    
+    if group == first.batch {
+      // leave the batch of the caller intact
+      group = NewWriteBatch()
+      group.Append(first.batch)
+    }
     group.Append(later.batch)
     last = later
   }
-  db.mutex.Unlock()
+  return group, last
+}
+
+func (db *dbImpl) CompactRange(begin, end []byte) error {
+  return nil
+}
+
+func (db *dbImpl) Close() error {
+  db.mutex.Lock()
+  defer db.mutex.Unlock()
   
-  err = db.wlog.AddRecord(group.Contents())
-  if err != nil {
-    log4go.Error("add log record failed %v", err)
-    goto finish
+  // no more background work is scheduled
+  db.shut.Store(true)
+  for db.flushing || db.compactions > 0 {
+    db.bg_cv.Wait()
+  }
+  
+  if err := db.wlog.Close(); err != nil {
+    return err
   }
+  return db.vset.Close()
+}
 
-  batch.SetSequence(seq)
-  err = batch.Iterate(handler)
+func (db *dbImpl) Get(option *util.ReadOption, key []byte) (error, []byte) {
   db.mutex.Lock()
-  db.vset.SetLastSequence(seq + uint64(batch.Count()))
-  if err != nil {
-    log4go.Error("add k/v pairs into mem failed %v", err)
-  }
+  seq := db.readSequence(option)
+  memtable, imm, current := db.mem, db.imm, db.vset.Current()
+  current.Ref()
+  db.mutex.Unlock()
+  defer func() {
+    db.mutex.Lock()
+    db.releaseVersion(current)
+    db.mutex.Unlock()
+  }()
 
-finish:
-  var idx int
-  var later *writer
-  for idx, later = range db.batches {
-    if later == last {
+  now := time.Now().Unix()
+  ucmp := db.userComparator()
+  lkey := util.NewLookupKey(key, seq, mem.SeekType)
+  
+  // range tombstones in the memtables cover every entry of the tables
+  dels := mem.RangeTombstones{}
+  for _, tbl := range []mem.Memtable{memtable, imm} {
+    if tbl != nil {
+      dels = append(dels, tbl.RangeTombstones()...)
+    }
+  }
+  delSeq := dels.MaxCoveringSeq(ucmp, key, seq)
+  
+  rtype, value, err := byte(0), []byte(nil), util.ErrNotFound
+  for _, tbl := range []mem.Memtable{memtable, imm} {
+    if tbl == nil {
+      continue
+    }
+    
+    if entry := tbl.Lookup(*lkey); entry != nil {
+      if entry.Seq < delSeq {
+        return util.ErrNotFound, nil
+      }
+      rtype, value, err = entry.Rtype, entry.Val, nil
       break
     }
-    later.state = writer_DONE
-    later.err = err
-    later.cv.Signal()
+  }
+
+  if err == util.ErrNotFound && delSeq == 0 {
+    rtype, value, err = current.Get(option, *lkey)
+  }
+  if err != nil {
+    return err, nil
   }
   
-  db.batches = db.batches[idx + 1:]
-  return w.err
+  if rtype == mem.MergeType {
+    // the operands have to be combined with the older entries of key
+    iter := db.newInternalIterator(option, memtable, imm, current)
+    iter.Seek(lkey.InternalKey())
+    dels = append(dels, current.RangeTombstones()...)
+    delSeq = dels.MaxCoveringSeq(ucmp, key, seq)
+    base, operands := collectMergeOperands(iter, ucmp, key, delSeq, now)
+    value, err = fullMerge(db.option.MergeOperator, key, base, operands)
+    return err, value
+  }
+  value, err = resolveEntry(rtype, value, now)
+  return err, value
 }
 
-func (db *dbImpl) CompactRange(begin, end []byte) error {
-  return nil
+func (db *dbImpl) NewIterator(option *util.ReadOption) Iterator {
+  db.mutex.Lock()
+  seq := db.readSequence(option)
+  current := db.vset.Current()
+  current.Ref()
+  iter := db.newInternalIterator(option, db.mem, db.imm, current)
+  dels := db.mem.RangeTombstones()
+  if db.imm != nil {
+    dels = append(dels, db.imm.RangeTombstones()...)
+  }
+  dels = append(dels, current.RangeTombstones()...)
+  db.mutex.Unlock()
+
+  dbiter := newDBIterator(iter, db.userComparator(), db.option.MergeOperator, dels, seq)
+  if option.PrefixSameAsStart {
+    dbiter.extractor = db.option.PrefixExtractor
+  }
+  dbiter.release = func() {
+    db.mutex.Lock()
+    db.releaseVersion(current)
+    db.mutex.Unlock()
+  }
+  // an iterator never released keeps its tables until it is collected
+  runtime.SetFinalizer(dbiter, (*dbIter).Release)
+  return dbiter
 }
 
-func (db *dbImpl) Get(option *util.ReadOption, key []byte) (error, []byte) {
-  return nil, nil
+// Return an iterator over the internal entries of the memtables and of
+// the tables of current
+func (db *dbImpl) newInternalIterator(option *util.ReadOption, memtable, imm mem.Memtable, current *version.Version) mem.Iterator {
+  iters := []mem.Iterator{memtable.NewIterator()}
+  if imm != nil {
+    iters = append(iters, imm.NewIterator())
+  }
+  iters = append(iters, current.GetIterators(option)...)
+  return table.NewMergeIterator(db.option.Comparator, iters)
 }
 
-func (db *dbImpl) NewIterator(option *util.ReadOption) mem.Iterator {
-  return nil
+func (db *dbImpl) userComparator() util.Comparator {
+  return db.option.Comparator.(*mem.InternalKeyComparator).UserComparator()
+}
+
+// Return the sequence a read with option is pinned to
+// REQUIRES: db.mutex is held
+func (db *dbImpl) readSequence(option *util.ReadOption) uint64 {
+  if option.Snapshot != nil {
+    return option.Snapshot.Sequence()
+  }
+  return db.vset.LastSequence()
+}
+
+// Return the user value held by an entry of type rtype, or
+// util.ErrNotFound if the entry hides the key at unix time now
+func resolveEntry(rtype byte, value []byte, now int64) ([]byte, error) {
+  switch rtype {
+  case mem.ValueType:
+    return value, nil
+  case mem.TTLValueType:
+    data, expiry, err := mem.DecodeTTLValue(value)
+    if err != nil {
+      return nil, err
+    }
+    
+    if mem.TTLExpired(expiry, now) {
+      return nil, util.ErrNotFound
+    }
+    return data, nil
+  }
+  return nil, util.ErrNotFound
+}
+
+// Gather the merge operands of the user key key from the entry iter is
+// at on, up to the first entry which is not an operand.  Entries below
+// delSeq are deleted by a range tombstone.  Returns the value the
+// operands apply to, nil if there is none, and the operands from the
+// oldest to the newest.  iter is left after the entries read.
+func collectMergeOperands(iter mem.Iterator, ucmp util.Comparator, key []byte, delSeq uint64, now int64) ([]byte, [][]byte) {
+  var base []byte
+  operands := [][]byte{}
+  ikey := new(util.ParsedInternalKey)
+  for iter.Valid() {
+    if err := ikey.Decode(iter.Key().([]byte)); err != nil || ucmp.Compare(ikey.Key, key) != 0 {
+      break
+    }
+    
+    if ikey.Seq < delSeq {
+      // nothing older is left to merge into
+      break
+    }
+    
+    value := iter.Value().([]byte)
+    iter.Next()
+    if ikey.Rtype != mem.MergeType {
+      // deleted or expired values leave nothing to merge into
+      base, _ = resolveEntry(ikey.Rtype, value, now)
+      break
+    }
+    operands = append(operands, value)
+  }
+  
+  for i, j := 0, len(operands) - 1; i < j; i, j = i + 1, j - 1 {
+    operands[i], operands[j] = operands[j], operands[i]
+  }
+  return base, operands
+}
+
+// Apply operands to existing with op
+func fullMerge(op util.MergeOperator, key, existing []byte, operands [][]byte) ([]byte, error) {
+  if op == nil {
+    return nil, errors.New("merge operator not set")
+  }
+  return op.FullMerge(key, existing, operands)
 }
 
 func (db *dbImpl) GetSnapshot() Snapshot {
-  return nil
+  db.mutex.Lock()
+  defer db.mutex.Unlock()
+  return db.snapshots.New(db.vset.LastSequence())
+}
+
+func (db *dbImpl) ReleaseSnapshot(snapshot Snapshot) {
+  db.mutex.Lock()
+  defer db.mutex.Unlock()
+  db.snapshots.Release(snapshot.(*snapshotImpl))
 }
 
 func (db *dbImpl) GetProperty(property []byte) (error, []byte) {
-  return nil, nil
+  db.mutex.Lock()
+  defer db.mutex.Unlock()
+
+  switch string(property) {
+  case "leveldb.stats":
+    return nil, []byte(db.stats.dump())
+  }
+  return errors.New("unknown property " + string(property)), nil
 }
 
 func (db *dbImpl) GetApproximateSizes(trange []Range) []uint64 {
   return nil
 }
 
+func (db *dbImpl) GetPropertiesOfAllTables() (map[string]*table.TableProperties, error) {
+  // the files of the current version are not removed meanwhile
+  db.mutex.Lock()
+  defer db.mutex.Unlock()
+  
+  current := db.vset.Current()
+  rslt := make(map[string]*table.TableProperties)
+  for level := 0; level < util.Global.MaxLevel; level++ {
+    for _, meta := range current.Files(level) {
+      tbl := db.cache.FindTable(meta.Number, meta.FileSize)
+      if tbl == nil {
+        return nil, errors.New("open table " + util.TableFileName(db.name, meta.Number) + " failed")
+      }
+      rslt[util.TableFileName(db.name, meta.Number)] = tbl.Properties()
+    }
+  }
+  return rslt, nil
+}
+
 // Make room for key/value pairs if there's too many data in the mem
 func (db *dbImpl) makeRoomForWrite(force bool) error {
+  allowDelay := !force
+  // fifo compaction keeps all files in level0 by design
+  limitL0 := db.option.CompactionStyle != util.FIFOCompaction
   for true {
     if db.status == 1 {
       return errors.New("db is in wrong status")
     }
+
+    // We are getting close to hitting a hard limit on the number of
+    // level0 files.  Rather than delaying a single write by several
+    // seconds when we hit the hard limit, start delaying each
+    // individual write by a little to reduce latency variance.  Also,
+    // this delay hands over some CPU to the compaction goroutine.
+    if allowDelay && limitL0 && db.vset.NumLevelFiles(0) >= util.Global.L0SlowdownWritesTrigger {
+      start := time.Now()
+      db.mutex.Unlock()
+      time.Sleep(time.Duration(util.Global.L0SlowdownWritesDelay) * time.Microsecond)
+      db.mutex.Lock()
+      db.stats.recordStall(stallSlowdown, time.Since(start))
+      allowDelay = false
+      continue
+    }
+
     // there's still room in the mem
     if !force && db.mem.ApproximateMemoryUsage() < db.option.BufferSize {
       return nil
@@ -288,20 +830,24 @@ func (db *dbImpl) makeRoomForWrite(force bool) error {
     
     // there's no room in mem and imm is still under compaction
     if db.imm != nil {
+      start := time.Now()
       db.bg_cv.Wait()
+      db.stats.recordStall(stallMemtable, time.Since(start))
       continue
     }
     
     // there's too many level0 files
-    if db.vset.NumLevelFiles(0) > util.Global.L0StopWritesTrigger {
+    if limitL0 && db.vset.NumLevelFiles(0) > util.Global.L0StopWritesTrigger {
+      start := time.Now()
       db.bg_cv.Wait()
+      db.stats.recordStall(stallL0Stop, time.Since(start))
       continue
     }
     
     // Attempt to switch to a new memtable and trigger compaction of old memtable
     lognum := db.vset.NewFileNumber()
     logname := util.LogFileName(db.name, lognum)
-    if logger, err := log.NewWriter(logname); err != nil {
+    if logger, err := log.NewWriter(logname, db.option.Format); err != nil {
       db.vset.ReuseFileNumber(lognum)
       return err
     } else {
@@ -309,17 +855,22 @@ func (db *dbImpl) makeRoomForWrite(force bool) error {
       db.mem = mem.NewMemtable(db.option.Comparator)
       db.wlog.Close()
       db.wlog = logger
-      db.vset.SetLogNumber(lognum)
+      db.logNumber = lognum
       db.mayScheduleCompaction()
     }
-    return nil
+    return db.logPrepared()
   }
   return nil
 }
 
+// Start background work for anything that needs it.  Memtable flushes
+// get a worker of their own so they never queue behind a long table
+// compaction, and up to MaxBackgroundCompactions table compactions
+// over disjoint inputs run next to it.
+// REQUIRES: db.mutex is held
 func (db *dbImpl) mayScheduleCompaction() {
-  // under compaction already or db is about to shut down
-  if db.is_cmp || db.shut.Load().(bool) {
+  // db is about to shut down
+  if db.shut.Load().(bool) {
     return
   }
   
@@ -328,150 +879,368 @@ func (db *dbImpl) mayScheduleCompaction() {
     return
   }
   
-  // db need no more compaction
-  if db.imm == nil && !db.vset.NeedsCompaction() {
-    return
+  // level0 files are ordered by number, so a flush must neither run
+  // nor start while a compaction writes into level0
+  if db.imm != nil && !db.flushing && !db.vset.HasPendingOutput(0) {
+    db.flushing = true
+    go db.doFlush()
+  }
+  
+  for db.compactions < util.Global.MaxBackgroundCompactions {
+    comp := db.vset.PickCompaction()
+    if comp == nil {
+      break
+    }
+    
+    if comp.OutputLevel == 0 && db.flushing {
+      db.vset.ReleaseCompaction(comp)
+      break
+    }
+    db.compactions++
+    go db.doCompaction(comp)
   }
-  go db.doCompaction()
 }
 
-func (db *dbImpl) doCompaction() {
+func (db *dbImpl) doFlush() {
   db.mutex.Lock()
-  defer func() {
-    db.is_cmp = false
-    db.mutex.Unlock()
-    db.bg_cv.Broadcast()
-    db.mayScheduleCompaction()
-  }()
+  defer db.mutex.Unlock()
 
-  if db.imm != nil {
-    db.is_cmp = true
-    db.compactMemtable()
-    return
-  }
-  
-  if db.vset.NeedsCompaction() {
-    db.is_cmp = true
-    db.compactTableFiles()
-    return
+  db.compactMemtable()
+  db.flushing = false
+  db.bg_cv.Broadcast()
+  db.mayScheduleCompaction()
+}
+
+func (db *dbImpl) doCompaction(comp *compact.Compact) {
+  db.mutex.Lock()
+  defer db.mutex.Unlock()
+
+  if err := db.compactTableFiles(comp); err != nil {
+    log4go.Error("compact table files failed %v", err)
   }
+  db.vset.ReleaseCompaction(comp)
+  db.compactions--
+  db.bg_cv.Broadcast()
+  db.mayScheduleCompaction()
 }
 
 func (db *dbImpl) compactMemtable() {
   memtable := db.imm
+  tombstones := memtable.RangeTombstones()
+  ucmp := db.userComparator()
 
+  var smallest, largest []byte
   iter := memtable.NewIterator()
-  if iter.SeekToFirst(); !iter.Valid() {
-    return
+  if iter.SeekToFirst(); iter.Valid() {
+    smallest = util.ExtractUserKey(iter.Key().([]byte))
+    iter.SeekToLast()
+    largest = util.ExtractUserKey(iter.Key().([]byte))
   }
-  smallest := util.ExtractUserKey(iter.Key().([]byte))
   
-  if iter.SeekToLast(); !iter.Valid() {
+  for _, t := range tombstones {
+    if smallest == nil || ucmp.Compare(t.Start, smallest) < 0 {
+      smallest = t.Start
+    }
+    
+    if largest == nil || ucmp.Compare(t.End, largest) > 0 {
+      largest = t.End
+    }
+  }
+  
+  // the logs before db.logNumber hold nothing but the updates of imm
+  edit := version.NewVersionEdit()
+  edit.SetLogNumber(db.logNumber)
+  if smallest == nil {
+    db.vset.LogAndApply(edit)
+    db.vset.SetLogNumber(db.logNumber)
+    db.imm = nil
     return
   }
-  largest := util.ExtractUserKey(iter.Key().([]byte))
 
-  level := db.vset.Current().PickLevelForMemTableOutput(smallest, largest)
+  level := db.vset.PickLevelForMemTableOutput(smallest, largest)
   filenum := db.vset.NewFileNumber()
   
-  edit := version.NewVersionEdit()
-  edit.SetLogNumber(db.vset.LogNumber())
-  
   db.mutex.Unlock()
-  meta := db.writeLevel0File(level, filenum, memtable)
+  meta := db.writeLevel0File(level, filenum, memtable, tombstones)
   db.mutex.Lock()
   
   edit.AddFile(level, meta.Number, meta.FileSize, &meta.Smallest, &meta.Largest)
+  edit.SetCreationTime(meta.Number, meta.CreationTime)
+  if meta.HasRangeDels {
+    edit.SetRangeDels(meta.Number)
+  }
   db.vset.LogAndApply(edit)
+  db.vset.SetLogNumber(db.logNumber)
   db.imm = nil
 }
 
-func (db *dbImpl) writeLevel0File(level, filenum int, imm mem.Memtable) *table.FileMetaData {
+func (db *dbImpl) writeLevel0File(level, filenum int, imm mem.Memtable, tombstones mem.RangeTombstones) *table.FileMetaData {
   filename := util.TableFileName(db.name, filenum)
   builder  := table.NewTableBuilder(filename, db.option)
   iter := imm.NewIterator()
   
-  iter.SeekToFirst() 
   var large, small []byte
-  small = iter.Key().([]byte)
-  for iter.Valid() {
+  for iter.SeekToFirst(); iter.Valid(); iter.Next() {
+    if small == nil {
+      small = iter.Key().([]byte)
+    }
     builder.Add(iter.Key().([]byte), iter.Value().([]byte))
     large = iter.Key().([]byte)
-    iter.Next()
   }
-  builder.Finish()
   
-  ismall := new(util.InternalKey)
-  ismall.Decode(small)
-  
-  ilarge := new(util.InternalKey)
-  ilarge.Decode(large)
-  
-  meta := new(table.FileMetaData)
-  meta.FileSize = builder.FileSize()
-  meta.Number = filenum
-  meta.Largest = *ilarge
-  meta.Smallest = *ismall
+  meta, err := newOutputMeta(filenum, builder, db.option.Comparator, small, large, tombstones)
+  if err != nil {
+    log4go.Error("finish level0 table %d failed %v", filenum, err)
+  }
   meta.AllowSeek = 1
   return meta 
 }
 
-func (db *dbImpl) compactTableFiles() error {
-  comp := db.vset.PickCompaction()
-  if comp == nil {
-    return errors.New("pick new compaction failed")
+// Merge the inputs of comp into new tables at the next level.  With
+// subcompactions enabled the key range of comp is split into shards
+// which are merged in parallel, and all of their outputs are installed
+// through one version edit.
+// REQUIRES: db.mutex is held, comp is registered within db.vset
+func (db *dbImpl) compactTableFiles(comp *compact.Compact) error {
+  if comp.OutputLevel < 0 {
+    return db.dropTableFiles(comp)
   }
+  
+  bounds := db.vset.SubcompactionBoundaries(comp, util.Global.MaxSubcompactions)
+  state := db.newCompactionState(comp)
   db.mutex.Unlock()
 
+  shards := len(bounds) + 1
+  outputs := make([][]*table.FileMetaData, shards)
+  errs := make([]error, shards)
+  states := make([]*compactionState, shards)
+  var wait sync.WaitGroup
+  for i := 0; i < shards; i++ {
+    var start, end []byte
+    if i > 0 {
+      start = bounds[i - 1]
+    }
+    if i < len(bounds) {
+      end = bounds[i]
+    }
+    
+    wait.Add(1)
+    states[i] = state.fork()
+    go func(idx int, start, end []byte) {
+      defer wait.Done()
+      outputs[idx], errs[idx] = db.runSubcompaction(states[idx], start, end)
+    }(i, start, end)
+  }
+  wait.Wait()
+  db.mutex.Lock()
+  db.releaseVersion(state.current)
+  
+  for _, shard := range states {
+    for misuse, cnt := range shard.misuses {
+      db.stats.recordSingleDeleteMisuse(misuse, cnt)
+    }
+  }
+  
+  for _, err := range errs {
+    if err != nil {
+      return err
+    }
+  }
+  
+  edit := version.NewVersionEdit()
+  for _, files := range outputs {
+    for _, meta := range files {
+      edit.AddFile(comp.OutputLevel, meta.Number, meta.FileSize, &meta.Smallest, &meta.Largest)
+      edit.SetCreationTime(meta.Number, meta.CreationTime)
+      if meta.HasRangeDels {
+        edit.SetRangeDels(meta.Number)
+      }
+    }
+  }
+
+  for i := 0; i < len(comp.Files); i++ {
+    for _, meta := range comp.Files[i] {
+      edit.DeleteFile(comp.Level + i, meta.Number)
+    } 
+  }
+  return db.installCompaction(comp, edit)
+}
+
+// Remove the inputs of comp from the db without merging them
+// REQUIRES: db.mutex is held
+func (db *dbImpl) dropTableFiles(comp *compact.Compact) error {
+  edit := version.NewVersionEdit()
+  for i := 0; i < len(comp.Files); i++ {
+    for _, meta := range comp.Files[i] {
+      edit.DeleteFile(comp.Level + i, meta.Number)
+    }
+  }
+  return db.installCompaction(comp, edit)
+}
+
+// Apply edit, which deletes the inputs of comp from the db, the inputs
+// become obsolete and are removed from disk once no version lists them
+// REQUIRES: db.mutex is held
+func (db *dbImpl) installCompaction(comp *compact.Compact, edit *version.VersionEdit) error {
+  if err := db.vset.LogAndApply(edit); err != nil {
+    return err
+  }
+  
+  for _, files := range comp.Files {
+    for _, meta := range files {
+      db.obsolete = append(db.obsolete, meta.Number)
+    }
+  }
+  db.deleteObsoleteFiles()
+  return nil
+}
+
+// Release a reference of v, the obsolete tables listed by v alone are
+// removed
+// REQUIRES: db.mutex is held
+func (db *dbImpl) releaseVersion(v *version.Version) {
+  v.Unref()
+  db.deleteObsoleteFiles()
+}
+
+// Remove the obsolete tables which no live version lists any more, the
+// others are kept until the readers of their versions are done
+// REQUIRES: db.mutex is held
+func (db *dbImpl) deleteObsoleteFiles() {
+  if len(db.obsolete) == 0 {
+    return
+  }
+  
+  live := make(map[int]bool)
+  for _, num := range db.vset.GetLiveFiles() {
+    live[num] = true
+  }
+  
+  kept := []int{}
+  for _, num := range db.obsolete {
+    if live[num] {
+      kept = append(kept, num)
+      continue
+    }
+    
+    db.cache.Evict(num)
+    err := os.Remove(util.TableFileName(db.name, num))
+    if os.IsNotExist(err) && db.option.Format == util.LevelDBFormat {
+      err = os.Remove(util.SSTTableFileName(db.name, num))
+    }
+    if err != nil {
+      log4go.Error("remove obsolete table %d failed %v", num, err)
+    }
+  }
+  db.obsolete = kept
+}
+
+// Merge the inputs of state.comp with user keys within [start, end) into
+// new tables, a nil start or end leaves that side of the range open.
+// Entries which are obsolete, deleted by a range tombstone or removed
+// by the compaction filter are dropped on the way, and merge operands
+// are combined.
+// REQUIRES: db.mutex is not held
+func (db *dbImpl) runSubcompaction(state *compactionState, start, end []byte) ([]*table.FileMetaData, error) {
+  comp := state.comp
+  ucmp := state.ucmp
   iter := db.vset.MakeInputIterator(comp)
-  iter.SeekToFirst()
+  if start == nil {
+    iter.SeekToFirst()
+  } else {
+    iter.Seek(util.NewInternalKey(start, util.Global.MaxSeq, mem.SeekType).Encode())
+  }
+  
+  outputs := []*table.FileMetaData{}
   var builder table.TableBuilder = nil
   var tableNum int = 0
   var smallest, largest []byte
-  edit := version.NewVersionEdit()
+  
+  // range tombstones are split between the outputs at the first key
+  // of each output, lower is where the ones of the current output begin
+  tombstones := state.outputTombstones(start, end)
+  lower, split := start, false
   
   for iter.Valid() {
-    if db.imm != nil {
-      db.mutex.Lock()
-      db.compactMemtable()
-      db.bg_cv.Broadcast()
-      db.mutex.Unlock()
+    if end != nil && ucmp.Compare(util.ExtractUserKey(iter.Key().([]byte)), end) >= 0 {
+      break
     }
     
-    if builder == nil {
-      builder, tableNum = db.openCompactionOutputFile()
-      smallest = iter.Key().([]byte)
-    }
-    largest = iter.Key().([]byte)
-    builder.Add(iter.Key().([]byte), iter.Value().([]byte))
-    if builder.FileSize() > version.MaxFileSizeForLevel(comp.Level + 1) {
-      builder.Finish()
+    keys, values := state.next(iter)
+    for idx, key := range keys {
+      // never split the entries of a user key between two outputs
+      ukey := util.ExtractUserKey(key)
+      if split && ucmp.Compare(ukey, util.ExtractUserKey(largest)) != 0 {
+        meta, err := newOutputMeta(tableNum, builder, db.option.Comparator, smallest, largest,
+            tombstones.Clip(ucmp, lower, ukey))
+        if err != nil {
+          return outputs, err
+        }
+        outputs = append(outputs, meta)
+        builder, lower, split = nil, ukey, false
+      }
       
-      edit.AddFile(comp.Level + 1, tableNum, builder.FileSize(),
-        util.DecodeInternalKey(smallest), util.DecodeInternalKey(largest))
-      builder = nil
+      if builder == nil {
+        builder, tableNum = db.openCompactionOutputFile()
+        if builder == nil {
+          return outputs, errors.New("open compaction output file failed")
+        }
+        smallest = key
+      }
+      largest = key
+      builder.Add(key, values[idx])
+      split = builder.FileSize() > version.MaxFileSizeForLevel(comp.OutputLevel)
     }
-    iter.Next()
+  }
+  
+  rest := tombstones.Clip(ucmp, lower, end)
+  if builder == nil && len(rest) != 0 {
+    builder, tableNum = db.openCompactionOutputFile()
+    if builder == nil {
+      return outputs, errors.New("open compaction output file failed")
+    }
+    smallest, largest = nil, nil
   }
   
   if builder != nil {
-    builder.Finish()
-    edit.AddFile(comp.Level + 1, tableNum, builder.FileSize(),
-      util.DecodeInternalKey(smallest), util.DecodeInternalKey(largest))
+    meta, err := newOutputMeta(tableNum, builder, db.option.Comparator, smallest, largest, rest)
+    if err != nil {
+      return outputs, err
+    }
+    outputs = append(outputs, meta)
   }
+  return outputs, nil
+}
 
-  for i := 0; i < len(comp.Files); i++ {
-    for _, meta := range comp.Files[i] {
-      edit.DeleteFile(comp.Level + i, meta.Number)
-    } 
+// Finish the table of builder holding the entries [smallest, largest]
+// and the range tombstones tombstones, the range of the table is
+// extended to cover the tombstones.  Returns the meta of the table.
+func newOutputMeta(num int, builder table.TableBuilder, icmp util.Comparator, smallest, largest []byte,
+    tombstones mem.RangeTombstones) (*table.FileMetaData, error) {
+  for _, t := range tombstones {
+    builder.AddRangeTombstone(t.Key(), t.End)
+    if low := t.Key(); smallest == nil || icmp.Compare(low, smallest) < 0 {
+      smallest = low
+    }
+    
+    // sorts before every entry of t.End, which t does not cover
+    high := util.NewInternalKey(t.End, util.Global.MaxSeq, mem.RangeDeleteType).Encode()
+    if largest == nil || icmp.Compare(high, largest) > 0 {
+      largest = high
+    }
   }
+  err := builder.Finish()
   
-  db.mutex.Lock()
-  db.vset.LogAndApply(edit)
-  return nil
+  meta := new(table.FileMetaData)
+  meta.Number = num
+  meta.FileSize = builder.FileSize()
+  meta.Smallest = *util.DecodeInternalKey(smallest)
+  meta.Largest = *util.DecodeInternalKey(largest)
+  meta.CreationTime = time.Now().Unix()
+  meta.HasRangeDels = len(tombstones) != 0
+  return meta, err
 }
 
-
 func (db *dbImpl) openCompactionOutputFile() (table.TableBuilder, int) {
   db.mutex.Lock()
   num  := db.vset.NewFileNumber()
@@ -1,16 +1,33 @@
 package db
 
 import (
+  "io"
+  "os"
   "fmt"
+  "time"
+  "bytes"
+  "strings"
   "testing"
+  "sync"
 )
 
 import (
   "github.com/jellybean4/goleveldb/util"
+  "github.com/jellybean4/goleveldb/log"
+  "github.com/jellybean4/goleveldb/version"
 )
 
+// Open the db name, failing t if it can not be opened
+func openDB(t *testing.T, option *util.Option, name string) *dbImpl {
+  db, err := Open(option, name)
+  if err != nil {
+    t.Fatalf("open db %s error %v", name, err)
+  }
+  return db
+}
+
 func TestSimpleDB(t *testing.T) {
-  db := Open(&util.DefaultOption, "/tmp/test")
+  db := openDB(t, &util.DefaultOption, "/tmp/test")
   cnt := 9000000
   for i := 0; i < cnt; i++ {
     key := fmt.Sprintf("key%d", i)
@@ -20,8 +37,1050 @@ func TestSimpleDB(t *testing.T) {
     }
   }
   
-  for db.is_cmp {
+  db.mutex.Lock()
+  for db.flushing || db.compactions > 0 {
+    db.bg_cv.Wait()
+  }
+  db.mutex.Unlock()
+}
+
+func TestGetAndIterate(t *testing.T) {
+  os.RemoveAll("/tmp/test_read")
+  option := util.DefaultOption
+  db := openDB(t, &option, "/tmp/test_read")
+  db.Put(&util.DefaultWriteOption, []byte("a"), []byte("va"))
+  db.Put(&util.DefaultWriteOption, []byte("b"), []byte("vb"))
+  db.Put(&util.DefaultWriteOption, []byte("c"), []byte("vc"))
+  db.Delete(&util.DefaultWriteOption, []byte("b"))
+
+  snapshot := db.GetSnapshot()
+  defer db.ReleaseSnapshot(snapshot)
+  db.Put(&util.DefaultWriteOption, []byte("a"), []byte("new"))
+  db.Put(&util.DefaultWriteOption, []byte("d"), []byte("vd"))
+
+  expects := map[string]string{"a" : "new", "b" : "", "c" : "vc", "d" : "vd"}
+  for key, expect := range expects {
+    err, val := db.Get(&util.DefaultReadOption, []byte(key))
+    if expect == "" && err != util.ErrNotFound {
+      t.Errorf("get deleted key %s returns %s %v", key, val, err)
+    } else if expect != "" && (err != nil || string(val) != expect) {
+      t.Errorf("get key %s returns %s %v", key, val, err)
+    }
+  }
+
+  read := util.DefaultReadOption
+  read.Snapshot = snapshot
+  if err, val := db.Get(&read, []byte("a")); err != nil || string(val) != "va" {
+    t.Errorf("get key a at snapshot returns %s %v", val, err)
+  }
+  if err, val := db.Get(&read, []byte("d")); err != util.ErrNotFound {
+    t.Errorf("get key d at snapshot returns %s %v", val, err)
+  }
+
+  scan := func(option *util.ReadOption) (string, string) {
+    forward, reverse := "", ""
+    iter := db.NewIterator(option)
+    defer iter.Release()
+    for iter.SeekToFirst(); iter.Valid(); iter.Next() {
+      forward += string(iter.Key().([]byte)) + "=" + string(iter.Value().([]byte)) + ","
+    }
+    for iter.SeekToLast(); iter.Valid(); iter.Prev() {
+      reverse += string(iter.Key().([]byte)) + ","
+    }
+    return forward, reverse
+  }
+
+  if forward, reverse := scan(&util.DefaultReadOption); forward != "a=new,c=vc,d=vd," || reverse != "d,c,a," {
+    t.Errorf("iterate keys not match %s %s", forward, reverse)
+  }
+  if forward, reverse := scan(&read); forward != "a=va,c=vc," || reverse != "c,a," {
+    t.Errorf("iterate keys at snapshot not match %s %s", forward, reverse)
+  }
+}
+
+func TestTTL(t *testing.T) {
+  os.RemoveAll("/tmp/test_ttl")
+  config := util.Global
+  util.Global.MaxBackgroundCompactions = 0
+  util.Global.MaxMemCompactLevel = 0
+  util.Global.L0CompactionTrigger = 1
+  defer func() { util.Global = config }()
+  option := util.DefaultOption
+  db := openDB(t, &option, "/tmp/test_ttl")
+  db.Put(&util.DefaultWriteOption, []byte("key1"), []byte("val1"))
+  db.PutWithTTL(&util.DefaultWriteOption, []byte("key2"), []byte("val2"), 1)
+  db.PutWithTTL(&util.DefaultWriteOption, []byte("key3"), []byte("val3"), 3600)
+  db.Put(&util.DefaultWriteOption, []byte("key4"), []byte("old4"))
+  db.PutWithTTL(&util.DefaultWriteOption, []byte("key4"), []byte("val4"), 1)
+
+  for i := 1; i <= 4; i++ {
+    key := fmt.Sprintf("key%d", i)
+    if err, val := db.Get(&util.DefaultReadOption, []byte(key)); err != nil {
+      t.Errorf("get live key %s error %v", key, err)
+    } else if string(val) != fmt.Sprintf("val%d", i) {
+      t.Errorf("get live key %s not match %s", key, val)
+    }
+  }
+
+  time.Sleep(2 * time.Second)
+  for _, key := range []string{"key2", "key4"} {
+    if err, val := db.Get(&util.DefaultReadOption, []byte(key)); err != util.ErrNotFound {
+      t.Errorf("get expired key %s returns %s %v", key, val, err)
+    }
+  }
+
+  keys := ""
+  iter := db.NewIterator(&util.DefaultReadOption)
+  defer iter.Release()
+  for iter.SeekToFirst(); iter.Valid(); iter.Next() {
+    keys += string(iter.Key().([]byte)) + "=" + string(iter.Value().([]byte)) + ","
+  }
+  if keys != "key1=val1,key3=val3," {
+    t.Errorf("iterate keys not match %s", keys)
+  }
+
+  keys = ""
+  for iter.SeekToLast(); iter.Valid(); iter.Prev() {
+    keys += string(iter.Key().([]byte)) + ","
+  }
+  if keys != "key3,key1," {
+    t.Errorf("reverse iterate keys not match %s", keys)
+  }
+
+  // the compaction drops the expired values along with the ones they hide
+  forceFlush(t, db)
+  forceCompaction(t, db)
+  keys = ""
+  db.mutex.Lock()
+  for level := 0; level < util.Global.MaxLevel; level++ {
+    for _, meta := range db.vset.Current().Files(level) {
+      _, titer := db.cache.NewIterator(meta.Number, meta.FileSize)
+      for titer.SeekToFirst(); titer.Valid(); titer.Next() {
+        keys += string(util.ExtractUserKey(titer.Key().([]byte))) + ","
+      }
+    }
+  }
+  db.mutex.Unlock()
+  if keys != "key1,key3," {
+    t.Errorf("compacted table keys not match %s", keys)
+  }
+}
+
+// appendOperator joins the operands of a key with commas
+type appendOperator struct {
+}
+
+func (o *appendOperator) FullMerge(key, existing []byte, operands [][]byte) ([]byte, error) {
+  if existing != nil {
+    operands = append([][]byte{existing}, operands...)
+  }
+  return bytes.Join(operands, []byte(",")), nil
+}
+
+func (o *appendOperator) PartialMerge(key []byte, operands [][]byte) ([]byte, bool) {
+  return bytes.Join(operands, []byte(",")), true
+}
+
+func (o *appendOperator) Name() string {
+  return "AppendOperator"
+}
+
+// renamedOperator merges like appendOperator under another name
+type renamedOperator struct {
+  appendOperator
+}
+
+func (o *renamedOperator) Name() string {
+  return "RenamedOperator"
+}
+
+func TestMerge(t *testing.T) {
+  os.RemoveAll("/tmp/test_merge")
+  option := util.DefaultOption
+  option.MergeOperator = new(appendOperator)
+  db := openDB(t, &option, "/tmp/test_merge")
+  db.Put(&util.DefaultWriteOption, []byte("key1"), []byte("a"))
+  db.Merge(&util.DefaultWriteOption, []byte("key1"), []byte("b"))
+  db.Merge(&util.DefaultWriteOption, []byte("key1"), []byte("c"))
+  db.Merge(&util.DefaultWriteOption, []byte("key2"), []byte("a"))
+  db.Put(&util.DefaultWriteOption, []byte("key3"), []byte("a"))
+  db.Delete(&util.DefaultWriteOption, []byte("key3"))
+  db.Merge(&util.DefaultWriteOption, []byte("key3"), []byte("b"))
+  snapshot := db.GetSnapshot()
+  db.Merge(&util.DefaultWriteOption, []byte("key3"), []byte("c"))
+
+  expects := map[string]string{"key1" : "a,b,c", "key2" : "a", "key3" : "b,c"}
+  for key, expect := range expects {
+    if err, val := db.Get(&util.DefaultReadOption, []byte(key)); err != nil {
+      t.Errorf("get merged key %s error %v", key, err)
+    } else if string(val) != expect {
+      t.Errorf("get merged key %s not match %s", key, val)
+    }
+  }
+
+  option2 := util.DefaultReadOption
+  option2.Snapshot = snapshot
+  if err, val := db.Get(&option2, []byte("key3")); err != nil || string(val) != "b" {
+    t.Errorf("get merged key from snapshot returns %s %v", val, err)
+  }
+  db.ReleaseSnapshot(snapshot)
+
+  keys := ""
+  iter := db.NewIterator(&util.DefaultReadOption)
+  defer iter.Release()
+  for iter.SeekToFirst(); iter.Valid(); iter.Next() {
+    keys += string(iter.Key().([]byte)) + "=" + string(iter.Value().([]byte)) + ";"
+  }
+  if keys != "key1=a,b,c;key2=a;key3=b,c;" {
+    t.Errorf("iterate keys not match %s", keys)
+  }
+
+  keys = ""
+  for iter.SeekToLast(); iter.Valid(); iter.Prev() {
+    keys += string(iter.Key().([]byte)) + "=" + string(iter.Value().([]byte)) + ";"
+  }
+  if keys != "key3=b,c;key2=a;key1=a,b,c;" {
+    t.Errorf("reverse iterate keys not match %s", keys)
+  }
+}
+
+func TestDeleteRange(t *testing.T) {
+  os.RemoveAll("/tmp/test_rangedel")
+  option := util.DefaultOption
+  option.BufferSize = 64 * 1024
+  db := openDB(t, &option, "/tmp/test_rangedel")
+  
+  cnt := 20000
+  for i := 0; i < cnt; i++ {
+    key := fmt.Sprintf("key%06d", i)
+    db.Put(&util.DefaultWriteOption, []byte(key), []byte(key))
+  }
+  snapshot := db.GetSnapshot()
+  db.DeleteRange(&util.DefaultWriteOption, []byte("key001000"), []byte("key015000"))
+  db.Put(&util.DefaultWriteOption, []byte("key002000"), []byte("new"))
+  
+  // push the tombstone into the tables
+  for i := 0; i < cnt; i++ {
+    key := fmt.Sprintf("other%06d", i)
+    db.Put(&util.DefaultWriteOption, []byte(key), []byte(key))
+  }
+  db.mutex.Lock()
+  for db.imm != nil || db.flushing || db.compactions > 0 {
+    db.bg_cv.Wait()
+  }
+  db.mutex.Unlock()
+  
+  for i := 0; i < cnt; i += 100 {
+    key := fmt.Sprintf("key%06d", i)
+    err, val := db.Get(&util.DefaultReadOption, []byte(key))
+    if i == 2000 {
+      if err != nil || string(val) != "new" {
+        t.Errorf("get key put after delete range %s returns %s %v", key, val, err)
+      }
+    } else if i >= 1000 && i < 15000 {
+      if err != util.ErrNotFound {
+        t.Errorf("get deleted key %s returns %s %v", key, val, err)
+      }
+    } else if err != nil || string(val) != key {
+      t.Errorf("get key %s returns %s %v", key, val, err)
+    }
+  }
+  
+  option2 := util.DefaultReadOption
+  option2.Snapshot = snapshot
+  if err, val := db.Get(&option2, []byte("key005000")); err != nil || string(val) != "key005000" {
+    t.Errorf("get deleted key from snapshot returns %s %v", val, err)
+  }
+  db.ReleaseSnapshot(snapshot)
+  
+  num := 0
+  iter := db.NewIterator(&util.DefaultReadOption)
+  defer iter.Release()
+  for iter.Seek([]byte("key")); iter.Valid(); iter.Next() {
+    if key := string(iter.Key().([]byte)); key >= "key001000" && key < "key015000" && key != "key002000" {
+      t.Errorf("iterate deleted key %s", key)
+    } else if key >= "other" {
+      break
+    }
+    num++
+  }
+  if num != cnt - 14000 + 1 {
+    t.Errorf("iterate keys cnt not match %d", num)
+  }
+}
+
+func TestSingleDelete(t *testing.T) {
+  os.RemoveAll("/tmp/test_singledel")
+  option := util.DefaultOption
+  option.BufferSize = 64 * 1024
+  db := openDB(t, &option, "/tmp/test_singledel")
+  
+  cnt := 20000
+  for i := 0; i < cnt; i++ {
+    key := fmt.Sprintf("key%06d", i)
+    db.Put(&util.DefaultWriteOption, []byte(key), []byte(key))
+  }
+  for i := 0; i < cnt; i += 2 {
+    key := fmt.Sprintf("key%06d", i)
+    db.SingleDelete(&util.DefaultWriteOption, []byte(key))
+  }
+  
+  // push the deletions into the tables
+  for i := 0; i < cnt; i++ {
+    key := fmt.Sprintf("other%06d", i)
+    db.Put(&util.DefaultWriteOption, []byte(key), []byte(key))
+  }
+  db.mutex.Lock()
+  for db.imm != nil || db.flushing || db.compactions > 0 {
+    db.bg_cv.Wait()
+  }
+  db.mutex.Unlock()
+  
+  for i := 0; i < cnt; i += 99 {
+    key := fmt.Sprintf("key%06d", i)
+    err, val := db.Get(&util.DefaultReadOption, []byte(key))
+    if i % 2 == 0 {
+      if err != util.ErrNotFound {
+        t.Errorf("get deleted key %s returns %s %v", key, val, err)
+      }
+    } else if err != nil || string(val) != key {
+      t.Errorf("get key %s returns %s %v", key, val, err)
+    }
+  }
+  
+  num := 0
+  iter := db.NewIterator(&util.DefaultReadOption)
+  defer iter.Release()
+  for iter.Seek([]byte("key")); iter.Valid(); iter.Next() {
+    if key := string(iter.Key().([]byte)); key >= "other" {
+      break
+    }
+    num++
+  }
+  if num != cnt / 2 {
+    t.Errorf("iterate keys cnt not match %d", num)
+  }
+}
+
+func TestSingleDeleteMisuse(t *testing.T) {
+  os.RemoveAll("/tmp/test_singledel_misuse")
+  config := util.Global
+  util.Global.MaxBackgroundCompactions = 0
+  util.Global.MaxMemCompactLevel = 0
+  util.Global.L0CompactionTrigger = 1
+  defer func() { util.Global = config }()
+  
+  db := openDB(t, &util.DefaultOption, "/tmp/test_singledel_misuse")
+  db.Put(&util.DefaultWriteOption, []byte("key1"), []byte("val1"))
+  db.Put(&util.DefaultWriteOption, []byte("key1"), []byte("val2"))
+  db.SingleDelete(&util.DefaultWriteOption, []byte("key1"))
+  // a SingleDelete right above its only Put is no misuse
+  db.Put(&util.DefaultWriteOption, []byte("key2"), []byte("val1"))
+  db.SingleDelete(&util.DefaultWriteOption, []byte("key2"))
+  forceFlush(t, db)
+  
+  if cnt := statCount(t, db, "multiple puts"); cnt != 0 {
+    t.Errorf("%d multiple puts counted before any compaction", cnt)
+  }
+  forceCompaction(t, db)
+  if cnt := statCount(t, db, "multiple puts"); cnt != 1 {
+    t.Errorf("%d multiple puts counted instead of 1", cnt)
+  }
+  if cnt := statCount(t, db, "mismatch"); cnt != 0 {
+    t.Errorf("%d mismatches counted instead of 0", cnt)
+  }
+}
+
+func TestGroupCommit(t *testing.T) {
+  os.RemoveAll("/tmp/test_group_commit")
+  option := util.DefaultOption
+  db := openDB(t, &option, "/tmp/test_group_commit")
+
+  // hold the front of the write queue so that every writer queues up
+  // behind it and the first of them commits all the others as a group
+  blocker := &writer{nil, sync.NewCond(db.mutex), nil, nil, writer_UNDONE, nil}
+  db.mutex.Lock()
+  db.batches = append(db.batches, blocker)
+  db.mutex.Unlock()
+
+  workers := 8
+  var wait sync.WaitGroup
+  for i := 0; i < workers; i++ {
+    wait.Add(1)
+    go func(worker int) {
+      defer wait.Done()
+      key := fmt.Sprintf("key%d", worker)
+      if err := db.Put(&util.DefaultWriteOption, []byte(key), []byte(key)); err != nil {
+        t.Errorf("put key %s error %v", key, err)
+      }
+    }(i)
+  }
+
+  for queued := 0; queued != workers + 1; {
+    time.Sleep(time.Millisecond)
+    db.mutex.Lock()
+    queued = len(db.batches)
+    db.mutex.Unlock()
+  }
+  db.mutex.Lock()
+  db.batches = db.batches[1:]
+  db.batches[0].cv.Signal()
+  db.mutex.Unlock()
+  wait.Wait()
+
+  if seq := db.vset.LastSequence(); seq != uint64(workers) {
+    t.Errorf("last sequence not match %d", seq)
+  }
+  for i := 0; i < workers; i++ {
+    key := fmt.Sprintf("key%d", i)
+    if err, val := db.Get(&util.DefaultReadOption, []byte(key)); err != nil || string(val) != key {
+      t.Errorf("get key %s returns %s %v", key, val, err)
+    }
+  }
+}
+
+func TestConcurrentWrite(t *testing.T) {
+  os.RemoveAll("/tmp/test_concurrent_write")
+  option := util.DefaultOption
+  option.BufferSize = 64 * 1024
+  db := openDB(t, &option, "/tmp/test_concurrent_write")
+
+  workers, cnt := 8, 2000
+  var wait sync.WaitGroup
+  for i := 0; i < workers; i++ {
+    wait.Add(1)
+    go func(worker int) {
+      defer wait.Done()
+      for j := 0; j < cnt; j++ {
+        key := fmt.Sprintf("key%d_%06d", worker, j)
+        if err := db.Put(&util.DefaultWriteOption, []byte(key), []byte(key)); err != nil {
+          t.Errorf("put key %s error %v", key, err)
+          return
+        }
+      }
+    }(i)
+  }
+  wait.Wait()
+
+  for i := 0; i < workers; i++ {
+    for j := 0; j < cnt; j += 7 {
+      key := fmt.Sprintf("key%d_%06d", i, j)
+      if err, val := db.Get(&util.DefaultReadOption, []byte(key)); err != nil || string(val) != key {
+        t.Errorf("get key %s returns %s %v", key, val, err)
+      }
+    }
+  }
+}
+
+func TestPropertiesOfAllTables(t *testing.T) {
+  os.RemoveAll("/tmp/test_props")
+  option := util.DefaultOption
+  option.BufferSize = 64 * 1024
+  db := openDB(t, &option, "/tmp/test_props")
+  
+  cnt := 20000
+  for i := 0; i < cnt; i++ {
+    key := fmt.Sprintf("key%06d", i)
+    db.Put(&util.DefaultWriteOption, []byte(key), []byte(key))
+  }
+  db.mutex.Lock()
+  for db.imm != nil || db.flushing || db.compactions > 0 {
+    db.bg_cv.Wait()
+  }
+  db.mutex.Unlock()
+  
+  props, err := db.GetPropertiesOfAllTables()
+  if err != nil || len(props) == 0 {
+    t.Fatalf("get properties of %d tables error %v", len(props), err)
+  }
+  
+  var entries uint64
+  for name, prop := range props {
+    if _, err := os.Stat(name); err != nil {
+      t.Errorf("table %s of properties missing %v", name, err)
+    }
+    if prop.ComparatorName != util.BinaryComparator.Name() || prop.NumDeletions != 0 {
+      t.Errorf("table %s properties not match %s %d", name, prop.ComparatorName, prop.NumDeletions)
+    }
+    entries += prop.NumEntries
+  }
+  // the last writes may still be in the memtable
+  if entries == 0 || entries > uint64(cnt) {
+    t.Errorf("tables hold %d entries of %d", entries, cnt)
+  }
+}
+
+func TestPrefixSameAsStart(t *testing.T) {
+  os.RemoveAll("/tmp/test_prefix")
+  option := util.DefaultOption
+  option.BufferSize = 64 * 1024
+  option.FilterType = util.FullFilter
+  option.PrefixExtractor = util.NewDelimitedPrefixExtractor('/')
+  db := openDB(t, &option, "/tmp/test_prefix")
+  
+  // only the even tenants have keys
+  for tenant := 0; tenant < 100; tenant += 2 {
+    for i := 0; i < 200; i++ {
+      key := fmt.Sprintf("tenant%03d/entity/%04d", tenant, i)
+      db.Put(&util.DefaultWriteOption, []byte(key), []byte(key))
+    }
+  }
+  db.mutex.Lock()
+  for db.imm != nil || db.flushing || db.compactions > 0 {
+    db.bg_cv.Wait()
+  }
+  db.mutex.Unlock()
+  
+  readOption := util.DefaultReadOption
+  readOption.PrefixSameAsStart = true
+  iter := db.NewIterator(&readOption)
+  defer iter.Release()
+  num := 0
+  for iter.Seek([]byte("tenant042/entity/0100")); iter.Valid(); iter.Next() {
+    if key := string(iter.Key().([]byte)); !strings.HasPrefix(key, "tenant042/") {
+      t.Fatalf("iterate key %s out of prefix", key)
+    }
+    num++
+  }
+  if num != 100 {
+    t.Errorf("iterate %d keys of the prefix", num)
+  }
+  
+  if iter.Seek([]byte("tenant043/")); iter.Valid() {
+    t.Errorf("seek missing prefix returns %s", iter.Key())
+  }
+  
+  // a seek out of the domain is not bounded
+  num = 0
+  for iter.Seek([]byte("tenant098")); iter.Valid(); iter.Next() {
+    num++
+  }
+  if num != 200 {
+    t.Errorf("iterate %d keys from out of the domain", num)
+  }
+  
+  iter = db.NewIterator(&util.DefaultReadOption)
+  defer iter.Release()
+  if iter.Seek([]byte("tenant043/")); !iter.Valid() || !strings.HasPrefix(string(iter.Key().([]byte)), "tenant044/") {
+    t.Errorf("unbounded seek stops at the missing prefix")
+  }
+}
+
+func TestFilterMultipleVersions(t *testing.T) {
+  os.RemoveAll("/tmp/test_versions")
+  option := util.DefaultOption
+  option.BufferSize = 64 * 1024
+  db := openDB(t, &option, "/tmp/test_versions")
+  
+  // every round writes a newer version of the keys to tables of its own
+  cnt := 2000
+  var snapshot Snapshot
+  for round := 0; round < 3; round++ {
+    for i := 0; i < cnt; i++ {
+      key := fmt.Sprintf("key%06d", i)
+      db.Put(&util.DefaultWriteOption, []byte(key), []byte(fmt.Sprintf("%s.%d", key, round)))
+    }
+    for i := 0; i < 5000; i++ {
+      key := fmt.Sprintf("fill%d.%06d", round, i)
+      db.Put(&util.DefaultWriteOption, []byte(key), []byte(key))
+    }
+    if round == 1 {
+      snapshot = db.GetSnapshot()
+    }
+  }
+  db.mutex.Lock()
+  for db.imm != nil || db.flushing || db.compactions > 0 {
+    db.bg_cv.Wait()
+  }
+  db.mutex.Unlock()
+  
+  readOption := util.DefaultReadOption
+  readOption.Snapshot = snapshot
+  for i := 0; i < cnt; i += 13 {
+    key := fmt.Sprintf("key%06d", i)
+    if err, val := db.Get(&util.DefaultReadOption, []byte(key)); err != nil || string(val) != key + ".2" {
+      t.Errorf("get key %s returns %s %v", key, val, err)
+    }
+    if err, val := db.Get(&readOption, []byte(key)); err != nil || string(val) != key + ".1" {
+      t.Errorf("get key %s from snapshot returns %s %v", key, val, err)
+    }
+    if err, _ := db.Get(&util.DefaultReadOption, []byte(key + "x")); err != util.ErrNotFound {
+      t.Errorf("get missing key %sx returns %v", key, err)
+    }
+  }
+  db.ReleaseSnapshot(snapshot)
+}
+
+// Return the count of the row name in the "leveldb.stats" property
+func statCount(t *testing.T, db *dbImpl, name string) int {
+  err, stats := db.GetProperty([]byte("leveldb.stats"))
+  if err != nil {
+    t.Fatalf("get stats error %v", err)
+  }
+  for _, line := range strings.Split(string(stats), "\n") {
+    if !strings.HasPrefix(line, name + " ") {
+      continue
+    }
+    var cnt int
+    if _, err := fmt.Sscanf(line[len(name):], "%d", &cnt); err != nil {
+      t.Fatalf("parse stats row %s error %v", line, err)
+    }
+    return cnt
+  }
+  t.Fatalf("stats miss row %s:\n%s", name, stats)
+  return 0
+}
+
+// Wait until no memtable flush or compaction is pending or running
+func waitBackgroundWork(db *dbImpl) {
+  db.mutex.Lock()
+  for db.imm != nil || db.flushing || db.compactions > 0 {
     db.bg_cv.Wait()
   }
+  db.mutex.Unlock()
 }
 
+func TestWriteSlowdown(t *testing.T) {
+  os.RemoveAll("/tmp/test_slowdown")
+  trigger, delay := util.Global.L0SlowdownWritesTrigger, util.Global.L0SlowdownWritesDelay
+  util.Global.L0SlowdownWritesTrigger = 1
+  util.Global.L0SlowdownWritesDelay = 100
+  defer func() {
+    util.Global.L0SlowdownWritesTrigger, util.Global.L0SlowdownWritesDelay = trigger, delay
+  }()
+  
+  option := util.DefaultOption
+  option.BufferSize = 64 * 1024
+  db := openDB(t, &option, "/tmp/test_slowdown")
+  before := statCount(t, db, "level0 slowdown")
+  
+  // every round overwrites the same keys, so the flushes overlap each
+  // other and pile up in level0
+  value := bytes.Repeat([]byte("v"), 100)
+  for round := 0; round < 10; round++ {
+    for i := 0; i < 500; i++ {
+      key := fmt.Sprintf("key%06d", i)
+      if err := db.Put(&util.DefaultWriteOption, []byte(key), value); err != nil {
+        t.Fatalf("put key %s error %v", key, err)
+      }
+    }
+  }
+  waitBackgroundWork(db)
+  
+  if after := statCount(t, db, "level0 slowdown"); after <= before {
+    t.Errorf("level0 slowdown count %d not increased from %d", after, before)
+  }
+  for i := 0; i < 500; i += 7 {
+    key := fmt.Sprintf("key%06d", i)
+    if err, val := db.Get(&util.DefaultReadOption, []byte(key)); err != nil || !bytes.Equal(val, value) {
+      t.Errorf("get key %s returns %s %v", key, val, err)
+    }
+  }
+}
+
+func TestBackgroundCompactions(t *testing.T) {
+  os.RemoveAll("/tmp/test_bg_compactions")
+  config := util.Global
+  util.Global.MaxBackgroundCompactions = 4
+  util.Global.MaxMemCompactLevel = 0
+  util.Global.TargetFileSize = 256 * 1024
+  defer func() { util.Global = config }()
+  
+  option := util.DefaultOption
+  option.BufferSize = 256 * 1024
+  db := openDB(t, &option, "/tmp/test_bg_compactions")
+  
+  // check the running compactions while the writes go on
+  done := make(chan bool)
+  maxPending := make(chan int)
+  go func() {
+    most := 0
+    for {
+      select {
+      case <-done:
+        maxPending <- most
+        return
+      case <-time.After(time.Millisecond):
+      }
+      
+      db.mutex.Lock()
+      pending := db.vset.PendingCompactions()
+      db.mutex.Unlock()
+      if len(pending) > most {
+        most = len(pending)
+      }
+      
+      owners := make(map[int]int)
+      for i, comp := range pending {
+        for _, files := range comp.Files {
+          for _, meta := range files {
+            if owner, ok := owners[meta.Number]; ok {
+              t.Errorf("file %d picked by compactions %d and %d at once", meta.Number, owner, i)
+            }
+            owners[meta.Number] = i
+          }
+        }
+      }
+    }
+  }()
+  
+  cnt := 160000
+  value := bytes.Repeat([]byte("v"), 100)
+  for i := 0; i < cnt; i++ {
+    key := fmt.Sprintf("key%08d", i)
+    if err := db.Put(&util.DefaultWriteOption, []byte(key), append([]byte(key), value...)); err != nil {
+      t.Fatalf("put key %s error %v", key, err)
+    }
+  }
+  waitBackgroundWork(db)
+  done <- true
+  if most := <-maxPending; most < 2 {
+    t.Errorf("at most %d compactions ran at once", most)
+  }
+  
+  for i := 0; i < cnt; i += 97 {
+    key := fmt.Sprintf("key%08d", i)
+    if err, val := db.Get(&util.DefaultReadOption, []byte(key)); err != nil || !bytes.Equal(val, append([]byte(key), value...)) {
+      t.Errorf("get key %s returns %v", key, err)
+    }
+  }
+  
+  num := 0
+  iter := db.NewIterator(&util.DefaultReadOption)
+  defer iter.Release()
+  for iter.SeekToFirst(); iter.Valid(); iter.Next() {
+    num++
+  }
+  if num != cnt {
+    t.Errorf("iterate %d keys of %d", num, cnt)
+  }
+}
+
+// Return the edits recorded in the current MANIFEST of db
+// REQUIRES: db.mutex is held
+func manifestEdits(t *testing.T, db *dbImpl) []*version.VersionEdit {
+  name := util.DescriptorFileName(db.name, db.vset.ManifestFileNumber())
+  reader, err := log.NewReader(name, true, 0, db.option.Format)
+  if err != nil {
+    t.Fatalf("open manifest %s error %v", name, err)
+  }
+  defer reader.Close()
+  
+  edits := []*version.VersionEdit{}
+  for {
+    record, err := reader.Read()
+    if err == io.EOF {
+      return edits
+    } else if err != nil {
+      t.Fatalf("read manifest %s error %v", name, err)
+    }
+    edit := version.NewVersionEdit()
+    if err := edit.Decode(record); err != nil {
+      t.Fatalf("decode manifest %s error %v", name, err)
+    }
+    edits = append(edits, edit)
+  }
+}
+
+func TestSubcompactions(t *testing.T) {
+  os.RemoveAll("/tmp/test_subcompactions")
+  config := util.Global
+  // flushes stay in level0 and only the test compacts
+  util.Global.MaxBackgroundCompactions = 0
+  util.Global.MaxMemCompactLevel = 0
+  util.Global.MaxSubcompactions = 4
+  util.Global.TargetFileSize = 32 * 1024
+  util.Global.L0CompactionTrigger = 2
+  defer func() { util.Global = config }()
+  
+  option := util.DefaultOption
+  option.BufferSize = 64 * 1024
+  db := openDB(t, &option, "/tmp/test_subcompactions")
+  
+  // every round overwrites half of the keys of the one before, the
+  // snapshot keeps the first version of the keys of the first round
+  cnt, rounds := 1500, 4
+  var snapshot Snapshot
+  for round := 0; round < rounds; round++ {
+    for i := round * cnt / 2; i < round * cnt / 2 + cnt; i++ {
+      key := fmt.Sprintf("key%06d", i)
+      db.Put(&util.DefaultWriteOption, []byte(key), []byte(fmt.Sprintf("%s.%d", key, round)))
+    }
+    if round == 0 {
+      snapshot = db.GetSnapshot()
+    }
+  }
+  waitBackgroundWork(db)
+  
+  db.mutex.Lock()
+  comp := db.vset.PickCompaction()
+  if comp == nil || comp.Level != 0 || len(db.vset.Current().Files(1)) != 0 {
+    db.mutex.Unlock()
+    t.Fatalf("no level0 compaction picked over %d files", db.vset.NumLevelFiles(0))
+  }
+  inputs := len(comp.Files[0]) + len(comp.Files[1])
+  bounds := db.vset.SubcompactionBoundaries(comp, util.Global.MaxSubcompactions)
+  before := len(manifestEdits(t, db))
+  err := db.compactTableFiles(comp)
+  db.vset.ReleaseCompaction(comp)
+  edits := manifestEdits(t, db)
+  outputs := db.vset.Current().Files(1)
+  db.mutex.Unlock()
+  
+  if err != nil {
+    t.Fatalf("compact %d files error %v", inputs, err)
+  } else if len(bounds) == 0 {
+    t.Fatalf("compaction of %d files not split", inputs)
+  }
+  
+  // the outputs of all the shards are installed by a single edit
+  if len(edits) != before + 1 {
+    t.Errorf("compaction wrote %d edits", len(edits) - before)
+  } else if last := edits[len(edits) - 1]; len(last.Files) != len(outputs) || len(last.Deletes) != inputs {
+    t.Errorf("last edit adds %d of %d files, deletes %d of %d", len(last.Files), len(outputs),
+        len(last.Deletes), inputs)
+  }
+  
+  // no user key has versions on both sides of a boundary or of a file
+  for i, meta := range outputs {
+    small, large := meta.Smallest.UserKey(), meta.Largest.UserKey()
+    for _, bound := range bounds {
+      if bytes.Compare(small, bound) < 0 && bytes.Compare(bound, large) <= 0 {
+        t.Errorf("output %d [%s, %s] spans boundary %s", meta.Number, small, large, bound)
+      }
+    }
+    if i > 0 && bytes.Compare(outputs[i - 1].Largest.UserKey(), small) >= 0 {
+      t.Errorf("output %d starts at %s, before the end of the one before", meta.Number, small)
+    }
+  }
+  if len(outputs) <= len(bounds) {
+    t.Errorf("%d shards wrote %d outputs", len(bounds) + 1, len(outputs))
+  }
+  
+  readOption := util.DefaultReadOption
+  readOption.Snapshot = snapshot
+  for i := 0; i < (rounds + 1) * cnt / 2; i++ {
+    key := fmt.Sprintf("key%06d", i)
+    round := i * 2 / cnt
+    if round >= rounds {
+      round = rounds - 1
+    }
+    if err, val := db.Get(&util.DefaultReadOption, []byte(key)); err != nil || string(val) != fmt.Sprintf("%s.%d", key, round) {
+      t.Errorf("get key %s returns %s %v", key, val, err)
+    }
+    if i >= cnt {
+      continue
+    } else if err, val := db.Get(&readOption, []byte(key)); err != nil || string(val) != key + ".0" {
+      t.Errorf("get key %s from snapshot returns %s %v", key, val, err)
+    }
+  }
+  db.ReleaseSnapshot(snapshot)
+}
+
+// Switch to a new memtable and wait until the old one is flushed
+func forceFlush(t *testing.T, db *dbImpl) {
+  if err := db.Write(&util.DefaultWriteOption, nil); err != nil {
+    t.Fatalf("flush memtable error %v", err)
+  }
+  waitBackgroundWork(db)
+}
+
+// Run the compaction db picks next
+// REQUIRES: no background compaction is running
+func forceCompaction(t *testing.T, db *dbImpl) {
+  db.mutex.Lock()
+  defer db.mutex.Unlock()
+  comp := db.vset.PickCompaction()
+  if comp == nil {
+    t.Fatalf("no compaction picked")
+  }
+  err := db.compactTableFiles(comp)
+  db.vset.ReleaseCompaction(comp)
+  if err != nil {
+    t.Fatalf("compaction error %v", err)
+  }
+}
+
+// recordingFilter removes the values of the keys holding "drop",
+// appends "!" to the ones holding "change" and records the bottommost
+// argument of every key it is called for
+type recordingFilter struct {
+  mutex sync.Mutex
+  calls map[string]bool
+}
+
+func (f *recordingFilter) Filter(level int, key, value []byte, bottommost bool) (int, []byte) {
+  f.mutex.Lock()
+  f.calls[string(key)] = bottommost
+  f.mutex.Unlock()
+  
+  if bytes.Contains(key, []byte("drop")) {
+    return util.FilterRemove, nil
+  } else if bytes.Contains(key, []byte("change")) {
+    return util.FilterChange, append(append([]byte{}, value...), '!')
+  }
+  return util.FilterKeep, nil
+}
+
+func (f *recordingFilter) Name() string {
+  return "RecordingFilter"
+}
+
+func TestCompactionFilter(t *testing.T) {
+  os.RemoveAll("/tmp/test_compaction_filter")
+  config := util.Global
+  util.Global.MaxBackgroundCompactions = 0
+  util.Global.L0CompactionTrigger = 2
+  defer func() { util.Global = config }()
+  
+  filter := &recordingFilter{calls : make(map[string]bool)}
+  option := util.DefaultOption
+  option.CompactionFilter = filter
+  db := openDB(t, &option, "/tmp/test_compaction_filter")
+  put := func(key, value string) {
+    if err := db.Put(&util.DefaultWriteOption, []byte(key), []byte(value)); err != nil {
+      t.Fatalf("put key %s error %v", key, err)
+    }
+  }
+  
+  // nothing overlaps the first flush, which is pushed down to level2,
+  // the later ones stay in level0
+  put("a0", "base")
+  forceFlush(t, db)
+  util.Global.MaxMemCompactLevel = 0
+  
+  put("bdrop0", "old")
+  snapshot := db.GetSnapshot()
+  put("bdrop1", "val")
+  put("bdrop2", "old")
+  put("bchange1", "val")
+  put("bkeep1", "val")
+  forceFlush(t, db)
+  put("bdrop2", "new")
+  db.PutWithTTL(&util.DefaultWriteOption, []byte("bchange2"), []byte("val"), 3600)
+  forceFlush(t, db)
+  forceCompaction(t, db)
+  
+  if _, ok := filter.calls["bdrop0"]; ok {
+    t.Errorf("filter called for a value a snapshot reads")
+  }
+  for _, key := range []string{"bdrop1", "bdrop2", "bchange1", "bchange2", "bkeep1"} {
+    if bottommost, ok := filter.calls[key]; !ok || !bottommost {
+      t.Errorf("filter called for key %s %v, bottommost %v", key, ok, bottommost)
+    }
+  }
+  
+  expects := map[string]string{"bdrop0" : "old", "bchange1" : "val!", "bchange2" : "val!", "bkeep1" : "val"}
+  for key, expect := range expects {
+    if err, val := db.Get(&util.DefaultReadOption, []byte(key)); err != nil || string(val) != expect {
+      t.Errorf("get key %s returns %s %v", key, val, err)
+    }
+  }
+  for _, key := range []string{"bdrop1", "bdrop2"} {
+    if err, val := db.Get(&util.DefaultReadOption, []byte(key)); err != util.ErrNotFound {
+      t.Errorf("get removed key %s returns %s %v", key, val, err)
+    }
+  }
+  db.ReleaseSnapshot(snapshot)
+  
+  // the level2 table lies below the range of this compaction
+  put("a0", "new")
+  put("a1", "val")
+  forceFlush(t, db)
+  put("a1", "new")
+  forceFlush(t, db)
+  forceCompaction(t, db)
+  if bottommost, ok := filter.calls["a1"]; !ok || bottommost {
+    t.Errorf("filter called for key a1 %v, bottommost %v", ok, bottommost)
+  }
+  if err, val := db.Get(&util.DefaultReadOption, []byte("a1")); err != nil || string(val) != "new" {
+    t.Errorf("get key a1 returns %s %v", val, err)
+  }
+}
+
+func TestObsoleteFiles(t *testing.T) {
+  os.RemoveAll("/tmp/test_obsolete_files")
+  config := util.Global
+  util.Global.MaxBackgroundCompactions = 0
+  util.Global.MaxMemCompactLevel = 0
+  util.Global.L0CompactionTrigger = 2
+  defer func() { util.Global = config }()
+  
+  db := openDB(t, &util.DefaultOption, "/tmp/test_obsolete_files")
+  cnt := 100
+  for round := 0; round < 2; round++ {
+    for i := 0; i < cnt; i++ {
+      key := []byte(fmt.Sprintf("key%03d", i))
+      db.Put(&util.DefaultWriteOption, key, []byte(fmt.Sprintf("val%d", round)))
+    }
+    forceFlush(t, db)
+  }
+  
+  inputs := []string{}
+  for _, meta := range db.vset.Current().Files(0) {
+    inputs = append(inputs, util.TableFileName(db.name, meta.Number))
+  }
+  exists := func() int {
+    rslt := 0
+    for _, name := range inputs {
+      if _, err := os.Stat(name); err == nil {
+        rslt++
+      }
+    }
+    return rslt
+  }
+  
+  // the iterator keeps reading the inputs the compaction deletes
+  iter := db.NewIterator(&util.DefaultReadOption)
+  forceCompaction(t, db)
+  if n := exists(); n != len(inputs) {
+    t.Fatalf("%d of %d inputs kept for a live iterator", n, len(inputs))
+  }
+  read := 0
+  for iter.SeekToFirst(); iter.Valid(); iter.Next() {
+    if string(iter.Value().([]byte)) != "val1" {
+      t.Errorf("iterate key %s returns %s", iter.Key(), iter.Value())
+    }
+    read++
+  }
+  if read != cnt {
+    t.Errorf("iterate %d keys instead of %d", read, cnt)
+  }
+  
+  // the inputs are removed as soon as the iterator is released
+  iter.Release()
+  if n := exists(); n != 0 {
+    t.Errorf("%d obsolete inputs left on disk", n)
+  }
+  for i := 0; i < cnt; i++ {
+    key := []byte(fmt.Sprintf("key%03d", i))
+    if err, val := db.Get(&util.DefaultReadOption, key); err != nil || string(val) != "val1" {
+      t.Errorf("get key %s returns %s %v", key, val, err)
+    }
+  }
+}
+
+func TestMergeOperatorMismatch(t *testing.T) {
+  os.RemoveAll("/tmp/test_merge_mismatch")
+  option := util.DefaultOption
+  option.MergeOperator = new(appendOperator)
+  db := openDB(t, &option, "/tmp/test_merge_mismatch")
+  db.Merge(&util.DefaultWriteOption, []byte("key1"), []byte("a"))
+  // the flush records the name of the operator in the descriptor
+  forceFlush(t, db)
+  if err := db.Close(); err != nil {
+    t.Fatalf("close db error %v", err)
+  }
+
+  option.MergeOperator = new(renamedOperator)
+  if db, err := Open(&option, "/tmp/test_merge_mismatch"); err == nil || db != nil {
+    t.Errorf("open with another merge operator returns %v %v", db, err)
+  }
+
+  option.MergeOperator = new(appendOperator)
+  db = openDB(t, &option, "/tmp/test_merge_mismatch")
+  if err, val := db.Get(&util.DefaultReadOption, []byte("key1")); err != nil || string(val) != "a" {
+    t.Errorf("get merged key1 returns %s %v", val, err)
+  }
+  db.Close()
+}
@@ -0,0 +1,343 @@
+package db
+
+import (
+  "time"
+  "bytes"
+)
+
+import (
+  "code.google.com/p/log4go"
+)
+
+import (
+  "github.com/jellybean4/goleveldb/mem"
+  "github.com/jellybean4/goleveldb/util"
+)
+
+// Iterator is an iterator over the user view of the db
+type Iterator interface {
+  mem.Iterator
+
+  // Release the tables the iterator reads, so that the ones dropped by
+  // compactions meanwhile can be removed.  The iterator must not be
+  // used after this call.
+  Release()
+}
+
+const (
+  iterForward = iota
+  iterReverse
+)
+
+// dbIter turns the merged internal entries of the memtables and the
+// tables into the user view of the db at sequence seq: one entry per
+// user key holding its newest value, with deleted and expired keys
+// left out, as are keys covered by range tombstones.  Merge operands
+// are combined with the value below them.
+// Keys and values are user keys and user values.
+//
+// Moving forward, the internal iterator is positioned at the exact
+// entry which yields Key() and Value(), unless the entry is a merge
+// operand: the iterator is then moved past the entries merged, and
+// the result is saved in savedKey and savedValue.  Moving backward, it
+// is positioned just before all the entries of the current user key,
+// which are saved in savedKey and savedValue.
+//
+// With an extractor, the iterator becomes invalid once it leaves the
+// prefix of the key it was positioned by Seek at.
+type dbIter struct {
+  iter       mem.Iterator
+  ucmp       util.Comparator
+  merger     util.MergeOperator
+  dels       mem.RangeTombstones
+  seq        uint64
+  now        int64
+  direction  int
+  valid      bool
+  merged     bool   // moving forward, the current entry is saved
+  savedKey   []byte
+  savedValue []byte
+  extractor  util.PrefixExtractor
+  prefix     []byte   // prefix of the key sought, nil if not bounded
+  release    func()   // called by the first Release
+}
+
+func newDBIterator(iter mem.Iterator, ucmp util.Comparator, merger util.MergeOperator,
+    dels mem.RangeTombstones, seq uint64) *dbIter {
+  dbiter := new(dbIter)
+  dbiter.init(iter, ucmp, merger, dels, seq)
+  return dbiter
+}
+
+func (i *dbIter) init(iter mem.Iterator, ucmp util.Comparator, merger util.MergeOperator,
+    dels mem.RangeTombstones, seq uint64) {
+  i.iter = iter
+  i.ucmp = ucmp
+  i.merger = merger
+  i.dels = dels
+  i.seq = seq
+  i.now = time.Now().Unix()
+  i.direction = iterForward
+  i.valid = false
+}
+
+func (i *dbIter) Release() {
+  if i.release != nil {
+    i.release()
+    i.release = nil
+  }
+  i.valid = false
+}
+
+func (i *dbIter) Valid() bool {
+  return i.valid && i.inPrefix()
+}
+
+// Return false if the iterator is out of the prefix it is bounded to
+func (i *dbIter) inPrefix() bool {
+  if i.prefix == nil {
+    return true
+  }
+  key := i.Key().([]byte)
+  return i.extractor.InDomain(key) && bytes.Equal(i.extractor.Transform(key), i.prefix)
+}
+
+func (i *dbIter) Key() interface{} {
+  if i.direction == iterReverse || i.merged {
+    return i.savedKey
+  }
+  return util.ExtractUserKey(i.iter.Key().([]byte))
+}
+
+func (i *dbIter) Value() interface{} {
+  if i.direction == iterReverse || i.merged {
+    return i.savedValue
+  }
+  ikey := new(util.ParsedInternalKey)
+  ikey.Decode(i.iter.Key().([]byte))
+  value, _ := i.liveValue(ikey.Rtype, i.iter.Value().([]byte))
+  return value
+}
+
+func (i *dbIter) Next() {
+  if i.direction == iterReverse {
+    i.direction = iterForward
+    // the internal iterator is before the entries of savedKey, which
+    // is still the key to skip
+    if !i.iter.Valid() {
+      i.iter.SeekToFirst()
+    } else {
+      i.iter.Next()
+    }
+  } else if i.merged {
+    // the internal iterator is already past the merged entries
+    i.merged = false
+  } else {
+    i.savedKey = copyBytes(util.ExtractUserKey(i.iter.Key().([]byte)))
+    i.iter.Next()
+  }
+  i.findNextUserEntry(true, i.savedKey)
+}
+
+func (i *dbIter) Prev() {
+  if i.direction == iterForward {
+    // step before all the entries of the current key
+    i.savedKey = copyBytes(i.Key().([]byte))
+    i.merged = false
+    if !i.iter.Valid() {
+      // merging the current key went through the last entry
+      i.iter.SeekToLast()
+    }
+    
+    for i.iter.Valid() && i.ucmp.Compare(util.ExtractUserKey(i.iter.Key().([]byte)), i.savedKey) >= 0 {
+      i.iter.Prev()
+    }
+    
+    if !i.iter.Valid() {
+      i.valid = false
+      i.savedKey, i.savedValue = nil, nil
+      return
+    }
+    i.direction = iterReverse
+  }
+  i.findPrevUserEntry()
+}
+
+// Position at the first user key not less than key
+func (i *dbIter) Seek(key interface{}) {
+  i.prefix = nil
+  if i.extractor != nil && i.extractor.InDomain(key.([]byte)) {
+    i.prefix = copyBytes(i.extractor.Transform(key.([]byte)))
+  }
+  i.merged = false
+  i.direction = iterForward
+  i.savedKey, i.savedValue = nil, nil
+  i.iter.Seek(util.NewInternalKey(key.([]byte), i.seq, mem.SeekType).Encode())
+  i.findNextUserEntry(false, nil)
+}
+
+func (i *dbIter) SeekToFirst() {
+  i.prefix = nil
+  i.merged = false
+  i.direction = iterForward
+  i.savedKey, i.savedValue = nil, nil
+  i.iter.SeekToFirst()
+  i.findNextUserEntry(false, nil)
+}
+
+func (i *dbIter) SeekToLast() {
+  i.prefix = nil
+  i.merged = false
+  i.direction = iterReverse
+  i.savedKey, i.savedValue = nil, nil
+  i.iter.SeekToLast()
+  i.findPrevUserEntry()
+}
+
+// Advance to the first visible entry which is a live value or a merge
+// operand, skipping the older entries of the user key skip if skipping
+// is set
+func (i *dbIter) findNextUserEntry(skipping bool, skip []byte) {
+  ikey := new(util.ParsedInternalKey)
+  for i.iter.Valid() {
+    if err := ikey.Decode(i.iter.Key().([]byte)); err != nil || ikey.Seq > i.seq {
+      i.iter.Next()
+      continue
+    }
+
+    if skipping && i.ucmp.Compare(ikey.Key, skip) <= 0 {
+      // hidden by a newer entry
+      i.iter.Next()
+      continue
+    }
+
+    delSeq := i.delSeq(ikey.Key)
+    if ikey.Rtype == mem.MergeType && ikey.Seq > delSeq {
+      key := copyBytes(ikey.Key)
+      base, operands := collectMergeOperands(i.iter, i.ucmp, key, delSeq, i.now)
+      if value, ok := i.merge(key, base, operands); ok {
+        i.valid, i.merged = true, true
+        i.savedKey, i.savedValue = key, value
+        return
+      }
+      skip, skipping = key, true
+      continue
+    }
+
+    if _, live := i.liveValue(ikey.Rtype, i.iter.Value().([]byte)); live && ikey.Seq > delSeq {
+      i.valid = true
+      i.savedKey = nil
+      return
+    }
+    // hides all the older entries of the key
+    skip = copyBytes(ikey.Key)
+    skipping = true
+    i.iter.Next()
+  }
+  i.valid = false
+  i.savedKey = nil
+}
+
+// Move backward over the entries of the previous user key, keeping the
+// newest visible value of them in savedKey and savedValue.  Keys whose
+// newest entry is not a live value or a merge operand are passed over.
+func (i *dbIter) findPrevUserEntry() {
+  live := false
+  var operands [][]byte
+  ikey := new(util.ParsedInternalKey)
+  for ; i.iter.Valid(); i.iter.Prev() {
+    if err := ikey.Decode(i.iter.Key().([]byte)); err != nil || ikey.Seq > i.seq {
+      continue
+    }
+
+    if live && i.ucmp.Compare(ikey.Key, i.savedKey) < 0 {
+      // all the entries of savedKey have been passed
+      if live = i.mergeSaved(operands); live {
+        break
+      }
+      operands = nil
+    }
+
+    if ikey.Seq < i.delSeq(ikey.Key) {
+      // deleted by a range tombstone
+      i.savedKey, i.savedValue = nil, nil
+      live, operands = false, nil
+    } else if ikey.Rtype == mem.MergeType {
+      // entries of a key are met from the oldest to the newest
+      if !live {
+        i.savedKey, i.savedValue = copyBytes(ikey.Key), nil
+        live = true
+      }
+      operands = append(operands, copyBytes(i.iter.Value().([]byte)))
+    } else if value, ok := i.liveValue(ikey.Rtype, i.iter.Value().([]byte)); ok {
+      i.savedKey = copyBytes(ikey.Key)
+      i.savedValue = copyBytes(value)
+      live, operands = true, nil
+    } else {
+      i.savedKey, i.savedValue = nil, nil
+      live, operands = false, nil
+    }
+  }
+
+  if live && i.iter.Valid() {
+    i.valid = true
+    return
+  }
+  
+  if !live || !i.mergeSaved(operands) {
+    i.valid = false
+    i.savedKey, i.savedValue = nil, nil
+    i.direction = iterForward
+    return
+  }
+  i.valid = true
+}
+
+// Return the largest sequence of the range tombstones covering the user
+// key key, the entries of key below it are deleted
+func (i *dbIter) delSeq(key []byte) uint64 {
+  if len(i.dels) == 0 {
+    return 0
+  }
+  return i.dels.MaxCoveringSeq(i.ucmp, key, i.seq)
+}
+
+// Apply operands to savedValue, returns false if the merge fails
+func (i *dbIter) mergeSaved(operands [][]byte) bool {
+  if len(operands) == 0 {
+    return true
+  }
+  
+  value, ok := i.merge(i.savedKey, i.savedValue, operands)
+  if ok {
+    i.savedValue = value
+  }
+  return ok
+}
+
+// Apply operands to the value existing for key, keys which fail to
+// merge are left out of the iteration
+func (i *dbIter) merge(key, existing []byte, operands [][]byte) ([]byte, bool) {
+  value, err := fullMerge(i.merger, key, existing, operands)
+  if err != nil {
+    log4go.Error("merge operands of key %s failed %v", key, err)
+    return nil, false
+  }
+  return value, true
+}
+
+// Return the user value of an entry of type rtype, ok is false if the
+// entry is a deletion or an expired value
+func (i *dbIter) liveValue(rtype byte, value []byte) ([]byte, bool) {
+  value, err := resolveEntry(rtype, value, i.now)
+  return value, err == nil
+}
+
+func copyBytes(data []byte) []byte {
+  if data == nil {
+    return nil
+  }
+  rslt := make([]byte, len(data))
+  copy(rslt, data)
+  return rslt
+}
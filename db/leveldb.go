@@ -0,0 +1,120 @@
+package db
+
+import (
+  "bytes"
+  "errors"
+)
+
+import (
+  "github.com/jellybean4/goleveldb/util"
+)
+
+// Tags of the records of a batch in the log of LevelDB, a record is a
+// tag followed by the varint32 prefixed key, and value for a put
+const (
+  levelDBDeletion = 0
+  levelDBValue = 1
+)
+
+var errLevelDBBatch = errors.New("update not supported by the LevelDB format")
+
+// levelDBEncoder encodes the updates of a batch into the records of
+// LevelDB, which only knows of puts and deletes
+type levelDBEncoder struct {
+  buffer bytes.Buffer
+  err error
+}
+
+func (e *levelDBEncoder) Put(key, value []byte) {
+  e.buffer.WriteByte(levelDBValue)
+  util.PutVarintBytes(&e.buffer, key)
+  util.PutVarintBytes(&e.buffer, value)
+}
+
+func (e *levelDBEncoder) PutWithExpiry(key, value []byte, expiry int64) {
+  e.err = errLevelDBBatch
+}
+
+func (e *levelDBEncoder) Merge(key, operand []byte) {
+  e.err = errLevelDBBatch
+}
+
+func (e *levelDBEncoder) Delete(key []byte) {
+  e.buffer.WriteByte(levelDBDeletion)
+  util.PutVarintBytes(&e.buffer, key)
+}
+
+func (e *levelDBEncoder) SingleDelete(key []byte) {
+  e.err = errLevelDBBatch
+}
+
+func (e *levelDBEncoder) DeleteRange(start, end []byte) {
+  e.err = errLevelDBBatch
+}
+
+func (e *levelDBEncoder) MarkBeginPrepare() {
+  e.err = errLevelDBBatch
+}
+
+func (e *levelDBEncoder) MarkEndPrepare(name []byte) {
+  e.err = errLevelDBBatch
+}
+
+func (e *levelDBEncoder) MarkCommit(name []byte) {
+  e.err = errLevelDBBatch
+}
+
+func (e *levelDBEncoder) MarkRollback(name []byte) {
+  e.err = errLevelDBBatch
+}
+
+// Return the log record LevelDB writes for batch.  The header of the
+// batch is the same in both formats.
+func encodeLevelDBBatch(batch WriteBatch) ([]byte, error) {
+  encoder := new(levelDBEncoder)
+  encoder.buffer.Write(batch.Contents()[:BatchHeader])
+  if err := batch.Iterate(encoder); err != nil {
+    return nil, err
+  } else if encoder.err != nil {
+    return nil, encoder.err
+  }
+  return encoder.buffer.Bytes(), nil
+}
+
+// Return the batch of the log record LevelDB wrote
+func decodeLevelDBBatch(record []byte) (WriteBatch, error) {
+  if len(record) < BatchHeader {
+    return nil, errors.New("batch size too small")
+  }
+
+  header := NewWriteBatch()
+  header.SetContents(record[:BatchHeader])
+  batch := NewWriteBatch()
+  batch.SetSequence(header.Sequence())
+  var key, val []byte
+  content := record[BatchHeader:]
+  for len(content) > 0 {
+    switch content[0] {
+    case levelDBValue:
+      key, content = util.GetVarintBytes(content[1:])
+      val, content = util.GetVarintBytes(content)
+      if key == nil || val == nil {
+        return nil, errors.New("bad LevelDB batch put")
+      }
+      batch.Put(key, val)
+    case levelDBDeletion:
+      key, content = util.GetVarintBytes(content[1:])
+      if key == nil {
+        return nil, errors.New("bad LevelDB batch del")
+      }
+      batch.Delete(key)
+    default:
+      return nil, errors.New("bad LevelDB batch tag")
+    }
+  }
+
+  if batch.Count() != header.Count() {
+    return nil, errors.New("content count not match")
+  }
+  return batch, nil
+}
@@ -0,0 +1,224 @@
+package db
+
+import (
+  "io"
+  "os"
+  "fmt"
+  "testing"
+  "io/ioutil"
+)
+
+import (
+  "github.com/jellybean4/goleveldb/util"
+  "github.com/jellybean4/goleveldb/mem"
+  "github.com/jellybean4/goleveldb/log"
+  "github.com/jellybean4/goleveldb/table"
+  "github.com/jellybean4/goleveldb/filter"
+)
+
+// Copy the files of the db in testdata/src to dst
+func copyTestDB(t *testing.T, src, dst string) {
+  os.RemoveAll(dst)
+  os.MkdirAll(dst, 0755)
+  dir, err := os.Open(src)
+  if err != nil {
+    t.Fatalf("open testdata error %v", err)
+  }
+  names, _ := dir.Readdirnames(-1)
+  dir.Close()
+
+  for _, name := range names {
+    in, err := os.Open(src + "/" + name)
+    if err != nil {
+      t.Fatalf("open testdata error %v", err)
+    }
+    out, err := os.Create(dst + "/" + name)
+    if err != nil {
+      t.Fatalf("create test file error %v", err)
+    }
+    io.Copy(out, in)
+    in.Close()
+    out.Close()
+  }
+}
+
+// testdata/leveldb is a LevelDB db holding key0000 to key0999 with
+// every tenth key deleted in a table, and every seventh key updated
+// and key0001 deleted in the log
+func TestLevelDBFormat(t *testing.T) {
+  copyTestDB(t, "testdata/leveldb", "/tmp/test_leveldb")
+  option := util.DefaultOption
+  option.Format = util.LevelDBFormat
+  db := openDB(t, &option, "/tmp/test_leveldb")
+  reopen := func() *dbImpl {
+    db.mutex.Lock()
+    for db.flushing || db.compactions > 0 {
+      db.bg_cv.Wait()
+    }
+    db.mutex.Unlock()
+    return openDB(t, &option, "/tmp/test_leveldb")
+  }
+
+  check := func(stage string) {
+    for i := 0; i < 1000; i++ {
+      key := fmt.Sprintf("key%04d", i)
+      expect := fmt.Sprintf("val%04d", i)
+      if i % 7 == 0 {
+        expect = fmt.Sprintf("new%04d", i)
+      } else if i % 10 == 0 || i == 1 {
+        expect = ""
+      }
+
+      err, val := db.Get(&util.DefaultReadOption, []byte(key))
+      if (expect == "" && err != util.ErrNotFound) || (expect != "" && string(val) != expect) {
+        t.Errorf("get key %s %s returns %s %v", key, stage, val, err)
+      }
+    }
+  }
+  check("of LevelDB")
+
+  // the updates written in the format of LevelDB read back as well
+  db.Put(&util.DefaultWriteOption, []byte("key1000"), []byte("val1000"))
+  db.Put(&util.DefaultWriteOption, []byte("key1001"), []byte("val1001"))
+  db.Delete(&util.DefaultWriteOption, []byte("key1001"))
+  if err := db.Merge(&util.DefaultWriteOption, []byte("key1002"), []byte("1")); err == nil {
+    t.Errorf("merge in the format of LevelDB succeeds")
+  }
+
+  db = reopen()
+  check("after reopen")
+  if err, val := db.Get(&util.DefaultReadOption, []byte("key1000")); err != nil || string(val) != "val1000" {
+    t.Errorf("get key written in the format of LevelDB returns %s %v", val, err)
+  }
+  if err, val := db.Get(&util.DefaultReadOption, []byte("key1001")); err != util.ErrNotFound {
+    t.Errorf("get key deleted in the format of LevelDB returns %s %v", val, err)
+  }
+}
+
+// testdata/leveldb_snappy is a db written with the defaults of LevelDB,
+// snappy compressed blocks, and its builtin bloom filter.  It holds
+// key0000 to key1999 with every tenth key deleted in a table, and every
+// seventh key updated and key0001 deleted in the log.
+func TestLevelDBSnappy(t *testing.T) {
+  for _, policy := range []filter.Policy{util.DefaultOption.Policy, nil} {
+    copyTestDB(t, "testdata/leveldb_snappy", "/tmp/test_leveldb_snappy")
+    option := util.DefaultOption
+    option.Format = util.LevelDBFormat
+    // the tables keep their filters of another name, which are ignored
+    option.Policy = policy
+    db := openDB(t, &option, "/tmp/test_leveldb_snappy")
+
+    expects := map[string]string{}
+    for i := 0; i < 2000; i++ {
+      key := fmt.Sprintf("key%04d", i)
+      val := fmt.Sprintf("val%04d-val%04d-val%04d", i, i, i)
+      if i % 7 == 0 {
+        val = fmt.Sprintf("new%04d-new%04d-new%04d", i, i, i)
+      } else if i % 10 == 0 || i == 1 {
+        val = ""
+      }
+
+      err, rslt := db.Get(&util.DefaultReadOption, []byte(key))
+      if val == "" && err != util.ErrNotFound {
+        t.Errorf("get deleted key %s returns %s %v", key, rslt, err)
+      } else if val != "" && (err != nil || string(rslt) != val) {
+        t.Errorf("get key %s returns %s %v", key, rslt, err)
+      }
+      if val != "" {
+        expects[key] = val
+      }
+    }
+
+    num := 0
+    iter := db.NewIterator(&util.DefaultReadOption)
+    for iter.SeekToFirst(); iter.Valid(); iter.Next() {
+      key := string(iter.Key().([]byte))
+      if val := string(iter.Value().([]byte)); val != expects[key] {
+        t.Errorf("iterate key %s returns %s", key, val)
+      }
+      num++
+    }
+    iter.Release()
+    if num != len(expects) {
+      t.Errorf("iterate %d keys instead of %d", num, len(expects))
+    }
+    db.Close()
+  }
+}
+
+// Fail t unless the files named name and golden hold the same bytes
+func checkGoldenFile(t *testing.T, name, golden string) {
+  data, err := ioutil.ReadFile(name)
+  if err != nil {
+    t.Fatalf("read %s error %v", name, err)
+  }
+  expect, err := ioutil.ReadFile(golden)
+  if err != nil {
+    t.Fatalf("read %s error %v", golden, err)
+  }
+
+  for i := 0; i < len(data) && i < len(expect); i++ {
+    if data[i] != expect[i] {
+      t.Errorf("%s differs from %s at byte %d", name, golden, i)
+      return
+    }
+  }
+  if len(data) != len(expect) {
+    t.Errorf("%s has %d bytes instead of %d", name, len(data), len(expect))
+  }
+}
+
+// The table and the log of testdata/leveldb written again in the format
+// of LevelDB hold the same bytes as the ones LevelDB wrote
+func TestLevelDBGoldenFiles(t *testing.T) {
+  os.RemoveAll("/tmp/test_leveldb_golden")
+  os.MkdirAll("/tmp/test_leveldb_golden", 0755)
+  option := util.DefaultOption
+  option.Format = util.LevelDBFormat
+  option.Comparator = mem.NewInternalKeyComparator(util.BinaryComparator)
+  // the golden table has no filter
+  option.Policy = nil
+
+  golden := "testdata/leveldb/000006.ldb"
+  info, err := os.Stat(golden)
+  if err != nil {
+    t.Fatalf("stat %s error %v", golden, err)
+  }
+  tbl := table.OpenTable(golden, info.Size(), &option)
+  if tbl == nil {
+    t.Fatalf("open %s failed", golden)
+  }
+  name := "/tmp/test_leveldb_golden/000006.ldb"
+  builder := table.NewTableBuilder(name, &option)
+  iter := tbl.NewIterator()
+  for iter.SeekToFirst(); iter.Valid(); iter.Next() {
+    builder.Add(iter.Key().([]byte), iter.Value().([]byte))
+  }
+  if err := builder.Finish(); err != nil {
+    t.Fatalf("finish table error %v", err)
+  }
+  checkGoldenFile(t, name, golden)
+
+  golden = "testdata/leveldb/000004.log"
+  reader, err := log.NewReader(golden, true, 0, util.LevelDBFormat)
+  if err != nil {
+    t.Fatalf("open %s error %v", golden, err)
+  }
+  defer reader.Close()
+  name = "/tmp/test_leveldb_golden/000004.log"
+  writer, err := log.NewWriter(name, util.LevelDBFormat)
+  if err != nil {
+    t.Fatalf("create %s error %v", name, err)
+  }
+  for {
+    record, err := reader.Read()
+    if err == io.EOF {
+      break
+    } else if err != nil {
+      t.Fatalf("read %s error %v", golden, err)
+    }
+    writer.AddRecord(record)
+  }
+  writer.Close()
+  checkGoldenFile(t, name, golden)
+}
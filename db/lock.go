@@ -0,0 +1,145 @@
+package db
+
+import (
+  "sync"
+  "time"
+  "hash/crc32"
+  "sync/atomic"
+)
+
+// lockManager keeps the exclusive key locks of the pessimistic
+// transactions of a db.  Keys are spread over stripes by their hash,
+// so transactions locking unrelated keys rarely wait on the same mutex.
+//
+// A transaction waiting for a lock waits for the single transaction
+// holding it, these waits form the wait-for graph deadlocks are
+// detected on.
+type lockManager struct {
+  stripes []*lockStripe
+  nextID  uint64
+
+  waitMutex sync.Mutex   // never held while a stripe mutex is acquired
+  waits     map[uint64]uint64   // txn -> txn holding the lock it waits for
+}
+
+type lockStripe struct {
+  mutex *sync.Mutex
+  cv    *sync.Cond
+  locks map[string]uint64   // key -> txn holding its lock
+}
+
+func newLockManager(stripes int) *lockManager {
+  manager := new(lockManager)
+  manager.init(stripes)
+  return manager
+}
+
+func (m *lockManager) init(stripes int) {
+  m.stripes = make([]*lockStripe, stripes)
+  for i := range m.stripes {
+    stripe := &lockStripe{mutex : new(sync.Mutex), locks : make(map[string]uint64)}
+    stripe.cv = sync.NewCond(stripe.mutex)
+    m.stripes[i] = stripe
+  }
+  m.waits = make(map[uint64]uint64)
+}
+
+// Return an id no other transaction of the db got
+func (m *lockManager) newTxnID() uint64 {
+  return atomic.AddUint64(&m.nextID, 1)
+}
+
+func (m *lockManager) stripe(key []byte) *lockStripe {
+  return m.stripes[crc32.ChecksumIEEE(key) % uint32(len(m.stripes))]
+}
+
+// Lock key for txn, waiting at most timeout milliseconds for another
+// transaction to release it, forever if timeout is negative.  If detect
+// is set, txn fails at once if its wait closes a cycle of transactions
+// waiting for each other.
+func (m *lockManager) Lock(txn uint64, key []byte, timeout int, detect bool) error {
+  stripe := m.stripe(key)
+  stripe.mutex.Lock()
+  defer stripe.mutex.Unlock()
+  defer m.clearWait(txn)
+
+  var deadline time.Time
+  var timer *time.Timer
+  for {
+    holder, locked := stripe.locks[string(key)]
+    if !locked || holder == txn {
+      stripe.locks[string(key)] = txn
+      break
+    }
+
+    if detect && m.wait(txn, holder) {
+      return &ErrDeadlock{copyBytes(key)}
+    }
+
+    if timeout >= 0 && timer == nil {
+      // wake the waiters of the stripe up once the time is over
+      deadline = time.Now().Add(time.Duration(timeout) * time.Millisecond)
+      timer = time.AfterFunc(time.Duration(timeout) * time.Millisecond, func() {
+        stripe.mutex.Lock()
+        stripe.cv.Broadcast()
+        stripe.mutex.Unlock()
+      })
+      defer timer.Stop()
+    } else if timeout >= 0 && !time.Now().Before(deadline) {
+      return &ErrLockTimeout{copyBytes(key)}
+    }
+    stripe.cv.Wait()
+  }
+  return nil
+}
+
+// Release the locks txn holds on keys
+func (m *lockManager) Unlock(txn uint64, keys [][]byte) {
+  for _, key := range keys {
+    stripe := m.stripe(key)
+    stripe.mutex.Lock()
+    if holder, locked := stripe.locks[string(key)]; locked && holder == txn {
+      delete(stripe.locks, string(key))
+      stripe.cv.Broadcast()
+    }
+    stripe.mutex.Unlock()
+  }
+
+  // the waiters woken up record their new waits themselves
+  m.waitMutex.Lock()
+  for waiter, holder := range m.waits {
+    if holder == txn {
+      delete(m.waits, waiter)
+    }
+  }
+  m.waitMutex.Unlock()
+}
+
+// Record that txn waits for holder, returns true if holder waits for
+// txn through the waits of other transactions
+func (m *lockManager) wait(txn, holder uint64) bool {
+  m.waitMutex.Lock()
+  defer m.waitMutex.Unlock()
+
+  m.waits[txn] = holder
+  // every transaction waits for one other at most, so following the
+  // waits from holder either comes back to txn or stops
+  for i := 0; i <= len(m.waits); i++ {
+    if holder == txn {
+      return true
+    }
+
+    next, waiting := m.waits[holder]
+    if !waiting {
+      return false
+    }
+    holder = next
+  }
+  return false
+}
+
+func (m *lockManager) clearWait(txn uint64) {
+  m.waitMutex.Lock()
+  delete(m.waits, txn)
+  m.waitMutex.Unlock()
+}
@@ -1,5 +1,76 @@
 package db
 
+// Snapshot is an immutable view of the db taken at some sequence number
 type Snapshot interface {
-  
-}
\ No newline at end of file
+  // Sequence number of the last write visible through this snapshot
+  Sequence() uint64
+}
+
+type snapshotImpl struct {
+  seq  uint64
+  prev *snapshotImpl
+  next *snapshotImpl
+}
+
+func (s *snapshotImpl) Sequence() uint64 {
+  return s.seq
+}
+
+// snapshotList is a circular doubly-linked list of the live snapshots,
+// ordered from the oldest to the newest.
+// REQUIRES: db.mutex is held on every access
+type snapshotList struct {
+  head snapshotImpl
+}
+
+func newSnapshotList() *snapshotList {
+  list := new(snapshotList)
+  list.init()
+  return list
+}
+
+func (l *snapshotList) init() {
+  l.head.prev = &l.head
+  l.head.next = &l.head
+}
+
+func (l *snapshotList) Empty() bool {
+  return l.head.next == &l.head
+}
+
+func (l *snapshotList) Oldest() *snapshotImpl {
+  return l.head.next
+}
+
+func (l *snapshotList) Newest() *snapshotImpl {
+  return l.head.prev
+}
+
+// Return the sequences of the snapshots from the oldest to the newest
+func (l *snapshotList) Sequences() []uint64 {
+  seqs := []uint64{}
+  for s := l.head.next; s != &l.head; s = s.next {
+    seqs = append(seqs, s.seq)
+  }
+  return seqs
+}
+
+// Create a snapshot at seq, which must not be smaller than the
+// sequence of any snapshot already in the list
+func (l *snapshotList) New(seq uint64) *snapshotImpl {
+  s := &snapshotImpl{seq : seq}
+  s.next = &l.head
+  s.prev = l.head.prev
+  s.prev.next = s
+  s.next.prev = s
+  return s
+}
+
+func (l *snapshotList) Release(s *snapshotImpl) {
+  if s.prev == nil || s.next == nil {
+    return
+  }
+  s.prev.next = s.next
+  s.next.prev = s.prev
+  s.prev, s.next = nil, nil
+}
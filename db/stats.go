@@ -0,0 +1,75 @@
+package db
+
+import (
+  "bytes"
+  "fmt"
+  "time"
+)
+
+const (
+  stallSlowdown = iota
+  stallMemtable
+  stallL0Stop
+  stallTypes
+)
+
+var stallNames = []string{"level0 slowdown", "memtable full", "level0 stop"}
+
+const (
+  misuseMismatch = iota   // SingleDelete above a deletion or merge operand
+  misuseMultiplePuts      // Put left below a SingleDelete and its Put
+  misuseTypes
+)
+
+var misuseNames = []string{"mismatch", "multiple puts"}
+
+// dbStats records how often and how long writers were held back
+// by makeRoomForWrite, and the misuses of SingleDelete met by
+// compactions.
+// REQUIRES: db.mutex is held on every access
+type dbStats struct {
+  stallCount    []int
+  stallDuration []time.Duration
+  misuseCount   []int
+}
+
+func newDBStats() *dbStats {
+  stats := new(dbStats)
+  stats.init()
+  return stats
+}
+
+func (s *dbStats) init() {
+  s.stallCount = make([]int, stallTypes)
+  s.stallDuration = make([]time.Duration, stallTypes)
+  s.misuseCount = make([]int, misuseTypes)
+}
+
+// Record one stall of the given type which lasted for cost
+func (s *dbStats) recordStall(stall int, cost time.Duration) {
+  s.stallCount[stall]++
+  s.stallDuration[stall] += cost
+}
+
+// Record cnt misuses of SingleDelete of the given type
+func (s *dbStats) recordSingleDeleteMisuse(misuse, cnt int) {
+  s.misuseCount[misuse] += cnt
+}
+
+func (s *dbStats) dump() string {
+  var buffer bytes.Buffer
+  buffer.WriteString("                               Stalls\n")
+  buffer.WriteString("Type              Count     Duration(ms)\n")
+  buffer.WriteString("----------------------------------------\n")
+  for i := 0; i < stallTypes; i++ {
+    msec := float64(s.stallDuration[i]) / float64(time.Millisecond)
+    buffer.WriteString(fmt.Sprintf("%-16s %6d %16.3f\n", stallNames[i], s.stallCount[i], msec))
+  }
+  buffer.WriteString("\n                 SingleDelete misuses\n")
+  buffer.WriteString("Type              Count\n")
+  buffer.WriteString("----------------------------------------\n")
+  for i := 0; i < misuseTypes; i++ {
+    buffer.WriteString(fmt.Sprintf("%-16s %6d\n", misuseNames[i], s.misuseCount[i]))
+  }
+  return buffer.String()
+}
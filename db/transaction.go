@@ -0,0 +1,369 @@
+package db
+
+import (
+  "fmt"
+  "errors"
+)
+
+import (
+  "code.google.com/p/log4go"
+)
+
+import (
+  "github.com/jellybean4/goleveldb/mem"
+  "github.com/jellybean4/goleveldb/util"
+)
+
+// Transaction groups reads and writes to a db which are committed
+// atomically.  Writes are buffered until Commit and are visible to the
+// reads of the transaction only.
+type Transaction interface {
+  // Read key through the transaction, its own writes included
+  Get(option *util.ReadOption, key []byte) (error, []byte)
+
+  // Buffer the mapping "key->value" until the commit.  Returns an
+  // error if key can't be locked or the transaction is prepared.
+  Put(key, value []byte) error
+
+  // Buffer the deletion of key until the commit.  Returns an error if
+  // key can't be locked or the transaction is prepared.
+  Delete(key []byte) error
+
+  // Set the name the transaction is prepared under, which must not be
+  // the name of another transaction prepared in the db
+  SetName(name string)
+
+  // Return the name of the transaction
+  Name() string
+
+  // Write the buffered updates to the log, without applying them, as
+  // the first phase of a two-phase commit.  A prepared transaction
+  // survives a crash of the db until it is committed or rolled back.
+  // Only pessimistic transactions can be prepared.
+  Prepare() error
+
+  // Write the buffered updates to the db atomically.  Returns an
+  // *ErrConflict, and writes nothing, if a key read by the transaction
+  // was written by someone else since.  The transaction is empty
+  // afterwards.
+  Commit(option *util.WriteOption) error
+
+  // Drop the buffered updates and the keys read, and release the locks
+  // taken.  The log records the rollback of a prepared transaction.
+  Rollback()
+}
+
+// ErrConflict is returned by the commit of a transaction which read a
+// key written by someone else before the commit
+type ErrConflict struct {
+  Key []byte
+}
+
+func (e *ErrConflict) Error() string {
+  return fmt.Sprintf("transaction conflict on key %s", e.Key)
+}
+
+// ErrDeadlock is returned to the pessimistic transaction chosen to fail
+// when waiting for the lock of Key would deadlock
+type ErrDeadlock struct {
+  Key []byte
+}
+
+func (e *ErrDeadlock) Error() string {
+  return fmt.Sprintf("deadlock waiting for the lock of key %s", e.Key)
+}
+
+// ErrLockTimeout is returned to a pessimistic transaction which waited
+// longer than its timeout for the lock of Key
+type ErrLockTimeout struct {
+  Key []byte
+}
+
+func (e *ErrLockTimeout) Error() string {
+  return fmt.Sprintf("timeout waiting for the lock of key %s", e.Key)
+}
+
+// optimisticTxn takes no lock.  The sequence of the db is recorded for
+// every key read, and the commit fails if any of them got a newer entry.
+type optimisticTxn struct {
+  db    *dbImpl
+  name  string
+  batch WriteBatchWithIndex
+  reads map[string]uint64   // key -> sequence the key was read at
+}
+
+func newOptimisticTxn(db *dbImpl) Transaction {
+  txn := new(optimisticTxn)
+  txn.init(db)
+  return txn
+}
+
+func (t *optimisticTxn) init(db *dbImpl) {
+  t.db = db
+  option := *db.option
+  option.Comparator = db.userComparator()
+  t.batch = NewWriteBatchWithIndex(&option)
+  t.reads = make(map[string]uint64)
+}
+
+func (t *optimisticTxn) Get(option *util.ReadOption, key []byte) (error, []byte) {
+  t.db.mutex.Lock()
+  seq := t.db.readSequence(option)
+  t.db.mutex.Unlock()
+
+  // the read sees at least what was written up to seq
+  if read, ok := t.reads[string(key)]; !ok || seq < read {
+    t.reads[string(key)] = seq
+  }
+  return t.batch.GetFromBatchAndDB(t.db, option, key)
+}
+
+func (t *optimisticTxn) Put(key, value []byte) error {
+  t.batch.Put(key, value)
+  return nil
+}
+
+func (t *optimisticTxn) Delete(key []byte) error {
+  t.batch.Delete(key)
+  return nil
+}
+
+func (t *optimisticTxn) SetName(name string) {
+  t.name = name
+}
+
+func (t *optimisticTxn) Name() string {
+  return t.name
+}
+
+func (t *optimisticTxn) Prepare() error {
+  return errors.New("optimistic transaction can't be prepared")
+}
+
+func (t *optimisticTxn) Commit(option *util.WriteOption) error {
+  defer t.Rollback()
+  if t.batch.Count() == 0 {
+    return nil
+  }
+  return t.db.write(option, t.batch, t.validate)
+}
+
+func (t *optimisticTxn) Rollback() {
+  t.batch.Clear()
+  t.reads = make(map[string]uint64)
+}
+
+// Check that no key read got a newer entry since
+// REQUIRES: db.mutex is held, no write is in progress
+func (t *optimisticTxn) validate() error {
+  for key, seq := range t.reads {
+    if t.db.latestSequence([]byte(key)) > seq {
+      return &ErrConflict{[]byte(key)}
+    }
+  }
+  return nil
+}
+
+// pessimisticTxn locks every key it reads or writes until it commits or
+// rolls back, so its commit can't conflict
+type pessimisticTxn struct {
+  db     *dbImpl
+  option util.TransactionOption
+  id     uint64
+  batch  WriteBatchWithIndex
+  locked map[string]bool
+  name     string
+  prepared bool   // the batch is in the log waiting for the decision
+}
+
+func newPessimisticTxn(db *dbImpl, option *util.TransactionOption) Transaction {
+  txn := new(pessimisticTxn)
+  txn.init(db, option)
+  return txn
+}
+
+// Return the transaction named name recovered prepared, its updates
+// are in batch
+// REQUIRES: no transaction of db holds a lock
+func newPreparedTxn(db *dbImpl, name string, batch *batchImpl) Transaction {
+  txn := new(pessimisticTxn)
+  txn.init(db, &util.DefaultTransactionOption)
+  txn.name = name
+  txn.prepared = true
+  txn.batch.SetContents(batch.Contents())
+
+  iter := newBatchDeltaIter(txn.batch.(*indexedBatchImpl))
+  for iter.SeekToFirst(); iter.Valid(); iter.Next() {
+    txn.lock(iter.key)
+  }
+  return txn
+}
+
+func (t *pessimisticTxn) init(db *dbImpl, option *util.TransactionOption) {
+  t.db = db
+  t.option = *option
+  t.id = db.locks.newTxnID()
+  dbOption := *db.option
+  dbOption.Comparator = db.userComparator()
+  t.batch = NewWriteBatchWithIndex(&dbOption)
+  t.locked = make(map[string]bool)
+}
+
+func (t *pessimisticTxn) Get(option *util.ReadOption, key []byte) (error, []byte) {
+  if err := t.lock(key); err != nil {
+    return err, nil
+  }
+  return t.batch.GetFromBatchAndDB(t.db, option, key)
+}
+
+func (t *pessimisticTxn) Put(key, value []byte) error {
+  if t.prepared {
+    return errors.New("put into prepared transaction")
+  }
+
+  if err := t.lock(key); err != nil {
+    return err
+  }
+  t.batch.Put(key, value)
+  return nil
+}
+
+func (t *pessimisticTxn) Delete(key []byte) error {
+  if t.prepared {
+    return errors.New("delete from prepared transaction")
+  }
+
+  if err := t.lock(key); err != nil {
+    return err
+  }
+  t.batch.Delete(key)
+  return nil
+}
+
+func (t *pessimisticTxn) SetName(name string) {
+  t.name = name
+}
+
+func (t *pessimisticTxn) Name() string {
+  return t.name
+}
+
+func (t *pessimisticTxn) Prepare() error {
+  if t.name == "" {
+    return errors.New("prepare transaction without name")
+  } else if t.prepared {
+    return errors.New("transaction is prepared already")
+  }
+
+  record := NewWriteBatch().(*batchImpl)
+  record.markBeginPrepare()
+  record.Append(t.batch)
+  record.markEndPrepare([]byte(t.name))
+  err := t.db.write(&util.DefaultWriteOption, record, func() error {
+    if _, ok := t.db.prepared[t.name]; ok {
+      return errors.New("transaction " + t.name + " is prepared already")
+    }
+    return nil
+  })
+
+  if err == nil {
+    t.prepared = true
+  }
+  return err
+}
+
+func (t *pessimisticTxn) Commit(option *util.WriteOption) error {
+  if t.prepared {
+    record := NewWriteBatch().(*batchImpl)
+    record.markCommit([]byte(t.name))
+    err := t.db.Write(option, record)
+    if err == nil {
+      t.release()
+    }
+    return err
+  }
+
+  defer t.release()
+  if t.batch.Count() == 0 {
+    return nil
+  }
+  return t.db.Write(option, t.batch)
+}
+
+func (t *pessimisticTxn) Rollback() {
+  if t.prepared {
+    record := NewWriteBatch().(*batchImpl)
+    record.markRollback([]byte(t.name))
+    if err := t.db.Write(&util.DefaultWriteOption, record); err != nil {
+      log4go.Error("roll back prepared transaction %s failed %v", t.name, err)
+      return
+    }
+  }
+  t.release()
+}
+
+// Drop the updates and release the locks of the transaction
+func (t *pessimisticTxn) release() {
+  keys := make([][]byte, 0, len(t.locked))
+  for key := range t.locked {
+    keys = append(keys, []byte(key))
+  }
+  t.db.locks.Unlock(t.id, keys)
+
+  t.batch.Clear()
+  t.locked = make(map[string]bool)
+  t.prepared = false
+  // waits recorded for the old id must not be taken for new ones
+  t.id = t.db.locks.newTxnID()
+}
+
+func (t *pessimisticTxn) lock(key []byte) error {
+  if t.locked[string(key)] {
+    return nil
+  }
+
+  if err := t.db.locks.Lock(t.id, key, t.option.LockTimeout, t.option.DeadlockDetect); err != nil {
+    return err
+  }
+  t.locked[string(key)] = true
+  return nil
+}
+
+// Return the sequence of the newest entry of the user key key, or of
+// the newest range tombstone covering key if it is newer, 0 if there
+// is none of them
+// REQUIRES: db.mutex is held
+func (db *dbImpl) latestSequence(key []byte) uint64 {
+  ucmp := db.userComparator()
+  lkey := util.NewLookupKey(key, util.Global.MaxSeq, mem.SeekType)
+  dels := mem.RangeTombstones{}
+  var latest uint64 = 0
+  found := false
+  for _, tbl := range []mem.Memtable{db.mem, db.imm} {
+    if tbl == nil {
+      continue
+    }
+
+    dels = append(dels, tbl.RangeTombstones()...)
+    if entry := tbl.Lookup(*lkey); entry != nil && !found {
+      latest, found = entry.Seq, true
+    }
+  }
+
+  if !found {
+    // the entries of the tables are older than those of the memtables
+    current := db.vset.Current()
+    iter := db.newInternalIterator(&util.DefaultReadOption, db.mem, db.imm, current)
+    iter.Seek(lkey.InternalKey())
+    ikey := new(util.ParsedInternalKey)
+    if iter.Valid() && ikey.Decode(iter.Key().([]byte)) == nil && ucmp.Compare(ikey.Key, key) == 0 {
+      latest = ikey.Seq
+    }
+    dels = append(dels, current.RangeTombstones()...)
+  }
+
+  if seq := dels.MaxCoveringSeq(ucmp, key, util.Global.MaxSeq); seq > latest {
+    latest = seq
+  }
+  return latest
+}
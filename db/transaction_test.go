@@ -0,0 +1,270 @@
+package db
+
+import (
+  "os"
+  "fmt"
+  "sync"
+  "strconv"
+  "testing"
+)
+
+import (
+  "github.com/jellybean4/goleveldb/util"
+)
+
+func TestOptimisticTransaction(t *testing.T) {
+  os.RemoveAll("/tmp/test_txn")
+  option := util.DefaultOption
+  db := openDB(t, &option, "/tmp/test_txn")
+  db.Put(&util.DefaultWriteOption, []byte("a"), []byte("1"))
+
+  txn1 := db.BeginOptimisticTransaction()
+  txn2 := db.BeginOptimisticTransaction()
+  if err, val := txn1.Get(&util.DefaultReadOption, []byte("a")); err != nil || string(val) != "1" {
+    t.Errorf("get key through transaction returns %s %v", val, err)
+  }
+  txn1.Put([]byte("b"), []byte("2"))
+  if err, val := txn1.Get(&util.DefaultReadOption, []byte("b")); err != nil || string(val) != "2" {
+    t.Errorf("get own write returns %s %v", val, err)
+  }
+  if err, _ := db.Get(&util.DefaultReadOption, []byte("b")); err != util.ErrNotFound {
+    t.Errorf("uncommitted write is visible %v", err)
+  }
+
+  txn2.Put([]byte("a"), []byte("3"))
+  if err := txn2.Commit(&util.DefaultWriteOption); err != nil {
+    t.Errorf("commit transaction error %v", err)
+  }
+
+  err := txn1.Commit(&util.DefaultWriteOption)
+  if conflict, ok := err.(*ErrConflict); !ok || string(conflict.Key) != "a" {
+    t.Errorf("commit conflicting transaction returns %v", err)
+  }
+  if err, _ := db.Get(&util.DefaultReadOption, []byte("b")); err != util.ErrNotFound {
+    t.Errorf("write of conflicting transaction is visible %v", err)
+  }
+
+  txn1.Put([]byte("c"), []byte("4"))
+  txn1.Rollback()
+  if err := txn1.Commit(&util.DefaultWriteOption); err != nil {
+    t.Errorf("commit rolled back transaction error %v", err)
+  }
+  if err, _ := db.Get(&util.DefaultReadOption, []byte("c")); err != util.ErrNotFound {
+    t.Errorf("rolled back write is visible %v", err)
+  }
+}
+
+func TestOptimisticTransactionCounter(t *testing.T) {
+  os.RemoveAll("/tmp/test_txn_counter")
+  option := util.DefaultOption
+  db := openDB(t, &option, "/tmp/test_txn_counter")
+
+  workers, increments := 8, 50
+  var wait sync.WaitGroup
+  for i := 0; i < workers; i++ {
+    wait.Add(1)
+    go func() {
+      defer wait.Done()
+      txn := db.BeginOptimisticTransaction()
+      for done := 0; done < increments; {
+        cnt := 0
+        if err, val := txn.Get(&util.DefaultReadOption, []byte("cnt")); err == nil {
+          cnt, _ = strconv.Atoi(string(val))
+        }
+        txn.Put([]byte("cnt"), []byte(strconv.Itoa(cnt + 1)))
+        if err := txn.Commit(&util.DefaultWriteOption); err == nil {
+          done++
+        } else if _, ok := err.(*ErrConflict); !ok {
+          t.Errorf("commit transaction error %v", err)
+          return
+        }
+      }
+    }()
+  }
+  wait.Wait()
+
+  if err, val := db.Get(&util.DefaultReadOption, []byte("cnt")); err != nil || string(val) != strconv.Itoa(workers * increments) {
+    t.Errorf("get counter returns %s %v", val, err)
+  }
+}
+
+func TestPessimisticTransaction(t *testing.T) {
+  os.RemoveAll("/tmp/test_txn_lock")
+  option := util.DefaultOption
+  db := openDB(t, &option, "/tmp/test_txn_lock")
+
+  workers, increments := 8, 50
+  var wait sync.WaitGroup
+  for i := 0; i < workers; i++ {
+    wait.Add(1)
+    go func() {
+      defer wait.Done()
+      txn := db.BeginTransaction(&util.DefaultTransactionOption)
+      for j := 0; j < increments; j++ {
+        cnt := 0
+        err, val := txn.Get(&util.DefaultReadOption, []byte("cnt"))
+        if err == nil {
+          cnt, _ = strconv.Atoi(string(val))
+        } else if err != util.ErrNotFound {
+          t.Errorf("get counter error %v", err)
+          return
+        }
+        txn.Put([]byte("cnt"), []byte(strconv.Itoa(cnt + 1)))
+        if err := txn.Commit(&util.DefaultWriteOption); err != nil {
+          t.Errorf("commit transaction error %v", err)
+          return
+        }
+      }
+    }()
+  }
+  wait.Wait()
+
+  if err, val := db.Get(&util.DefaultReadOption, []byte("cnt")); err != nil || string(val) != strconv.Itoa(workers * increments) {
+    t.Errorf("get counter returns %s %v", val, err)
+  }
+
+  // the lock of a key is held until the commit
+  txnOption := util.DefaultTransactionOption
+  txnOption.LockTimeout = 50
+  txn1 := db.BeginTransaction(&txnOption)
+  txn2 := db.BeginTransaction(&txnOption)
+  txn1.Put([]byte("a"), []byte("1"))
+  if _, ok := txn2.Put([]byte("a"), []byte("2")).(*ErrLockTimeout); !ok {
+    t.Errorf("put locked key did not time out")
+  }
+  txn1.Commit(&util.DefaultWriteOption)
+  if err := txn2.Put([]byte("a"), []byte("2")); err != nil {
+    t.Errorf("put released key error %v", err)
+  }
+  txn2.Rollback()
+}
+
+func TestTransactionDeadlock(t *testing.T) {
+  os.RemoveAll("/tmp/test_txn_deadlock")
+  option := util.DefaultOption
+  db := openDB(t, &option, "/tmp/test_txn_deadlock")
+
+  txnOption := util.DefaultTransactionOption
+  txnOption.LockTimeout = -1
+  txn1 := db.BeginTransaction(&txnOption)
+  txn2 := db.BeginTransaction(&txnOption)
+  txn1.Put([]byte("a"), []byte("1"))
+  txn2.Put([]byte("b"), []byte("2"))
+
+  errs1, errs2 := make(chan error, 1), make(chan error, 1)
+  go func() {
+    errs1 <- txn1.Put([]byte("b"), []byte("1"))
+  }()
+  go func() {
+    errs2 <- txn2.Put([]byte("a"), []byte("2"))
+  }()
+
+  // the victim gives its locks up, the other one gets them
+  victim, survivor, errs := txn1, txn2, errs2
+  var err error
+  select {
+  case err = <-errs1:
+  case err = <-errs2:
+    victim, survivor, errs = txn2, txn1, errs1
+  }
+  if _, ok := err.(*ErrDeadlock); !ok {
+    t.Fatalf("deadlocked transaction returns %v", err)
+  }
+  victim.Rollback()
+  if err := <-errs; err != nil {
+    t.Errorf("surviving transaction returns %v", err)
+  }
+  survivor.Rollback()
+}
+
+func TestTwoPhaseCommit(t *testing.T) {
+  os.RemoveAll("/tmp/test_txn_2pc")
+  option := util.DefaultOption
+  option.BufferSize = 64 * 1024
+  db := openDB(t, &option, "/tmp/test_txn_2pc")
+  // the db left behind must not write files anymore
+  reopen := func() *dbImpl {
+    db.mutex.Lock()
+    for db.flushing || db.compactions > 0 {
+      db.bg_cv.Wait()
+    }
+    db.mutex.Unlock()
+    return openDB(t, &option, "/tmp/test_txn_2pc")
+  }
+  db.Put(&util.DefaultWriteOption, []byte("a"), []byte("1"))
+
+  txn1 := db.BeginTransaction(&util.DefaultTransactionOption)
+  txn1.SetName("t1")
+  txn1.Put([]byte("b"), []byte("1"))
+  if err := txn1.Prepare(); err != nil {
+    t.Fatalf("prepare transaction error %v", err)
+  }
+  if err := txn1.Put([]byte("b"), []byte("2")); err == nil {
+    t.Errorf("put into prepared transaction succeeds")
+  }
+  if err, val := db.Get(&util.DefaultReadOption, []byte("b")); err != util.ErrNotFound {
+    t.Errorf("get key of prepared transaction returns %s %v", val, err)
+  }
+
+  txn2 := db.BeginTransaction(&util.DefaultTransactionOption)
+  txn2.SetName("t1")
+  if err := txn2.Prepare(); err == nil {
+    t.Errorf("prepare transaction of a prepared name succeeds")
+  }
+  txn2.SetName("t2")
+  txn2.Put([]byte("c"), []byte("2"))
+  txn2.Prepare()
+  if err := txn2.Commit(&util.DefaultWriteOption); err != nil {
+    t.Errorf("commit prepared transaction error %v", err)
+  }
+
+  // t1 is undecided when the db is opened again
+  db = reopen()
+  for key, expect := range map[string]string{"a" : "1", "b" : "", "c" : "2"} {
+    err, val := db.Get(&util.DefaultReadOption, []byte(key))
+    if (expect == "" && err != util.ErrNotFound) || (expect != "" && string(val) != expect) {
+      t.Errorf("get key %s after reopen returns %s %v", key, val, err)
+    }
+  }
+
+  txns := db.GetPreparedTransactions()
+  if len(txns) != 1 || txns[0].Name() != "t1" {
+    t.Fatalf("recovered %d prepared transactions", len(txns))
+  }
+  if len(db.GetPreparedTransactions()) != 0 {
+    t.Errorf("prepared transactions returned twice")
+  }
+  if err, val := txns[0].Get(&util.DefaultReadOption, []byte("b")); err != nil || string(val) != "1" {
+    t.Errorf("get key through recovered transaction returns %s %v", val, err)
+  }
+  if err := txns[0].Commit(&util.DefaultWriteOption); err != nil {
+    t.Errorf("commit recovered transaction error %v", err)
+  }
+
+  // a prepared transaction outlives the logs switched away from
+  txn3 := db.BeginTransaction(&util.DefaultTransactionOption)
+  txn3.SetName("t3")
+  txn3.Put([]byte("d"), []byte("3"))
+  txn3.Prepare()
+  for i := 0; i < 20000; i++ {
+    db.Put(&util.DefaultWriteOption, []byte(fmt.Sprintf("key%d", i)), []byte(fmt.Sprintf("val%d", i)))
+  }
+
+  db = reopen()
+  txns = db.GetPreparedTransactions()
+  if len(txns) != 1 || txns[0].Name() != "t3" {
+    t.Fatalf("recovered %d prepared transactions after log switch", len(txns))
+  }
+  txns[0].Rollback()
+
+  db = reopen()
+  if txns := db.GetPreparedTransactions(); len(txns) != 0 {
+    t.Errorf("recovered %d rolled back transactions", len(txns))
+  }
+  for key, expect := range map[string]string{"b" : "1", "d" : "", "key19999" : "val19999"} {
+    err, val := db.Get(&util.DefaultReadOption, []byte(key))
+    if (expect == "" && err != util.ErrNotFound) || (expect != "" && string(val) != expect) {
+      t.Errorf("get key %s after rollback returns %s %v", key, val, err)
+    }
+  }
+}
@@ -0,0 +1,98 @@
+package filter
+
+const (
+  // the probes of each key fall in a single cache line of the filter
+  cacheLineBytes = 64
+  cacheLineBits = cacheLineBytes * 8
+)
+
+// This struct implements a Bloom Filter Policy whose filters are split
+// into cache lines, one line holds all the bits of a key.  A lookup
+// touches a single line of memory at the cost of a slightly higher
+// false positive rate than a Bloom filter of the same size with
+// well spread probes, which crc32 doesn't give bloomPolicy anyway.
+//
+// The filter is the cache lines followed by a byte holding the number
+// of probes.
+type blockedBloomPolicy struct {
+  bitsPerKey int
+  k          int
+}
+
+func NewBlockedBloomPolicy(bitsPerKey int) Policy {
+  bloom := new(blockedBloomPolicy)
+  bloom.init(bitsPerKey)
+  return bloom
+}
+
+func (b *blockedBloomPolicy) init(bitsPerKey int) {
+  b.bitsPerKey = bitsPerKey
+  k := int(float32(bitsPerKey) * 0.69)
+  if k < 1 {
+    k = 1
+  } else if k > 30 {
+    k = 30
+  }
+  b.k = k
+}
+
+func (b *blockedBloomPolicy) Name() string {
+  return "goleveldb.BlockedBloomFilter"
+}
+
+func (b *blockedBloomPolicy) CreateFilter(keys [][]byte) []byte {
+  lines := (len(keys) * b.bitsPerKey + cacheLineBits - 1) / cacheLineBits
+  if lines == 0 {
+    lines = 1
+  }
+  rslt := make([]byte, lines * cacheLineBytes + 1)
+  rslt[lines * cacheLineBytes] = byte(b.k)
+  for _, key := range keys {
+    h := hash64(key)
+    line := rslt[cacheLine(h, lines):]
+    probe := firstProbe(h)
+    for j := 0; j < b.k; j++ {
+      bitpos := probe >> 23
+      line[bitpos / 8] |= 1 << (bitpos % 8)
+      probe *= 0x9e3779b9
+    }
+  }
+  return rslt
+}
+
+func (b *blockedBloomPolicy) KeyMayMatch(key []byte, filter []byte) bool {
+  if len(filter) <= cacheLineBytes || (len(filter) - 1) % cacheLineBytes != 0 {
+    return true
+  }
+  lines := (len(filter) - 1) / cacheLineBytes
+  k := int(filter[len(filter) - 1])
+  if k > 30 {
+    return true
+  }
+
+  h := hash64(key)
+  line := filter[cacheLine(h, lines):]
+  probe := firstProbe(h)
+  for j := 0; j < k; j++ {
+    bitpos := probe >> 23
+    if line[bitpos / 8] & (1 << (bitpos % 8)) == 0 {
+      return false
+    }
+    probe *= 0x9e3779b9
+  }
+  return true
+}
+
+// Return the offset of the line among lines the hash h falls in, picked
+// by the high half of h
+func cacheLine(h uint64, lines int) int {
+  return int((h >> 32) * uint64(lines) >> 32) * cacheLineBytes
+}
+
+// Return the first probe of the hash h within its line, picked by the
+// low half of h.  The probe is made odd: the multiplications moving to
+// the next probes would keep an even one stuck on its low zero bits,
+// on the very first bit of the line for a low half of 0.
+func firstProbe(h uint64) uint32 {
+  return uint32(h) | 1
+}
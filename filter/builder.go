@@ -14,7 +14,7 @@ type BlockBuilder interface {
   Finish() []byte
 
   // Start another block
-  StartBlock(offset int)
+  StartBlock(offset uint64)
 
   // Clear data within this filter builder
   Reset()
@@ -61,8 +61,8 @@ func (f *filterBuilderImpl) AddKey(key []byte) {
   f.keys = append(f.keys, key)
 }
 
-func (f *filterBuilderImpl) StartBlock(offset int) {
-  index := offset / base
+func (f *filterBuilderImpl) StartBlock(offset uint64) {
+  index := int(offset / base)
   for len(f.offset) < index {
     f.generateFilter()
   }
@@ -7,5 +7,8 @@
 // DB::Get() call.
 //
 // Most people will want to use the builtin bloom filter support (see
-// NewBloomFilterPolicy() below).
+// NewBloomFilterPolicy() below).  NewBlockedBloomPolicy() gives faster
+// filters with fewer false positives, which LevelDB can't read.
+// NewRibbonPolicy() gives filters about 25% smaller than a Bloom filter
+// of the same false positive rate, at a higher cost to build them.
 package filter
\ No newline at end of file
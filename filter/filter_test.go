@@ -2,6 +2,7 @@ package filter
 
 import (
   "fmt"
+  "math"
   "math/rand"
   "testing"
 )
@@ -178,8 +179,8 @@ func TestMulti(t *testing.T) {
 func TestBuilder(t *testing.T) {
   policy := NewBloomPolicy(16)
   builder := NewBlockBuilder(policy)
-  offset := 0
-  list := []int{0}
+  var offset uint64 = 0
+  list := []uint64{0}
 
   for i := 0; i < 10000; i++ {
     key := fmt.Sprintf("key%d", i)
@@ -187,7 +188,7 @@ func TestBuilder(t *testing.T) {
 
     if i % 100 == 99 {
       offset += 4096
-      offset += rand.Int() % 4096
+      offset += uint64(rand.Int() % 4096)
       list = append(list, offset)
       builder.StartBlock(offset)
     } 
@@ -202,7 +203,7 @@ func TestBuilder(t *testing.T) {
   }
   for i := 0; i < 10000; i++ {
     key := fmt.Sprintf("key%d", i)
-    offset := uint32(list[cnt])
+    offset := list[cnt]
     if reader.KeyMayMatch(offset, []byte(key)) == false {
       t.Errorf("exist key not match %v", key)
     }
@@ -210,4 +211,182 @@ func TestBuilder(t *testing.T) {
       cnt++
     }
   }
-}
\ No newline at end of file
+}
+
+func TestFullFilter(t *testing.T) {
+  policy := NewBloomPolicy(10)
+  builder := NewFullBuilder(policy)
+  if reader := NewFullReader(policy, builder.Finish()); reader.KeyMayMatch(0, []byte("foo")) {
+    t.Errorf("empty full filter matches")
+  }
+
+  for i := 0; i < 1000; i++ {
+    builder.StartBlock(uint64(i * 100))
+    builder.AddKey([]byte(fmt.Sprintf("key%d", i)))
+  }
+  reader := NewFullReader(policy, builder.Finish())
+  for i := 0; i < 1000; i++ {
+    if !reader.KeyMayMatch(uint64(i), []byte(fmt.Sprintf("key%d", i))) {
+      t.Errorf("exist key key%d not match", i)
+    }
+  }
+}
+
+func TestHash64(t *testing.T) {
+  // filters persist the hash, it must stay xxHash64
+  cases := map[string]uint64 {
+    "" : 0xef46db3751d8e999,
+    "abc" : 0x44bc2cf5ad770999,
+    "Nobody inspects the spammish repetition" : 0xfbcea83c8a378bf1,
+  }
+  for data, expect := range cases {
+    if h := hash64([]byte(data)); h != expect {
+      t.Errorf("hash of %q is %x, not %x", data, h, expect)
+    }
+  }
+}
+
+// Return the share of the missing keys the filter of keys matches
+func falsePositiveRate(policy Policy, keys, probes int) float64 {
+  var added [][]byte
+  for i := 0; i < keys; i++ {
+    added = append(added, []byte(fmt.Sprintf("key%d", i)))
+  }
+  data := policy.CreateFilter(added)
+
+  matched := 0
+  for i := 0; i < probes; i++ {
+    if policy.KeyMayMatch([]byte(fmt.Sprintf("missing%d", i)), data) {
+      matched++
+    }
+  }
+  return float64(matched) / float64(probes)
+}
+
+func TestBlockedBloom(t *testing.T) {
+  policy := NewBlockedBloomPolicy(10)
+  if policy.Name() == NewBloomPolicy(10).Name() {
+    t.Errorf("blocked bloom named as the legacy bloom")
+  }
+  if policy.KeyMayMatch([]byte("foo"), policy.CreateFilter(nil)) {
+    t.Errorf("empty blocked bloom matches")
+  }
+
+  for _, cnt := range []int{1, 10, 100, 1000, 10000} {
+    var keys [][]byte
+    for i := 0; i < cnt; i++ {
+      keys = append(keys, []byte(fmt.Sprintf("key%d", i)))
+    }
+    data := policy.CreateFilter(keys)
+    for _, key := range keys {
+      if !policy.KeyMayMatch(key, data) {
+        t.Errorf("exist key %s not match among %d", key, cnt)
+      }
+    }
+    if rate := falsePositiveRate(policy, cnt, 10000); rate > 0.03 {
+      t.Errorf("false positive rate %f among %d keys", rate, cnt)
+    }
+  }
+
+  // hashes whose low half has no or few bits set still probe different
+  // bits of their line
+  for _, h := range []uint64{0x12345678 << 32, 0x12345678 << 32 | 0x80000000} {
+    bits := map[uint32]bool{}
+    probe := firstProbe(h)
+    for j := 0; j < 6; j++ {
+      bits[probe >> 23] = true
+      probe *= 0x9e3779b9
+    }
+    if len(bits) < 5 {
+      t.Errorf("hash %x probes %d different bits", h, len(bits))
+    }
+  }
+}
+
+func benchmarkPolicy(b *testing.B, policy Policy) {
+  var keys [][]byte
+  for i := 0; i < 100000; i++ {
+    keys = append(keys, []byte(fmt.Sprintf("key%d", i)))
+  }
+  data := policy.CreateFilter(keys)
+  rate := falsePositiveRate(policy, len(keys), 10000)
+
+  b.ResetTimer()
+  for i := 0; i < b.N; i++ {
+    policy.KeyMayMatch(keys[i % len(keys)], data)
+  }
+  b.ReportMetric(rate * 100, "%fp")
+  b.ReportMetric(float64(len(data) * 8) / float64(len(keys)), "bits/key")
+}
+
+func BenchmarkBloom(b *testing.B) {
+  benchmarkPolicy(b, NewBloomPolicy(10))
+}
+
+func BenchmarkBlockedBloom(b *testing.B) {
+  benchmarkPolicy(b, NewBlockedBloomPolicy(10))
+}
+
+func BenchmarkRibbon(b *testing.B) {
+  benchmarkPolicy(b, NewRibbonPolicy(7))
+}
+
+func TestRibbon(t *testing.T) {
+  policy := NewRibbonPolicy(10)
+  if policy.KeyMayMatch([]byte("foo"), policy.CreateFilter(nil)) {
+    t.Errorf("empty ribbon matches")
+  }
+
+  for _, cnt := range []int{1, 10, 100, 1000, 10000} {
+    var keys [][]byte
+    for i := 0; i < cnt; i++ {
+      keys = append(keys, []byte(fmt.Sprintf("key%d", i)))
+    }
+    // the same key twice adds the same equation
+    keys = append(keys, keys[0])
+    data := policy.CreateFilter(keys)
+    for _, key := range keys {
+      if !policy.KeyMayMatch(key, data) {
+        t.Errorf("exist key %s not match among %d", key, cnt)
+      }
+    }
+    if rate := falsePositiveRate(policy, cnt, 10000); rate > 0.01 {
+      t.Errorf("false positive rate %f among %d keys", rate, cnt)
+    }
+  }
+
+  // tuned to the same false positive rate, 2^-8 for 8 result bits, a
+  // ribbon filter takes about a quarter less room than a bloom filter
+  ribbon, bloom := NewRibbonPolicy(9), NewBloomPolicy(12)
+  var keys [][]byte
+  for i := 0; i < 10000; i++ {
+    keys = append(keys, []byte(fmt.Sprintf("key%d", i)))
+  }
+  r, b := falsePositiveRate(ribbon, 10000, 200000), falsePositiveRate(bloom, 10000, 200000)
+  if math.Abs(r - b) > 0.15 * b {
+    t.Errorf("ribbon false positive rate %f against bloom %f", r, b)
+  }
+  if r, b := len(ribbon.CreateFilter(keys)), len(bloom.CreateFilter(keys)); float64(r) > 0.78 * float64(b) {
+    t.Errorf("ribbon filter of %d bytes against bloom filter of %d", r, b)
+  }
+}
+
+func TestRibbonBlocks(t *testing.T) {
+  policy := NewRibbonPolicy(10)
+  builder := NewBlockBuilder(policy)
+  builder.AddKey([]byte("foo"))
+  builder.AddKey([]byte("bar"))
+  builder.StartBlock(4096)
+  builder.AddKey([]byte("box"))
+
+  reader := NewBlockReader(policy, builder.Finish())
+  if !reader.KeyMayMatch(0, []byte("foo")) || !reader.KeyMayMatch(0, []byte("bar")) {
+    t.Errorf("key of first block not match")
+  }
+  if !reader.KeyMayMatch(4096, []byte("box")) {
+    t.Errorf("key of second block not match")
+  }
+  if reader.KeyMayMatch(4096, []byte("foo")) {
+    t.Errorf("foo match second block")
+  }
+}
@@ -0,0 +1,67 @@
+package filter
+
+// fullBuilderImpl builds a single filter over every key added, the
+// offsets of the blocks don't matter to it
+type fullBuilderImpl struct {
+  policy Policy
+  keys   [][]byte
+  size   int   // bytes of the keys added
+}
+
+// Return a builder of one filter for all the keys of a table
+func NewFullBuilder(policy Policy) BlockBuilder {
+  builder := new(fullBuilderImpl)
+  builder.init(policy)
+  return builder
+}
+
+func (f *fullBuilderImpl) init(policy Policy) {
+  f.policy = policy
+  f.Reset()
+}
+
+func (f *fullBuilderImpl) Reset() {
+  f.keys = [][]byte{}
+  f.size = 0
+}
+
+// Return the size of the keys added, the filter is built by Finish
+func (f *fullBuilderImpl) Size() int {
+  return f.size
+}
+
+func (f *fullBuilderImpl) AddKey(key []byte) {
+  f.keys = append(f.keys, key)
+  f.size += len(key)
+}
+
+func (f *fullBuilderImpl) StartBlock(offset uint64) {
+}
+
+// Return the filter of the keys added, empty if there are none
+func (f *fullBuilderImpl) Finish() []byte {
+  if len(f.keys) == 0 {
+    return []byte{}
+  }
+  rslt := f.policy.CreateFilter(f.keys)
+  f.Reset()
+  return rslt
+}
+
+type fullReaderImpl struct {
+  policy Policy
+  filter []byte
+}
+
+// Return a reader of the filter built by a full builder
+func NewFullReader(policy Policy, block []byte) BlockReader {
+  return &fullReaderImpl{policy, block}
+}
+
+// The filter covers all the blocks, so offset is ignored
+func (f *fullReaderImpl) KeyMayMatch(offset uint64, key []byte) bool {
+  if len(f.filter) == 0 {
+    return false
+  }
+  return f.policy.KeyMayMatch(key, f.filter)
+}
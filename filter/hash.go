@@ -0,0 +1,76 @@
+package filter
+
+import (
+  "math/bits"
+  "encoding/binary"
+)
+
+// Primes of xxHash64, variables as the hash relies on them wrapping
+var (
+  prime64a uint64 = 11400714785074694791
+  prime64b uint64 = 14029467366897019727
+  prime64c uint64 = 1609587929392839161
+  prime64d uint64 = 9650029242287828579
+  prime64e uint64 = 2870177450012600261
+)
+
+// Return the xxHash64 of data with seed 0.  Filters persist it, so it
+// must never change.
+func hash64(data []byte) uint64 {
+  n := uint64(len(data))
+  var h uint64
+
+  if len(data) >= 32 {
+    v1 := prime64a + prime64b
+    v2 := prime64b
+    v3 := uint64(0)
+    v4 := -prime64a
+    for ; len(data) >= 32; data = data[32:] {
+      v1 = hashRound(v1, binary.LittleEndian.Uint64(data))
+      v2 = hashRound(v2, binary.LittleEndian.Uint64(data[8:]))
+      v3 = hashRound(v3, binary.LittleEndian.Uint64(data[16:]))
+      v4 = hashRound(v4, binary.LittleEndian.Uint64(data[24:]))
+    }
+    h = bits.RotateLeft64(v1, 1) + bits.RotateLeft64(v2, 7) +
+        bits.RotateLeft64(v3, 12) + bits.RotateLeft64(v4, 18)
+    h = hashMerge(h, v1)
+    h = hashMerge(h, v2)
+    h = hashMerge(h, v3)
+    h = hashMerge(h, v4)
+  } else {
+    h = prime64e
+  }
+  h += n
+
+  for ; len(data) >= 8; data = data[8:] {
+    h ^= hashRound(0, binary.LittleEndian.Uint64(data))
+    h = bits.RotateLeft64(h, 27) * prime64a + prime64d
+  }
+  if len(data) >= 4 {
+    h ^= uint64(binary.LittleEndian.Uint32(data)) * prime64a
+    h = bits.RotateLeft64(h, 23) * prime64b + prime64c
+    data = data[4:]
+  }
+  for _, b := range data {
+    h ^= uint64(b) * prime64e
+    h = bits.RotateLeft64(h, 11) * prime64a
+  }
+
+  h ^= h >> 33
+  h *= prime64b
+  h ^= h >> 29
+  h *= prime64c
+  h ^= h >> 32
+  return h
+}
+
+func hashRound(acc, input uint64) uint64 {
+  acc += input * prime64b
+  acc = bits.RotateLeft64(acc, 31)
+  return acc * prime64a
+}
+
+func hashMerge(acc, val uint64) uint64 {
+  acc ^= hashRound(0, val)
+  return acc * prime64a + prime64d
+}
@@ -9,7 +9,7 @@ import (
 // Reader parses bytes created with builder.
 type BlockReader interface {
   // Return true iff key may exists
-  KeyMayMatch(offset uint32, key []byte) bool
+  KeyMayMatch(offset uint64, key []byte) bool
 }
 
 func NewBlockReader(policy Policy, block []byte) BlockReader {
@@ -62,9 +62,9 @@ func (f *filterReaderImpl) check(limit uint32) bool {
   return true
 }
 
-func (f *filterReaderImpl) KeyMayMatch(offset uint32, key []byte) bool {
-  index := int(offset / f.base)
-  if index >= len(f.offset) - 1 {
+func (f *filterReaderImpl) KeyMayMatch(offset uint64, key []byte) bool {
+  index := offset / uint64(f.base)
+  if index >= uint64(len(f.offset) - 1) {
     return true
   }
 
@@ -0,0 +1,209 @@
+package filter
+
+import (
+  "math/bits"
+  "encoding/binary"
+)
+
+const (
+  // bits of the coefficients of a key, the width of the band
+  ribbonWidth = 64
+
+  // number of slots, fixed32, the seed and the result bits of a key
+  ribbonTrailerSize = 6
+
+  // slots over keys a filter is built with, the band needs a margin
+  // to be solved with a good chance
+  ribbonOverhead = 1.08
+)
+
+// This struct implements the Ribbon Filter Policy, a filter which
+// solves a banded linear system over GF(2) instead of setting bits.
+// Every key adds an equation: the xor of the solutions of the slots its
+// coefficients pick is a result of r bits hashed from the key.  A
+// missing key matches with probability 2^-r, so the filter takes about
+// ribbonOverhead * r bits per key where a Bloom filter needs 1.44 * r.
+//
+// The filter stores the solution as r columns of one bit per slot,
+// followed by the trailer.  A filter of no keys has no slots.
+type ribbonPolicy struct {
+  bitsPerKey int
+  r          int   // result bits of a key
+}
+
+func NewRibbonPolicy(bitsPerKey int) Policy {
+  ribbon := new(ribbonPolicy)
+  ribbon.init(bitsPerKey)
+  return ribbon
+}
+
+func (p *ribbonPolicy) init(bitsPerKey int) {
+  p.bitsPerKey = bitsPerKey
+  r := int(float64(bitsPerKey) / ribbonOverhead)
+  if r < 1 {
+    r = 1
+  } else if r > 32 {
+    r = 32
+  }
+  p.r = r
+}
+
+func (p *ribbonPolicy) Name() string {
+  return "goleveldb.RibbonFilter"
+}
+
+func (p *ribbonPolicy) CreateFilter(keys [][]byte) []byte {
+  if len(keys) == 0 {
+    return make([]byte, ribbonTrailerSize)
+  }
+
+  hashes := make([]uint64, len(keys))
+  for i, key := range keys {
+    hashes[i] = hash64(key)
+  }
+
+  slots := (len(keys) * p.bitsPerKey + p.r - 1) / p.r
+  if slots < ribbonWidth {
+    slots = ribbonWidth
+  }
+  for seed := 0; seed < 256; seed++ {
+    // give the band more room if it keeps failing
+    if seed > 0 && seed % 4 == 0 {
+      slots += slots / 10
+    }
+    if rslt := p.solve(hashes, slots, seed); rslt != nil {
+      return rslt
+    }
+  }
+
+  // no result bits, a filter matching every key
+  rslt := make([]byte, ribbonTrailerSize)
+  binary.LittleEndian.PutUint32(rslt, uint32(slots))
+  return rslt
+}
+
+// Return the filter of the keys hashed to hashes with the number of
+// slots and seed, nil if their system has no solution
+func (p *ribbonPolicy) solve(hashes []uint64, slots, seed int) []byte {
+  // banding, the coefficients of each slot start at it
+  coeffs := make([]uint64, slots)
+  results := make([]uint32, slots)
+  for _, h := range hashes {
+    row := newRibbonRow(h, seed, slots, p.r)
+    i, coeff, result := row.start, row.coeff, row.result
+    for {
+      if coeffs[i] == 0 {
+        coeffs[i], results[i] = coeff, result
+        break
+      }
+      coeff ^= coeffs[i]
+      result ^= results[i]
+      if coeff == 0 {
+        if result != 0 {
+          return nil
+        }
+        // the equation of a key added before
+        break
+      }
+      shift := bits.TrailingZeros64(coeff)
+      i += shift
+      coeff >>= uint(shift)
+    }
+  }
+
+  // back substitution, slots with no equation solve to 0
+  words := (slots + 63) / 64
+  columns := make([][]uint64, p.r)
+  for j := range columns {
+    columns[j] = make([]uint64, words)
+  }
+  for i := slots - 1; i >= 0; i-- {
+    for j, column := range columns {
+      var hi uint64
+      if i / 64 + 1 < words {
+        hi = column[i / 64 + 1]
+      }
+      bit := uint64(results[i] >> uint(j)) & 1
+      bit ^= uint64(bits.OnesCount64(coeffs[i] & ribbonWindow(column[i / 64], hi, i))) & 1
+      column[i / 64] |= bit << uint(i % 64)
+    }
+  }
+
+  rslt := make([]byte, p.r * words * 8 + ribbonTrailerSize)
+  for j, column := range columns {
+    for k, word := range column {
+      binary.LittleEndian.PutUint64(rslt[(j * words + k) * 8:], word)
+    }
+  }
+  trailer := rslt[len(rslt) - ribbonTrailerSize:]
+  binary.LittleEndian.PutUint32(trailer, uint32(slots))
+  trailer[4] = byte(seed)
+  trailer[5] = byte(p.r)
+  return rslt
+}
+
+func (p *ribbonPolicy) KeyMayMatch(key []byte, filter []byte) bool {
+  if len(filter) < ribbonTrailerSize {
+    return true
+  }
+  trailer := filter[len(filter) - ribbonTrailerSize:]
+  slots := int(binary.LittleEndian.Uint32(trailer))
+  seed, r := int(trailer[4]), int(trailer[5])
+  if slots == 0 {
+    return false
+  }
+  words := (slots + 63) / 64
+  if slots < ribbonWidth || r < 1 || r > 32 || len(filter) != r * words * 8 + ribbonTrailerSize {
+    return true
+  }
+
+  row := newRibbonRow(hash64(key), seed, slots, r)
+  k := row.start / 64
+  for j := 0; j < r; j++ {
+    column := filter[j * words * 8:]
+    var hi uint64
+    if k + 1 < words {
+      hi = binary.LittleEndian.Uint64(column[(k + 1) * 8:])
+    }
+    window := ribbonWindow(binary.LittleEndian.Uint64(column[k * 8:]), hi, row.start)
+    if uint32(bits.OnesCount64(row.coeff & window)) & 1 != (row.result >> uint(j)) & 1 {
+      return false
+    }
+  }
+  return true
+}
+
+// ribbonRow is the equation of a key, the solutions of the slots from
+// start on picked by the bits of coeff xor to result
+type ribbonRow struct {
+  start  int
+  coeff  uint64   // the lowest bit is always set
+  result uint32
+}
+
+func newRibbonRow(h uint64, seed, slots, r int) ribbonRow {
+  x := mix64(h + uint64(seed) * 0x9e3779b97f4a7c15)
+  start := int((x >> 32) * uint64(slots - ribbonWidth + 1) >> 32)
+  coeff := mix64(x ^ 0xc2b2ae3d27d4eb4f) | 1
+  result := uint32(mix64(x + 0x165667b19e3779f9) & (1 << uint(r) - 1))
+  return ribbonRow{start, coeff, result}
+}
+
+// Return the 64 bits of a column from bit start on, lo is the word of
+// the column holding bit start and hi the one after it
+func ribbonWindow(lo, hi uint64, start int) uint64 {
+  if shift := uint(start % 64); shift != 0 {
+    return lo >> shift | hi << (64 - shift)
+  }
+  return lo
+}
+
+// Return h with its bits mixed, the finalizer of MurmurHash3
+func mix64(h uint64) uint64 {
+  h ^= h >> 33
+  h *= 0xff51afd7ed558ccd
+  h ^= h >> 33
+  h *= 0xc4ceb9fe1a85ec53
+  h ^= h >> 33
+  return h
+}
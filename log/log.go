@@ -1,5 +1,13 @@
 package log
 
+import (
+  "hash/crc32"
+)
+
+import (
+  "github.com/jellybean4/goleveldb/util"
+)
+
 const (
   ZeroType  byte = 0
   FullType   = 1
@@ -13,4 +21,13 @@ const (
   MaxRecordType = LastType
   BlockSize = 32768
   HeaderSize = 4 + 2 + 1
-)
\ No newline at end of file
+)
+
+// Return the checksum of the physical record of rtype holding data.
+// LevelDB checksums the type as well and masks the crc32c.
+func checksum(rtype byte, data []byte, format int) uint32 {
+  if format == util.LevelDBFormat {
+    return util.MaskedCRC([]byte{rtype}, data)
+  }
+  return crc32.ChecksumIEEE(data)
+}
@@ -9,6 +9,10 @@ import (
   "fmt"
 )
 
+import (
+  "github.com/jellybean4/goleveldb/util"
+)
+
 func BigString(partial string, size int) string {
   var rslt bytes.Buffer
   for rslt.Len() < size {
@@ -101,11 +105,11 @@ var (
 
 func (t *LogTest) init() {
   var err error
-  if t.writer, err = NewWriter("/tmp/log_test"); err != nil {
+  if t.writer, err = NewWriter("/tmp/log_test", util.NativeFormat); err != nil {
     t.assert.Errorf("build log writer failed %s", err.Error())
   }
 
-  if t.reader, err = NewReader("/tmp/log_test", true, 0); err != nil {
+  if t.reader, err = NewReader("/tmp/log_test", true, 0, util.NativeFormat); err != nil {
     t.assert.Errorf("build log reader failed %s", err.Error())
   }
   t.reading = false
@@ -139,11 +143,11 @@ func (t *LogTest) WriteInitialOffsetLog() {
   }
 }
 
-func (t *LogTest) CheckOffsetPastEndReturnsNoRecords(offsetPastEnd uint32) {
+func (t *LogTest) CheckOffsetPastEndReturnsNoRecords(offsetPastEnd uint64) {
   t.WriteInitialOffsetLog()
   t.reading = true
   var err error
-  t.reader, err = NewReader("/tmp/log_test", true, uint32(t.writtenBytes) + offsetPastEnd)
+  t.reader, err = NewReader("/tmp/log_test", true, uint64(t.writtenBytes) + offsetPastEnd, util.NativeFormat)
 
   if err != nil {
     t.assert.Errorf("create past end log reader failed %s", err.Error())
@@ -154,12 +158,12 @@ func (t *LogTest) CheckOffsetPastEndReturnsNoRecords(offsetPastEnd uint32) {
   }
 }
 
-func (t *LogTest) CheckInitialOffsetRecord(initialOffset uint32, expected uint32) {
+func (t *LogTest) CheckInitialOffsetRecord(initialOffset uint64, expected uint32) {
   t.WriteInitialOffsetLog()
   t.reader.Close()
   t.reader = nil
   var err error
-  t.reader, err = NewReader("/tmp/log_test", true, initialOffset)
+  t.reader, err = NewReader("/tmp/log_test", true, initialOffset, util.NativeFormat)
   msg, err := t.reader.Read()
 
   if err != nil {
@@ -432,3 +436,32 @@ func wrapper(t *testing.T, exmain func(*LogTest)) {
   test.reader.Close()
   os.Remove("/tmp/log_test")
 }
+
+// A record written past 4GB, after a hole in the file, is read from
+// its offset
+func TestLargeOffset(t *testing.T) {
+  var offset uint64 = 1 << 32 + 2 * BlockSize
+  os.Remove("/tmp/log_test_large")
+  if file, err := os.Create("/tmp/log_test_large"); err != nil {
+    t.Fatalf("create log file failed %v", err)
+  } else if err := file.Truncate(int64(offset)); err != nil {
+    file.Close()
+    t.Skipf("file system has no sparse files %v", err)
+  } else {
+    file.Close()
+  }
+  defer os.Remove("/tmp/log_test_large")
+
+  writer, _ := NewWriter("/tmp/log_test_large", util.NativeFormat)
+  writer.AddRecord([]byte("foo"))
+  writer.Close()
+
+  reader, err := NewReader("/tmp/log_test_large", true, offset, util.NativeFormat)
+  if err != nil {
+    t.Fatalf("build log reader failed %v", err)
+  }
+  defer reader.Close()
+  if msg, err := reader.Read(); err != nil || string(msg) != "foo" {
+    t.Errorf("read record past 4GB returns %s %v", msg, err)
+  }
+}
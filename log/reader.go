@@ -4,7 +4,6 @@ import (
   "os"
   "errors"
   "bytes"
-  "hash/crc32"
   "encoding/binary"
 )
 
@@ -13,9 +12,12 @@ type Reader interface {
   Close() error
 }
 
-func NewReader(filename string, check bool, initOffset uint32) (Reader, error) {
+// Return a reader of the records in format, util.NativeFormat or
+// util.LevelDBFormat, of the file filename starting at initOffset.  The
+// checksums of the records are verified if check is set.
+func NewReader(filename string, check bool, initOffset uint64, format int) (Reader, error) {
   reader := new(ReaderImpl)
-  if err := reader.init(filename, check, initOffset); err != nil {
+  if err := reader.init(filename, check, initOffset, format); err != nil {
     return nil, err
   } else {
     return reader, nil
@@ -24,20 +26,22 @@ func NewReader(filename string, check bool, initOffset uint32) (Reader, error) {
 
 type ReaderImpl struct {
   check bool
+  format int
   file *os.File
   store  []byte
   buffer []byte
-  bufferEndOffset uint32
+  bufferEndOffset uint64
 
-  initOffset   uint32
-  lastRecordOffset uint32
+  initOffset   uint64
+  lastRecordOffset uint64
 }
 
-func (r *ReaderImpl) init(filename string, check bool, initOffset uint32) error {
+func (r *ReaderImpl) init(filename string, check bool, initOffset uint64, format int) error {
   if file, err := os.OpenFile(filename, os.O_RDONLY, 0); err != nil {
     return err
   } else {
     r.file = file
+    r.format = format
     r.initOffset = initOffset
     r.lastRecordOffset = 0
     r.store = make([]byte, BlockSize)
@@ -66,7 +70,7 @@ func (r *ReaderImpl) Read() ([]byte, error) {
     }
 
     if rtype == FullType {
-      r.lastRecordOffset = r.bufferEndOffset - uint32(len(r.buffer))
+      r.lastRecordOffset = r.bufferEndOffset - uint64(len(r.buffer))
       rslt.Write(data)
       break
     }
@@ -94,12 +98,12 @@ func (r *ReaderImpl) Read() ([]byte, error) {
 func (r *ReaderImpl) readPartialRecord() (uint8, []byte, error) {
   if len(r.buffer) < HeaderSize {
     if cnt, err := r.file.Read(r.store); err != nil {
-      r.bufferEndOffset += uint32(cnt)
+      r.bufferEndOffset += uint64(cnt)
       r.buffer = make([]byte, 0)
       return 0, nil, err
     } else {
       r.buffer = r.store[:cnt]
-      r.bufferEndOffset += uint32(cnt)
+      r.bufferEndOffset += uint64(cnt)
     }
   }
 
@@ -118,14 +122,14 @@ func (r *ReaderImpl) readPartialRecord() (uint8, []byte, error) {
   }
 
   if r.check {
-    calcSum := crc32.ChecksumIEEE(r.buffer[HeaderSize:HeaderSize + length])
+    calcSum := checksum(rtype, r.buffer[HeaderSize:HeaderSize + length], r.format)
     if calcSum != checkSum {
       r.buffer = make([]byte, 0)
       return 0, nil, errors.New("crc32 check failed")
     }
   }
 
-  if r.bufferEndOffset - uint32(len(r.buffer)) < r.initOffset {
+  if r.bufferEndOffset - uint64(len(r.buffer)) < r.initOffset {
     r.buffer = r.buffer[HeaderSize + length : ]
     return BadRecord, nil, nil
   }
@@ -157,6 +161,6 @@ func (r *ReaderImpl) Close() error {
   return r.file.Close()
 }
 
-func (r *ReaderImpl) LastRecordOffset() uint32 {
+func (r *ReaderImpl) LastRecordOffset() uint64 {
   return r.lastRecordOffset
 }
\ No newline at end of file
@@ -2,7 +2,6 @@ package log
 
 import (
   "os"
-  "hash/crc32"
   "encoding/binary"
 )
 
@@ -15,22 +14,26 @@ type WriterImpl struct {
   file *os.File
   headBuffer []byte
   blockOffset uint32
+  format int
 }
 
-func NewWriter(filename string) (Writer, error) {
+// Return a writer of records to the new file filename in format,
+// util.NativeFormat or util.LevelDBFormat
+func NewWriter(filename string, format int) (Writer, error) {
   writer := new(WriterImpl)
-  if err := writer.init(filename); err != nil {
+  if err := writer.init(filename, format); err != nil {
     return nil, err
   } else {
     return writer, nil
   }
 }
 
-func (w *WriterImpl) init(filename string) error {
+func (w *WriterImpl) init(filename string, format int) error {
   if file, err := os.OpenFile(filename, os.O_APPEND | os.O_WRONLY | os.O_CREATE, 0660); err != nil {
     return err
   } else {
     w.file = file
+    w.format = format
     w.blockOffset = 0
     w.headBuffer = make([]byte, HeaderSize)
     w.clearHeader()
@@ -84,7 +87,7 @@ func (w *WriterImpl) emitPhysicalRecord(data []byte, rtype uint8, dataOffset , l
 }
 
 func (w *WriterImpl) writeHeader(data []byte, length uint16, rtype byte) {
-  checkSum := crc32.ChecksumIEEE(data)
+  checkSum := checksum(rtype, data, w.format)
   binary.LittleEndian.PutUint32(w.headBuffer, checkSum)
   binary.LittleEndian.PutUint16(w.headBuffer[4:], length)
   w.headBuffer[HeaderSize - 1] = rtype
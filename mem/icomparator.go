@@ -53,15 +53,30 @@ func (i *InternalKeyComparator) FindShortestSep(ikey1, ikey2 interface{}) interf
   ukey2 := util.ExtractUserKey(ikey2.([]byte))
   rslt := i.cmp.FindShortestSep(ukey1, ukey2).([]byte)
   if len(rslt) < len(ukey1) && i.cmp.Compare(ukey1, rslt) < 0 {
-    store := make([]byte, 8)
-    binary.LittleEndian.PutUint64(store,
-        util.PackSeqAndType(util.Global.MaxSeq, SeekType))
-    rslt = append(rslt, store...)
-    return rslt
+    return i.separatorKey(rslt)
   }
   return ikey1
 }
 
+// FindShortSuccessor finds a short key no smaller than ikey
+func (i *InternalKeyComparator) FindShortSuccessor(ikey interface{}) interface{} {
+  ukey := util.ExtractUserKey(ikey.([]byte))
+  rslt := i.cmp.FindShortSuccessor(ukey).([]byte)
+  if len(rslt) < len(ukey) && i.cmp.Compare(ukey, rslt) < 0 {
+    return i.separatorKey(rslt)
+  }
+  return ikey
+}
+
+// Return a copy of the user key ukey with the max sequence, which sorts
+// before every entry of ukey whatever the type is.  The value type is
+// used, as LevelDB does.
+func (i *InternalKeyComparator) separatorKey(ukey []byte) []byte {
+  store := make([]byte, 8)
+  binary.LittleEndian.PutUint64(store, util.PackSeqAndType(util.Global.MaxSeq, ValueType))
+  return append(append([]byte{}, ukey...), store...)
+}
+
 // MemtableKeyComparator is used to compare memtable entry key
 type MemtableKeyComparator struct {
   icmp util.Comparator
@@ -87,6 +102,11 @@ func (m *MemtableKeyComparator) FindShortestSep(ikey1, ikey2 interface{}) interf
   return ikey1
 }
 
+// FindShortSuccessor returns ikey as it is
+func (m *MemtableKeyComparator) FindShortSuccessor(ikey interface{}) interface{} {
+  return ikey
+}
+
 func (m *MemtableKeyComparator) Name() string {
   return "memtable_key_comparator"
 }
@@ -0,0 +1,42 @@
+package mem
+
+import "github.com/jellybean4/goleveldb/filter"
+
+import "github.com/jellybean4/goleveldb/util"
+
+// InternalFilterPolicy filters internal keys by their user keys, so
+// that a lookup matches the entries of its key whatever their sequence
+type InternalFilterPolicy struct {
+  policy filter.Policy
+}
+
+// NewInternalFilterPolicy returns a new InternalFilterPolicy
+func NewInternalFilterPolicy(policy filter.Policy) *InternalFilterPolicy {
+  ipolicy := new(InternalFilterPolicy)
+  ipolicy.policy = policy
+  return ipolicy
+}
+
+// Name is the one of the user policy, as LevelDB names its filters
+func (i *InternalFilterPolicy) Name() string {
+  return i.policy.Name()
+}
+
+// CreateFilter returns the filter of the user keys of keys
+func (i *InternalFilterPolicy) CreateFilter(keys [][]byte) []byte {
+  ukeys := make([][]byte, len(keys))
+  for j, key := range keys {
+    ukeys[j] = util.ExtractUserKey(key)
+  }
+  return i.policy.CreateFilter(ukeys)
+}
+
+// KeyMayMatch returns true if the user key of key may be in filter
+func (i *InternalFilterPolicy) KeyMayMatch(key []byte, filter []byte) bool {
+  return i.policy.KeyMayMatch(util.ExtractUserKey(key), filter)
+}
+
+// UserPolicy returns internal user policy
+func (i *InternalFilterPolicy) UserPolicy() filter.Policy {
+  return i.policy
+}
@@ -68,11 +68,25 @@ type Memtable interface {
 
   Get(key util.LookupKey) []byte
 
+  // Return the newest entry for the user key of key whose sequence is
+  // not larger than the one of key, nil if there is none
+  Lookup(key util.LookupKey) *MemEntry
+
+  // Return the range tombstones added to the memtable, which are kept
+  // apart from the entries returned by NewIterator and Lookup
+  RangeTombstones() RangeTombstones
+
   DumpData() []MemEntry
 }
 
+// Types of the entries, SeekType must stay the largest one so that a
+// lookup key sorts before every entry with the same user key and seq.
 const (
   ValueType = iota
   DeleteType
+  TTLValueType   // value prefixed with the unix time it expires at
+  MergeType      // operand for the merge operator of the db
+  RangeDeleteType   // key is the start of the deleted range, value its end
+  SingleDeleteType  // deletes the single put right below it
   SeekType
 )
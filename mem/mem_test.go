@@ -5,6 +5,7 @@ import (
   "testing"
   "fmt"
   "sort"
+  "github.com/jellybean4/goleveldb/filter"
   "github.com/jellybean4/goleveldb/util"
 )
 
@@ -105,3 +106,40 @@ func TestMem(t *testing.T) {
     }
   }
 }
+
+func TestInternalFilterPolicy(t *testing.T) {
+  policy := NewInternalFilterPolicy(filter.NewBloomPolicy(10))
+  if policy.Name() != policy.UserPolicy().Name() {
+    t.Errorf("internal policy named %s", policy.Name())
+  }
+
+  // several versions of every key
+  var keys [][]byte
+  for i := 0; i < 100; i++ {
+    for seq := uint64(1); seq <= 3; seq++ {
+      key := []byte(fmt.Sprintf("key%d", i))
+      keys = append(keys, util.NewInternalKey(key, uint64(i) * 10 + seq, ValueType).Encode())
+    }
+  }
+  data := policy.CreateFilter(keys)
+
+  for i := 0; i < 100; i++ {
+    key := []byte(fmt.Sprintf("key%d", i))
+    for _, seq := range []uint64{0, uint64(i) * 10 + 2, util.Global.MaxSeq} {
+      if !policy.KeyMayMatch(util.NewInternalKey(key, seq, SeekType).Encode(), data) {
+        t.Errorf("lookup of key %s at %d not match", key, seq)
+      }
+    }
+  }
+
+  matched := 0
+  for i := 0; i < 1000; i++ {
+    key := util.NewInternalKey([]byte(fmt.Sprintf("missing%d", i)), 5, SeekType).Encode()
+    if policy.KeyMayMatch(key, data) {
+      matched++
+    }
+  }
+  if matched > 50 {
+    t.Errorf("%d missing keys of 1000 match", matched)
+  }
+}
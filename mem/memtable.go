@@ -19,6 +19,7 @@ func NewMemtable(cmp util.Comparator) Memtable {
 
 type memImpl struct {
   list Skiplist
+  rangeDels Skiplist   // entries of RangeDeleteType
   cmp  util.Comparator
   written int
 }
@@ -26,6 +27,7 @@ type memImpl struct {
 func (m *memImpl) init(cmp util.Comparator) {
   m.cmp = cmp
   m.list = NewSkiplist(NewMemtableKeyComparator(cmp))
+  m.rangeDels = NewSkiplist(NewMemtableKeyComparator(cmp))
   m.written = 0
 }
 
@@ -59,11 +61,22 @@ func (m *memImpl) Add(seq uint64, rtype byte, key, value []byte) {
   buffer.Write(value)
 
   node := buffer.Bytes()
-  m.list.Insert(node)
+  if rtype == RangeDeleteType {
+    m.rangeDels.Insert(node)
+  } else {
+    m.list.Insert(node)
+  }
   m.written += len(node)
 }
 
 func (m *memImpl) Get(key util.LookupKey) []byte {
+  if entry := m.Lookup(key); entry != nil && entry.Rtype == ValueType {
+    return entry.Val
+  }
+  return nil
+}
+
+func (m *memImpl) Lookup(key util.LookupKey) *MemEntry {
   sKey := key.MemtableKey()
   iter := m.list.NewIterator()
   iter.Seek(sKey)
@@ -72,25 +85,32 @@ func (m *memImpl) Get(key util.LookupKey) []byte {
     return nil
   }
 
-  offset := 0
-  entry := iter.Key().([]byte)
-  entryKey, _ := util.GetLenPrefixBytes(entry)
-  offset = len(entryKey) + 4
-  if util.BinaryCompare(entry[4 : offset - 8], key.UserKey()) != 0 {
+  ikey, val := decodeEntry(iter.Key().([]byte))
+  ucmp := m.cmp.(*InternalKeyComparator).UserComparator()
+  if ucmp.Compare(ikey[ : len(ikey) - 8], key.UserKey()) != 0 {
     return nil
   }
 
-  rtype := binary.LittleEndian.Uint64(entry[offset - 8:]) & 0xFF
-  switch rtype {
-  case ValueType:
-    val, _ := util.GetLenPrefixBytes(entry[offset : ])
-    return val
-  case DeleteType:
-    return nil
+  seq := binary.LittleEndian.Uint64(ikey[len(ikey) - 8 : ])
+  return &MemEntry{
+    Key : ikey[ : len(ikey) - 8],
+    Val : val,
+    Seq : seq >> 8,
+    Rtype : byte(seq & 0xFF),
   }
-  return nil
 }
 
+func (m *memImpl) RangeTombstones() RangeTombstones {
+  rslt := RangeTombstones{}
+  iter := new(memIterator)
+  iter.init(m.rangeDels)
+  for iter.SeekToFirst(); iter.Valid(); iter.Next() {
+    if t, err := DecodeRangeTombstone(iter.Key().([]byte), iter.Value().([]byte)); err == nil {
+      rslt = append(rslt, t)
+    }
+  }
+  return rslt
+}
 
 func (m *memImpl) DumpData() []MemEntry {
   iter := m.NewIterator()
@@ -0,0 +1,77 @@
+package mem
+
+import (
+  "errors"
+)
+
+import (
+  "github.com/jellybean4/goleveldb/util"
+)
+
+// RangeTombstone deletes every user key within [Start, End) written
+// before Seq.  It is stored as the entry with the internal key
+// (Start, Seq, RangeDeleteType) and the value End.
+type RangeTombstone struct {
+  Start []byte
+  End   []byte
+  Seq   uint64
+}
+
+// Return the internal key the tombstone is stored under
+func (t *RangeTombstone) Key() []byte {
+  return util.NewInternalKey(t.Start, t.Seq, RangeDeleteType).Encode()
+}
+
+// Return the tombstone stored as key -> value
+func DecodeRangeTombstone(key, value []byte) (*RangeTombstone, error) {
+  ikey := new(util.ParsedInternalKey)
+  if err := ikey.Decode(key); err != nil {
+    return nil, err
+  }
+
+  if ikey.Rtype != RangeDeleteType {
+    return nil, errors.New("not a range tombstone")
+  }
+  return &RangeTombstone{ikey.Key, value, ikey.Seq}, nil
+}
+
+// RangeTombstones is a set of range tombstones in no particular order
+type RangeTombstones []*RangeTombstone
+
+// Return the largest sequence not larger than seq of the tombstones
+// covering key, 0 if there is none.  An entry of key with a smaller
+// sequence is deleted for a read at seq.
+func (r RangeTombstones) MaxCoveringSeq(ucmp util.Comparator, key []byte, seq uint64) uint64 {
+  var rslt uint64 = 0
+  for _, t := range r {
+    if t.Seq > seq || t.Seq <= rslt {
+      continue
+    }
+
+    if ucmp.Compare(t.Start, key) <= 0 && ucmp.Compare(key, t.End) < 0 {
+      rslt = t.Seq
+    }
+  }
+  return rslt
+}
+
+// Return the parts of the tombstones within [lower, upper), a nil bound
+// leaves that side open
+func (r RangeTombstones) Clip(ucmp util.Comparator, lower, upper []byte) RangeTombstones {
+  rslt := RangeTombstones{}
+  for _, t := range r {
+    start, end := t.Start, t.End
+    if lower != nil && ucmp.Compare(start, lower) < 0 {
+      start = lower
+    }
+
+    if upper != nil && ucmp.Compare(end, upper) > 0 {
+      end = upper
+    }
+
+    if ucmp.Compare(start, end) < 0 {
+      rslt = append(rslt, &RangeTombstone{start, end, t.Seq})
+    }
+  }
+  return rslt
+}
@@ -27,6 +27,10 @@ func (k Key) FindShortestSep(a, b interface{}) interface{} {
   return a
 }
 
+func (k Key) FindShortSuccessor(a interface{}) interface{} {
+  return a
+}
+
 func (k Key) Name() string {
   return "tmp"
 }
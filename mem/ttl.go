@@ -0,0 +1,30 @@
+package mem
+
+import (
+  "errors"
+  "encoding/binary"
+)
+
+// Format of a TTLValueType value is concatenation of:
+// expiry     : int64 unix time the value expires at
+// value bytes: [len(value)]byte
+func EncodeTTLValue(value []byte, expiry int64) []byte {
+  rslt := make([]byte, 8 + len(value))
+  binary.LittleEndian.PutUint64(rslt, uint64(expiry))
+  copy(rslt[8:], value)
+  return rslt
+}
+
+// Split a TTLValueType value into the user value and its expiry
+func DecodeTTLValue(data []byte) ([]byte, int64, error) {
+  if len(data) < 8 {
+    return nil, 0, errors.New("bad ttl value format")
+  }
+  expiry := int64(binary.LittleEndian.Uint64(data))
+  return data[8:], expiry, nil
+}
+
+// Returns true iff a value expiring at expiry is gone at unix time now
+func TTLExpired(expiry, now int64) bool {
+  return now >= expiry
+}
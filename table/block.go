@@ -3,6 +3,7 @@ package table
 import (
   "bytes"
   "errors"
+  "hash/fnv"
   "encoding/binary"
 )
 
@@ -28,12 +29,29 @@ import (
 //     value_length: varint32
 //     key_delta: char[unshared_bytes]
 //     value: char[value_length]
+// in the LevelDB format, the native format stores the three lengths
+// as fixed uint32 instead:
+//     shared_bytes: uint32
+//     unshared_bytes: uint32
+//     value_length: uint32
+//     key_delta: char[unshared_bytes]
+//     value: char[value_length]
 // shared_bytes == 0 for restart points.
 //
 // The trailer of the block has the form:
 //     restarts: uint32[num_restarts]
 //     num_restarts: uint32
 // restarts[i] contains the offset within the block of the ith restart point.
+//
+// Native blocks may carry a hash index between the restart array and
+// num_restarts, whose highest bit is set if it does:
+//     restarts: uint32[num_restarts]
+//     buckets: uint8[num_buckets]
+//     num_buckets: uint16
+//     num_restarts: uint32
+// buckets[hash(user_key) % num_buckets] is the index of the restart
+// interval holding the user key, hashEmpty if no key hashes to it and
+// hashCollision if keys of several intervals do.
 type BlockBuilder interface {
 
   // Reset all data within the builder
@@ -52,23 +70,53 @@ type BlockBuilder interface {
   Empty() bool
 }
 
+// Values of the buckets of a hash index which are not restart intervals
+const (
+  hashCollision = 254
+  hashEmpty     = 255
+  maxHashRestarts = hashCollision   // blocks with more restarts have no index
+  maxHashBuckets  = 1 << 16 - 1
+  hashIndexFlag   = 1 << 31
+)
+
 type blockBuilderImpl struct {
   restart  []int
   entryCnt int
   bytes    int
   lastKey  []byte
   interval int
+  format   int
   buffer   bytes.Buffer
+  hashRatio float64   // keys per bucket of the hash index, 0 for none
+  internal  bool      // keys are internal keys, hashed by their user keys
+  hashes    []uint32  // hashes of the keys added
+  intervals []int     // restart intervals of the keys hashed
 }
 
-func NewBlockBuilder(interval int) BlockBuilder {
+// Return a builder of blocks in format, util.NativeFormat or
+// util.LevelDBFormat, with a restart point every interval keys
+func NewBlockBuilder(interval int, format int) BlockBuilder {
   builder := new(blockBuilderImpl)
-  builder.init(interval)
+  builder.init(interval, format)
   return builder
 }
 
-func (b *blockBuilderImpl) init(interval int) {
+// Return a builder of blocks like NewBlockBuilder, native blocks have a
+// hash index of about ratio keys per bucket.  Keys are internal keys if
+// internal is set.
+func NewHashBlockBuilder(interval int, format int, ratio float64, internal bool) BlockBuilder {
+  builder := new(blockBuilderImpl)
+  builder.init(interval, format)
+  if format != util.LevelDBFormat && ratio > 0 {
+    builder.hashRatio = ratio
+    builder.internal = internal
+  }
+  return builder
+}
+
+func (b *blockBuilderImpl) init(interval int, format int) {
   b.interval = interval
+  b.format = format
   b.entryCnt = 0
   b.bytes    = 0
   b.restart = []int{0}
@@ -80,6 +128,8 @@ func (b *blockBuilderImpl) Reset() {
   b.bytes    = 0
   b.restart = []int{0}
   b.lastKey = []byte{}
+  b.hashes = nil
+  b.intervals = nil
   b.buffer.Reset()
 }
 
@@ -89,13 +139,54 @@ func (b *blockBuilderImpl) Finish() []byte {
     binary.LittleEndian.PutUint32(store, uint32(p))
     b.buffer.Write(store)
   }
-  binary.LittleEndian.PutUint32(store, uint32(len(b.restart)))
+  cnt := uint32(len(b.restart))
+  if buckets := b.hashBuckets(); buckets > 0 {
+    b.writeHashIndex(buckets)
+    cnt |= hashIndexFlag
+  }
+  binary.LittleEndian.PutUint32(store, cnt)
   b.buffer.Write(store)
   return b.buffer.Bytes()
 }
 
 func (b *blockBuilderImpl) CurrentSizeEstimate() int {
-  return b.bytes + 4 * len(b.restart) + 4
+  size := b.bytes + 4 * len(b.restart) + 4
+  if buckets := b.hashBuckets(); buckets > 0 {
+    size += buckets + 2
+  }
+  return size
+}
+
+// Return the number of buckets of the hash index, 0 if the block has
+// no index
+func (b *blockBuilderImpl) hashBuckets() int {
+  if b.hashRatio <= 0 || len(b.hashes) == 0 || len(b.restart) > maxHashRestarts {
+    return 0
+  }
+  buckets := int(float64(len(b.hashes)) / b.hashRatio) + 1
+  if buckets > maxHashBuckets {
+    buckets = maxHashBuckets
+  }
+  return buckets
+}
+
+func (b *blockBuilderImpl) writeHashIndex(num int) {
+  buckets := make([]byte, num)
+  for i := range buckets {
+    buckets[i] = hashEmpty
+  }
+  for i, h := range b.hashes {
+    bucket := &buckets[h % uint32(num)]
+    if *bucket == hashEmpty {
+      *bucket = byte(b.intervals[i])
+    } else if *bucket != byte(b.intervals[i]) {
+      *bucket = hashCollision
+    }
+  }
+  b.buffer.Write(buckets)
+  store := make([]byte, 2)
+  binary.LittleEndian.PutUint16(store, uint16(num))
+  b.buffer.Write(store)
 }
 
 func (b *blockBuilderImpl) Empty() bool {
@@ -108,19 +199,57 @@ func (b *blockBuilderImpl) Add(key, value []byte) {
     b.lastKey = []byte{}
     b.restart = append(b.restart, b.bytes)
   }
+  if b.hashRatio > 0 {
+    b.addHash(key)
+  }
   
   b.lastKey, key = key, b.cutCommonPrefix(key)
-  header := make([]byte, 3 * 4)
-  binary.LittleEndian.PutUint32(header, uint32(len(b.lastKey) - len(key)))
-  binary.LittleEndian.PutUint32(header[4:], uint32(len(key)))
-  binary.LittleEndian.PutUint32(header[8:], uint32(len(value)))
+  header := b.entryHeader(len(b.lastKey) - len(key), len(key), len(value))
   b.buffer.Write(header)
   b.buffer.Write(key)
   b.buffer.Write(value)
-  b.bytes += 3 * 4 + len(key) + len(value)
+  b.bytes += len(header) + len(key) + len(value)
   b.entryCnt++
 }
 
+// Record the hash of the user key of key, the versions of a user key
+// following each other in an interval are hashed once
+func (b *blockBuilderImpl) addHash(key []byte) {
+  if b.internal {
+    key = util.ExtractUserKey(key)
+  }
+  h, interval := blockHash(key), len(b.restart) - 1
+  last := len(b.hashes) - 1
+  if last >= 0 && b.hashes[last] == h && b.intervals[last] == interval {
+    return
+  }
+  b.hashes = append(b.hashes, h)
+  b.intervals = append(b.intervals, interval)
+}
+
+// Return the hash of the user key key in the hash index of a block
+func blockHash(key []byte) uint32 {
+  h := fnv.New32a()
+  h.Write(key)
+  return h.Sum32()
+}
+
+func (b *blockBuilderImpl) entryHeader(shared, unshared, valLen int) []byte {
+  if b.format != util.LevelDBFormat {
+    header := make([]byte, 3 * 4)
+    binary.LittleEndian.PutUint32(header, uint32(shared))
+    binary.LittleEndian.PutUint32(header[4:], uint32(unshared))
+    binary.LittleEndian.PutUint32(header[8:], uint32(valLen))
+    return header
+  }
+
+  header := make([]byte, 3 * binary.MaxVarintLen32)
+  n := binary.PutUvarint(header, uint64(shared))
+  n += binary.PutUvarint(header[n:], uint64(unshared))
+  n += binary.PutUvarint(header[n:], uint64(valLen))
+  return header[:n]
+}
+
 func (b *blockBuilderImpl) cutCommonPrefix(key []byte) []byte {
   var minLen int
   if len(key) < len(b.lastKey) {
@@ -150,21 +279,44 @@ type blockImpl struct {
   content []byte
   restart []int
   limit   int
+  format  int
+  buckets []byte   // the hash index, nil if the block has none
 }
 
-func NewBlock(content []byte) Block {
+// Return the block stored as content in format, nil if content is not
+// a block
+func NewBlock(content []byte, format int) Block {
   block := new(blockImpl)
-  if err := block.init(content); err != nil {
+  if err := block.init(content, format); err != nil {
     return nil
   }
   return block
 }
 
-func (b *blockImpl) init(content []byte) error {
+func (b *blockImpl) init(content []byte, format int) error {
   b.content = content
+  b.format = format
 
   size := len(content)
-  cnt := int(binary.LittleEndian.Uint32(content[size - 4 : ]))
+  if size < 4 {
+    return errors.New("content too small to be decode")
+  }
+  raw := binary.LittleEndian.Uint32(content[size - 4 : ])
+  cnt := int(raw &^ hashIndexFlag)
+
+  if format == util.LevelDBFormat {
+    cnt = int(raw)
+  } else if raw & hashIndexFlag != 0 {
+    if size < 6 {
+      return errors.New("content too small to be decode")
+    }
+    num := int(binary.LittleEndian.Uint16(content[size - 6 : ]))
+    if num == 0 || size < num + 6 {
+      return errors.New("content too small to be decode")
+    }
+    b.buckets = content[size - 6 - num : size - 6]
+    size -= num + 2
+  }
 
   if size < (cnt + 1) * 4 {
     return errors.New("content too small to be decode")
@@ -201,6 +353,7 @@ type blockIterImpl struct {
 }
 
 type blockEntry struct {
+  header   int   // size of the lengths ahead of the key
   shared   int
   unshared int
   partial  []byte
@@ -212,7 +365,7 @@ func (b *blockEntry) size() int {
   if b.partial == nil || b.value == nil {
     return 0
   }
-  return 4 * 3 + len(b.partial) + len(b.value)
+  return b.header + len(b.partial) + len(b.value)
 }
 
 func newBlockIterator(b *blockImpl, cmp util.Comparator) mem.Iterator {
@@ -300,8 +453,13 @@ func (b *blockIterImpl) Seek(key interface{}) {
       left = mid
     }
   }
-  
-  b.offset, b.entry = b.block.restart[left], nil
+  b.seekFrom(left, skey)
+}
+
+// Position at the first key not less than skey, scanning from the
+// restart point at index restart
+func (b *blockIterImpl) seekFrom(restart int, skey []byte) {
+  b.offset, b.entry = b.block.restart[restart], nil
   last := []byte{}
   for true {
     if err := b.decodeNextEntry(last); err != nil {
@@ -316,6 +474,29 @@ func (b *blockIterImpl) Seek(key interface{}) {
   }
 }
 
+// Position at the first key not less than key within the restart
+// interval the hash index maps the user key ukey to, the iterator is
+// invalid if the index proves ukey is not in the block.  The key found
+// is the one Seek finds only if its user key is ukey.  Returns false
+// if the index can't tell, for there is no index or its bucket holds
+// several intervals.
+func (b *blockIterImpl) hashSeek(key, ukey []byte) bool {
+  if b.block.buckets == nil {
+    return false
+  }
+  bucket := b.block.buckets[blockHash(ukey) % uint32(len(b.block.buckets))]
+  if bucket == hashCollision {
+    return false
+  } else if bucket == hashEmpty {
+    b.offset, b.entry = -1, nil
+    return true
+  } else if int(bucket) >= len(b.block.restart) {
+    return false
+  }
+  b.seekFrom(int(bucket), key)
+  return true
+}
+
 func (b *blockIterImpl) SeekToFirst() {
   b.offset, b.entry = 0, nil
   b.decodeNextEntry([]byte{})
@@ -338,16 +519,34 @@ func (b *blockIterImpl) nextEntryOffset() int {
 }
 
 func (b *blockIterImpl) decodeEntry(offset int, entry *blockEntry, last []byte) error {
-  data := b.block.content[offset:]
-  entry.shared = int(binary.LittleEndian.Uint32(data))
-  data = data[4:]
-
-  entry.unshared = int(binary.LittleEndian.Uint32(data))
-  data = data[4:]
-
-  valLen := int(binary.LittleEndian.Uint32(data))
-  data = data[4:]
+  data := b.block.content[offset : b.block.limit]
+  var lens [3]int
+  for i := range lens {
+    if b.block.format != util.LevelDBFormat {
+      if len(data) < 4 {
+        b.entry = nil
+        return errors.New("bad block format")
+      }
+      lens[i] = int(binary.LittleEndian.Uint32(data))
+      data = data[4:]
+    } else {
+      val, n := binary.Uvarint(data)
+      if n <= 0 {
+        b.entry = nil
+        return errors.New("bad block format")
+      }
+      lens[i] = int(val)
+      data = data[n:]
+    }
+  }
+  entry.shared, entry.unshared = lens[0], lens[1]
+  valLen := lens[2]
+  entry.header = b.block.limit - offset - len(data)
 
+  if entry.unshared < 0 || valLen < 0 || entry.unshared + valLen > len(data) {
+    b.entry = nil
+    return errors.New("bad block format")
+  }
   entry.partial =  data[:entry.unshared]
   data = data[entry.unshared:]
 
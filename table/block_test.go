@@ -11,7 +11,13 @@ import (
 )
 
 func TestBlock(t *testing.T) {
-  builder := NewBlockBuilder(16)
+  for _, format := range []int{util.NativeFormat, util.LevelDBFormat} {
+    testBlock(t, format)
+  }
+}
+
+func testBlock(t *testing.T, format int) {
+  builder := NewBlockBuilder(16, format)
   keys := make([]string, 1000)
   vals := make([]string, 1000)
   for i := 0; i < 1000; i++ {
@@ -58,7 +64,7 @@ func TestBlock(t *testing.T) {
     }
   }
 
-  reader := NewBlock(rslt)
+  reader := NewBlock(rslt, format)
   if reader.Size() != size {
     t.Errorf("reader size not the same with precalc size %d %d", reader.Size(), size)
   }
@@ -142,3 +148,63 @@ func TestBlock(t *testing.T) {
     }
   }
 }
+
+func TestHashBlock(t *testing.T) {
+  for _, format := range []int{util.NativeFormat, util.LevelDBFormat} {
+    builder := NewHashBlockBuilder(16, format, 0.25, false)
+    for i := 0; i < 1000; i++ {
+      builder.Add([]byte(fmt.Sprintf("key%04d", i)), []byte(fmt.Sprintf("val%04d", i)))
+    }
+    size := builder.CurrentSizeEstimate()
+    content := builder.Finish()
+    if size != len(content) {
+      t.Errorf("format %d precalc size not the same with real size %d %d", format, size, len(content))
+    }
+
+    block := NewBlock(content, format).(*blockImpl)
+    if (block.buckets != nil) != (format == util.NativeFormat) {
+      t.Errorf("format %d block hash index %v", format, block.buckets)
+    }
+
+    iter := block.NewIterator(util.BinaryComparator).(*blockIterImpl)
+    cnt := 0
+    for iter.SeekToFirst(); iter.Valid(); iter.Next() {
+      if string(iter.Key().([]byte)) != fmt.Sprintf("key%04d", cnt) {
+        t.Errorf("format %d iter key not match %s %d", format, iter.Key().([]byte), cnt)
+      }
+      cnt++
+    }
+    if cnt != 1000 {
+      t.Errorf("format %d iterates %d keys", format, cnt)
+    }
+
+    if format != util.NativeFormat {
+      continue
+    }
+    hashed := 0
+    for i := 0; i < 1000; i++ {
+      key := []byte(fmt.Sprintf("key%04d", i))
+      if !iter.hashSeek(key, key) {
+        iter.Seek(key)
+      } else {
+        hashed++
+      }
+      if !iter.Valid() || string(iter.Key().([]byte)) != string(key) {
+        t.Errorf("could not find %s", key)
+      } else if string(iter.Value().([]byte)) != fmt.Sprintf("val%04d", i) {
+        t.Errorf("seek %s value not match %s", key, iter.Value().([]byte))
+      }
+    }
+    // a quarter of the buckets hold keys, few of them collide
+    if hashed < 700 {
+      t.Errorf("hash index finds %d keys of 1000", hashed)
+    }
+
+    for i := 0; i < 1000; i++ {
+      key := []byte(fmt.Sprintf("key%04dx", i))
+      if iter.hashSeek(key, key) && iter.Valid() && string(iter.Key().([]byte)) == string(key) {
+        t.Errorf("could find %s", key)
+      }
+    }
+  }
+}
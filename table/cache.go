@@ -1,6 +1,8 @@
 package table
 
 import (
+  "os"
+  "sync"
   "container/ring"
 )
 
@@ -12,17 +14,17 @@ import (
 type TableCache interface {
 
   // Find the specified table within cache
-  FindTable(num int, fileSize int) Table
+  FindTable(num int, fileSize int64) Table
   
   // Return an iterator for the specified file number (the corresponding
   // file length must be exactly "file_size" bytes).  If "tableptr" is
   // non-NULL, also sets "*tableptr" to point to the Table object
   // underlying the returned iterator, or NULL if no Table object underlies
   // the returned iterator.
-  NewIterator(num int, fileSize int) (Table, mem.Iterator)
+  NewIterator(num int, fileSize int64) (Table, mem.Iterator)
 
   // If a seek to internal key "k" in specified file finds an entry, return key and value
-  Get(option *util.ReadOption, num, fileSize int, key []byte) ([]byte, []byte)
+  Get(option *util.ReadOption, num int, fileSize int64, key []byte) ([]byte, []byte)
 
   // Evict any entry for the specified file number
   Evict(num int)
@@ -43,6 +45,7 @@ type cacheImpl struct {
   cache   map[int]Table
   head    *ring.Ring
   size    int              // num of data within the cache
+  mutex   sync.Mutex       // background workers share the cache
 }
 
 func (c *cacheImpl) init(dbname string, option *util.Option, entries int) error {
@@ -55,12 +58,19 @@ func (c *cacheImpl) init(dbname string, option *util.Option, entries int) error
   return nil
 }
 
-func (c *cacheImpl) FindTable(num, fileSize int) Table {
+func (c *cacheImpl) FindTable(num int, fileSize int64) Table {
+  c.mutex.Lock()
+  defer c.mutex.Unlock()
+
   if table, ok := c.cache[num]; ok {
     return table
   }
   
   tableName := util.TableFileName(c.dbname, num)
+  if _, err := os.Stat(tableName); os.IsNotExist(err) && c.option.Format == util.LevelDBFormat {
+    // older versions of LevelDB named tables .sst
+    tableName = util.SSTTableFileName(c.dbname, num)
+  }
   table := OpenTable(tableName, fileSize, c.option)
   if table == nil {
     return nil
@@ -75,12 +85,13 @@ func (c *cacheImpl) FindTable(num, fileSize int) Table {
   elem := ring.New(1)
   elem.Value = num
   c.head.Prev().Link(elem)
+  c.cache[num] = table
   c.size++
 
   return table
 }
 
-func (c *cacheImpl) NewIterator(num, fileSize int) (Table, mem.Iterator) {
+func (c *cacheImpl) NewIterator(num int, fileSize int64) (Table, mem.Iterator) {
   if table := c.FindTable(num, fileSize); table == nil {
     return nil, nil
   } else if iter := table.NewIterator(); iter == nil {
@@ -90,26 +101,27 @@ func (c *cacheImpl) NewIterator(num, fileSize int) (Table, mem.Iterator) {
   }
 }
 
-func (c *cacheImpl) Get(option *util.ReadOption, num, fileSize int, key []byte) ([]byte, []byte) {
-  table, iter := c.NewIterator(num, fileSize)
-  if table == nil || iter == nil {
-    return nil, nil
-  }
-  iter.Seek(key)
-  if iter.Valid() {
-    return iter.Key().([]byte), iter.Value().([]byte)
+func (c *cacheImpl) Get(option *util.ReadOption, num int, fileSize int64, key []byte) ([]byte, []byte) {
+  // the table checks its filters before it reads any block
+  if table := c.FindTable(num, fileSize); table != nil {
+    return table.Get(key)
   }
   return nil, nil
 }
 
 func (c *cacheImpl) Evict(num int) {
-  current := c.head.Next()
-  for current != c.head {
-    n := current.Value.(int)
-    if n == num {
-        current.Prev().Unlink(1)
+  c.mutex.Lock()
+  defer c.mutex.Unlock()
+
+  if _, ok := c.cache[num]; !ok {
+    return
+  }
+  // an unlinked element is a ring of its own, stop at the first match
+  for current := c.head.Next(); current != c.head; current = current.Next() {
+    if current.Value.(int) == num {
+      current.Prev().Unlink(1)
+      break
     }
-    current = current.Next()
   }
   delete(c.cache, num)
   c.size--
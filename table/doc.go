@@ -25,7 +25,9 @@
 //order and partitioned into a sequence of data blocks.  These blocks
 //come one after another at the beginning of the file.  Each data block
 //is formatted according to the code in block_builder.cc, and then
-//optionally compressed.
+//optionally compressed.  Native data blocks built with
+//Option.BlockHashRatio end with a hash index of their user keys, as
+//described by BlockBuilder.
 //
 //(2) After the data blocks we store a bunch of meta blocks.  The
 //supported meta block types are described below.  More meta block types
@@ -49,6 +51,13 @@
                                        //// (40==2*BlockHandle::kMaxEncodedLength)
        //magic:            fixed64;    // == 0xdb4775248b80fb57 (little-endian)
 //
+//Native tables put a version between the padding and the magic:
+       //version:          fixed32;    // == 1
+       //magic:            fixed64;    // == 0x57fb808b247547db (little-endian)
+//Older native tables end with a 24 byte footer holding the handles as
+//fixed32 size and offset followed by the LevelDB magic, and their
+//index and metaindex blocks store the handles the same way.
+//
 //"filter" Meta Block
 //-------------------
 //
@@ -90,16 +99,29 @@
 //The offset array at the end of the filter block allows efficient
 //mapping from a data block offset to the corresponding filter.
 //
-//"stats" Meta Block
-//------------------
-//
-//This meta block contains a bunch of stats.  The key is the name
-//of the statistic.  The value contains the statistic.
-//TODO(postrelease): record following stats.
-//  data size
-//  index size
-//  key size (uncompressed)
-//  value size (uncompressed)
-//  number of entries
-//  number of data blocks
+//Native tables may store other layouts of filters instead, chosen by
+//Option.FilterType.  A "fullfilter.<N>" block holds a single filter
+//over all the keys of the table.  A "partitionedfilter.<N>" block is
+//an index over filter partitions, one for each partition of the index:
+//the key of an entry is the last separator of the index partition and
+//the value is the BlockHandle of the filter of its keys.
+//
+//"properties" Meta Block
+//------------------------
+//
+//This meta block contains the properties of the table, sorted by name.
+//The built-in ones are named "table.<N>" and hold varint64 numbers,
+//but for "table.comparator" which holds the name of the comparator:
+//  data-size, index-size, index-partitions, filter-size
+//  num-entries, num-deletions
+//  raw-key-size, raw-value-size
+//  creation-time
+//"table.filter-user-keys" is 1 if the filter holds the user keys of the
+//internal keys of the table, as LevelDB filters do, and is left out
+//otherwise.
+//"table.prefix-extractor" holds the name of the Option.PrefixExtractor
+//whose prefixes the filters hold besides the keys, one for each block
+//a prefix has keys in.
+//The properties of each TablePropertiesCollector are stored under
+//their names prefixed with "user.".
 package table
\ No newline at end of file
@@ -5,62 +5,168 @@ import (
   "encoding/binary"
 )
 
+import (
+  "github.com/jellybean4/goleveldb/util"
+)
+
 type BlockHandler struct {
-  size int
-  offset int 
+  size uint64
+  offset uint64
 }
 
+// Encode the handler as varint64 offset and size, the way both the
+// native format and LevelDB store it
 func EncodeHandler(b *BlockHandler) []byte {
-  store := make([]byte, 8)
-  binary.LittleEndian.PutUint32(store, uint32(b.size))
-  binary.LittleEndian.PutUint32(store[4:], uint32(b.offset))
-  return store
+  store := make([]byte, maxHandlerLength)
+  n := binary.PutUvarint(store, b.offset)
+  n += binary.PutUvarint(store[n:], b.size)
+  return store[:n]
 }
 
+// Decode the handler encoded at the beginning of value, returns nil if
+// value is too short
 func DecodeHandler(value []byte) *BlockHandler {
-  handler := new(BlockHandler)
-  handler.size = int(binary.LittleEndian.Uint32(value))
-  handler.offset = int(binary.LittleEndian.Uint32(value[4:]))
+  handler, _ := decodeHandler(value)
   return handler
 }
 
+// Return the handler encoded at the beginning of value and the rest
+func decodeHandler(value []byte) (*BlockHandler, []byte) {
+  offset, n := binary.Uvarint(value)
+  if n <= 0 {
+    return nil, nil
+  }
+  size, m := binary.Uvarint(value[n:])
+  if m <= 0 {
+    return nil, nil
+  }
+  return &BlockHandler{size, offset}, value[n + m:]
+}
+
+// Return the handler tables of the legacy native footer store at the
+// beginning of value, fixed uint32 size and offset, and the rest
+func decodeLegacyHandler(value []byte) (*BlockHandler, []byte) {
+  if len(value) < 8 {
+    return nil, nil
+  }
+  handler := new(BlockHandler)
+  handler.size = uint64(binary.LittleEndian.Uint32(value))
+  handler.offset = uint64(binary.LittleEndian.Uint32(value[4:]))
+  return handler, value[8:]
+}
+
 const (
+  // magic of LevelDB tables, and of native tables with the legacy footer
   FOOTER_MAGIC = 0xdb4775248b80fb57
+
+  // magic of native tables with a versioned footer
+  NATIVE_FOOTER_MAGIC = 0x57fb808b247547db
+
+  // two varint64 at most
+  maxHandlerLength = 2 * binary.MaxVarintLen64
+
+  // the footers with varint handlers pad them to their longest encoding
+  levelDBFooterSize = 2 * maxHandlerLength + 8
+  nativeFooterSize = 2 * maxHandlerLength + 4 + 8
+  legacyFooterSize = 2 * 8 + 8
+  maxFooterSize = nativeFooterSize
+)
+
+// Versions of the native footer.  The legacy footer holds the handlers
+// as fixed uint32, so do the index and metaindex blocks of its table.
+const (
+  legacyFooterVersion = iota
+  varintFooterVersion
 )
 
 type FooterHandler struct {
   metaindex *BlockHandler
   index     *BlockHandler
   magic     uint64
+  format    int
+  version   int
+}
+
+// Return a footer for a new table in format
+func newFooter(format int) *FooterHandler {
+  return &FooterHandler{format : format, version : varintFooterVersion}
 }
 
 func (footer *FooterHandler) Encode() []byte {
   var buffer bytes.Buffer
   buffer.Write(EncodeHandler(footer.metaindex))
   buffer.Write(EncodeHandler(footer.index))
+  buffer.Write(make([]byte, 2 * maxHandlerLength - buffer.Len()))
 
   store := make([]byte, 8)
-  binary.LittleEndian.PutUint64(store, FOOTER_MAGIC)
+  if footer.format == util.LevelDBFormat {
+    binary.LittleEndian.PutUint64(store, FOOTER_MAGIC)
+  } else {
+    binary.LittleEndian.PutUint32(store, uint32(footer.version))
+    buffer.Write(store[:4])
+    binary.LittleEndian.PutUint64(store, NATIVE_FOOTER_MAGIC)
+  }
   buffer.Write(store)
   return buffer.Bytes()
 }
 
+// Decode the footer at the end of value, which holds the last
+// maxFooterSize bytes of the table or all of a shorter one
 func (footer *FooterHandler) Decode(value []byte) bool {
-  if magic := binary.LittleEndian.Uint64(value[16:]); magic != FOOTER_MAGIC {
+  if len(value) < 8 {
+    return false
+  }
+
+  footer.magic = binary.LittleEndian.Uint64(value[len(value) - 8:])
+  switch {
+  case footer.format == util.LevelDBFormat && footer.magic == FOOTER_MAGIC:
+    footer.version = varintFooterVersion
+  case footer.format == util.LevelDBFormat:
+    return false
+  case footer.magic == FOOTER_MAGIC:
+    footer.version = legacyFooterVersion
+  case footer.magic == NATIVE_FOOTER_MAGIC && len(value) >= nativeFooterSize:
+    footer.version = int(binary.LittleEndian.Uint32(value[len(value) - 12:]))
+    if footer.version != varintFooterVersion {
+      return false
+    }
+  default:
+    return false
+  }
+
+  if len(value) < footer.Size() {
+    return false
+  }
+  value = value[len(value) - footer.Size():]
+
+  var rest []byte
+  if footer.metaindex, rest = footer.decodeHandler(value); footer.metaindex == nil {
+    return false
+  } else if footer.index, _ = footer.decodeHandler(rest); footer.index == nil {
     return false
   }
-  footer.metaindex = DecodeHandler(value)
-  footer.index = DecodeHandler(value[8:])
-  footer.magic = FOOTER_MAGIC
   return true
 }
 
+// Return the handler encoded at the beginning of value in the table of
+// the footer, and the rest
+func (footer *FooterHandler) decodeHandler(value []byte) (*BlockHandler, []byte) {
+  if footer.version == legacyFooterVersion {
+    return decodeLegacyHandler(value)
+  }
+  return decodeHandler(value)
+}
+
 func (footer *FooterHandler) Size() int {
-  return 24
+  if footer.format == util.LevelDBFormat {
+    return levelDBFooterSize
+  } else if footer.version == legacyFooterVersion {
+    return legacyFooterSize
+  }
+  return nativeFooterSize
 }
 
 type entry struct {
   key string
   handler BlockHandler
 }
-
@@ -58,6 +58,7 @@ func (m *mergeIterator) Value() interface{} {
 }
 
 func (m *mergeIterator) Next() {
+  // move all the other children after the current key
   if m.direct != 0 {
     current := m.Key()
     for i := 0; i < len(m.children); i++ {
@@ -74,6 +75,7 @@ func (m *mergeIterator) Next() {
         m.children[i].Next()
       }
     }
+    m.direct = 0
   }
   iter := m.children[m.current]
   iter.Next()
@@ -81,6 +83,7 @@ func (m *mergeIterator) Next() {
 }
 
 func (m *mergeIterator) Prev() {
+  // move all the other children before the current key
   if m.direct != 1 {
     current := m.Key()
     
@@ -89,11 +92,14 @@ func (m *mergeIterator) Prev() {
         continue
       }
       m.children[i].Seek(current)
-      if !m.children[i].Valid() {
-        continue
+      if m.children[i].Valid() {
+        m.children[i].Prev()
+      } else {
+        // no entry at or after current, the last one is before it
+        m.children[i].SeekToLast()
       }
-      m.children[i].Prev()
     }
+    m.direct = 1
   }
   
   iter := m.children[m.current]
@@ -124,7 +130,7 @@ func (m *mergeIterator) SeekToLast() {
     m.children[i].SeekToLast()
   }
   m.current = m.findLargest()
-  m.direct  = 0
+  m.direct  = 1
 }
 
 func (m *mergeIterator) findSmallest() int {
@@ -0,0 +1,140 @@
+package table
+
+import (
+  "sync"
+  "container/list"
+)
+
+import (
+  "github.com/jellybean4/goleveldb/filter"
+  "github.com/jellybean4/goleveldb/util"
+  "github.com/jellybean4/goleveldb/mem"
+)
+
+// indexPartition is a finished partition of the index of a table being
+// built, key is the last separator the partition holds
+type indexPartition struct {
+  key     []byte
+  content []byte
+  filter  []byte   // the filter of its keys, if the filter is partitioned
+}
+
+// partitionCache keeps the partitions of a table used last, tables are
+// shared between goroutines
+type partitionCache struct {
+  mutex   sync.Mutex
+  entries int                        // cache size limit
+  blocks  map[uint64]*list.Element   // partitions by offset
+  lru     *list.List                 // partitions used last first
+}
+
+type cachedPartition struct {
+  offset uint64
+  value  interface{}
+}
+
+func newPartitionCache(entries int) *partitionCache {
+  cache := new(partitionCache)
+  cache.entries = entries
+  cache.blocks = make(map[uint64]*list.Element)
+  cache.lru = list.New()
+  return cache
+}
+
+// Return the partition at offset, nil if it is not cached
+func (c *partitionCache) get(offset uint64) interface{} {
+  c.mutex.Lock()
+  defer c.mutex.Unlock()
+
+  if elem, ok := c.blocks[offset]; ok {
+    c.lru.MoveToFront(elem)
+    return elem.Value.(*cachedPartition).value
+  }
+  return nil
+}
+
+// Cache the partition at offset, dropping the one used least recently
+// if the cache is full
+func (c *partitionCache) put(offset uint64, value interface{}) {
+  c.mutex.Lock()
+  defer c.mutex.Unlock()
+
+  if _, ok := c.blocks[offset]; ok {
+    return
+  }
+  for c.lru.Len() >= c.entries && c.lru.Len() > 0 {
+    last := c.lru.Remove(c.lru.Back()).(*cachedPartition)
+    delete(c.blocks, last.offset)
+  }
+  c.blocks[offset] = c.lru.PushFront(&cachedPartition{offset, value})
+}
+
+// Return the index of the table, an iterator over the separators of
+// the data blocks and their handlers.  A partitioned index reads the
+// partitions as the iterator moves over them.
+func (t *tableImpl) newIndexIterator(cmp util.Comparator) mem.Iterator {
+  iter := t.convertKeys(t.index.NewIterator(cmp))
+  if t.partitions == nil {
+    return iter
+  }
+  return NewTwoLevelIterator(iter, func(value interface{}) mem.Iterator {
+    return t.newPartitionIterator(value, cmp)
+  }, &util.DefaultReadOption, util.BinaryCompare)
+}
+
+// Return an iterator over the index partition the handler encoded in
+// value points to, nil if it can not be read
+func (t *tableImpl) newPartitionIterator(value interface{}, cmp util.Comparator) mem.Iterator {
+  handler := t.decodeHandler(value.([]byte))
+  if handler == nil {
+    return nil
+  }
+
+  block, ok := t.partitions.get(handler.offset).(Block)
+  if !ok {
+    if content, err := t.readBlock(handler); err != nil {
+      return nil
+    } else if block = NewBlock(content, t.option.Format); block == nil {
+      return nil
+    }
+    t.partitions.put(handler.offset, block)
+  }
+  return t.convertKeys(block.NewIterator(cmp))
+}
+
+// partitionedFilter checks the filter partition written along the
+// index partition a key falls in
+type partitionedFilter struct {
+  table *tableImpl
+  index Block             // handlers of the filter partitions by separator
+  cache *partitionCache   // readers of the filter partitions by offset
+}
+
+func newPartitionedFilter(t *tableImpl, index Block) *partitionedFilter {
+  return &partitionedFilter{t, index, newPartitionCache(util.Global.IndexPartitionCacheEntries)}
+}
+
+// The filters cover the partitions of the index, so offset is ignored
+func (f *partitionedFilter) KeyMayMatch(offset uint64, key []byte) bool {
+  iter := f.index.NewIterator(f.table.option.Comparator)
+  iter.Seek(key)
+  if !iter.Valid() {
+    // after the last key of the table
+    return false
+  }
+
+  handler := f.table.decodeHandler(iter.Value().([]byte))
+  if handler == nil {
+    return true
+  }
+  reader, ok := f.cache.get(handler.offset).(filter.BlockReader)
+  if !ok {
+    content, err := f.table.readBlock(handler)
+    if err != nil {
+      return true
+    }
+    reader = filter.NewFullReader(f.table.option.Policy, content)
+    f.cache.put(handler.offset, reader)
+  }
+  return reader.KeyMayMatch(offset, key)
+}
@@ -0,0 +1,100 @@
+package table
+
+import (
+  "github.com/jellybean4/goleveldb/util"
+  "github.com/jellybean4/goleveldb/mem"
+)
+
+// Return the prefix option.PrefixExtractor takes from the user key of
+// key, nil if there is no extractor or key is out of its domain.  The
+// prefix of an internal key is an internal key as well, which sorts
+// before the entries of the prefix and which mem.InternalFilterPolicy
+// filters as the prefix.
+func extractPrefix(option *util.Option, key []byte) []byte {
+  extractor := option.PrefixExtractor
+  if extractor == nil {
+    return nil
+  }
+  _, internal := option.Comparator.(*mem.InternalKeyComparator)
+  if internal {
+    key = util.ExtractUserKey(key)
+  }
+  if !extractor.InDomain(key) {
+    return nil
+  } else if internal {
+    return util.NewInternalKey(extractor.Transform(key), util.Global.MaxSeq, mem.SeekType).Encode()
+  }
+  return extractor.Transform(key)
+}
+
+// Return the prefix of key the filters of the table hold, nil if they
+// hold none: tables built with another extractor hold other prefixes
+func (t *tableImpl) filterPrefix(key []byte) []byte {
+  extractor := t.option.PrefixExtractor
+  if t.filter == nil || extractor == nil || t.props.PrefixExtractorName != extractor.Name() {
+    return nil
+  }
+  return extractPrefix(t.option, key)
+}
+
+// Return false if the filter at offset proves that neither key nor its
+// prefix is in the table
+func (t *tableImpl) filterMayMatch(offset uint64, key []byte) bool {
+  if !t.filter.KeyMayMatch(offset, key) {
+    return false
+  }
+  prefix := t.filterPrefix(key)
+  return prefix == nil || t.filter.KeyMayMatch(offset, prefix)
+}
+
+func (t *tableImpl) PrefixMayMatch(key []byte) bool {
+  prefix := t.filterPrefix(key)
+  if prefix == nil {
+    return true
+  } else if t.filterType != util.BlockFilter {
+    return t.filter.KeyMayMatch(0, prefix)
+  }
+
+  // the keys of the prefix from key on start in the block key falls in
+  iter := t.newIndexIterator(t.option.Comparator)
+  iter.Seek(key)
+  if !iter.Valid() {
+    return false
+  }
+  handler := t.decodeHandler(iter.Value().([]byte))
+  return handler == nil || t.filter.KeyMayMatch(handler.offset, prefix)
+}
+
+// prefixIterator leaves its table out of the seeks whose prefix the
+// filters of the table rule out
+type prefixIterator struct {
+  mem.Iterator
+  table   Table
+  skipped bool   // the last seek was ruled out
+}
+
+// Return an iterator over iter, the iterator of table, which is invalid
+// after a Seek to a key if table holds no key from it on with its prefix
+func NewPrefixIterator(iter mem.Iterator, table Table) mem.Iterator {
+  return &prefixIterator{iter, table, false}
+}
+
+func (i *prefixIterator) Valid() bool {
+  return !i.skipped && i.Iterator.Valid()
+}
+
+func (i *prefixIterator) Seek(key interface{}) {
+  if i.skipped = !i.table.PrefixMayMatch(key.([]byte)); !i.skipped {
+    i.Iterator.Seek(key)
+  }
+}
+
+func (i *prefixIterator) SeekToFirst() {
+  i.skipped = false
+  i.Iterator.SeekToFirst()
+}
+
+func (i *prefixIterator) SeekToLast() {
+  i.skipped = false
+  i.Iterator.SeekToLast()
+}
@@ -0,0 +1,191 @@
+package table
+
+import (
+  "sort"
+  "errors"
+  "encoding/binary"
+)
+
+import (
+  "github.com/jellybean4/goleveldb/util"
+  "github.com/jellybean4/goleveldb/mem"
+)
+
+// Name of the meta block holding the properties of a table
+const PropertiesBlockName = "properties"
+
+// Names the built-in properties are stored under, the properties of
+// collectors are stored under their names prefixed with userProperty
+const (
+  propDataSize = "table.data-size"
+  propIndexSize = "table.index-size"
+  propIndexPartitions = "table.index-partitions"
+  propFilterSize = "table.filter-size"
+  propNumEntries = "table.num-entries"
+  propNumDeletions = "table.num-deletions"
+  propRawKeySize = "table.raw-key-size"
+  propRawValueSize = "table.raw-value-size"
+  propComparator = "table.comparator"
+  propPrefixExtractor = "table.prefix-extractor"
+  propFilterUserKeys = "table.filter-user-keys"
+  propCreationTime = "table.creation-time"
+  userProperty = "user."
+)
+
+// TableProperties describes the contents of a table.  Tables written
+// before the properties block was added have them all zero.
+type TableProperties struct {
+  DataSize     uint64   // bytes of the data blocks
+  IndexSize    uint64   // bytes of the index block, or of all its partitions
+  IndexPartitions uint64   // number of index partitions, 0 if not partitioned
+  FilterSize   uint64   // bytes of the filter block
+  FilterUserKeys bool   // the filter holds the user keys of internal keys
+  NumEntries   uint64
+  NumDeletions uint64   // entries deleting a single key
+  RawKeySize   uint64   // bytes of the keys before any encoding
+  RawValueSize uint64   // bytes of the values before any encoding
+  ComparatorName string
+  PrefixExtractorName string   // extractor of the prefixes in the filters
+  CreationTime int64    // unix time the table was built at
+
+  // properties stored by the collectors of util.Option
+  UserCollected map[string][]byte
+}
+
+// propertiesCollector gathers the properties of a table being built
+type propertiesCollector struct {
+  props      TableProperties
+  internal   bool   // keys are internal keys
+  collectors []util.TablePropertiesCollector
+}
+
+func newPropertiesCollector(option *util.Option) *propertiesCollector {
+  c := new(propertiesCollector)
+  c.props.ComparatorName = option.Comparator.Name()
+  if icmp, ok := option.Comparator.(*mem.InternalKeyComparator); ok {
+    c.internal = true
+    c.props.ComparatorName = icmp.UserComparator().Name()
+  }
+  if option.Policy != nil && option.PrefixExtractor != nil {
+    c.props.PrefixExtractorName = option.PrefixExtractor.Name()
+  }
+  _, c.props.FilterUserKeys = option.Policy.(*mem.InternalFilterPolicy)
+
+  for _, factory := range option.TablePropertiesCollectors {
+    c.collectors = append(c.collectors, factory())
+  }
+  return c
+}
+
+// Account for the entry key -> value added to the table
+func (c *propertiesCollector) add(key, value []byte) {
+  c.props.NumEntries++
+  c.props.RawKeySize += uint64(len(key))
+  c.props.RawValueSize += uint64(len(value))
+
+  ukey, rtype := key, byte(mem.ValueType)
+  if c.internal {
+    ukey, rtype = util.ExtractUserKey(key), key[len(key) - 8]
+  }
+  if rtype == mem.DeleteType || rtype == mem.SingleDeleteType {
+    c.props.NumDeletions++
+  }
+
+  for _, collector := range c.collectors {
+    collector.Add(ukey, value, rtype)
+  }
+}
+
+// Return the content of the properties block
+func (c *propertiesCollector) finish(format int) []byte {
+  values := make(map[string][]byte)
+  putUvarint := func(name string, val uint64) {
+    store := make([]byte, binary.MaxVarintLen64)
+    values[name] = store[:binary.PutUvarint(store, val)]
+  }
+
+  putUvarint(propDataSize, c.props.DataSize)
+  putUvarint(propIndexSize, c.props.IndexSize)
+  putUvarint(propIndexPartitions, c.props.IndexPartitions)
+  putUvarint(propFilterSize, c.props.FilterSize)
+  putUvarint(propNumEntries, c.props.NumEntries)
+  putUvarint(propNumDeletions, c.props.NumDeletions)
+  putUvarint(propRawKeySize, c.props.RawKeySize)
+  putUvarint(propRawValueSize, c.props.RawValueSize)
+  putUvarint(propCreationTime, uint64(c.props.CreationTime))
+  values[propComparator] = []byte(c.props.ComparatorName)
+  if c.props.PrefixExtractorName != "" {
+    values[propPrefixExtractor] = []byte(c.props.PrefixExtractorName)
+  }
+  if c.props.FilterUserKeys {
+    putUvarint(propFilterUserKeys, 1)
+  }
+  for _, collector := range c.collectors {
+    for name, value := range collector.Finish() {
+      values[userProperty + name] = value
+    }
+  }
+
+  names := make([]string, 0, len(values))
+  for name := range values {
+    names = append(names, name)
+  }
+  sort.Strings(names)
+
+  builder := NewBlockBuilder(1, format)
+  for _, name := range names {
+    builder.Add([]byte(name), values[name])
+  }
+  return builder.Finish()
+}
+
+// Decode the properties stored in block
+func decodeProperties(block Block) (*TableProperties, error) {
+  props := &TableProperties{UserCollected : make(map[string][]byte)}
+  getUvarint := func(value []byte) (uint64, error) {
+    val, n := binary.Uvarint(value)
+    if n <= 0 {
+      return 0, errors.New("bad table property")
+    }
+    return val, nil
+  }
+
+  fields := map[string]*uint64 {
+    propDataSize : &props.DataSize,
+    propIndexSize : &props.IndexSize,
+    propIndexPartitions : &props.IndexPartitions,
+    propFilterSize : &props.FilterSize,
+    propNumEntries : &props.NumEntries,
+    propNumDeletions : &props.NumDeletions,
+    propRawKeySize : &props.RawKeySize,
+    propRawValueSize : &props.RawValueSize,
+  }
+
+  iter := block.NewIterator(util.BinaryComparator)
+  for iter.SeekToFirst(); iter.Valid(); iter.Next() {
+    name, value := string(iter.Key().([]byte)), iter.Value().([]byte)
+    var err error
+    if field, ok := fields[name]; ok {
+      *field, err = getUvarint(value)
+    } else if name == propCreationTime {
+      var ctime uint64
+      ctime, err = getUvarint(value)
+      props.CreationTime = int64(ctime)
+    } else if name == propComparator {
+      props.ComparatorName = string(value)
+    } else if name == propPrefixExtractor {
+      props.PrefixExtractorName = string(value)
+    } else if name == propFilterUserKeys {
+      var userKeys uint64
+      userKeys, err = getUvarint(value)
+      props.FilterUserKeys = userKeys != 0
+    } else if len(name) > len(userProperty) && name[:len(userProperty)] == userProperty {
+      props.UserCollected[name[len(userProperty):]] = append([]byte{}, value...)
+    }
+
+    if err != nil {
+      return nil, err
+    }
+  }
+  return props, nil
+}
@@ -0,0 +1,99 @@
+package table
+
+import (
+  "errors"
+  "encoding/binary"
+)
+
+// Types of compression of a block, stored in its trailer
+const (
+  noCompression = iota
+  snappyCompression
+)
+
+// Tags of the elements of snappy compressed data, the low two bits of
+// the first byte of an element
+const (
+  snappyLiteral = iota
+  snappyCopy1   // copy with an offset of 11 bits
+  snappyCopy2   // copy with an offset of 16 bits
+  snappyCopy4   // copy with an offset of 32 bits
+)
+
+var errSnappyCorrupt = errors.New("corrupt snappy compressed block")
+
+// Return the data snappy compressed into src.  The compressed data is
+// the varint length of the data followed by elements, each of which is
+// either a literal run of bytes or a copy of bytes decoded before.
+func snappyDecode(src []byte) ([]byte, error) {
+  length, n := binary.Uvarint(src)
+  if n <= 0 || length > uint64(len(src)) * 255 {
+    return nil, errSnappyCorrupt
+  }
+  src = src[n:]
+  dst := make([]byte, 0, length)
+
+  for len(src) > 0 {
+    tag := src[0]
+    var size, offset int
+    switch tag & 0x03 {
+    case snappyLiteral:
+      size = int(tag >> 2)
+      src = src[1:]
+      // lengths of 60 and more are stored in the next 1 to 4 bytes
+      if size >= 60 {
+        bytes := size - 59
+        if len(src) < bytes {
+          return nil, errSnappyCorrupt
+        }
+        size = 0
+        for i := bytes - 1; i >= 0; i-- {
+          size = size << 8 | int(src[i])
+        }
+        src = src[bytes:]
+      }
+      size++
+      if size <= 0 || size > len(src) || uint64(len(dst) + size) > length {
+        return nil, errSnappyCorrupt
+      }
+      dst = append(dst, src[:size]...)
+      src = src[size:]
+      continue
+    case snappyCopy1:
+      if len(src) < 2 {
+        return nil, errSnappyCorrupt
+      }
+      size = 4 + int(tag >> 2) & 0x07
+      offset = int(tag & 0xe0) << 3 | int(src[1])
+      src = src[2:]
+    case snappyCopy2:
+      if len(src) < 3 {
+        return nil, errSnappyCorrupt
+      }
+      size = 1 + int(tag >> 2)
+      offset = int(binary.LittleEndian.Uint16(src[1:]))
+      src = src[3:]
+    case snappyCopy4:
+      if len(src) < 5 {
+        return nil, errSnappyCorrupt
+      }
+      size = 1 + int(tag >> 2)
+      offset = int(binary.LittleEndian.Uint32(src[1:]))
+      src = src[5:]
+    }
+
+    if offset <= 0 || offset > len(dst) || uint64(len(dst) + size) > length {
+      return nil, errSnappyCorrupt
+    }
+    // the copy may overlap the bytes it appends, repeating them
+    start := len(dst) - offset
+    for i := 0; i < size; i++ {
+      dst = append(dst, dst[start + i])
+    }
+  }
+
+  if uint64(len(dst)) != length {
+    return nil, errSnappyCorrupt
+  }
+  return dst, nil
+}
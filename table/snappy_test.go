@@ -0,0 +1,42 @@
+package table
+
+import (
+  "testing"
+  "strings"
+)
+
+func TestSnappyDecode(t *testing.T) {
+  long := strings.Repeat("0123456789", 10)
+  cases := []struct {
+    src    string
+    expect string
+  }{
+    {"\x00", ""},
+    {"\x03\x08abc", "abc"},
+    // a copy of 1 byte offset overlapping the bytes it appends
+    {"\x0d\x08abc\x15\x03\x00X", "abcabcabcabcX"},
+    // a copy of 2 bytes offset
+    {"\x08\x08abc\x12\x03\x00", "abcabcab"},
+    // a literal whose length is stored in the next byte
+    {"\x64\xf0\x63" + long, long},
+  }
+  for _, c := range cases {
+    if rslt, err := snappyDecode([]byte(c.src)); err != nil || string(rslt) != c.expect {
+      t.Errorf("decode %q returns %q %v", c.src, rslt, err)
+    }
+  }
+
+  corrupts := []string{
+    "",
+    "\x04\x08abc",          // shorter than its length
+    "\x02\x08abc",          // longer than its length
+    "\x06\x08abc\x15\x04",  // copy from before the start
+    "\x08\x08abc\x12\x03",  // truncated copy
+    "\x04\x0cabc",          // truncated literal
+  }
+  for _, src := range corrupts {
+    if rslt, err := snappyDecode([]byte(src)); err == nil {
+      t.Errorf("decode corrupt %q returns %q", src, rslt)
+    }
+  }
+}
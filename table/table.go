@@ -3,6 +3,9 @@ package table
 import (
   "os"
   "fmt"
+  "bytes"
+  "sort"
+  "time"
   "encoding/binary"
   "hash/crc32"
   "errors"
@@ -21,9 +24,11 @@ import (
 type FileMetaData struct {
   AllowSeek int
   Number    int
-  FileSize  int
+  FileSize  int64
   Smallest  util.InternalKey
   Largest   util.InternalKey
+  CreationTime int64   // unix time the file was written at, 0 if unknown
+  HasRangeDels bool    // the file holds range tombstones
 }
 
 
@@ -41,6 +46,11 @@ type TableBuilder interface {
   // REQUIRES: Finish(), Abandon() have not been called
   Add(key, value []byte) error
 
+  // Add the range tombstone stored as key -> value to the table.  The
+  // tombstones are kept in a meta block of their own, in any order.
+  // REQUIRES: Finish(), Abandon() have not been called
+  AddRangeTombstone(key, value []byte)
+
   // Advanced operation: flush any buffered key/value pairs to file.
   // Can be used to ensure that two adjacent entries never live in
   // the same data block.  Most clients should not need to use this method.
@@ -67,9 +77,16 @@ type TableBuilder interface {
 
   // Size of the file generated so far.  If invoked after a successful
   // Finish() call, returns the size of the final generated file.
-  FileSize() int
+  FileSize() int64
 }
 
+// Name of the meta block holding the range tombstones of a table
+const RangeDelBlockName = "rangedel"
+
+// Prefixes of the name of the filter block in the metaindex, one for
+// each util.Option.FilterType, followed by the name of the policy
+var filterBlockPrefixes = []string{"filter.", "fullfilter.", "partitionedfilter."}
+
 const (
   FINISH = iota
   ABANDON
@@ -80,14 +97,20 @@ const (
 type tableBuilderImpl struct {
   blockBuilder BlockBuilder
   idxBuilder   BlockBuilder
+  partitions   []indexPartition   // finished partitions of the index
+  lastSep      []byte             // separator added to the index last
   option       *util.Option
   file         *os.File
   metaindex    []entry
   filterBuilder filter.BlockBuilder
-  offset       int
+  filterType   int                // layout of the filters of the table
+  offset       uint64
   status       int
   entries      int
   lastKey      []byte
+  lastPrefix   []byte             // prefix added to the filter last
+  rangeDels    []interface{}   // tombstone entries, key then value
+  props        *propertiesCollector
 }
 
 func NewTableBuilder(filename string, option *util.Option) TableBuilder {
@@ -103,8 +126,9 @@ func (t *tableBuilderImpl) init(filename string, option *util.Option) error {
   if file, err := os.OpenFile(filename, os.O_TRUNC | os.O_WRONLY | os.O_CREATE, 0600); err != nil {
     return err
   } else {
-    t.blockBuilder = NewBlockBuilder(option.Interval)
-    t.idxBuilder = NewBlockBuilder(1)
+    _, internal := option.Comparator.(*mem.InternalKeyComparator)
+    t.blockBuilder = NewHashBlockBuilder(option.Interval, option.Format, option.BlockHashRatio, internal)
+    t.idxBuilder = NewBlockBuilder(1, option.Format)
     t.option = option
     t.file = file
     t.metaindex = []entry{}
@@ -113,10 +137,22 @@ func (t *tableBuilderImpl) init(filename string, option *util.Option) error {
     t.entries = 0
     t.status = OK
     t.lastKey = []byte{}
+    t.rangeDels = []interface{}{}
+    t.props = newPropertiesCollector(option)
+
+    t.filterType = option.FilterType
+    if option.Format == util.LevelDBFormat {
+      t.filterType = util.BlockFilter
+    } else if t.filterType == util.PartitionedFilter && !t.partitioned() {
+      t.filterType = util.FullFilter
+    }
 
-    if option.Policy != nil {
+    if option.Policy == nil {
+    } else if t.filterType == util.BlockFilter {
       t.filterBuilder = filter.NewBlockBuilder(option.Policy)
-    } 
+    } else {
+      t.filterBuilder = filter.NewFullBuilder(option.Policy)
+    }
     return nil
   }
 }
@@ -136,8 +172,8 @@ func (t *tableBuilderImpl) NumEntries() int {
   return t.entries
 }
 
-func (t *tableBuilderImpl) FileSize() int {
-  return t.offset
+func (t *tableBuilderImpl) FileSize() int64 {
+  return int64(t.offset)
 }
 
 func (t *tableBuilderImpl) Flush() error {
@@ -150,49 +186,69 @@ func (t *tableBuilderImpl) Flush() error {
 func (t *tableBuilderImpl) Finish() error {
 
   if t.blockBuilder.Empty() {
-  } else if err := t.addBlock(t.lastKey); err != nil {
+  } else if err := t.addBlock(nil); err != nil {
     t.status = ERROR
     return err
   }
   defer t.file.Close()
+  if t.partitioned() && !t.idxBuilder.Empty() {
+    t.cutPartition()
+  }
 
-  metaBuilder := NewBlockBuilder(1)
+  format := t.option.Format
+  props := &t.props.props
+  props.DataSize = t.offset
+  // the metaindex entries are added in the order of their names
+  metaBuilder := NewBlockBuilder(1, format)
   if t.filterBuilder != nil {
-    filter := t.filterBuilder.Finish()
-    metaHandler := &BlockHandler{len(filter), t.offset}
-    metaName := fmt.Sprintf("filter.%s", t.option.Policy.Name())
-    metaBuilder.Add([]byte(metaName), EncodeHandler(metaHandler))   
-    if _, err := t.file.Write(filter); err != nil {
-      t.status = ERROR
+    metaHandler, err := t.writeFilter()
+    if err != nil {
       return err
     }
-    t.offset += len(filter)
+    metaName := filterBlockPrefixes[t.filterType] + t.option.Policy.Name()
+    metaBuilder.Add([]byte(metaName), EncodeHandler(metaHandler))
   }
   
-  metaidxBlock := metaBuilder.Finish()
-  if _, err := t.file.Write(metaidxBlock); err != nil {
-    t.status = ERROR
+  var rangeDelHandler *BlockHandler
+  if len(t.rangeDels) != 0 {
+    var err error
+    if rangeDelHandler, err = t.writeMetaBlock(t.rangeDelBlock()); err != nil {
+      return err
+    }
+  }
+  
+  index, err := t.finishIndex()
+  if err != nil {
     return err
   }
-
-  footer := new(FooterHandler)
-  footer.metaindex = &BlockHandler{len(metaidxBlock), t.offset}
-  t.offset += len(metaidxBlock)
-
-  idxBlock := t.idxBuilder.Finish()
-  if _, err := t.file.Write(idxBlock); err != nil {
-    t.status = ERROR
+  props.IndexSize += uint64(len(index))
+  props.CreationTime = time.Now().Unix()
+  if format == util.LevelDBFormat {
+    // LevelDB writes no properties, leave them out to write the same bytes
+  } else if propsHandler, err := t.writeMetaBlock(t.props.finish(format)); err != nil {
+    return err
+  } else {
+    metaBuilder.Add([]byte(PropertiesBlockName), EncodeHandler(propsHandler))
+  }
+  
+  if rangeDelHandler != nil {
+    metaBuilder.Add([]byte(RangeDelBlockName), EncodeHandler(rangeDelHandler))
+  }
+  
+  footer := newFooter(format)
+  if footer.metaindex, err = t.writeMetaBlock(metaBuilder.Finish()); err != nil {
     return err
   }
 
-  footer.index = &BlockHandler{len(idxBlock), t.offset}
-  t.offset += len(idxBlock)
+  if footer.index, err = t.writeMetaBlock(index); err != nil {
+    return err
+  }
 
   if _, err := t.file.Write(footer.Encode()); err != nil {
     t.status = ERROR
     return err
   }
-  t.offset += footer.Size()
+  t.offset += uint64(footer.Size())
   
   t.status = FINISH
   return nil
@@ -206,25 +262,64 @@ func (t *tableBuilderImpl) Add(key, value []byte) error {
     t.addBlock(key)
   }
 
-  t.blockBuilder.Add(key, value)
+  if t.option.Format == util.LevelDBFormat {
+    t.blockBuilder.Add(util.LevelDBInternalKey(key), value)
+  } else {
+    t.blockBuilder.Add(key, value)
+  }
   if t.filterBuilder != nil {
     t.filterBuilder.AddKey(key)
+    // each block adds the prefixes of its keys once
+    if prefix := extractPrefix(t.option, key); prefix != nil && !bytes.Equal(prefix, t.lastPrefix) {
+      t.filterBuilder.AddKey(prefix)
+      t.lastPrefix = prefix
+    }
   }
+  t.props.add(key, value)
   t.entries++
   t.lastKey = key
   return nil
 }
 
+func (t *tableBuilderImpl) AddRangeTombstone(key, value []byte) {
+  t.rangeDels = append(t.rangeDels, [][]byte{key, value})
+}
+
+// Return the block holding the range tombstones sorted by key
+func (t *tableBuilderImpl) rangeDelBlock() []byte {
+  sort.Sort(util.NewSliceSorter(t.rangeDels, func(a, b interface{}) int {
+    return t.option.Comparator.Compare(a.([][]byte)[0], b.([][]byte)[0])
+  }))
+  
+  builder := NewBlockBuilder(1, t.option.Format)
+  for _, entry := range t.rangeDels {
+    builder.Add(entry.([][]byte)[0], entry.([][]byte)[1])
+  }
+  return builder.Finish()
+}
+
+// Write the block built so far, indexed by a short key between its last
+// key and successor, the first key of the next block.  A nil successor
+// means the block is the last one.
 func (t *tableBuilderImpl) addBlock(successor []byte) error {
-  sep := t.option.Comparator.FindShortestSep(t.lastKey, successor).([]byte)
+  var sep []byte
+  if successor == nil {
+    sep = t.option.Comparator.FindShortSuccessor(t.lastKey).([]byte)
+  } else {
+    sep = t.option.Comparator.FindShortestSep(t.lastKey, successor).([]byte)
+  }
   block := t.blockBuilder.Finish()
   t.blockBuilder.Reset()
+  t.lastPrefix = nil
 
-  handler := &BlockHandler{len(block), t.offset}
+  if t.option.Format == util.LevelDBFormat {
+    sep = util.LevelDBInternalKey(sep)
+  }
+  handler := &BlockHandler{uint64(len(block)), t.offset}
   t.idxBuilder.Add(sep, EncodeHandler(handler))
-  
-  if t.filterBuilder != nil {
-    t.filterBuilder.StartBlock(t.offset)
+  t.lastSep = sep
+  if t.partitioned() && t.idxBuilder.CurrentSizeEstimate() >= t.option.IndexPartitionSize {
+    t.cutPartition()
   }
 
   if cnt, err := t.file.Write(block); err != nil {
@@ -235,7 +330,7 @@ func (t *tableBuilderImpl) addBlock(successor []byte) error {
     msg := fmt.Sprintf("write block %d/%d", cnt, len(block))
     return errors.New(msg)
   }
-  t.offset += len(block)
+  t.offset += uint64(len(block))
   
   trailer := t.blockTrailer(block)
   if cnt, err := t.file.Write(trailer); err != nil {
@@ -246,18 +341,109 @@ func (t *tableBuilderImpl) addBlock(successor []byte) error {
     msg := fmt.Sprintf("write block trailer %d/%d", cnt, len(trailer))
     return errors.New(msg)
   }
-  t.offset += len(trailer)
+  t.offset += uint64(len(trailer))
+
+  // the keys added so far belong to the filters before the next block
+  if t.filterBuilder != nil {
+    t.filterBuilder.StartBlock(t.offset)
+  }
   return nil
 }
 
+// Return true iff the index of the table is split into partitions,
+// which LevelDB can't read
+func (t *tableBuilderImpl) partitioned() bool {
+  return t.option.IndexPartitionSize > 0 && t.option.Format != util.LevelDBFormat
+}
+
+// Close the index partition being built, along with the partition of
+// the filter holding its keys
+func (t *tableBuilderImpl) cutPartition() {
+  partition := indexPartition{key : t.lastSep, content : t.idxBuilder.Finish()}
+  t.idxBuilder = NewBlockBuilder(1, t.option.Format)
+  if t.filterType == util.PartitionedFilter {
+    partition.filter = t.filterBuilder.Finish()
+  }
+  t.partitions = append(t.partitions, partition)
+}
+
+// Write the filters of the table and return the handler of the filter
+// block.  A partitioned filter writes its partitions and the filter
+// block is the top-level index over them.
+func (t *tableBuilderImpl) writeFilter() (*BlockHandler, error) {
+  props := &t.props.props
+  if t.filterType != util.PartitionedFilter {
+    content := t.filterBuilder.Finish()
+    props.FilterSize = uint64(len(content))
+    return t.writeMetaBlock(content)
+  }
+
+  top := NewBlockBuilder(1, t.option.Format)
+  for _, partition := range t.partitions {
+    handler, err := t.writeMetaBlock(partition.filter)
+    if err != nil {
+      return nil, err
+    }
+    top.Add(partition.key, EncodeHandler(handler))
+    props.FilterSize += handler.size
+  }
+  content := top.Finish()
+  props.FilterSize += uint64(len(content))
+  return t.writeMetaBlock(content)
+}
+
+// Return the content of the index block.  A partitioned index writes
+// its partitions and returns the top-level index over them.
+func (t *tableBuilderImpl) finishIndex() ([]byte, error) {
+  if !t.partitioned() {
+    return t.idxBuilder.Finish(), nil
+  }
+  
+  top := NewBlockBuilder(1, t.option.Format)
+  for _, partition := range t.partitions {
+    handler, err := t.writeMetaBlock(partition.content)
+    if err != nil {
+      return nil, err
+    }
+    top.Add(partition.key, EncodeHandler(handler))
+    t.props.props.IndexSize += handler.size
+  }
+  t.props.props.IndexPartitions = uint64(len(t.partitions))
+  return top.Finish(), nil
+}
+
+// Write the block content which is not a data block, LevelDB gives it
+// a trailer as well
+func (t *tableBuilderImpl) writeMetaBlock(content []byte) (*BlockHandler, error) {
+  handler := &BlockHandler{uint64(len(content)), t.offset}
+  if t.option.Format == util.LevelDBFormat {
+    content = append(content, t.blockTrailer(content)...)
+  }
+
+  if _, err := t.file.Write(content); err != nil {
+    t.status = ERROR
+    return nil, err
+  }
+  t.offset += uint64(len(content))
+  return handler, nil
+}
+
+// Return the trailer of block content: the type of compression, none,
+// and the checksum of content, which LevelDB computes over the type too
 func (t *tableBuilderImpl) blockTrailer(content []byte) []byte {
-  store := make([]byte, 5)
-  store[0] = 0
+  store := make([]byte, blockTrailerSize)
+  store[0] = noCompression
   crc := crc32.ChecksumIEEE(content)
+  if t.option.Format == util.LevelDBFormat {
+    crc = util.MaskedCRC(content, store[:1])
+  }
   binary.LittleEndian.PutUint32(store[1:], crc)
   return store
 }
 
+// Size of the compression type and checksum following a block
+const blockTrailerSize = 5
+
 
 // A Table is a sorted map from strings to strings.  Tables are
 // immutable and persistent.  A Table may be safely accessed from
@@ -277,19 +463,34 @@ type Table interface {
   // bytes, and so includes effects like compression of the underlying data.
   // E.g., the approximate offset of the last key in the table will
   // be close to the file length.
-  ApproximateOffsetOf(key []byte) int
+  ApproximateOffsetOf(key []byte) int64
   
-  // Get the given key/value pair from table if there's any
+  // Get the given key/value pair from table if there's any, the pair
+  // returned may be of another user key, which callers must skip
   Get(key []byte) ([]byte, []byte)
+  
+  // Return the range tombstones stored in the table
+  RangeTombstones() mem.RangeTombstones
+  
+  // Return the properties stored in the table
+  Properties() *TableProperties
+
+  // Return false if the filters of the table prove that no key from
+  // key on shares the prefix of key, see util.Option.PrefixExtractor
+  PrefixMayMatch(key []byte) bool
 }
 
 type tableImpl struct {
   index     Block
   metaindex Block
+  partitions *partitionCache   // nil unless the index is partitioned
   footer    *FooterHandler
   filter    filter.BlockReader
+  filterType int   // layout of the filters, see util.Option.FilterType
+  rangeDels mem.RangeTombstones
+  props     *TableProperties
   file      *os.File
-  filesize  int
+  filesize  int64
   option    *util.Option
 }
 
@@ -305,7 +506,7 @@ type tableImpl struct {
 // for the duration of the returned table's lifetime.
 //
 // *file must remain live while this Table is in use.
-func OpenTable(filename string, filesize int, option *util.Option) Table {
+func OpenTable(filename string, filesize int64, option *util.Option) Table {
   table := new(tableImpl)
   if err := table.init(filename, filesize, option); err != nil {
     log4go.Error("could not open table %s %s", filename, err.Error())
@@ -314,7 +515,7 @@ func OpenTable(filename string, filesize int, option *util.Option) Table {
   return table
 }
 
-func (t *tableImpl) init(filename string, filesize int, option *util.Option) error {
+func (t *tableImpl) init(filename string, filesize int64, option *util.Option) error {
   if file, err := os.OpenFile(filename,os.O_RDONLY, 0); err != nil {
     return err
   } else {
@@ -330,23 +531,44 @@ func (t *tableImpl) Close() {
 }
 
 func (t *tableImpl) Get(key []byte) ([]byte, []byte) {
-  iiter := t.index.NewIterator(util.BinaryComparator)
+  // the filters covering the whole table are checked before the index
+  if t.filter != nil && t.filterType != util.BlockFilter && !t.filterMayMatch(0, key) {
+    return nil, nil
+  }
+
+  iiter := t.newIndexIterator(t.option.Comparator)
   iiter.Seek(key)
   if !iiter.Valid() {
     return nil, nil
   }
-  handler := DecodeHandler(iiter.Value().([]byte))
-  if t.filter != nil && !t.filter.KeyMayMatch(uint32(handler.offset), key) {
+  handler := t.decodeHandler(iiter.Value().([]byte))
+  if handler == nil {
+    return nil, nil
+  } else if t.filter != nil && t.filterType == util.BlockFilter && !t.filterMayMatch(handler.offset, key) {
     return nil, nil
   }
   
-  if biter := t.NewBlockIterator(iiter.Value()); biter == nil {
+  biter := t.NewBlockIterator(iiter.Value())
+  if biter == nil {
     return nil, nil
-  } else if biter.Seek(key); !biter.Valid() {
+  }
+  // the hash index of the block finds the restart interval of the key
+  if hiter, ok := biter.(*blockIterImpl); !ok || !hiter.hashSeek(key, t.userKey(key)) {
+    biter.Seek(key)
+  }
+  if !biter.Valid() {
     return nil, nil
-  } else {
-    return biter.Key().([]byte), biter.Value().([]byte)
   }
+  return biter.Key().([]byte), biter.Value().([]byte)
+}
+
+// Return the user key of key, key itself if the table is not keyed by
+// internal keys
+func (t *tableImpl) userKey(key []byte) []byte {
+  if _, ok := t.option.Comparator.(*mem.InternalKeyComparator); ok {
+    return util.ExtractUserKey(key)
+  }
+  return key
 }
 
 func (t *tableImpl) parseTable() error {
@@ -366,8 +588,35 @@ func (t *tableImpl) parseTable() error {
     t.metaindex = metaBlock
   }
   
-  if err := t.parseFilter(); err != nil {
+  // the properties tell which keys the filter holds
+  if err := t.parseProperties(); err != nil {
     return err
+  } else if err := t.parseFilter(); err != nil {
+    return err
+  }
+  return t.parseRangeDels()
+}
+
+func (t *tableImpl) parseProperties() error {
+  iter := t.findMetaBlock(PropertiesBlockName)
+  if iter == nil {
+    t.props = &TableProperties{UserCollected : make(map[string][]byte)}
+    return nil
+  }
+  
+  handler := t.decodeHandler(iter.Value().([]byte))
+  if handler == nil {
+    return errors.New("bad properties block handler")
+  }
+  
+  block, err := t.parseIndex(handler)
+  if err != nil {
+    return err
+  }
+  if t.props, err = decodeProperties(block); err != nil {
+    return err
+  } else if t.props.IndexPartitions > 0 {
+    t.partitions = newPartitionCache(util.Global.IndexPartitionCacheEntries)
   }
   return nil
 }
@@ -379,36 +628,101 @@ func (t *tableImpl) parseFilter() error {
     return nil
   }
 
-  filtername := fmt.Sprintf("filter.%s", t.option.Policy.Name())
-  iter := t.metaindex.NewIterator(t.option.Comparator)
-  iter.Seek([]byte(filtername))
-  
-  if !iter.Valid() {
+  // the name of the filter block tells the layout of the filters
+  var iter mem.Iterator
+  for ftype, prefix := range filterBlockPrefixes {
+    if iter = t.findMetaBlock(prefix + t.option.Policy.Name()); iter != nil {
+      t.filterType = ftype
+      break
+    }
+  }
+  if iter == nil && t.option.Format == util.LevelDBFormat {
+    // LevelDB reads tables written with another policy, or none
+    return nil
+  } else if iter == nil {
     return errors.New("could not find given policy")   
-  } else if name := iter.Key().([]byte); string(name) != filtername {
-    return errors.New("could not find given policy")
+  }
+
+  // native tables built before the filters held user keys can't be
+  // matched by the user keys of the lookups, LevelDB always held them
+  _, userKeys := t.option.Policy.(*mem.InternalFilterPolicy)
+  if userKeys && t.option.Format != util.LevelDBFormat && !t.props.FilterUserKeys {
+    return nil
   }
   
-  handler := DecodeHandler(iter.Value().([]byte))
-  if content, err :=  t.readContent(handler.offset, handler.size); err != nil {
+  handler := t.decodeHandler(iter.Value().([]byte))
+  if handler == nil {
+    return errors.New("bad filter block handler")
+  } else if content, err :=  t.readBlock(handler); err != nil {
     return err
-  } else {
+  } else if t.filterType == util.BlockFilter {
     t.filter = filter.NewBlockReader(t.option.Policy, content)
+  } else if t.filterType == util.FullFilter {
+    t.filter = filter.NewFullReader(t.option.Policy, content)
+  } else if index := NewBlock(content, t.option.Format); index == nil {
+    return errors.New("bad partitioned filter index")
+  } else {
+    t.filter = newPartitionedFilter(t, index)
   }
   return nil
 }
 
-func (t *tableImpl) parseIndex(handler *BlockHandler) (Block, error) {
-  if handler.size > t.filesize {
-    msg := fmt.Sprintf("index size too large %d/%d", handler.size, t.filesize)
-    return nil, errors.New(msg)
+func (t *tableImpl) parseRangeDels() error {
+  t.rangeDels = mem.RangeTombstones{}
+  
+  iter := t.findMetaBlock(RangeDelBlockName)
+  if iter == nil {
+    return nil
+  }
+  
+  handler := t.decodeHandler(iter.Value().([]byte))
+  if handler == nil {
+    return errors.New("bad range tombstone block handler")
+  }
+  
+  block, err := t.parseIndex(handler)
+  if err != nil {
+    return err
+  }
+  
+  biter := block.NewIterator(t.option.Comparator)
+  for biter.SeekToFirst(); biter.Valid(); biter.Next() {
+    tombstone, err := mem.DecodeRangeTombstone(biter.Key().([]byte), biter.Value().([]byte))
+    if err != nil {
+      return err
+    }
+    t.rangeDels = append(t.rangeDels, tombstone)
   }
+  return nil
+}
 
-  content, err := t.readContent(handler.offset, handler.size)
+// Return an iterator positioned at the metaindex entry of the block
+// name, nil if the table has no such block.  Meta block names are not
+// internal keys, so the entries are scanned instead of searched.
+func (t *tableImpl) findMetaBlock(name string) mem.Iterator {
+  iter := t.metaindex.NewIterator(util.BinaryComparator)
+  for iter.SeekToFirst(); iter.Valid(); iter.Next() {
+    if string(iter.Key().([]byte)) == name {
+      return iter
+    }
+  }
+  return nil
+}
+
+func (t *tableImpl) RangeTombstones() mem.RangeTombstones {
+  return t.rangeDels
+}
+
+func (t *tableImpl) Properties() *TableProperties {
+  return t.props
+}
+
+func (t *tableImpl) parseIndex(handler *BlockHandler) (Block, error) {
+  content, err := t.readBlock(handler)
   if err != nil {
     return nil, err
   }
-  reader := NewBlock(content)
+  reader := NewBlock(content, t.option.Format)
   if reader == nil {
     return nil, errors.New("parse index block failed")
   }
@@ -417,8 +731,12 @@ func (t *tableImpl) parseIndex(handler *BlockHandler) (Block, error) {
 }
 
 func (t *tableImpl) parseFooter() error {
-  footer := new(FooterHandler)
-  content, err := t.readContent(t.filesize - footer.Size(), footer.Size())
+  footer := &FooterHandler{format : t.option.Format}
+  size := int64(maxFooterSize)
+  if t.filesize < size {
+    size = t.filesize
+  }
+  content, err := t.readContent(uint64(t.filesize - size), uint64(size))
   if err != nil {
     return err
   }
@@ -429,13 +747,47 @@ func (t *tableImpl) parseFooter() error {
   return nil
 }
 
-func (t *tableImpl) readContent(offset, size int) ([]byte, error) {
+// Return the content of the block handler points to.  The trailers of
+// LevelDB blocks are checked and dropped, and snappy compressed blocks
+// are decompressed.
+func (t *tableImpl) readBlock(handler *BlockHandler) ([]byte, error) {
+  if t.option.Format != util.LevelDBFormat {
+    return t.readContent(handler.offset, handler.size)
+  }
+
+  content, err := t.readContent(handler.offset, handler.size + blockTrailerSize)
+  if err != nil {
+    return nil, err
+  }
+
+  trailer := content[handler.size:]
+  content = content[:handler.size]
+  if binary.LittleEndian.Uint32(trailer[1:]) != util.MaskedCRC(content, trailer[:1]) {
+    msg := fmt.Sprintf("block checksum mismatch at %d", handler.offset)
+    return nil, errors.New(msg)
+  }
+
+  switch trailer[0] {
+  case noCompression:
+    return content, nil
+  case snappyCompression:
+    return snappyDecode(content)
+  }
+  msg := fmt.Sprintf("block at %d compressed with unsupported type %d", handler.offset, trailer[0])
+  return nil, errors.New(msg)
+}
+
+func (t *tableImpl) readContent(offset, size uint64) ([]byte, error) {
+  if offset > uint64(t.filesize) || size > uint64(t.filesize) - offset {
+    msg := fmt.Sprintf("content %d/%d past the end of table %d", offset, size, t.filesize)
+    return nil, errors.New(msg)
+  }
   buffer := make([]byte, size)
-  t.file.Seek(int64(offset), os.SEEK_SET)
 
-  if cnt, err := t.file.Read(buffer); err != nil {
+  // tables are shared between goroutines, so never move the file offset
+  if cnt, err := t.file.ReadAt(buffer, int64(offset)); err != nil {
     return nil, err
-  } else if cnt < size {
+  } else if uint64(cnt) < size {
     msg := fmt.Sprintf("read content failed %d / %d", cnt, size)
     return nil, errors.New(msg)
   }
@@ -444,29 +796,66 @@ func (t *tableImpl) readContent(offset, size int) ([]byte, error) {
 
 
 func (t *tableImpl) NewIterator() mem.Iterator {
-  indexIter := t.index.NewIterator(t.option.Comparator)
+  indexIter := t.newIndexIterator(t.option.Comparator)
   return NewTwoLevelIterator(indexIter, t.NewBlockIterator, &util.DefaultReadOption,
       util.BinaryCompare)
 }
 
-func (t *tableImpl) ApproximateOffsetOf(key []byte) int {
-  iter := t.index.NewIterator(t.option.Comparator)
+func (t *tableImpl) ApproximateOffsetOf(key []byte) int64 {
+  iter := t.newIndexIterator(t.option.Comparator)
   iter.Seek(key)
   if !iter.Valid() {
     return t.filesize
   }
   
-  handler := DecodeHandler(iter.Value().([]byte))
-  return handler.offset
+  if handler := t.decodeHandler(iter.Value().([]byte)); handler != nil {
+    return int64(handler.offset)
+  }
+  return t.filesize
 }
 
 func (t *tableImpl) NewBlockIterator(value interface{}) mem.Iterator {
-  handler := DecodeHandler(value.([]byte))
-  if content, err := t.readContent(handler.offset, handler.size); err != nil {
+  handler := t.decodeHandler(value.([]byte))
+  if handler == nil {
     return nil
-  } else if block := NewBlock(content); block == nil {
+  } else if content, err := t.readBlock(handler); err != nil {
+    return nil
+  } else if block := NewBlock(content, t.option.Format); block == nil {
     return nil
   } else {
-      return block.NewIterator(t.option.Comparator)
+      return t.convertKeys(block.NewIterator(t.option.Comparator))
   }
 }
+
+// Return the handler encoded in value, an entry of the index or the
+// metaindex block, nil if value is too short
+func (t *tableImpl) decodeHandler(value []byte) *BlockHandler {
+  handler, _ := t.footer.decodeHandler(value)
+  return handler
+}
+
+// Return iter, over keys stored in the format of the table, as an
+// iterator over internal keys of this package
+func (t *tableImpl) convertKeys(iter mem.Iterator) mem.Iterator {
+  if t.option.Format == util.LevelDBFormat {
+    return &levelDBKeyIterator{iter}
+  }
+  return iter
+}
+
+// levelDBKeyIterator converts the internal keys of LevelDB, whose
+// value types are numbered differently, passing through it
+type levelDBKeyIterator struct {
+  mem.Iterator
+}
+
+func (i *levelDBKeyIterator) Key() interface{} {
+  if key := i.Iterator.Key(); key != nil {
+    return util.LevelDBInternalKey(key.([]byte))
+  }
+  return nil
+}
+
+func (i *levelDBKeyIterator) Seek(key interface{}) {
+  i.Iterator.Seek(util.LevelDBInternalKey(key.([]byte)))
+}
@@ -4,11 +4,15 @@ import (
   "os"
   "fmt"
   "sort"
+  "time"
   "testing"
+  "io/ioutil"
+  "encoding/binary"
 )
 
 import (
   "github.com/jellybean4/goleveldb/util"
+  "github.com/jellybean4/goleveldb/mem"
 )
 
 func TestTableBuild(t *testing.T) {
@@ -226,3 +230,565 @@ func TestTableBuild(t *testing.T) {
     t.Errorf("builder status %d after finish", builder.Status())
   }
 }
+
+func TestTableRangeTombstones(t *testing.T) {
+  filename := "/tmp/test_rangedel.dat"
+  builder := NewTableBuilder(filename, &util.DefaultOption)
+  for i := 0; i < 100; i++ {
+    key := fmt.Sprintf("key%03d", i)
+    builder.Add([]byte(key), []byte(key))
+  }
+  
+  tombstones := []*mem.RangeTombstone{
+    &mem.RangeTombstone{Start : []byte("key050"), End : []byte("key060"), Seq : 20},
+    &mem.RangeTombstone{Start : []byte("key010"), End : []byte("key020"), Seq : 10},
+  }
+  for _, tombstone := range tombstones {
+    builder.AddRangeTombstone(tombstone.Key(), tombstone.End)
+  }
+  builder.Finish()
+  defer os.Remove(filename)
+  
+  table := OpenTable(filename, builder.FileSize(), &util.DefaultOption)
+  if table == nil {
+    t.Errorf("open table %s failed", filename)
+    return
+  }
+  
+  rslt := table.RangeTombstones()
+  if len(rslt) != 2 {
+    t.Errorf("range tombstones cnt wrong %d", len(rslt))
+    return
+  }
+  
+  for i, tombstone := range []*mem.RangeTombstone{tombstones[1], tombstones[0]} {
+    if string(rslt[i].Start) != string(tombstone.Start) || string(rslt[i].End) != string(tombstone.End) ||
+        rslt[i].Seq != tombstone.Seq {
+      t.Errorf("range tombstone %d not match %s %s %d", i, rslt[i].Start, rslt[i].End, rslt[i].Seq)
+    }
+  }
+  
+  if key, _ := table.Get([]byte("key055")); string(key) != "key055" {
+    t.Errorf("get key within tombstone not match %s", key)
+  }
+}
+
+// Tables written before the footer was versioned hold the handlers as
+// fixed uint32 and stay readable
+func TestLegacyTable(t *testing.T) {
+  filename := "/tmp/test_legacy.dat"
+  option := util.DefaultOption
+  option.Policy = nil
+
+  data := NewBlockBuilder(option.Interval, util.NativeFormat)
+  for i := 0; i < 100; i++ {
+    data.Add([]byte(fmt.Sprintf("key%03d", i)), []byte(fmt.Sprintf("val%03d", i)))
+  }
+  content := data.Finish()
+  content = append(content, make([]byte, blockTrailerSize)...)
+
+  legacyHandler := func(size, offset int) []byte {
+    store := make([]byte, 8)
+    binary.LittleEndian.PutUint32(store, uint32(size))
+    binary.LittleEndian.PutUint32(store[4:], uint32(offset))
+    return store
+  }
+  index := NewBlockBuilder(1, util.NativeFormat)
+  index.Add([]byte("key099"), legacyHandler(len(content) - blockTrailerSize, 0))
+  metaindex := NewBlockBuilder(1, util.NativeFormat).Finish()
+  metaOffset := len(content)
+  content = append(content, metaindex...)
+  indexOffset := len(content)
+  indexBlock := index.Finish()
+  content = append(content, indexBlock...)
+
+  content = append(content, legacyHandler(len(metaindex), metaOffset)...)
+  content = append(content, legacyHandler(len(indexBlock), indexOffset)...)
+  magic := make([]byte, 8)
+  binary.LittleEndian.PutUint64(magic, FOOTER_MAGIC)
+  content = append(content, magic...)
+
+  if err := ioutil.WriteFile(filename, content, 0600); err != nil {
+    t.Fatalf("write legacy table failed %v", err)
+  }
+  defer os.Remove(filename)
+
+  table := OpenTable(filename, int64(len(content)), &option)
+  if table == nil {
+    t.Fatalf("open legacy table failed")
+  }
+  defer table.Close()
+
+  iter := table.NewIterator()
+  cnt := 0
+  for iter.SeekToFirst(); iter.Valid(); iter.Next() {
+    if string(iter.Value().([]byte)) != fmt.Sprintf("val%03d", cnt) {
+      t.Errorf("legacy table value %d not match %s", cnt, iter.Value())
+    }
+    cnt++
+  }
+  if cnt != 100 {
+    t.Errorf("legacy table holds %d entries", cnt)
+  }
+  if key, val := table.Get([]byte("key042")); string(key) != "key042" || string(val) != "val042" {
+    t.Errorf("get key of legacy table returns %s %s", key, val)
+  }
+  if props := table.Properties(); props.NumEntries != 0 || len(props.UserCollected) != 0 {
+    t.Errorf("legacy table has properties %v", props)
+  }
+}
+
+func TestLargeFooter(t *testing.T) {
+  for _, format := range []int{util.NativeFormat, util.LevelDBFormat} {
+    footer := newFooter(format)
+    footer.metaindex = &BlockHandler{1 << 20, 5 << 32}
+    footer.index = &BlockHandler{1 << 33, 6 << 32}
+    content := footer.Encode()
+    if len(content) != footer.Size() {
+      t.Errorf("footer of format %d size %d not %d", format, len(content), footer.Size())
+    }
+
+    // the footer is decoded from the tail of the table
+    decoded := &FooterHandler{format : format}
+    tail := append(make([]byte, 7), content...)
+    if !decoded.Decode(tail) {
+      t.Errorf("decode footer of format %d failed", format)
+    } else if *decoded.metaindex != *footer.metaindex || *decoded.index != *footer.index {
+      t.Errorf("footer handlers of format %d not match %v %v", format, decoded.metaindex, decoded.index)
+    }
+  }
+
+  handler := &BlockHandler{1 << 40, 1 << 50}
+  if decoded := DecodeHandler(EncodeHandler(handler)); decoded == nil || *decoded != *handler {
+    t.Errorf("decode handler returns %v", decoded)
+  }
+}
+
+// countCollector counts the entries of each type
+type countCollector struct {
+  counts map[byte]int
+}
+
+func (c *countCollector) Add(key, value []byte, rtype byte) {
+  c.counts[rtype]++
+}
+
+func (c *countCollector) Finish() map[string][]byte {
+  return map[string][]byte {
+    "puts" : []byte(fmt.Sprintf("%d", c.counts[mem.ValueType])),
+    "deletes" : []byte(fmt.Sprintf("%d", c.counts[mem.DeleteType])),
+  }
+}
+
+func (c *countCollector) Name() string {
+  return "CountCollector"
+}
+
+func TestTableProperties(t *testing.T) {
+  filename := "/tmp/test_props.dat"
+  option := util.DefaultOption
+  option.Comparator = mem.NewInternalKeyComparator(util.BinaryComparator)
+  option.TablePropertiesCollectors = []func() util.TablePropertiesCollector {
+    func() util.TablePropertiesCollector {
+      return &countCollector{make(map[byte]int)}
+    },
+  }
+
+  builder := NewTableBuilder(filename, &option)
+  var keySize, valueSize uint64
+  for i := 0; i < 1000; i++ {
+    key := []byte(fmt.Sprintf("key%04d", i))
+    val := []byte(fmt.Sprintf("val%04d", i))
+    rtype := byte(mem.ValueType)
+    if i % 4 == 0 {
+      rtype, val = mem.DeleteType, []byte{}
+    }
+    ikey := util.NewInternalKey(key, uint64(i + 1), rtype).Encode()
+    builder.Add(ikey, val)
+    keySize += uint64(len(ikey))
+    valueSize += uint64(len(val))
+  }
+  start := time.Now().Unix()
+  builder.Finish()
+  defer os.Remove(filename)
+
+  table := OpenTable(filename, builder.FileSize(), &option)
+  if table == nil {
+    t.Fatalf("open table %s failed", filename)
+  }
+  defer table.Close()
+
+  props := table.Properties()
+  if props.NumEntries != 1000 || props.NumDeletions != 250 {
+    t.Errorf("entries %d deletions %d not match", props.NumEntries, props.NumDeletions)
+  }
+  if props.RawKeySize != keySize || props.RawValueSize != valueSize {
+    t.Errorf("raw key size %d value size %d not match", props.RawKeySize, props.RawValueSize)
+  }
+  if props.DataSize == 0 || props.IndexSize == 0 || props.FilterSize == 0 {
+    t.Errorf("block sizes %d %d %d missing", props.DataSize, props.IndexSize, props.FilterSize)
+  }
+  if props.DataSize + props.IndexSize + props.FilterSize >= uint64(builder.FileSize()) {
+    t.Errorf("block sizes %d %d %d larger than the table", props.DataSize, props.IndexSize, props.FilterSize)
+  }
+  if props.ComparatorName != util.BinaryComparator.Name() {
+    t.Errorf("comparator name %s not match", props.ComparatorName)
+  }
+  if props.CreationTime < start {
+    t.Errorf("creation time %d before %d", props.CreationTime, start)
+  }
+  if string(props.UserCollected["puts"]) != "750" || string(props.UserCollected["deletes"]) != "250" {
+    t.Errorf("user collected properties not match %s %s", props.UserCollected["puts"], props.UserCollected["deletes"])
+  }
+}
+
+func TestPartitionedIndex(t *testing.T) {
+  filename := "/tmp/test_partition.dat"
+  option := util.DefaultOption
+  option.BlockSize = 256
+  option.IndexPartitionSize = 512
+  cnt := 20000
+
+  builder := NewTableBuilder(filename, &option)
+  for i := 0; i < cnt; i++ {
+    key := fmt.Sprintf("key%06d", i)
+    builder.Add([]byte(key), []byte(fmt.Sprintf("val%06d", i)))
+  }
+  builder.Finish()
+  defer os.Remove(filename)
+
+  table := OpenTable(filename, builder.FileSize(), &option)
+  if table == nil {
+    t.Fatalf("open table %s failed", filename)
+  }
+  defer table.Close()
+
+  props := table.Properties()
+  if props.IndexPartitions < 2 {
+    t.Fatalf("index split into %d partitions", props.IndexPartitions)
+  }
+
+  iter := table.NewIterator()
+  i := 0
+  for iter.SeekToFirst(); iter.Valid(); iter.Next() {
+    if key := fmt.Sprintf("key%06d", i); string(iter.Key().([]byte)) != key {
+      t.Fatalf("iter key %s not match %s", iter.Key(), key)
+    }
+    i++
+  }
+  if i != cnt {
+    t.Errorf("iter over %d keys of %d", i, cnt)
+  }
+
+  i = cnt - 1
+  for iter.SeekToLast(); iter.Valid(); iter.Prev() {
+    if key := fmt.Sprintf("key%06d", i); string(iter.Key().([]byte)) != key {
+      t.Fatalf("iter key backward %s not match %s", iter.Key(), key)
+    }
+    i--
+  }
+  if i != -1 {
+    t.Errorf("iter backward stops at %d", i)
+  }
+
+  for i := 0; i < cnt; i += 37 {
+    key := fmt.Sprintf("key%06d", i)
+    if k, v := table.Get([]byte(key)); string(k) != key || string(v) != fmt.Sprintf("val%06d", i) {
+      t.Errorf("get key %s returns %s %s", key, k, v)
+    }
+  }
+  if k, _ := table.Get([]byte("key999999")); k != nil {
+    t.Errorf("get key past the end returns %s", k)
+  }
+
+  var last int64
+  for i := 0; i < cnt; i += 1000 {
+    offset := table.ApproximateOffsetOf([]byte(fmt.Sprintf("key%06d", i)))
+    if offset < last {
+      t.Errorf("approximate offset of key %d goes back %d %d", i, offset, last)
+    }
+    last = offset
+  }
+
+  // the partitions read are kept within the bound
+  if cached := table.(*tableImpl).partitions.lru.Len(); cached > util.Global.IndexPartitionCacheEntries {
+    t.Errorf("%d partitions cached", cached)
+  }
+}
+
+func TestFilterTypes(t *testing.T) {
+  filename := "/tmp/test_filter_types.dat"
+  defer os.Remove(filename)
+  cnt := 10000
+
+  cases := []struct {
+    filterType     int
+    partitionSize  int
+    metaName       string
+  }{
+    {util.BlockFilter, 0, "filter.leveldb.BloomFilter"},
+    {util.FullFilter, 0, "fullfilter.leveldb.BloomFilter"},
+    {util.PartitionedFilter, 512, "partitionedfilter.leveldb.BloomFilter"},
+    // without index partitions the filter can't be partitioned
+    {util.PartitionedFilter, 0, "fullfilter.leveldb.BloomFilter"},
+  }
+  for _, c := range cases {
+    option := util.DefaultOption
+    option.BlockSize = 256
+    option.FilterType = c.filterType
+    option.IndexPartitionSize = c.partitionSize
+
+    builder := NewTableBuilder(filename, &option)
+    for i := 0; i < cnt; i++ {
+      builder.Add([]byte(fmt.Sprintf("key%06d", i)), []byte(fmt.Sprintf("val%06d", i)))
+    }
+    builder.Finish()
+
+    table := OpenTable(filename, builder.FileSize(), &option)
+    if table == nil {
+      t.Fatalf("open table with filter type %d failed", c.filterType)
+    }
+    impl := table.(*tableImpl)
+    if impl.findMetaBlock(c.metaName) == nil {
+      t.Errorf("filter type %d stored without meta block %s", c.filterType, c.metaName)
+    }
+    if table.Properties().FilterSize == 0 {
+      t.Errorf("filter type %d has no filter size", c.filterType)
+    }
+
+    for i := 0; i < cnt; i += 7 {
+      key := fmt.Sprintf("key%06d", i)
+      if k, v := table.Get([]byte(key)); string(k) != key || string(v) != fmt.Sprintf("val%06d", i) {
+        t.Errorf("filter type %d get key %s returns %s %s", c.filterType, key, k, v)
+      }
+    }
+
+    // the whole table filters reject most of the missing keys
+    if impl.filterType != util.BlockFilter {
+      matched := 0
+      for i := 0; i < cnt; i++ {
+        if impl.filter.KeyMayMatch(0, []byte(fmt.Sprintf("key%06dx", i))) {
+          matched++
+        }
+      }
+      if matched > cnt / 20 {
+        t.Errorf("filter type %d matches %d missing keys of %d", c.filterType, matched, cnt)
+      }
+    }
+    table.Close()
+  }
+}
+
+func TestPrefixFilter(t *testing.T) {
+  filename := "/tmp/test_prefix_filter.dat"
+  defer os.Remove(filename)
+
+  for _, filterType := range []int{util.BlockFilter, util.FullFilter, util.PartitionedFilter} {
+    option := util.DefaultOption
+    option.BlockSize = 256
+    option.IndexPartitionSize = 512
+    option.FilterType = filterType
+    option.PrefixExtractor = util.NewDelimitedPrefixExtractor('/')
+
+    // only the even tenants have keys
+    builder := NewTableBuilder(filename, &option)
+    for tenant := 0; tenant < 200; tenant += 2 {
+      for i := 0; i < 20; i++ {
+        key := fmt.Sprintf("tenant%03d/entity/%02d", tenant, i)
+        builder.Add([]byte(key), []byte(key))
+      }
+    }
+    builder.Finish()
+
+    table := OpenTable(filename, builder.FileSize(), &option)
+    if table == nil {
+      t.Fatalf("open table with filter type %d failed", filterType)
+    }
+    if name := table.Properties().PrefixExtractorName; name != option.PrefixExtractor.Name() {
+      t.Errorf("filter type %d prefix extractor %s", filterType, name)
+    }
+
+    matched := 0
+    for tenant := 0; tenant < 200; tenant++ {
+      key := []byte(fmt.Sprintf("tenant%03d/", tenant))
+      if tenant % 2 == 0 && !table.PrefixMayMatch(key) {
+        t.Errorf("filter type %d rules out prefix %s", filterType, key)
+      } else if tenant % 2 == 1 && table.PrefixMayMatch(key) {
+        matched++
+      }
+    }
+    if matched > 10 {
+      t.Errorf("filter type %d matches %d missing prefixes", filterType, matched)
+    }
+
+    // the iterator skips the table for a missing prefix only
+    iter := NewPrefixIterator(table.NewIterator(), table)
+    if iter.Seek([]byte("tenant042/entity/05")); !iter.Valid() || string(iter.Key().([]byte)) != "tenant042/entity/05" {
+      t.Errorf("filter type %d seek within prefix failed", filterType)
+    }
+    missing := 0
+    for tenant := 1; tenant < 200; tenant += 2 {
+      if iter.Seek([]byte(fmt.Sprintf("tenant%03d/", tenant))); iter.Valid() {
+        missing++
+      }
+    }
+    if missing > 10 {
+      t.Errorf("filter type %d seeks %d missing prefixes", filterType, missing)
+    }
+    table.Close()
+
+    // the prefixes of another extractor are not used
+    other := option
+    other.PrefixExtractor = util.NewFixedPrefixExtractor(6)
+    table = OpenTable(filename, builder.FileSize(), &other)
+    if !table.PrefixMayMatch([]byte("absent/")) {
+      t.Errorf("filter type %d rules out prefix of another extractor", filterType)
+    }
+    table.Close()
+  }
+}
+
+func TestInternalFilter(t *testing.T) {
+  filename := "/tmp/test_internal_filter.dat"
+  defer os.Remove(filename)
+  cnt := 2000
+
+  build := func(option *util.Option) int64 {
+    builder := NewTableBuilder(filename, option)
+    for i := 0; i < cnt; i++ {
+      key := []byte(fmt.Sprintf("key%04d", i))
+      // the versions of a key from the newest
+      for seq := uint64(3); seq > 0; seq-- {
+        val := []byte(fmt.Sprintf("val%04d.%d", i, seq))
+        builder.Add(util.NewInternalKey(key, uint64(i) * 10 + seq, mem.ValueType).Encode(), val)
+      }
+    }
+    builder.Finish()
+    return builder.FileSize()
+  }
+
+  for _, filterType := range []int{util.BlockFilter, util.FullFilter, util.PartitionedFilter} {
+    option := util.DefaultOption
+    option.Comparator = mem.NewInternalKeyComparator(util.BinaryComparator)
+    option.Policy = mem.NewInternalFilterPolicy(option.Policy)
+    option.BlockSize = 256
+    option.IndexPartitionSize = 512
+    option.FilterType = filterType
+
+    table := OpenTable(filename, build(&option), &option)
+    if table == nil {
+      t.Fatalf("open table with filter type %d failed", filterType)
+    }
+    if !table.Properties().FilterUserKeys || table.(*tableImpl).filter == nil {
+      t.Errorf("filter type %d doesn't filter user keys", filterType)
+    }
+
+    for i := 0; i < cnt; i += 7 {
+      key := []byte(fmt.Sprintf("key%04d", i))
+      // lookups newer than every version and between two of them
+      for seq, expect := range map[uint64]uint64{util.Global.MaxSeq : 3, uint64(i) * 10 + 2 : 2} {
+        lookup := util.NewInternalKey(key, seq, mem.SeekType).Encode()
+        k, v := table.Get(lookup)
+        if k == nil || string(util.ExtractUserKey(k)) != string(key) {
+          t.Errorf("filter type %d get %s at %d returns %v", filterType, key, seq, k)
+        } else if string(v) != fmt.Sprintf("val%04d.%d", i, expect) {
+          t.Errorf("filter type %d get %s at %d returns %s", filterType, key, seq, v)
+        }
+      }
+    }
+
+    matched := 0
+    for i := 0; i < cnt; i++ {
+      lookup := util.NewInternalKey([]byte(fmt.Sprintf("key%04dx", i)), util.Global.MaxSeq, mem.SeekType).Encode()
+      if k, _ := table.Get(lookup); k != nil && string(util.ExtractUserKey(k)) == fmt.Sprintf("key%04dx", i) {
+        t.Errorf("filter type %d get missing key %s", filterType, k)
+      }
+      impl := table.(*tableImpl)
+      if impl.filterType != util.BlockFilter && impl.filter.KeyMayMatch(0, lookup) {
+        matched++
+      }
+    }
+    if matched > cnt / 20 {
+      t.Errorf("filter type %d matches %d missing keys of %d", filterType, matched, cnt)
+    }
+    table.Close()
+
+    // tables whose filter holds the internal keys are read unfiltered
+    legacy := option
+    legacy.Policy = util.DefaultOption.Policy
+    table = OpenTable(filename, build(&legacy), &option)
+    if table.Properties().FilterUserKeys || table.(*tableImpl).filter != nil {
+      t.Errorf("filter type %d filters internal keys by user key", filterType)
+    }
+    lookup := util.NewInternalKey([]byte("key0007"), util.Global.MaxSeq, mem.SeekType).Encode()
+    if k, v := table.Get(lookup); k == nil || string(v) != "val0007.3" {
+      t.Errorf("filter type %d get from legacy table returns %s", filterType, v)
+    }
+    table.Close()
+  }
+}
+
+func TestBlockHashIndex(t *testing.T) {
+  filename := "/tmp/test_block_hash_index.dat"
+  defer os.Remove(filename)
+  cnt := 2000
+
+  option := util.DefaultOption
+  option.Comparator = mem.NewInternalKeyComparator(util.BinaryComparator)
+  option.Policy = nil
+  option.Interval = 4
+  option.BlockHashRatio = 0.75
+
+  builder := NewTableBuilder(filename, &option)
+  for i := 0; i < cnt; i++ {
+    key := []byte(fmt.Sprintf("key%04d", i))
+    // versions of a key may span restart intervals
+    for seq := uint64(3); seq > 0; seq-- {
+      val := []byte(fmt.Sprintf("val%04d.%d", i, seq))
+      builder.Add(util.NewInternalKey(key, uint64(i) * 10 + seq, mem.ValueType).Encode(), val)
+    }
+  }
+  builder.Finish()
+
+  table := OpenTable(filename, builder.FileSize(), &option)
+  if table == nil {
+    t.Fatalf("open table with block hash index failed")
+  }
+  defer table.Close()
+
+  impl := table.(*tableImpl)
+  iiter := impl.newIndexIterator(option.Comparator)
+  iiter.SeekToFirst()
+  if biter, ok := impl.NewBlockIterator(iiter.Value()).(*blockIterImpl); !ok || biter.block.buckets == nil {
+    t.Errorf("data block has no hash index")
+  }
+
+  for i := 0; i < cnt; i++ {
+    key := []byte(fmt.Sprintf("key%04d", i))
+    for seq, expect := range map[uint64]uint64{util.Global.MaxSeq : 3, uint64(i) * 10 + 2 : 2, uint64(i) * 10 + 1 : 1} {
+      lookup := util.NewInternalKey(key, seq, mem.SeekType).Encode()
+      k, v := table.Get(lookup)
+      if k == nil || string(util.ExtractUserKey(k)) != string(key) {
+        t.Errorf("get %s at %d returns %v", key, seq, k)
+      } else if string(v) != fmt.Sprintf("val%04d.%d", i, expect) {
+        t.Errorf("get %s at %d returns %s", key, seq, v)
+      }
+    }
+
+    lookup := util.NewInternalKey([]byte(fmt.Sprintf("key%04dx", i)), util.Global.MaxSeq, mem.SeekType).Encode()
+    if k, _ := table.Get(lookup); k != nil && string(util.ExtractUserKey(k)) == fmt.Sprintf("key%04dx", i) {
+      t.Errorf("get missing key %s", k)
+    }
+  }
+
+  iter := table.NewIterator()
+  for iter.SeekToFirst(); cnt > 0 && iter.Valid(); iter.Next() {
+    cnt--
+    for j := 0; j < 2; j++ {
+      iter.Next()
+    }
+  }
+  if cnt != 0 || iter.Valid() {
+    t.Errorf("iterate table with block hash index, %d keys left", cnt)
+  }
+}
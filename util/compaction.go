@@ -0,0 +1,38 @@
+package util
+
+// Compaction styles, chosen through Option.CompactionStyle
+const (
+  // Merge each level into the next once it grows over its size limit
+  LevelCompaction = iota
+  
+  // Merge sorted runs of similar size, trading read and space
+  // amplification for less write amplification
+  UniversalCompaction
+  
+  // Keep all files in level0 and drop the oldest ones once they take
+  // too much space or grow too old, for data that is never updated
+  FIFOCompaction
+)
+
+// Decisions a CompactionFilter may make about an entry
+const (
+  FilterKeep = iota    // keep the entry unchanged
+  FilterRemove         // drop the entry as if it was deleted
+  FilterChange         // keep the key but replace its value
+)
+
+// CompactionFilter allows an application to drop or rewrite values
+// while they are merged by background compactions.  Entries which may
+// still be read through a live snapshot are never passed to the filter.
+// Values put with a ttl are passed without their expiry, which a
+// changed value keeps.
+type CompactionFilter interface {
+  // Decide the fate of the entry "key" -> "value" which is compacted
+  // into level.  bottommost is true iff no older data for the compacted
+  // key range lives below level.  When FilterChange is returned, the
+  // second result is stored as the new value.
+  Filter(level int, key, value []byte, bottommost bool) (int, []byte)
+  
+  // Name of this filter
+  Name() string
+}
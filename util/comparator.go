@@ -8,6 +8,9 @@ type Comparator interface {
   // Return the shortest data between a and b
   FindShortestSep(a, b interface{}) interface{}
   
+  // Return a short data no smaller than a
+  FindShortSuccessor(a interface{}) interface{}
+  
   // Name of this comparator
   Name() string
 }
@@ -68,15 +71,27 @@ func (binary binaryCmp) FindShortestSep(val1, val2 interface{}) interface{} {
   }
 
   var pos int
-  for pos = 0; pos < minLen; pos++ {
-    if key1[pos] + 1 >= key2[pos] {
-      continue
-    }
+  for pos = 0; pos < minLen && key1[pos] == key2[pos]; pos++ {
   }
 
-  if pos < minLen {
-    key1[pos]++
-    return key1[:pos + 1]
+  // key1 is left as it is if it is a prefix of key2
+  if pos < minLen && key1[pos] < 0xff && key1[pos] + 1 < key2[pos] {
+    rslt := append([]byte{}, key1[:pos + 1]...)
+    rslt[pos]++
+    return rslt
   }
   return key1
 }
+
+func (binary binaryCmp) FindShortSuccessor(val interface{}) interface{} {
+  key := val.([]byte)
+  for pos := 0; pos < len(key); pos++ {
+    if key[pos] != 0xff {
+      rslt := append([]byte{}, key[:pos + 1]...)
+      rslt[pos]++
+      return rslt
+    }
+  }
+  // key is a run of 0xff
+  return key
+}
@@ -2,7 +2,16 @@ package util
 
 // Config defines settings for database
 type Config struct {
+  // Hard limit on the number of level0 files.  We stop writes at this point.
   L0StopWritesTrigger int
+
+  // Soft limit on the number of level0 files.  We slow down writes at
+  // this point, delaying each write once by L0SlowdownWritesDelay.
+  L0SlowdownWritesTrigger int
+
+  // Microseconds a single write is delayed once the slowdown trigger is hit
+  L0SlowdownWritesDelay int
+
   MaxLevel int
   MaxSeq uint64
   // Maximum level to which a new compacted memtable is pushed if it
@@ -28,6 +37,45 @@ type Config struct {
   L0CompactionTrigger int
   
   TableCacheEntries int
+  
+  // Number of index partitions each open table with a partitioned
+  // index keeps in memory
+  IndexPartitionCacheEntries int
+
+  // Maximum number of table compactions running at the same time.
+  // Memtable flushes have a worker of their own and are not counted.
+  MaxBackgroundCompactions int
+
+  // Maximum number of key range shards a single compaction is split
+  // into and merged in parallel.  1 disables subcompactions.
+  MaxSubcompactions int
+
+  // Universal compaction: a sorted run joins the runs picked before it
+  // while it is at most this many percent larger than their total size
+  UniversalSizeRatio int
+
+  // Universal compaction: minimum number of sorted runs merged at once
+  UniversalMinMergeWidth int
+
+  // Universal compaction: all sorted runs are merged into the oldest
+  // one once the others take more than this percentage of its size
+  UniversalMaxSizeAmplificationPercent int
+
+  // FIFO compaction: the oldest files are dropped once all files take
+  // more than this many bytes
+  FIFOMaxTableFilesSize int
+
+  // FIFO compaction: files older than this many seconds are dropped,
+  // 0 keeps files regardless of their age
+  FIFOTTL int
+
+  // Maximum bytes of the batches written to the log as one record by
+  // the writer at the front of the write queue
+  MaxBatchGroupSize int
+
+  // Number of stripes of the key lock table of pessimistic
+  // transactions, each stripe has a mutex of its own
+  LockStripes int
 }
 
 // Global defines default db settings
@@ -35,6 +83,8 @@ var Global Config
 
 func init() {
   Global.L0StopWritesTrigger = 12
+  Global.L0SlowdownWritesTrigger = 8
+  Global.L0SlowdownWritesDelay = 1000
   Global.MaxLevel = 7
   Global.MaxSeq = 0x1 << 56 - 1
   Global.MaxMemCompactLevel = 2
@@ -43,4 +93,14 @@ func init() {
   Global.ExpandedCompactionByteSizeLimit = 25 * Global.TargetFileSize
   Global.L0CompactionTrigger = 4
   Global.TableCacheEntries = 16
+  Global.IndexPartitionCacheEntries = 8
+  Global.MaxBackgroundCompactions = 1
+  Global.MaxSubcompactions = 1
+  Global.UniversalSizeRatio = 1
+  Global.UniversalMinMergeWidth = 2
+  Global.UniversalMaxSizeAmplificationPercent = 200
+  Global.FIFOMaxTableFilesSize = 1024 * 1048576
+  Global.FIFOTTL = 0
+  Global.MaxBatchGroupSize = 1048576
+  Global.LockStripes = 16
 }
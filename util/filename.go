@@ -32,6 +32,12 @@ func TableFileName(dbname string, number int) string {
   return fmt.Sprintf("%s/%06d.%s", dbname, number, "ldb")
 }
 
+// Return the name older versions of LevelDB gave the sstable with the
+// specified number in the db named by "dbname".
+func SSTTableFileName(dbname string, number int) string {
+  return fmt.Sprintf("%s/%06d.%s", dbname, number, "sst")
+}
+
 // Return the name of the descriptor file for the db named by
 // "dbname" and the specified incarnation number.  The result will be
 // prefixed with "dbname".
@@ -92,7 +98,7 @@ func ParseFileName(filename string) (int, int) {
   switch rtype {
   case "log":
     return num, LogFile
-  case "ldb":
+  case "ldb", "sst":
     return num, TableFile
   case "dbtmp":
     return num, TempFile
@@ -101,13 +107,17 @@ func ParseFileName(filename string) (int, int) {
   return -1, -1
 }
 // Make the CURRENT file point to the descriptor file with the
-// specified number.
-func SetCurrentFile(dbname string, num int) error {
+// specified number.  LevelDB stores the name of the file relative to
+// the db directory.
+func SetCurrentFile(dbname string, num int, format int) error {
   filename := CurrentFileName(dbname)
   if file, err := os.OpenFile(filename, os.O_TRUNC | os.O_WRONLY | os.O_CREATE, 0660); err != nil {
     return err
   } else {
     desc := DescriptorFileName(dbname, num)
+    if format == LevelDBFormat {
+      desc = fmt.Sprintf("MANIFEST-%06d", num)
+    }
     file.WriteString(desc + "\n")
     file.Close()
   }
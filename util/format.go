@@ -4,6 +4,7 @@ import (
   "sort"
   "bytes"
   "errors"
+  "hash/crc32"
   "encoding/binary"
 )
 
@@ -35,6 +36,11 @@ func (l *LookupKey) UserKey() []byte {
   return l.key
 }
 
+// Return the sequence the lookup reads at
+func (l *LookupKey) Sequence() uint64 {
+  return l.seq
+}
+
 func (l *LookupKey) InternalKey() []byte {
   store := make([]byte, len(l.key) + 8)
   for i, b := range l.key {
@@ -146,6 +152,50 @@ func GetBytesLen(data []byte) []byte {
   return store
 }
 
+// Append data to buffer prefixed with its length as a varint32, the
+// way LevelDB stores strings
+func PutVarintBytes(buffer *bytes.Buffer, data []byte) {
+  store := make([]byte, binary.MaxVarintLen32)
+  buffer.Write(store[:binary.PutUvarint(store, uint64(len(data)))])
+  buffer.Write(data)
+}
+
+// Split data into the string PutVarintBytes stored at its beginning
+// and the rest, returns nil, nil if data is too short
+func GetVarintBytes(data []byte) ([]byte, []byte) {
+  clen, n := binary.Uvarint(data)
+  if n <= 0 || uint64(len(data) - n) < clen {
+    return nil, nil
+  }
+  return data[n : n + int(clen)], data[n + int(clen) : ]
+}
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+// Return the crc32c of the concatenation of data masked the way
+// LevelDB stores checksums, so a checksum of data holding checksums
+// is not trivially related to them
+func MaskedCRC(data ...[]byte) uint32 {
+  var crc uint32 = 0
+  for _, d := range data {
+    crc = crc32.Update(crc, castagnoli, d)
+  }
+  return (crc >> 15 | crc << 17) + 0xa282ead8
+}
+
+// Return a copy of the internal key ikey with the type numbering of
+// LevelDB, which numbers deletions 0 and values 1, the other way
+// around of this package.  As the conversion is its own inverse, it
+// converts keys read from LevelDB files back too.
+func LevelDBInternalKey(ikey []byte) []byte {
+  key := make([]byte, len(ikey))
+  copy(key, ikey)
+  if tpos := len(key) - 8; tpos >= 0 && key[tpos] <= 1 {
+    key[tpos] ^= 1
+  }
+  return key
+}
+
 func PackSeqAndType(seq uint64, rtype byte) uint64 {
   return seq << 8 | (uint64(rtype) & 0xFF)
 }
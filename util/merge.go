@@ -0,0 +1,24 @@
+package util
+
+// MergeOperator combines the operands stored through Merge with the
+// value of a key.  Operands are not applied when they are written but
+// lazily while the key is read or compacted, so a read-modify-write
+// such as a counter increment needs no Get before the update.
+//
+// The name of the operator is recorded with the db, which refuses to
+// open with an operator of another name later.
+type MergeOperator interface {
+  // Apply operands, ordered from the oldest to the newest, to the value
+  // existing for key, which is nil if the key has no value below the
+  // operands.  Returns the new value of key.
+  FullMerge(key, existing []byte, operands [][]byte) ([]byte, error)
+
+  // Combine operands, ordered from the oldest to the newest, into a
+  // single operand with the same effect.  ok is false if the operands
+  // can't be combined without the existing value, in which case they
+  // are kept as they are.
+  PartialMerge(key []byte, operands [][]byte) (operand []byte, ok bool)
+
+  // Name of this operator
+  Name() string
+}
@@ -10,6 +10,7 @@ func init() {
   DefaultOption.Policy = filter.NewBloomPolicy(10)
   DefaultOption.Comparator = BinaryComparator
   DefaultOption.BufferSize = 1024 * 1024 * 4
+  DefaultOption.CompactionStyle = LevelCompaction
 }
 
 type Option struct {
@@ -18,8 +19,67 @@ type Option struct {
   Policy     filter.Policy
   Comparator Comparator
   BufferSize int
+  
+  // If non-nil, called for every live value merged by a compaction
+  CompactionFilter CompactionFilter
+  
+  // How files are picked for compaction, LevelCompaction by default
+  CompactionStyle int
+  
+  // Combines the operands written through Merge, required to read or
+  // compact keys holding merge operands
+  MergeOperator MergeOperator
+  
+  // Layout of the tables, logs and descriptor of the db, NativeFormat
+  // by default.  LevelDBFormat reads and writes the databases of C++
+  // LevelDB, which knows of Put and Delete only: writes of any other
+  // operation fail.  Snappy compressed blocks are read, the blocks
+  // written are not compressed.  Filters of a name other than the one
+  // of Policy, e.g. the builtin bloom filter of LevelDB, are ignored.
+  // The tables written hold no properties, like the ones of LevelDB.
+  Format int
+  
+  // When non-zero the index of each table is split into partitions of
+  // about this many bytes, which are read as they are needed instead of
+  // being kept in memory along with the table.  Ignored in LevelDBFormat.
+  IndexPartitionSize int
+  
+  // How the filters of each table cover its keys, BlockFilter by
+  // default.  FullFilter is a single filter checked before the index is
+  // read, PartitionedFilter splits it along the index partitions and
+  // is a FullFilter when IndexPartitionSize is zero.  Tables in
+  // LevelDBFormat always use BlockFilter.
+  FilterType int
+  
+  // If non-nil, the filters of the tables hold the prefixes of their
+  // keys as well, see ReadOption.PrefixSameAsStart
+  PrefixExtractor PrefixExtractor
+  
+  // When non-zero the data blocks of each table carry a hash index of
+  // about this many keys per bucket, which point lookups use in place
+  // of the binary search of the restart points.  Lookups whose bucket
+  // holds keys of several restart intervals fall back to the search, the
+  // lower the ratio the fewer of them.  Ignored in LevelDBFormat.
+  BlockHashRatio float64
+  
+  // Each table built calls every function for a collector of its own,
+  // whose properties are stored along with the built-in ones
+  TablePropertiesCollectors []func() TablePropertiesCollector
 }
 
+// On-disk formats of a db, see Option.Format
+const (
+  NativeFormat = iota
+  LevelDBFormat
+)
+
+// Layouts of the filters of a table, see Option.FilterType
+const (
+  BlockFilter = iota
+  FullFilter
+  PartitionedFilter
+)
+
 var DefaultOption Option
 
 
@@ -30,6 +90,25 @@ func init() {
 type ReadOption struct {
   Verify bool
   Cache  bool
+  
+  // If non-nil, read as of the supplied snapshot (which must belong
+  // to the DB that is being read and which must not have been
+  // released).  If nil, use an implicit snapshot of the state at the
+  // beginning of this read operation.
+  Snapshot Snapshot
+  
+  // If true, an iterator positioned by Seek stays within the prefix
+  // Option.PrefixExtractor takes from the key sought, and leaves out
+  // the tables whose filters rule the prefix out.  It becomes invalid
+  // at the end of the prefix.  Keys out of the domain of the extractor
+  // are not bounded.  Only moving forward from the key sought is
+  // supported, the tables left out may hold keys before it.
+  PrefixSameAsStart bool
+}
+
+// Snapshot is the sequence a read is pinned to, see db.GetSnapshot
+type Snapshot interface {
+  Sequence() uint64
 }
 
 var DefaultReadOption ReadOption
@@ -57,4 +136,23 @@ type WriteOption struct {
 func init() {
   DefaultWriteOption.Sync = false
 }
-var DefaultWriteOption WriteOption
\ No newline at end of file
+var DefaultWriteOption WriteOption
+
+// Options that control pessimistic transactions
+type TransactionOption struct {
+
+  // Milliseconds a transaction waits for the lock of a key held by
+  // another one before it fails, a negative value waits forever.
+  LockTimeout int
+
+  // If true, a transaction whose wait for a lock would close a cycle of
+  // transactions waiting for each other fails at once instead of
+  // waiting for the timeout.
+  DeadlockDetect bool
+}
+
+func init() {
+  DefaultTransactionOption.LockTimeout = 1000
+  DefaultTransactionOption.DeadlockDetect = true
+}
+var DefaultTransactionOption TransactionOption
@@ -0,0 +1,70 @@
+package util
+
+import (
+  "bytes"
+  "strconv"
+)
+
+// PrefixExtractor maps user keys to prefixes.  The filters of the tables
+// hold the prefixes of their keys as well, so that iterations bounded
+// to a prefix skip the tables holding none of it, see
+// ReadOption.PrefixSameAsStart.
+//
+// The name of the extractor is recorded in each table, the prefixes in
+// the filters of tables built with another extractor are not used.
+type PrefixExtractor interface {
+  // Return the prefix of key, which must be in the domain
+  Transform(key []byte) []byte
+
+  // Return true iff key has a prefix, keys out of the domain add no
+  // prefix to the filters
+  InDomain(key []byte) bool
+
+  // Name of this extractor
+  Name() string
+}
+
+type fixedPrefix struct {
+  length int
+}
+
+// Return an extractor of the first length bytes of the keys, shorter
+// keys are out of its domain
+func NewFixedPrefixExtractor(length int) PrefixExtractor {
+  return &fixedPrefix{length}
+}
+
+func (p *fixedPrefix) Transform(key []byte) []byte {
+  return key[:p.length]
+}
+
+func (p *fixedPrefix) InDomain(key []byte) bool {
+  return len(key) >= p.length
+}
+
+func (p *fixedPrefix) Name() string {
+  return "goleveldb.FixedPrefix." + strconv.Itoa(p.length)
+}
+
+type delimitedPrefix struct {
+  delim byte
+}
+
+// Return an extractor of the keys up to and including the first delim,
+// keys without it are out of its domain.  With '/' as delim, the keys
+// tenant/entity/id have the prefix tenant/.
+func NewDelimitedPrefixExtractor(delim byte) PrefixExtractor {
+  return &delimitedPrefix{delim}
+}
+
+func (p *delimitedPrefix) Transform(key []byte) []byte {
+  return key[:bytes.IndexByte(key, p.delim) + 1]
+}
+
+func (p *delimitedPrefix) InDomain(key []byte) bool {
+  return bytes.IndexByte(key, p.delim) >= 0
+}
+
+func (p *delimitedPrefix) Name() string {
+  return "goleveldb.DelimitedPrefix." + strconv.Itoa(int(p.delim))
+}
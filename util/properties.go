@@ -0,0 +1,17 @@
+package util
+
+// TablePropertiesCollector gathers properties of its own over the
+// entries of a table while the table is built.  The properties are
+// stored in the table and returned by its Properties.
+type TablePropertiesCollector interface {
+  // Called for every entry added to the table in key order.  key is
+  // the user key and rtype the type of the entry as defined by package
+  // mem.
+  Add(key, value []byte, rtype byte)
+  
+  // Return the properties to store once all the entries are added
+  Finish() map[string][]byte
+  
+  // Name of this collector
+  Name() string
+}
@@ -0,0 +1,8 @@
+package util
+
+import (
+  "errors"
+)
+
+// ErrNotFound is returned when there is no live value for a key
+var ErrNotFound = errors.New("not found")
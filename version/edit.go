@@ -17,10 +17,12 @@ type VersionEdit struct {
   LogNumber  int
   FileNumber int
   CmpName    string
+  MergeName  string
   Sequence   uint64
   Files      []*entry
   Pointers   []*entry
   Deletes    []*entry
+  hasSequence bool   // Sequence is set, even if it is 0
 }
 
 func NewVersionEdit() *VersionEdit {
@@ -42,6 +44,10 @@ const (
   typeFiles
   typePointers
   typeDeletes
+  typeCreationTime
+  typeMergeName
+  typeRangeDels
+  typeLargeFiles   // typeFiles with a uint64 file size
 )
 
 func (e *VersionEdit) init() {
@@ -52,7 +58,9 @@ func (e *VersionEdit) Clear() {
   e.LogNumber = -1
   e.FileNumber = -1
   e.CmpName = ""
+  e.MergeName = ""
   e.Sequence = 0
+  e.hasSequence = false
   e.Files = []*entry{}
   e.Pointers = []*entry{}
   e.Deletes = []*entry{}
@@ -62,6 +70,11 @@ func (e *VersionEdit) SetComparatorName(name string) {
   e.CmpName = name
 }
 
+// Record the name of the merge operator of the db
+func (e *VersionEdit) SetMergeOperatorName(name string) {
+  e.MergeName = name
+}
+
 func (e *VersionEdit) SetLogNumber(num int) {
   e.LogNumber = num
 }
@@ -74,13 +87,14 @@ func (e *VersionEdit) SetNextFile(num int) {
 
 func (e *VersionEdit) SetLastSequence(seq uint64) {
   e.Sequence = seq
+  e.hasSequence = true
 }
 
 func (e *VersionEdit) SetCompactPointer(level int, key *util.InternalKey) {
   e.Pointers = append(e.Pointers, &entry{level, key})
 }
 
-func (e *VersionEdit) AddFile(level, file, filesize int, smallest, largest *util.InternalKey) {
+func (e *VersionEdit) AddFile(level, file int, filesize int64, smallest, largest *util.InternalKey) {
   meta := &table.FileMetaData {
     AllowSeek : 0,
     Number    : file,
@@ -91,6 +105,24 @@ func (e *VersionEdit) AddFile(level, file, filesize int, smallest, largest *util
   e.Files = append(e.Files, &entry{level, meta})
 }
 
+// Record the unix time at which file, added by this edit, was written
+func (e *VersionEdit) SetCreationTime(file int, ctime int64) {
+  for _, entry := range e.Files {
+    if meta := entry.value.(*table.FileMetaData); meta.Number == file {
+      meta.CreationTime = ctime
+    }
+  }
+}
+
+// Record that file, added by this edit, holds range tombstones
+func (e *VersionEdit) SetRangeDels(file int) {
+  for _, entry := range e.Files {
+    if meta := entry.value.(*table.FileMetaData); meta.Number == file {
+      meta.HasRangeDels = true
+    }
+  }
+}
+
 func (e *VersionEdit) DeleteFile(level int, file int) {
   entry := &entry {level, file}
   e.Deletes = append(e.Deletes, entry)
@@ -117,6 +149,11 @@ func (e *VersionEdit) Encode() []byte {
     util.PutLenPrefixBytes(&buffer, store, []byte(e.CmpName))
   }
   
+  if e.MergeName != "" {
+    buffer.WriteByte(typeMergeName)
+    util.PutLenPrefixBytes(&buffer, store, []byte(e.MergeName))
+  }
+  
   if e.Sequence != 0 {
     binary.LittleEndian.PutUint64(store, e.Sequence)
     buffer.WriteByte(typeSequence)
@@ -125,20 +162,34 @@ func (e *VersionEdit) Encode() []byte {
   
   // encode files
   for i := 0; i < len(e.Files); i++ {
-    buffer.WriteByte(typeFiles)
+    buffer.WriteByte(typeLargeFiles)
     
     binary.LittleEndian.PutUint32(store, uint32(e.Files[i].level))
     buffer.Write(store[:4])
     
     meta := e.Files[i].value.(*table.FileMetaData)
-    binary.LittleEndian.PutUint32(store, uint32(meta.FileSize))
-    buffer.Write(store[:4])
+    binary.LittleEndian.PutUint64(store, uint64(meta.FileSize))
+    buffer.Write(store)
     
     binary.LittleEndian.PutUint32(store, uint32(meta.Number))
     buffer.Write(store[:4])
     
     util.PutLenPrefixBytes(&buffer, store, meta.Smallest.Encode())
     util.PutLenPrefixBytes(&buffer, store, meta.Largest.Encode())
+    
+    if meta.CreationTime != 0 {
+      buffer.WriteByte(typeCreationTime)
+      binary.LittleEndian.PutUint32(store, uint32(meta.Number))
+      buffer.Write(store[:4])
+      binary.LittleEndian.PutUint64(store, uint64(meta.CreationTime))
+      buffer.Write(store)
+    }
+    
+    if meta.HasRangeDels {
+      buffer.WriteByte(typeRangeDels)
+      binary.LittleEndian.PutUint32(store, uint32(meta.Number))
+      buffer.Write(store[:4])
+    }
   }
   
   // encode deleted file
@@ -181,18 +232,33 @@ func (e *VersionEdit) Decode(data []byte) error {
         return errors.New("bad cmp name")
       }
       e.CmpName = string(cmpName)
+    case typeMergeName:
+      var mergeName []byte
+      mergeName, data = util.GetLenPrefixBytes(data[1:])
+      if mergeName == nil || data == nil {
+        return errors.New("bad merge operator name")
+      }
+      e.MergeName = string(mergeName)
     case typeSequence:
       e.Sequence = binary.LittleEndian.Uint64(data[1:])
       data = data[9:]
-    case typeFiles:
+    case typeFiles, typeLargeFiles:
 
+      tag := data[0]
       level := binary.LittleEndian.Uint32(data[1:])
       data = data[5:]
       meta := new(table.FileMetaData)
       meta.AllowSeek = 0
-      meta.FileSize = int(binary.LittleEndian.Uint32(data))
-      meta.Number = int(binary.LittleEndian.Uint32(data[4:]))
-      data = data[8:]
+      // descriptors written before typeLargeFiles store uint32 sizes
+      if tag == typeFiles {
+        meta.FileSize = int64(binary.LittleEndian.Uint32(data))
+        data = data[4:]
+      } else {
+        meta.FileSize = int64(binary.LittleEndian.Uint64(data))
+        data = data[8:]
+      }
+      meta.Number = int(binary.LittleEndian.Uint32(data))
+      data = data[4:]
       val, data = util.GetLenPrefixBytes(data)
       if val == nil || data == nil {
         return errors.New("bad internal key")
@@ -222,6 +288,23 @@ func (e *VersionEdit) Decode(data []byte) error {
       intern.Decode(val)
       e.Pointers = append(e.Pointers, &entry{int(level), intern})
       
+    case typeCreationTime:
+      if len(data) < 13 {
+        return errors.New("bad creation time")
+      }
+      num   := binary.LittleEndian.Uint32(data[1:])
+      ctime := binary.LittleEndian.Uint64(data[5:])
+      e.SetCreationTime(int(num), int64(ctime))
+      data = data[13:]
+      
+    case typeRangeDels:
+      if len(data) < 5 {
+        return errors.New("bad range dels")
+      }
+      num := binary.LittleEndian.Uint32(data[1:])
+      e.SetRangeDels(int(num))
+      data = data[5:]
+      
     default:
       msg := fmt.Sprintf("bad edit type %d", data[0])
       return errors.New(msg)
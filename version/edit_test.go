@@ -1,12 +1,18 @@
 package version
 
 import (
+  "io"
+  "os"
   "fmt"
+  "bytes"
   "testing"
+  "io/ioutil"
+  "encoding/binary"
 )
 
 import (
   "github.com/jellybean4/goleveldb/util"
+  "github.com/jellybean4/goleveldb/log"
   "github.com/jellybean4/goleveldb/table"
 )
 
@@ -18,6 +24,7 @@ func TestSimpleEdit(t *testing.T) {
   
   edit := NewVersionEdit()
   edit.SetComparatorName(cmpName)
+  edit.SetMergeOperatorName("AppendOperator")
   edit.SetLogNumber(logNumber)
   edit.SetNextFile(nextFile)
   edit.SetLastSequence(lastSeq)
@@ -35,6 +42,10 @@ func TestSimpleEdit(t *testing.T) {
     t.Errorf("cmp name not match %v", edit2.CmpName)
   }
   
+  if edit2.MergeName != "AppendOperator" {
+    t.Errorf("merge operator name not match %v", edit2.MergeName)
+  }
+  
   if edit2.LogNumber != logNumber {
     t.Errorf("log num not match %d", edit2.LogNumber)
   }
@@ -78,7 +89,7 @@ func TestFullEdit(t *testing.T) {
     meta := table.FileMetaData {
       AllowSeek : 0,
       Number    : i,
-      FileSize  : i * 100,
+      FileSize  : int64(i) * 100,
       Smallest  : *util.NewInternalKey([]byte(key), i2, byte(i % 2)),
       Largest   : *util.NewInternalKey([]byte(key2), i2, byte(i % 2)),
     }
@@ -186,3 +197,157 @@ func metaCmp(f1, f2 *table.FileMetaData) bool {
   }
   return true
 }
+
+func TestCreationTimeEdit(t *testing.T) {
+  smallest := util.NewInternalKey([]byte("key1"), 1, 0)
+  largest := util.NewInternalKey([]byte("key9"), 9, 0)
+  var ctime int64 = 1500000000
+
+  edit := NewVersionEdit()
+  edit.AddFile(0, 10, 1000, smallest, largest)
+  edit.AddFile(0, 11, 2000, smallest, largest)
+  edit.SetCreationTime(11, ctime)
+  rslt := edit.Encode()
+
+  edit2 := NewVersionEdit()
+  if err := edit2.Decode(rslt); err != nil {
+    t.Errorf("edit decode fail %v", err)
+  }
+
+  if len(edit2.Files) != 2 {
+    t.Errorf("files len not match %d", len(edit2.Files))
+    return
+  }
+
+  if meta := edit2.Files[0].value.(*table.FileMetaData); meta.CreationTime != 0 {
+    t.Errorf("unset creation time not zero %d", meta.CreationTime)
+  }
+
+  if meta := edit2.Files[1].value.(*table.FileMetaData); meta.CreationTime != ctime {
+    t.Errorf("creation time not match %d", meta.CreationTime)
+  }
+}
+
+func TestLevelDBEdit(t *testing.T) {
+  smallest := util.NewInternalKey([]byte("key1"), 1, 0)
+  largest := util.NewInternalKey([]byte("key9"), 9, 1)
+
+  edit := NewVersionEdit()
+  edit.SetComparatorName(levelDBBytewiseComparator)
+  edit.SetLogNumber(12)
+  edit.SetNextFile(34)
+  edit.SetLastSequence(56)
+  edit.AddFile(1, 7, 1000, smallest, largest)
+  edit.DeleteFile(2, 8)
+  edit.SetCompactPointer(3, largest)
+  rslt := edit.encodeLevelDB()
+
+  // LevelDB stores values as type 1 and deletions as type 0
+  if rslt[len(rslt) - 8] != 0 {
+    t.Errorf("largest key of deletion not encoded as type 0")
+  }
+
+  // LevelDB also writes the prev log number, tag 9
+  rslt = append(rslt, levelDBPrevLogNumber, 0)
+  edit2 := NewVersionEdit()
+  if err := edit2.decodeLevelDB(rslt); err != nil {
+    t.Fatalf("edit decode fail %v", err)
+  }
+
+  if edit2.CmpName != levelDBBytewiseComparator || edit2.LogNumber != 12 || edit2.FileNumber != 34 || edit2.Sequence != 56 {
+    t.Errorf("edit fields not match %s %d %d %d", edit2.CmpName, edit2.LogNumber, edit2.FileNumber, edit2.Sequence)
+  }
+
+  if len(edit2.Files) != 1 || !metaCmp(edit2.Files[0].value.(*table.FileMetaData), edit.Files[0].value.(*table.FileMetaData)) {
+    t.Errorf("file content not match")
+  } else if !ikCmp(&edit2.Files[0].value.(*table.FileMetaData).Largest, largest) {
+    t.Errorf("largest key not match")
+  }
+
+  if len(edit2.Deletes) != 1 || edit2.Deletes[0].value.(int) != 8 {
+    t.Errorf("delete not match")
+  }
+
+  if len(edit2.Pointers) != 1 || !ikCmp(edit2.Pointers[0].value.(*util.InternalKey), largest) {
+    t.Errorf("pointer content not match")
+  }
+
+  if err := NewVersionEdit().decodeLevelDB([]byte{levelDBNewFile, 1}); err == nil {
+    t.Errorf("decode truncated edit succeeds")
+  }
+}
+
+// The edits of the descriptor of the LevelDB db in the testdata of the
+// db package, decoded and written again, hold the same bytes
+func TestLevelDBGoldenDescriptor(t *testing.T) {
+  golden := "../db/testdata/leveldb/MANIFEST-000000"
+  reader, err := log.NewReader(golden, true, 0, util.LevelDBFormat)
+  if err != nil {
+    t.Fatalf("open %s error %v", golden, err)
+  }
+  defer reader.Close()
+  name := "/tmp/test_leveldb_golden_MANIFEST-000000"
+  os.Remove(name)
+  writer, err := log.NewWriter(name, util.LevelDBFormat)
+  if err != nil {
+    t.Fatalf("create %s error %v", name, err)
+  }
+
+  edits := 0
+  for ;; edits++ {
+    record, err := reader.Read()
+    if err == io.EOF {
+      break
+    } else if err != nil {
+      t.Fatalf("read %s error %v", golden, err)
+    }
+
+    edit := NewVersionEdit()
+    if err := edit.decodeLevelDB(record); err != nil {
+      t.Fatalf("decode edit %d error %v", edits, err)
+    }
+    writer.AddRecord(edit.encodeLevelDB())
+  }
+  writer.Close()
+
+  data, _ := ioutil.ReadFile(name)
+  expect, _ := ioutil.ReadFile(golden)
+  if edits == 0 || !bytes.Equal(data, expect) {
+    t.Errorf("%d edits written again differ from %s", edits, golden)
+  }
+}
+
+func TestLargeFileEdit(t *testing.T) {
+  smallest := util.NewInternalKey([]byte("key1"), 1, 0)
+  largest := util.NewInternalKey([]byte("key9"), 9, 0)
+  var size int64 = 5 << 32
+
+  edit := NewVersionEdit()
+  edit.AddFile(2, 7, size, smallest, largest)
+  edit2 := NewVersionEdit()
+  if err := edit2.Decode(edit.Encode()); err != nil {
+    t.Fatalf("edit decode fail %v", err)
+  }
+  if meta := edit2.Files[0].value.(*table.FileMetaData); meta.FileSize != size || meta.Number != 7 {
+    t.Errorf("large file not match %d %d", meta.FileSize, meta.Number)
+  }
+
+  // descriptors written before store the size as uint32
+  var buffer bytes.Buffer
+  store := make([]byte, 8)
+  buffer.WriteByte(typeFiles)
+  for _, val := range []uint32{2, 1000, 7} {
+    binary.LittleEndian.PutUint32(store, val)
+    buffer.Write(store[:4])
+  }
+  util.PutLenPrefixBytes(&buffer, store, smallest.Encode())
+  util.PutLenPrefixBytes(&buffer, store, largest.Encode())
+
+  edit3 := NewVersionEdit()
+  if err := edit3.Decode(buffer.Bytes()); err != nil {
+    t.Fatalf("legacy edit decode fail %v", err)
+  }
+  if meta := edit3.Files[0].value.(*table.FileMetaData); meta.FileSize != 1000 || meta.Number != 7 || !ikCmp(&meta.Largest, largest) {
+    t.Errorf("legacy file not match %d %d", meta.FileSize, meta.Number)
+  }
+}
@@ -0,0 +1,93 @@
+package version
+
+import (
+  "sort"
+  "time"
+)
+
+import (
+  "github.com/jellybean4/goleveldb/util"
+  "github.com/jellybean4/goleveldb/compact"
+  "github.com/jellybean4/goleveldb/table"
+)
+
+// fifoPicker keeps every file in level0 and never merges anything.
+// Once the files take more than FIFOMaxTableFilesSize bytes, or the
+// oldest ones are older than FIFOTTL seconds, whole files are dropped
+// from the oldest one on.  Expired files are only noticed when some
+// background work is scheduled, e.g. after a memtable flush.
+type fifoPicker struct {
+  set *VersionSet
+}
+
+func newFIFOPicker(set *VersionSet) *fifoPicker {
+  picker := new(fifoPicker)
+  picker.set = set
+  return picker
+}
+
+func (p *fifoPicker) Score(v *Version) {
+  v.scores = make([]float32, util.Global.MaxLevel - 1)
+  v.cscore = float32(TotalFileSize(v.files[0])) / float32(util.Global.FIFOMaxTableFilesSize)
+  v.clevel = 0
+
+  files := p.oldestFirst(v)
+  if len(files) != 0 && p.expired(files[0], time.Now().Unix()) && v.cscore < 1 {
+    v.cscore = 1
+  }
+}
+
+func (p *fifoPicker) Pick(v *Version) *compact.Compact {
+  if len(p.set.pending) > 0 {
+    return nil
+  }
+
+  now := time.Now().Unix()
+  files := p.oldestFirst(v)
+  total := TotalFileSize(files)
+  victims := []*table.FileMetaData{}
+  for _, meta := range files {
+    if total <= int64(util.Global.FIFOMaxTableFilesSize) && !p.expired(meta, now) {
+      break
+    }
+    victims = append(victims, meta)
+    total -= meta.FileSize
+  }
+
+  if len(victims) == 0 {
+    return nil
+  }
+
+  comp := compact.NewCompact()
+  comp.Level = 0
+  comp.OutputLevel = -1
+  comp.Files[0] = victims
+  comp.Smallest, comp.Largest = p.set.getRange(victims)
+  return comp
+}
+
+func (p *fifoPicker) LevelForMemTableOutput(v *Version, smallest, largest []byte) int {
+  return 0
+}
+
+// Return the level0 files of v, the oldest one first
+func (p *fifoPicker) oldestFirst(v *Version) []*table.FileMetaData {
+  files := make([]interface{}, len(v.files[0]))
+  for i, meta := range v.files[0] {
+    files[i] = meta
+  }
+  // level0 files are flushed one at a time, a smaller number is older
+  sort.Sort(util.NewSliceSorter(files, TableFileCompare))
+
+  rslt := make([]*table.FileMetaData, len(files))
+  for i, meta := range files {
+    rslt[i] = meta.(*table.FileMetaData)
+  }
+  return rslt
+}
+
+// Returns true iff meta is older than the ttl at unix time now
+func (p *fifoPicker) expired(meta *table.FileMetaData, now int64) bool {
+  ttl := int64(util.Global.FIFOTTL)
+  return ttl > 0 && meta.CreationTime != 0 && now - meta.CreationTime > ttl
+}
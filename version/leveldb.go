@@ -0,0 +1,150 @@
+package version
+
+import (
+  "bytes"
+  "errors"
+  "fmt"
+  "encoding/binary"
+)
+
+import (
+  "github.com/jellybean4/goleveldb/util"
+  "github.com/jellybean4/goleveldb/table"
+)
+
+// Tags of the fields of a version edit in the descriptor of LevelDB,
+// every field is a tag followed by varints and varint32 prefixed
+// strings.  Tag 8 is no longer used by LevelDB.
+const (
+  levelDBComparator = 1
+  levelDBLogNumber = 2
+  levelDBNextFile = 3
+  levelDBLastSequence = 4
+  levelDBCompactPointer = 5
+  levelDBDeletedFile = 6
+  levelDBNewFile = 7
+  levelDBPrevLogNumber = 9
+)
+
+// Name LevelDB gives to its bytewise comparator, which orders keys as
+// util.BinaryComparator does
+const levelDBBytewiseComparator = "leveldb.BytewiseComparator"
+
+// Encode the edit the way LevelDB does.  LevelDB has no merge
+// operators, creation times or range tombstones, so they are left out.
+func (e *VersionEdit) encodeLevelDB() []byte {
+  var buffer bytes.Buffer
+  store := make([]byte, binary.MaxVarintLen64)
+  putVarint := func(val uint64) {
+    buffer.Write(store[:binary.PutUvarint(store, val)])
+  }
+
+  if e.CmpName != "" {
+    putVarint(levelDBComparator)
+    util.PutVarintBytes(&buffer, []byte(e.CmpName))
+  }
+
+  if e.LogNumber != -1 {
+    putVarint(levelDBLogNumber)
+    putVarint(uint64(e.LogNumber))
+  }
+
+  if e.FileNumber != -1 {
+    putVarint(levelDBNextFile)
+    putVarint(uint64(e.FileNumber))
+  }
+
+  // LevelDB writes the sequence of an empty db as well
+  if e.Sequence != 0 || e.hasSequence {
+    putVarint(levelDBLastSequence)
+    putVarint(e.Sequence)
+  }
+
+  for _, pointer := range e.Pointers {
+    putVarint(levelDBCompactPointer)
+    putVarint(uint64(pointer.level))
+    key := pointer.value.(*util.InternalKey).Encode()
+    util.PutVarintBytes(&buffer, util.LevelDBInternalKey(key))
+  }
+
+  for _, del := range e.Deletes {
+    putVarint(levelDBDeletedFile)
+    putVarint(uint64(del.level))
+    putVarint(uint64(del.value.(int)))
+  }
+
+  for _, file := range e.Files {
+    meta := file.value.(*table.FileMetaData)
+    putVarint(levelDBNewFile)
+    putVarint(uint64(file.level))
+    putVarint(uint64(meta.Number))
+    putVarint(uint64(meta.FileSize))
+    util.PutVarintBytes(&buffer, util.LevelDBInternalKey(meta.Smallest.Encode()))
+    util.PutVarintBytes(&buffer, util.LevelDBInternalKey(meta.Largest.Encode()))
+  }
+  return buffer.Bytes()
+}
+
+// Decode the edit LevelDB encoded as data
+func (e *VersionEdit) decodeLevelDB(data []byte) error {
+  var err error
+  getVarint := func() uint64 {
+    val, n := binary.Uvarint(data)
+    if n <= 0 {
+      err = errors.New("bad varint in edit")
+      data = nil
+      return 0
+    }
+    data = data[n:]
+    return val
+  }
+  getBytes := func() []byte {
+    val, rest := util.GetVarintBytes(data)
+    if val == nil {
+      err = errors.New("bad string in edit")
+    }
+    data = rest
+    return util.LevelDBInternalKey(val)
+  }
+
+  for len(data) > 0 && err == nil {
+    switch tag := getVarint(); tag {
+    case levelDBComparator:
+      if name, rest := util.GetVarintBytes(data); name == nil {
+        err = errors.New("bad cmp name")
+      } else {
+        e.CmpName, data = string(name), rest
+      }
+    case levelDBLogNumber:
+      e.LogNumber = int(getVarint())
+    case levelDBPrevLogNumber:
+      // the logs of this package are never kept for a previous number
+      getVarint()
+    case levelDBNextFile:
+      e.FileNumber = int(getVarint())
+    case levelDBLastSequence:
+      e.SetLastSequence(getVarint())
+    case levelDBCompactPointer:
+      level := int(getVarint())
+      key := util.DecodeInternalKey(getBytes())
+      e.Pointers = append(e.Pointers, &entry{level, key})
+    case levelDBDeletedFile:
+      level := int(getVarint())
+      num := int(getVarint())
+      e.Deletes = append(e.Deletes, &entry{level, num})
+    case levelDBNewFile:
+      level := int(getVarint())
+      meta := new(table.FileMetaData)
+      meta.Number = int(getVarint())
+      meta.FileSize = int64(getVarint())
+      (&meta.Smallest).Decode(getBytes())
+      (&meta.Largest).Decode(getBytes())
+      e.Files = append(e.Files, &entry{level, meta})
+    default:
+      if err == nil {
+        err = errors.New(fmt.Sprintf("bad edit tag %d", tag))
+      }
+    }
+  }
+  return err
+}
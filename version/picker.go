@@ -0,0 +1,112 @@
+package version
+
+import (
+  "github.com/jellybean4/goleveldb/util"
+  "github.com/jellybean4/goleveldb/compact"
+  "github.com/jellybean4/goleveldb/table"
+)
+
+// Picker decides for a compaction style which files to merge next.
+// All methods are called with *mu held.
+type Picker interface {
+  // Compute the compaction scores of the newly built version v
+  Score(v *Version)
+
+  // Return the next compaction to run over v, or nil if nothing needs
+  // to be compacted.  The result must not conflict with the pending
+  // compactions of the version set.
+  Pick(v *Version) *compact.Compact
+
+  // Return the level a memtable flush covering the user key range
+  // [smallest, largest] is written to
+  LevelForMemTableOutput(v *Version, smallest, largest []byte) int
+}
+
+// Return the picker for the compaction style chosen in option
+func NewPicker(set *VersionSet, option *util.Option) Picker {
+  switch option.CompactionStyle {
+  case util.UniversalCompaction:
+    return newUniversalPicker(set)
+  case util.FIFOCompaction:
+    return newFIFOPicker(set)
+  }
+  return newLevelPicker(set)
+}
+
+// levelPicker merges one level into the next once the level grows over
+// its size limit, or level0 over its file number limit
+type levelPicker struct {
+  set *VersionSet
+}
+
+func newLevelPicker(set *VersionSet) *levelPicker {
+  picker := new(levelPicker)
+  picker.set = set
+  return picker
+}
+
+func (p *levelPicker) Score(v *Version) {
+  var compLevel int = 0
+  var compScore, tmpScore float32 = 0, 0
+  v.scores = make([]float32, util.Global.MaxLevel - 1)
+  for i := 0; i < util.Global.MaxLevel - 1; i++ {
+    if i == 0 {
+      clen := len(v.files[i])
+      tmpScore = float32(clen) / float32(util.Global.L0CompactionTrigger)
+    } else {
+      tmpScore = float32(TotalFileSize(v.files[i])) / MaxBytesForLevel(i)
+    }
+    v.scores[i] = tmpScore
+
+    if tmpScore > compScore {
+      compLevel = i
+      compScore = tmpScore
+    }
+  }
+  v.cscore, v.clevel = compScore, compLevel
+}
+
+func (p *levelPicker) Pick(v *Version) *compact.Compact {
+  for _, level := range v.levelsByScore() {
+    if comp := p.pickLevel(v, level); comp != nil {
+      return comp
+    }
+  }
+  return nil
+}
+
+func (p *levelPicker) LevelForMemTableOutput(v *Version, smallest, largest []byte) int {
+  return v.PickLevelForMemTableOutput(smallest, largest)
+}
+
+func (p *levelPicker) pickLevel(v *Version, level int) *compact.Compact {
+  files := v.files[level]
+  for _, meta := range files {
+    comp := compact.NewCompact()
+    comp.Level = level
+    comp.OutputLevel = level + 1
+    if level == 0 {
+      // level0 files overlap each other, compact them one group at a time
+      comp.Files[0] = v.GetOverlappingInputs(level, &meta.Smallest, &meta.Largest)
+      small, large := p.set.getRange(comp.Files[0])
+      comp.Files[1] = v.GetOverlappingInputs(level + 1, small, large)
+    } else {
+      comp.Files[0] = []*table.FileMetaData{meta}
+      comp.Files[1] = v.GetOverlappingInputs(level + 1, &meta.Smallest, &meta.Largest)
+    }
+
+    var inputs []*table.FileMetaData
+    inputs = append(inputs, comp.Files[0]...)
+    inputs = append(inputs, comp.Files[1]...)
+    comp.Smallest, comp.Largest = p.set.getRange(inputs)
+
+    if p.set.conflictWithPending(comp) {
+      if level == 0 {
+        return nil
+      }
+      continue
+    }
+    return comp
+  }
+  return nil
+}
@@ -0,0 +1,222 @@
+package version
+
+import (
+  "time"
+  "testing"
+)
+
+import (
+  "github.com/jellybean4/goleveldb/util"
+  "github.com/jellybean4/goleveldb/mem"
+  "github.com/jellybean4/goleveldb/table"
+  "github.com/jellybean4/goleveldb/compact"
+)
+
+// Return a version set of the given compaction style which lives in
+// memory only, versions are built by hand on top of it
+func newTestVersionSet(style int) *VersionSet {
+  option := util.DefaultOption
+  option.Comparator = mem.NewInternalKeyComparator(util.BinaryComparator)
+  option.CompactionStyle = style
+  set := new(VersionSet)
+  set.option = &option
+  set.pending = []*compact.Compact{}
+  set.picker = NewPicker(set, &option)
+  return set
+}
+
+// Return the meta of table num of size bytes holding the user keys
+// within [smallest, largest]
+func newTestFile(num int, size int64, smallest, largest string) *table.FileMetaData {
+  meta := new(table.FileMetaData)
+  meta.Number = num
+  meta.FileSize = size
+  meta.Smallest = *util.NewInternalKey([]byte(smallest), uint64(num), mem.ValueType)
+  meta.Largest = *util.NewInternalKey([]byte(largest), uint64(num), mem.ValueType)
+  return meta
+}
+
+// Return the version of set holding files[level] at each level
+func newTestVersion(set *VersionSet, files map[int][]*table.FileMetaData) *Version {
+  v := NewVersion(set)
+  for level, metas := range files {
+    v.files[level] = metas
+  }
+  set.picker.Score(v)
+  return v
+}
+
+// Return the numbers of the input files of comp, level by level
+func inputNumbers(comp *compact.Compact) []int {
+  nums := []int{}
+  for _, files := range comp.Files {
+    for _, meta := range files {
+      nums = append(nums, meta.Number)
+    }
+  }
+  return nums
+}
+
+func sameNumbers(nums, expects []int) bool {
+  if len(nums) != len(expects) {
+    return false
+  }
+  for i := range nums {
+    if nums[i] != expects[i] {
+      return false
+    }
+  }
+  return true
+}
+
+// Return the level0 runs of the given sizes from the newest one, along
+// with a run of size last in the last level
+func universalRuns(sizes []int64, last int64) map[int][]*table.FileMetaData {
+  files := map[int][]*table.FileMetaData{}
+  for i, size := range sizes {
+    // a larger number is newer
+    files[0] = append(files[0], newTestFile(100 - i, size, "a", "z"))
+  }
+  files[util.Global.MaxLevel - 1] = []*table.FileMetaData{newTestFile(1, last, "a", "z")}
+  return files
+}
+
+func TestUniversalPicker(t *testing.T) {
+  config := util.Global
+  util.Global.L0CompactionTrigger = 4
+  util.Global.UniversalSizeRatio = 1
+  util.Global.UniversalMinMergeWidth = 2
+  util.Global.UniversalMaxSizeAmplificationPercent = 200
+  defer func() { util.Global = config }()
+  bottom := util.Global.MaxLevel - 1
+
+  cases := []struct {
+    name     string
+    sizes    []int64   // level0 runs from the newest
+    last     int64     // the run of the last level
+    minWidth int
+    inputs   []int     // nil if nothing is picked
+    output   int
+  }{
+    // fewer runs than the trigger
+    {"below trigger", []int64{100, 100}, 100, 2, nil, 0},
+    // the newer runs take 300% of the last one
+    {"size amplification", []int64{100, 100, 100}, 100, 2, []int{100, 99, 98, 1}, bottom},
+    // the newest three runs are of similar size, the last one is huge
+    {"size ratio", []int64{10, 10, 10}, 10000, 2, []int{100, 99, 98}, bottom - 1},
+    // no run is close to the size of the ones before it
+    {"no similar runs", []int64{10, 100, 1000}, 100000, 2, []int{100, 99}, 0},
+    // the window of similar runs is narrower than the minimum width
+    {"min merge width", []int64{10, 10, 1000}, 100000, 3, []int{100, 99, 98}, bottom - 1},
+  }
+
+  for _, c := range cases {
+    util.Global.UniversalMinMergeWidth = c.minWidth
+    set := newTestVersionSet(util.UniversalCompaction)
+    v := newTestVersion(set, universalRuns(c.sizes, c.last))
+    comp := set.picker.Pick(v)
+    if c.inputs == nil {
+      if comp != nil {
+        t.Errorf("%s: picks %v", c.name, inputNumbers(comp))
+      }
+      continue
+    }
+
+    if comp == nil {
+      t.Errorf("%s: picks nothing", c.name)
+    } else if nums := inputNumbers(comp); !sameNumbers(nums, c.inputs) {
+      t.Errorf("%s: picks %v instead of %v", c.name, nums, c.inputs)
+    } else if comp.Level != 0 || comp.OutputLevel != c.output {
+      t.Errorf("%s: compacts level %d into %d", c.name, comp.Level, comp.OutputLevel)
+    }
+  }
+
+  // a single universal compaction runs at a time
+  set := newTestVersionSet(util.UniversalCompaction)
+  v := newTestVersion(set, universalRuns([]int64{100, 100, 100}, 100))
+  set.pending = append(set.pending, compact.NewCompact())
+  if comp := set.picker.Pick(v); comp != nil {
+    t.Errorf("picks %v while another compaction runs", inputNumbers(comp))
+  }
+}
+
+func TestUniversalMemTableOutput(t *testing.T) {
+  files := map[int][]*table.FileMetaData{3 : {newTestFile(1, 100, "m", "n")}}
+  universal := newTestVersionSet(util.UniversalCompaction)
+  v := newTestVersion(universal, files)
+  // memtables are always flushed into level0, overlapping or not
+  for _, r := range [][]string{{"a", "b"}, {"m", "n"}} {
+    if level := universal.picker.LevelForMemTableOutput(v, []byte(r[0]), []byte(r[1])); level != 0 {
+      t.Errorf("flush of [%s, %s] goes to level %d", r[0], r[1], level)
+    }
+  }
+
+  // unlike the level style, which pushes a flush overlapping nothing down
+  leveled := newTestVersionSet(util.LevelCompaction)
+  v = newTestVersion(leveled, files)
+  if level := leveled.picker.LevelForMemTableOutput(v, []byte("a"), []byte("b")); level == 0 {
+    t.Errorf("level style flush overlapping nothing stays in level0")
+  }
+}
+
+func TestFIFOPicker(t *testing.T) {
+  config := util.Global
+  util.Global.FIFOMaxTableFilesSize = 250
+  util.Global.FIFOTTL = 0
+  defer func() { util.Global = config }()
+
+  now := time.Now().Unix()
+  fifoFiles := func(ctimes []int64) map[int][]*table.FileMetaData {
+    files := map[int][]*table.FileMetaData{}
+    // listed from the newest file, a smaller number is older
+    for i, ctime := range ctimes {
+      meta := newTestFile(len(ctimes) - i, 100, "a", "z")
+      meta.CreationTime = ctime
+      files[0] = append(files[0], meta)
+    }
+    return files
+  }
+
+  cases := []struct {
+    name   string
+    ttl    int
+    ctimes []int64   // creation time of each 100 bytes file from the newest
+    inputs []int     // nil if nothing is picked
+  }{
+    // the files fit within the size cap
+    {"below size cap", 0, []int64{now, now}, nil},
+    // the oldest files are dropped until the rest fit
+    {"size cap", 0, []int64{now, now, now, now}, []int{1, 2}},
+    // files older than the ttl are dropped though they fit
+    {"ttl", 60, []int64{now, now - 120, now - 180}, []int{1, 2}},
+    // files without a creation time never expire
+    {"no creation time", 60, []int64{now, 0}, nil},
+    // an expired file is dropped after the ones over the cap
+    {"ttl and size cap", 60, []int64{now, now - 120, now}, []int{1, 2}},
+  }
+
+  for _, c := range cases {
+    util.Global.FIFOTTL = c.ttl
+    set := newTestVersionSet(util.FIFOCompaction)
+    v := newTestVersion(set, fifoFiles(c.ctimes))
+    comp := set.picker.Pick(v)
+    if c.inputs == nil {
+      if comp != nil {
+        t.Errorf("%s: picks %v", c.name, inputNumbers(comp))
+      } else if v.cscore >= 1 {
+        t.Errorf("%s: scores %f with nothing to drop", c.name, v.cscore)
+      }
+      continue
+    }
+
+    if comp == nil {
+      t.Errorf("%s: picks nothing", c.name)
+    } else if nums := inputNumbers(comp); !sameNumbers(nums, c.inputs) {
+      t.Errorf("%s: picks %v instead of %v", c.name, nums, c.inputs)
+    } else if comp.Level != 0 || comp.OutputLevel != -1 {
+      t.Errorf("%s: compacts level %d into %d", c.name, comp.Level, comp.OutputLevel)
+    } else if v.cscore < 1 {
+      t.Errorf("%s: scores %f with files to drop", c.name, v.cscore)
+    }
+  }
+}
@@ -4,9 +4,11 @@ import (
   "os"
   "io"
   "fmt"
+  "sort"
   "bytes"
   "bufio"
   "errors"
+  "strings"
 )
 
 import (
@@ -33,11 +35,14 @@ type VersionSet struct {
   fileNum int
   descNum int
   writer  log.Writer
+  pending []*compact.Compact   // compactions picked but not yet released
+  picker  Picker
 }
 
 func NewVersionSet(db string, option *util.Option, cache table.TableCache) *VersionSet {
   set := new(VersionSet)
   if err := set.init(db, option, cache); err != nil {
+    log4go.Error("recover version set failed %v", err)
     return nil
   }
   return set
@@ -46,9 +51,12 @@ func NewVersionSet(db string, option *util.Option, cache table.TableCache) *Vers
 func (set *VersionSet) init(db string, option *util.Option, cache table.TableCache) error {
   set.option = option
   set.current = NewVersion(set)
+  set.current.Ref()
   set.cache = cache
   set.dbname = db
   set.pointer = make([]*table.FileMetaData, util.Global.MaxLevel)
+  set.pending = []*compact.Compact{}
+  set.picker = NewPicker(set, option)
   return set.Recover()
 }
 
@@ -69,10 +77,10 @@ func (set *VersionSet) LogAndApply(edit *VersionEdit) error {
   builder.Finish(version)
   
   set.append(version)
-  set.current.cscore, set.current.clevel = set.scoreCompaction(set.current)
+  set.picker.Score(set.current)
   if set.writer == nil {
     descName := util.DescriptorFileName(set.dbname, set.descNum)
-    if writer, err := log.NewWriter(descName); err != nil {
+    if writer, err := log.NewWriter(descName, set.option.Format); err != nil {
       return err
     } else {
       set.writer = writer
@@ -80,10 +88,10 @@ func (set *VersionSet) LogAndApply(edit *VersionEdit) error {
     set.writeSnapshot()
   }
   
-  if err := set.writer.AddRecord(edit.Encode()); err != nil {
+  if err := set.writer.AddRecord(set.encodeEdit(edit)); err != nil {
     return err
   }
-  util.SetCurrentFile(set.dbname, set.descNum)
+  util.SetCurrentFile(set.dbname, set.descNum, set.option.Format)
   log4go.Info("%s", edit.dumpInfo())
   log4go.Info("%s", set.dumpCurrent())
   return nil
@@ -101,11 +109,15 @@ func (set *VersionSet) Recover() error {
   descName := set.parseCurrentFile()
   if descName == "" {
     return errors.New("parse current file error")
+  } else if !strings.Contains(descName, "/") {
+    // LevelDB names the descriptor relative to the db directory
+    descName = set.dbname + "/" + descName
   }
   
   if err := set.parseDescFile(string(descName)); err != nil {
     return err
   }
+  set.picker.Score(set.current)
   set.descNum = set.NewFileNumber()
   return nil
 }
@@ -146,7 +158,7 @@ func (set *VersionSet) NumLevelFiles(level int) int {
 }
   
 // Return the combined file size of all files at the specified level
-func (set *VersionSet) NumLevelBytes(level int) int {
+func (set *VersionSet) NumLevelBytes(level int) int64 {
   if level >= util.Global.MaxLevel || set.current == nil {
     return 0
   }
@@ -187,38 +199,105 @@ func (set *VersionSet) SetLogNumber(num int) {
 // Returns NULL if there is no compaction to be done.
 // Otherwise returns a pointer to a heap-allocated object that
 // describes the compaction.  Caller should delete the result.
+//
+// The picked compaction never shares an input file with, nor writes
+// into a key range of, a compaction that is still running.  It stays
+// registered until ReleaseCompaction is called.
+// REQUIRES: *mu is held
 func (set *VersionSet) PickCompaction() *compact.Compact {
-   if set.current.cscore < 1 {
-     return nil
-   } 
-   comp := compact.NewCompact()
-   comp.Level = set.current.clevel
-   
-   if set.current.files[comp.Level] == nil || len(set.current.files[comp.Level]) == 0 {
-     return nil
-   }
-   
-   meta := set.current.files[comp.Level][0]
-   if comp.Level == 0 {
-     comp.Files[0] = set.current.GetOverlappingInputs(comp.Level, &meta.Smallest, &meta.Largest)
-     small, large := set.getRange(comp.Files[0])
-     comp.Files[1] = set.current.GetOverlappingInputs(comp.Level + 1, small, large)
-   } else {
-     comp.Files[0] = []*table.FileMetaData{meta}
-     comp.Files[1] = set.current.GetOverlappingInputs(comp.Level + 1, &meta.Smallest, &meta.Largest)
-   }
-   
-   var files []*table.FileMetaData
-   files = append(files, comp.Files[0]...)
-   files = append(files, comp.Files[1]...)
-   comp.Smallest, comp.Largest = set.getRange(files)
-   return comp
+  comp := set.picker.Pick(set.current)
+  if comp != nil {
+    set.pending = append(set.pending, comp)
+  }
+  return comp
+}
+
+// Forget about a compaction returned by PickCompaction once it's
+// finished, so that its input files may be picked again.
+// REQUIRES: *mu is held
+func (set *VersionSet) ReleaseCompaction(c *compact.Compact) {
+  for i, comp := range set.pending {
+    if comp == c {
+      set.pending = append(set.pending[:i], set.pending[i + 1:]...)
+      return
+    }
+  }
+}
+
+// Returns the number of compactions picked but not yet released
+func (set *VersionSet) NumPendingCompactions() int {
+  return len(set.pending)
+}
+
+// Returns the compactions picked but not yet released
+func (set *VersionSet) PendingCompactions() []*compact.Compact {
+  return append([]*compact.Compact{}, set.pending...)
+}
+
+// Returns true iff comp takes an input file of a running compaction, or
+// writes into a key range a running compaction is writing into.
+func (set *VersionSet) conflictWithPending(comp *compact.Compact) bool {
+  for _, other := range set.pending {
+    for _, files := range comp.Files {
+      for _, meta := range files {
+        if other.Contains(meta.Number) {
+          return true
+        }
+      }
+    }
+    
+    // both write into the same level
+    if other.OutputLevel == comp.OutputLevel && set.rangeOverlap(other,
+        comp.Smallest.UserKey(), comp.Largest.UserKey()) {
+      return true
+    }
+  }
+  return false
+}
+
+// Returns true iff a running compaction writes its output into level
+// within the user key range [smallest, largest]
+func (set *VersionSet) PendingOutputOverlap(level int, smallest, largest []byte) bool {
+  for _, other := range set.pending {
+    if other.OutputLevel == level && set.rangeOverlap(other, smallest, largest) {
+      return true
+    }
+  }
+  return false
+}
+
+// Returns true iff a running compaction writes its output into level
+func (set *VersionSet) HasPendingOutput(level int) bool {
+  for _, other := range set.pending {
+    if other.OutputLevel == level {
+      return true
+    }
+  }
+  return false
+}
+
+// Return the level a memtable flush covering the user key range
+// [smallest, largest] should be written to
+// REQUIRES: *mu is held
+func (set *VersionSet) PickLevelForMemTableOutput(smallest, largest []byte) int {
+  return set.picker.LevelForMemTableOutput(set.current, smallest, largest)
+}
+
+func (set *VersionSet) rangeOverlap(c *compact.Compact, smallest, largest []byte) bool {
+  ucmp := set.option.Comparator.(*mem.InternalKeyComparator).UserComparator()
+  if ucmp.Compare(c.Largest.UserKey(), smallest) < 0 {
+    return false
+  }
+  if ucmp.Compare(c.Smallest.UserKey(), largest) > 0 {
+    return false
+  }
+  return true
 }
 
 // Return the maximum overlapping data (in bytes) at next level for any
 // file at a level >= 1.
-func (set *VersionSet) MaxNextLevelOverlappingBytes() int {
-  rslt := 0
+func (set *VersionSet) MaxNextLevelOverlappingBytes() int64 {
+  var rslt int64 = 0
   for i := 1; i < util.Global.MaxLevel - 1; i++ {
     for _, meta := range set.current.files[i] {
       inputs := set.current.GetOverlappingInputs(i + 1, &meta.Smallest, &meta.Largest)
@@ -235,7 +314,11 @@ func (set *VersionSet) MaxNextLevelOverlappingBytes() int {
 // The caller should delete the iterator when no longer needed.
 func (set *VersionSet) MakeInputIterator(c *compact.Compact) mem.Iterator {
   var iters []mem.Iterator
-  for i := 0; i < 2; i++ {
+  for i := 0; i < len(c.Files); i++ {
+    if len(c.Files[i]) == 0 {
+      continue
+    }
+    
     if c.Level + i == 0 {
       for j := 0; j < len(c.Files[i]); j++ {
         _, iter := set.cache.NewIterator(c.Files[i][j].Number, c.Files[i][j].FileSize)
@@ -243,13 +326,76 @@ func (set *VersionSet) MakeInputIterator(c *compact.Compact) mem.Iterator {
       }
       continue
     }
-    idxIter := NewFilesIterator(c.Files[i])
+    idxIter := NewFilesIterator(set.option.Comparator, c.Files[i])
     iter := table.NewTwoLevelIterator(idxIter, set.newFileIterator, nil, TableFileCompare)
     iters = append(iters, iter)
   }
   return table.NewMergeIterator(set.option.Comparator, iters) 
 }
   
+// Split the key range of c into at most n shards holding about the same
+// amount of input, and return the user keys where neighbouring shards
+// meet, so that shard i covers [bounds[i-1], bounds[i]).  Candidates are
+// the boundaries of the input files, weighed with ApproximateOffsetOf
+// of the input tables.  Every version of a user key lands in one shard.
+// REQUIRES: *mu is held
+func (set *VersionSet) SubcompactionBoundaries(c *compact.Compact, n int) [][]byte {
+  if n <= 1 {
+    return nil
+  }
+  
+  ucmp := set.option.Comparator.(*mem.InternalKeyComparator).UserComparator()
+  inputs := []*table.FileMetaData{}
+  candidates := []interface{}{}
+  for _, files := range c.Files {
+    for _, meta := range files {
+      inputs = append(inputs, meta)
+      candidates = append(candidates, meta.Smallest.UserKey(), meta.Largest.UserKey())
+    }
+  }
+  sort.Sort(util.NewSliceSorter(candidates, ucmp.Compare))
+  
+  keys := [][]byte{}
+  for _, key := range candidates {
+    if len(keys) == 0 || ucmp.Compare(keys[len(keys) - 1], key) != 0 {
+      keys = append(keys, key.([]byte))
+    }
+  }
+  
+  total := TotalFileSize(inputs)
+  bounds := [][]byte{}
+  shard := 1
+  // nothing is smaller than the first key, it never splits anything
+  for i := 1; i < len(keys) && shard < n; i++ {
+    offset := set.approximateInputOffset(inputs, keys[i])
+    if offset * int64(n) < total * int64(shard) {
+      continue
+    }
+    bounds = append(bounds, keys[i])
+    for shard < n && offset * int64(n) >= total * int64(shard) {
+      shard++
+    }
+  }
+  return bounds
+}
+
+// Return the approximate number of input bytes before user key ukey
+func (set *VersionSet) approximateInputOffset(inputs []*table.FileMetaData, ukey []byte) int64 {
+  ucmp := set.option.Comparator.(*mem.InternalKeyComparator).UserComparator()
+  ikey := util.NewInternalKey(ukey, util.Global.MaxSeq, mem.SeekType).Encode()
+  var rslt int64 = 0
+  for _, meta := range inputs {
+    if ucmp.Compare(meta.Largest.UserKey(), ukey) < 0 {
+      rslt += meta.FileSize
+    } else if ucmp.Compare(meta.Smallest.UserKey(), ukey) >= 0 {
+      continue
+    } else if tbl := set.cache.FindTable(meta.Number, meta.FileSize); tbl != nil {
+      rslt += tbl.ApproximateOffsetOf(ikey)
+    }
+  }
+  return rslt
+}
+
 // Return a compaction object for compacting the range [begin,end] in
 // the specified level.  Returns NULL if there is nothing in that
 // level that overlaps the specified range.  Caller should delete
@@ -258,13 +404,21 @@ func (set *VersionSet) CompactRange(level int, begin, end *util.InternalKey) {
   
 }
   
+// Close the descriptor log of the set
+func (set *VersionSet) Close() error {
+  if set.writer == nil {
+    return nil
+  }
+  return set.writer.Close()
+}
+
 // Returns true iff some level needs a compaction.
 func (set *VersionSet) NeedsCompaction() bool {
   return set.current.cscore >= 1
 }
  
-// Get all files listed in any live version
-// May also mutate some internal state.
+// Get all files listed in any live version, i.e. the current one and
+// the older ones still referenced
 func (set *VersionSet) GetLiveFiles() []int {
   ver := set.current
   rslt := []int{}
@@ -300,25 +454,6 @@ func (set *VersionSet) Option() *util.Option {
   return set.option
 }
 
-func (set *VersionSet) scoreCompaction(v *Version) (float32, int) {
-  var compLevel int = 0
-  var compScore, tmpScore float32 = 0, 0
-  for i := 0; i < util.Global.MaxLevel - 1; i++ {
-    if i == 0 {
-      clen := len(v.files[i])
-      tmpScore = float32(clen) / float32(util.Global.L0CompactionTrigger)
-    } else {
-      tmpScore = float32(TotalFileSize(v.files[i])) / MaxBytesForLevel(i)
-    }
-    
-    if tmpScore > compScore {
-      compLevel = i
-      compScore = tmpScore
-    }
-  }
-  return compScore, compLevel
-}
-
 func (set *VersionSet) parseCurrentFile() string {
   curfile := util.CurrentFileName(set.dbname)
   if file, err := os.OpenFile(curfile, os.O_RDONLY, 0); err != nil {
@@ -335,7 +470,7 @@ func (set *VersionSet) parseCurrentFile() string {
 }
 
 func (set *VersionSet) parseDescFile(descName string) error {
-  reader, err := log.NewReader(descName, false, 0)
+  reader, err := log.NewReader(descName, false, 0, set.option.Format)
   if err != nil {
     return err
   }
@@ -344,15 +479,16 @@ func (set *VersionSet) parseDescFile(descName string) error {
   builder := NewVersionBuilder(set.current, set.option.Comparator)
 
   for true {
+    // every record holds one edit, never apply an older one twice
+    edit.Clear()
     if data, err := reader.Read(); err == io.EOF {
       builder.Finish(set.current)
       return nil
     } else if err != nil {
       return err 
-    } else if err = edit.Decode(data); err != nil {
+    } else if err = set.decodeEdit(edit, data); err != nil {
       return err
     } else {
-      edit.Decode(data)
       if edit.LogNumber != -1 {
         set.logNum = edit.LogNumber
       }
@@ -365,9 +501,13 @@ func (set *VersionSet) parseDescFile(descName string) error {
         set.fileNum = edit.FileNumber
       }
       
-      if edit.CmpName != "" && edit.CmpName != set.option.Comparator.Name() {
+      if edit.CmpName != "" && edit.CmpName != set.comparatorName() {
         return errors.New("comparator name not match with older one")
       }
+      
+      if edit.MergeName != "" && edit.MergeName != set.mergeOperatorName() {
+        return errors.New("merge operator name not match with older one")
+      }
       builder.Apply(edit)
     }
   }
@@ -400,25 +540,68 @@ func (set *VersionSet) newFileIterator(meta interface{}) mem.Iterator {
   return iter
 }
 
-// Append another version into version set
+// Append another version into version set, the set keeps a reference
+// on its current version only
 func (set *VersionSet) append(v *Version) {
-  set.current.next = v
-  v.prev = set.current
+  old := set.current
+  old.next = v
+  v.prev = old
   v.next = nil
   set.current = v 
+  v.Ref()
+  old.Unref()
 }
 
 func (set *VersionSet) writeSnapshot() error {
   edit := NewVersionEdit()
-  edit.SetComparatorName(set.option.Comparator.Name())
+  edit.SetComparatorName(set.comparatorName())
+  edit.SetMergeOperatorName(set.mergeOperatorName())
   
   for i := 0; i < util.Global.MaxLevel; i++ {
     for j := 0; j < len(set.current.files[i]); j++ {
       meta := set.current.files[i][j]
       edit.AddFile(i, meta.Number, meta.FileSize, &meta.Smallest, &meta.Largest)
+      edit.SetCreationTime(meta.Number, meta.CreationTime)
+      if meta.HasRangeDels {
+        edit.SetRangeDels(meta.Number)
+      }
     }
   }
-  return set.writer.AddRecord(edit.Encode())
+  return set.writer.AddRecord(set.encodeEdit(edit))
+}
+
+// Encode edit in the format of the db
+func (set *VersionSet) encodeEdit(edit *VersionEdit) []byte {
+  if set.option.Format == util.LevelDBFormat {
+    return edit.encodeLevelDB()
+  }
+  return edit.Encode()
+}
+
+// Decode the edit data encoded in the format of the db into edit
+func (set *VersionSet) decodeEdit(edit *VersionEdit, data []byte) error {
+  if set.option.Format == util.LevelDBFormat {
+    return edit.decodeLevelDB(data)
+  }
+  return edit.Decode(data)
+}
+
+// Return the name of the comparator the descriptor records.  LevelDB
+// records the name of the user comparator, and knows the binary one
+// under a name of its own.
+func (set *VersionSet) comparatorName() string {
+  if set.option.Format != util.LevelDBFormat {
+    return set.option.Comparator.Name()
+  }
+
+  cmp := set.option.Comparator
+  if icmp, ok := cmp.(*mem.InternalKeyComparator); ok {
+    cmp = icmp.UserComparator()
+  }
+  if cmp == util.BinaryComparator {
+    return levelDBBytewiseComparator
+  }
+  return cmp.Name()
 }
 
 func (set *VersionSet) setVersionEdit(edit *VersionEdit) {
@@ -431,12 +614,24 @@ func (set *VersionSet) setVersionEdit(edit *VersionEdit) {
   }
   
   if edit.CmpName == "" {
-    edit.SetComparatorName(set.option.Comparator.Name())
+    edit.SetComparatorName(set.comparatorName())
   }
   
   if edit.FileNumber == -1 {
     edit.SetNextFile(set.fileNum)
   }
+  
+  if edit.MergeName == "" {
+    edit.SetMergeOperatorName(set.mergeOperatorName())
+  }
+}
+
+// Return the name of the merge operator of the db, "" if there is none
+func (set *VersionSet) mergeOperatorName() string {
+  if set.option.MergeOperator == nil {
+    return ""
+  }
+  return set.option.MergeOperator.Name()
 }
 
 func (set *VersionSet) dumpCurrent() string {
@@ -0,0 +1,172 @@
+package version
+
+import (
+  "sort"
+)
+
+import (
+  "github.com/jellybean4/goleveldb/util"
+  "github.com/jellybean4/goleveldb/compact"
+  "github.com/jellybean4/goleveldb/table"
+)
+
+// sortedRun is either a single level0 file or a whole level >= 1
+type sortedRun struct {
+  level int
+  files []*table.FileMetaData
+  size  int64
+}
+
+// universalPicker merges sorted runs of similar size.  Memtables are
+// always flushed into level0, every level0 file being a run of its own,
+// and merged runs are pushed towards the last level so that a level
+// with a smaller number always holds newer data.  A compaction is
+// started once there are L0CompactionTrigger runs, and only one runs
+// at a time as each one may take the newest runs.
+type universalPicker struct {
+  set *VersionSet
+}
+
+func newUniversalPicker(set *VersionSet) *universalPicker {
+  picker := new(universalPicker)
+  picker.set = set
+  return picker
+}
+
+func (p *universalPicker) Score(v *Version) {
+  v.scores = make([]float32, util.Global.MaxLevel - 1)
+  runs := p.sortedRuns(v)
+  v.cscore = float32(len(runs)) / float32(util.Global.L0CompactionTrigger)
+  v.clevel = 0
+}
+
+func (p *universalPicker) Pick(v *Version) *compact.Compact {
+  if len(p.set.pending) > 0 {
+    return nil
+  }
+
+  runs := p.sortedRuns(v)
+  if len(runs) < util.Global.L0CompactionTrigger {
+    return nil
+  }
+
+  if comp := p.pickSizeAmp(runs); comp != nil {
+    return comp
+  }
+
+  if comp := p.pickSizeRatio(runs); comp != nil {
+    return comp
+  }
+
+  // still too many runs, merge the newest ones whatever their sizes
+  width := len(runs) - util.Global.L0CompactionTrigger + 1
+  if width < util.Global.UniversalMinMergeWidth {
+    width = util.Global.UniversalMinMergeWidth
+  }
+  if width > len(runs) {
+    width = len(runs)
+  }
+  return p.newCompaction(runs, 0, width)
+}
+
+func (p *universalPicker) LevelForMemTableOutput(v *Version, smallest, largest []byte) int {
+  return 0
+}
+
+// Return the sorted runs of v from the newest to the oldest
+func (p *universalPicker) sortedRuns(v *Version) []*sortedRun {
+  level0 := make([]interface{}, len(v.files[0]))
+  for i, meta := range v.files[0] {
+    level0[i] = meta
+  }
+  // level0 files are flushed one at a time, a larger number is newer
+  sort.Sort(util.NewSliceSorter(level0, func(a, b interface{}) int {
+    return TableFileCompare(b, a)
+  }))
+
+  runs := []*sortedRun{}
+  for _, meta := range level0 {
+    file := meta.(*table.FileMetaData)
+    runs = append(runs, &sortedRun{0, []*table.FileMetaData{file}, file.FileSize})
+  }
+
+  for level := 1; level < util.Global.MaxLevel; level++ {
+    if len(v.files[level]) != 0 {
+      runs = append(runs, &sortedRun{level, v.files[level], TotalFileSize(v.files[level])})
+    }
+  }
+  return runs
+}
+
+// Merge all runs into the oldest one if the newer runs take too much
+// space compared with it
+func (p *universalPicker) pickSizeAmp(runs []*sortedRun) *compact.Compact {
+  last := runs[len(runs) - 1]
+  var candidate int64 = 0
+  for _, run := range runs[ : len(runs) - 1] {
+    candidate += run.size
+  }
+
+  if candidate * 100 < last.size * int64(util.Global.UniversalMaxSizeAmplificationPercent) {
+    return nil
+  }
+  return p.newCompaction(runs, 0, len(runs))
+}
+
+// Pick the newest window of runs where every run is not much larger
+// than all the runs before it within the window
+func (p *universalPicker) pickSizeRatio(runs []*sortedRun) *compact.Compact {
+  ratio := int64(util.Global.UniversalSizeRatio)
+  for start := 0; start < len(runs); start++ {
+    size := runs[start].size
+    end := start + 1
+    for ; end < len(runs); end++ {
+      if size * (100 + ratio) < runs[end].size * 100 {
+        break
+      }
+      size += runs[end].size
+    }
+
+    if end - start < util.Global.UniversalMinMergeWidth {
+      continue
+    }
+    
+    // level0 keeps newer files at larger numbers, the output of a
+    // window behind newer level0 runs can't go back into level0
+    if start > 0 && p.outputLevel(runs, end) == 0 {
+      continue
+    }
+    return p.newCompaction(runs, start, end)
+  }
+  return nil
+}
+
+// Return a compaction merging runs[start:end]
+func (p *universalPicker) newCompaction(runs []*sortedRun, start, end int) *compact.Compact {
+  comp := compact.NewCompact()
+  comp.Level = runs[start].level
+  comp.Files = make([][]*table.FileMetaData, util.Global.MaxLevel - comp.Level)
+
+  inputs := []*table.FileMetaData{}
+  for _, run := range runs[start : end] {
+    idx := run.level - comp.Level
+    comp.Files[idx] = append(comp.Files[idx], run.files...)
+    inputs = append(inputs, run.files...)
+  }
+  comp.Smallest, comp.Largest = p.set.getRange(inputs)
+  comp.OutputLevel = p.outputLevel(runs, end)
+  return comp
+}
+
+// The output of a window ending before runs[end] goes right above that
+// run, or into the last level if there is no older run.
+func (p *universalPicker) outputLevel(runs []*sortedRun, end int) int {
+  if end == len(runs) {
+    return util.Global.MaxLevel - 1
+  }
+  
+  if runs[end].level == 0 {
+    return 0
+  }
+  return runs[end].level - 1
+}
@@ -36,19 +36,23 @@ func TableFileCompare(f, s interface{}) int {
   }
 }
 
-func MaxFileSizeForLevel(level int) int {
-  return util.Global.TargetFileSize
+func MaxFileSizeForLevel(level int) int64 {
+  return int64(util.Global.TargetFileSize)
 }
 
-func NewFilesIterator(data []*table.FileMetaData) mem.Iterator {
+// NewFilesIterator returns an iterator over the sorted, non-overlapping
+// files of a level.  Seek positions at the first file whose largest key
+// is not less than the given internal key.
+func NewFilesIterator(cmp util.Comparator, data []*table.FileMetaData) mem.Iterator {
   iter := new(filesIterator)
+  iter.cmp = cmp
   iter.value = data
   iter.cur = -1
   return iter
 }
 
-func TotalFileSize(files []*table.FileMetaData) int {
-  rslt := 0
+func TotalFileSize(files []*table.FileMetaData) int64 {
+  var rslt int64 = 0
   for _, f := range files {
     rslt += f.FileSize
   }
@@ -65,6 +69,7 @@ func MaxBytesForLevel(level int) float32 {
 }
 
 type filesIterator struct {
+  cmp   util.Comparator
   value []*table.FileMetaData
   cur   int
 }
@@ -96,8 +101,17 @@ func (s *filesIterator) Prev() {
 }
 
 func (s *filesIterator) Seek(key interface{}) {
-  vkey := key.(int)
-  s.cur = vkey
+  vkey := key.([]byte)
+  left, right := 0, len(s.value)
+  for left < right {
+    mid := (left + right) / 2
+    if s.cmp.Compare(s.value[mid].Largest.Encode(), vkey) < 0 {
+      left = mid + 1
+    } else {
+      right = mid
+    }
+  }
+  s.cur = left
 }
 
 func (s *filesIterator) SeekToFirst() {
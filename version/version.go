@@ -2,7 +2,6 @@ package version
 
 import (
   "sort"
-  "errors"
 )
 
 import (
@@ -23,6 +22,7 @@ type Version struct {
   files [][]*table.FileMetaData
   cscore float32    // compaction score
   clevel int        // compaction level 
+  scores []float32  // compaction score of each level
   
   slevel int           // seek compaction level
   sfile  *table.FileMetaData // seek compaction file
@@ -30,15 +30,18 @@ type Version struct {
   vset   *VersionSet    // version set this version associated with
   next   *Version       // next version within the set
   prev   *Version       // prev version within the set
+  refs   int            // references held on this version
 }
 
 
 func (v *Version) init(vset *VersionSet) {
   v.vset = vset
   v.cscore, v.clevel = 0, 0
+  v.scores = []float32{}
   v.slevel, v.sfile = 0, nil
 
   v.next, v.prev = nil, nil
+  v.refs = 0
 
   v.files = make([][]*table.FileMetaData, util.Global.MaxLevel)
   for i := 0; i < util.Global.MaxLevel; i++ {
@@ -46,6 +49,29 @@ func (v *Version) init(vset *VersionSet) {
   }
 }
 
+// Keep v listed within its set, the files of v are kept on disk
+// until the reference is released
+// REQUIRES: the lock of the db is held
+func (v *Version) Ref() {
+  v.refs++
+}
+
+// Release a reference of v, a version left without any reference is
+// dropped from its set and its files are no longer live
+// REQUIRES: the lock of the db is held
+func (v *Version) Unref() {
+  if v.refs--; v.refs > 0 {
+    return
+  }
+  if v.prev != nil {
+    v.prev.next = v.next
+  }
+  if v.next != nil {
+    v.next.prev = v.prev
+  }
+  v.next, v.prev = nil, nil
+}
+
 // Append to iters a sequence of iterators that will
 // yield the contents of this Version when merged together.
 // REQUIRES: This version has been saved (see VersionSet::SaveTo)
@@ -53,29 +79,41 @@ func (v *Version) GetIterators(option *util.ReadOption) []mem.Iterator {
   rslt := []mem.Iterator{}
   level0 := v.files[0]
   for i := 0; i < len(level0); i++ {
-    _, iter := v.vset.TableCache().NewIterator(level0[i].Number, level0[i].FileSize);
+    tbl, iter := v.vset.TableCache().NewIterator(level0[i].Number, level0[i].FileSize);
     if iter == nil {
       return nil
     }
+    if option.PrefixSameAsStart {
+      iter = table.NewPrefixIterator(iter, tbl)
+    }
     rslt = append(rslt, iter)
   }
   
+  tableIterator := v.newTableIterator
+  if option.PrefixSameAsStart {
+    tableIterator = v.newPrefixTableIterator
+  }
   for i := 1; i < util.Global.MaxLevel; i++ {
-    fiter := NewFilesIterator(v.files[i])
-    iter := table.NewTwoLevelIterator(fiter, v.newTableIterator, option, TableFileCompare)
+    fiter := NewFilesIterator(v.vset.Option().Comparator, v.files[i])
+    iter := table.NewTwoLevelIterator(fiter, tableIterator, option, TableFileCompare)
     rslt = append(rslt, iter)
   }
   return rslt
 }
 
-// Lookup the value for key.  If found, store it in *val and
-// return OK.  Else return a non-OK status.  Fills *stats.
+// Lookup the newest entry for the user key of key whose sequence is not
+// larger than the one of key.  Returns the type and the value of the
+// entry, or util.ErrNotFound if there is none or if it is deleted by a
+// range tombstone.
 // REQUIRES: lock is not held 
-func (v *Version) Get(option *util.ReadOption, key util.LookupKey) ([]byte, error) {
+func (v *Version) Get(option *util.ReadOption, key util.LookupKey) (byte, []byte, error) {
   cmp  := v.vset.Option().Comparator
   ucmp := cmp.(*mem.InternalKeyComparator).UserComparator()
   ikey := key.InternalKey()
   ukey := key.UserKey()
+  
+  // newest range tombstone covering ukey in the files searched so far
+  var delSeq uint64 = 0
   for i := 0; i < util.Global.MaxLevel; i++ {
     var search []interface{}
     if i == 0 {
@@ -84,12 +122,15 @@ func (v *Version) Get(option *util.ReadOption, key util.LookupKey) ([]byte, erro
           continue
         }
         
-        if ucmp.Compare(ukey, file.Smallest.UserKey) < 0 {
+        if ucmp.Compare(ukey, file.Smallest.UserKey()) < 0 {
           continue
         }
         search = append(search, file)
-        sort.Sort(util.NewSliceSorter(search, TableFileCompare))
       }
+      // level0 files may overlap, search the newest one first
+      sort.Sort(util.NewSliceSorter(search, func(a, b interface{}) int {
+        return TableFileCompare(b, a)
+      }))
     } else {
       file := FindTable(cmp, v.files[i], key.InternalKey())
       if file == nil {
@@ -100,19 +141,63 @@ func (v *Version) Get(option *util.ReadOption, key util.LookupKey) ([]byte, erro
 
     for k := 0; k < len(search); k++ {
       meta := search[k].(*table.FileMetaData)
+      if meta.HasRangeDels {
+        if seq := v.maxCoveringSeq(meta, ukey, key.Sequence()); seq > delSeq {
+          delSeq = seq
+        }
+      }
+      
       skey, sval := v.vset.TableCache().Get(option, meta.Number, meta.FileSize, ikey)
       if skey == nil || sval == nil {
         continue
       }
       
-      if ucmp.Compare(util.ExtractUserKey(skey), ukey) == 0 {
-        return sval, nil
+      parsed := new(util.ParsedInternalKey)
+      if err := parsed.Decode(skey); err != nil {
+        return 0, nil, err
       }
+      
+      if ucmp.Compare(parsed.Key, ukey) != 0 {
+        continue
+      }
+      
+      if parsed.Seq < delSeq {
+        // deleted by a range tombstone
+        return 0, nil, util.ErrNotFound
+      }
+      return parsed.Rtype, sval, nil
     }
   }
-  return nil, errors.New("could not find target")  
+  return 0, nil, util.ErrNotFound
 }
 
+// Return the largest sequence not larger than seq of the range
+// tombstones in meta covering the user key ukey, 0 if there is none
+func (v *Version) maxCoveringSeq(meta *table.FileMetaData, ukey []byte, seq uint64) uint64 {
+  tbl := v.vset.TableCache().FindTable(meta.Number, meta.FileSize)
+  if tbl == nil {
+    return 0
+  }
+  ucmp := v.vset.Option().Comparator.(*mem.InternalKeyComparator).UserComparator()
+  return tbl.RangeTombstones().MaxCoveringSeq(ucmp, ukey, seq)
+}
+
+// Return the range tombstones of all the files of v
+func (v *Version) RangeTombstones() mem.RangeTombstones {
+  rslt := mem.RangeTombstones{}
+  for level := 0; level < util.Global.MaxLevel; level++ {
+    for _, meta := range v.files[level] {
+      if !meta.HasRangeDels {
+        continue
+      }
+      
+      if tbl := v.vset.TableCache().FindTable(meta.Number, meta.FileSize); tbl != nil {
+        rslt = append(rslt, tbl.RangeTombstones()...)
+      }
+    }
+  }
+  return rslt
+}
 
 func (v *Version) GetOverlappingInputs(level int, begin, end *util.InternalKey) []*table.FileMetaData {
   if level >= util.Global.MaxLevel {
@@ -143,14 +228,22 @@ func (v *Version) GetOverlappingInputs(level int, begin, end *util.InternalKey)
       continue
     }
     
+    // level0 files may overlap each other, if the range grows restart
+    // the search with the new range
+    restart := false
     if begin != nil && ucmp.Compare(ubegin, file.Smallest.UserKey()) > 0 {
       ubegin = file.Smallest.UserKey()
-      i = 0
+      restart = true
     } 
     
     if end != nil && ucmp.Compare(uend, file.Largest.UserKey()) < 0 {
       uend = file.Largest.UserKey()
-      i = 0
+      restart = true
+    }
+    
+    if restart {
+      rslt = []*table.FileMetaData{}
+      i = -1
     }
   }
   
@@ -180,6 +273,17 @@ func (v *Version) OverlapInLevel(level int, smallest, largest []byte) bool {
   return false
 }
 
+// Returns true iff no file in the levels below level may contain
+// data for userKey.
+func (v *Version) IsBaseLevelForKey(level int, userKey []byte) bool {
+  for l := level + 1; l < util.Global.MaxLevel; l++ {
+    if v.OverlapInLevel(l, userKey, userKey) {
+      return false
+    }
+  }
+  return true
+}
+
 // Return the level at which we should place a new memtable compaction
 // result that covers the range [smallest_user_key,largest_user_key].  
 func (v *Version) PickLevelForMemTableOutput(smallest, largest []byte) int {
@@ -196,16 +300,52 @@ func (v *Version) PickLevelForMemTableOutput(smallest, largest []byte) int {
     if level >= util.Global.MaxMemCompactLevel {
       break
     }
+    
+    // a running compaction is writing into this range of the level
+    if v.vset.PendingOutputOverlap(level + 1, smallest, largest) {
+      break
+    }
     level++
   }
   return level
 }
 
+// Levels whose compaction score reaches 1, from the highest score down
+func (v *Version) levelsByScore() []int {
+  levels := []interface{}{}
+  for i, score := range v.scores {
+    if score >= 1 {
+      levels = append(levels, i)
+    }
+  }
+  sort.Sort(util.NewSliceSorter(levels, func(a, b interface{}) int {
+    sa, sb := v.scores[a.(int)], v.scores[b.(int)]
+    switch true {
+    case sa > sb:
+      return -1
+    case sa < sb:
+      return 1
+    }
+    return 0
+  }))
+  
+  rslt := make([]int, len(levels))
+  for i, level := range levels {
+    rslt[i] = level.(int)
+  }
+  return rslt
+}
+
 // File number at the specified level
 func (v *Version) NumFiles(level int) int {
   return len(v.files[level])
 }
 
+// Files at the specified level, which must not be modified
+func (v *Version) Files(level int) []*table.FileMetaData {
+  return v.files[level]
+}
+
 // Call handler(arg, level, f) for every file that overlaps user_key in
 // order from newest to oldest.  If an invocation of func returns
 // false, makes no more calls.
@@ -229,3 +369,14 @@ func (v *Version) newTableIterator(meta interface{}) mem.Iterator {
   _, iter := v.vset.TableCache().NewIterator(table.Number, table.FileSize)
   return iter
 }
+
+// Return the iterator of the table of meta, which leaves the table out
+// of the seeks whose prefix its filters rule out
+func (v *Version) newPrefixTableIterator(meta interface{}) mem.Iterator {
+  file := meta.(*table.FileMetaData)
+  tbl, iter := v.vset.TableCache().NewIterator(file.Number, file.FileSize)
+  if iter == nil {
+    return nil
+  }
+  return table.NewPrefixIterator(iter, tbl)
+}